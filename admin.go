@@ -0,0 +1,158 @@
+
+package geoip
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+
+// This file provides the admin endpoints of the REST API, served under
+// /admin/ by NewGeoLocServer(), and their authentication, also required
+// by /status.
+
+
+// Token required by the admin endpoints, sent in an "Authorization:
+// Bearer <token>" header. Without it, nor AdminUser or AdminAllowed, the
+// reload endpoint is refused.
+var AdminToken string
+
+
+// User and password of the HTTP basic authentication of the admin
+// endpoints, accepted as well as the AdminToken. The authentication is
+// not required without AdminUser.
+var AdminUser, AdminPassword string
+
+
+// Networks allowed to use the admin endpoints, see ParseTrustedProxies(),
+// or any if empty. The client IP is taken from the headers of the
+// TrustedProxies.
+var AdminAllowed []*net.IPNet
+
+
+// Held while the admin endpoint reloads the default DB, so concurrent
+// requests do not download the files twice
+var admin_reload_mu sync.Mutex
+
+
+// Tells if the admin endpoints are protected, by an AdminToken, an
+// AdminUser or AdminAllowed networks : they are refused otherwise, as
+// anyone could force reloads of the data
+func adminConfigured() bool {
+	return AdminToken != "" || AdminUser != "" || len(AdminAllowed) > 0
+}
+
+
+// Tells if a request is authorized to use the admin endpoints : its
+// client must belong to the AdminAllowed networks, or else the request
+// is answered with a 403 status code, and it must be authenticated with
+// the AdminToken or the AdminUser, or else it is answered with a 401.
+func adminAuthorized(writer http.ResponseWriter, request *http.Request) bool {
+	if len(AdminAllowed) > 0 {
+		ip := clientIP(request)
+		if ip == nil || !slices.ContainsFunc(AdminAllowed, func(network *net.IPNet) bool { return network.Contains(ip) }) {
+			writeJSONError(writer, http.StatusForbidden, "forbidden")
+			return false
+		}
+	}
+	if AdminToken == "" && AdminUser == "" {
+		return true
+	}
+
+	if AdminToken != "" {
+		token, found := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer ")
+		if found && subtle.ConstantTimeCompare([]byte(token), []byte(AdminToken)) == 1 {
+			return true
+		}
+		writer.Header().Add("WWW-Authenticate", `Bearer realm="geoip admin"`)
+	}
+	if AdminUser != "" {
+		user, password, found := request.BasicAuth()
+		// both compared, so the time does not tell which one is wrong
+		user_ok := subtle.ConstantTimeCompare([]byte(user), []byte(AdminUser))
+		password_ok := subtle.ConstantTimeCompare([]byte(password), []byte(AdminPassword))
+		if found && user_ok & password_ok == 1 {
+			return true
+		}
+		writer.Header().Add("WWW-Authenticate", `Basic realm="geoip admin", charset="UTF-8"`)
+	}
+	writeJSONError(writer, http.StatusUnauthorized, "unauthorized")
+	return false
+}
+
+
+// Data loaded in the default DB, as returned by the admin endpoints
+type reloadResponse struct {
+	Records map[string]int `json:"records"`
+	Modified *time.Time `json:"modified,omitempty"`
+	BuildDates map[string]time.Time `json:"build_dates,omitempty"`
+}
+
+
+// Returns the description of the data of the snapshot : the number of
+// records of each dataset, the modification time of the files, and
+// the build dates of the GeoLite2 databases
+func (data *snapshot) reloadResponse() reloadResponse {
+	response := reloadResponse{ Records: data.recordCounts() }
+	if !data.modified.IsZero() {
+		modified := data.modified
+		response.Modified = &modified
+	}
+	if data.geolite2 != nil {
+		response.BuildDates = data.geolite2.buildDates()
+	}
+	return response
+}
+
+
+//  This serves a POST request reloading the default DB, after downloading
+//  the MaxMind files if they are old (see Reload()), and answers with a
+//  JSON object holding the number of records of each dataset, the time
+//  the files were modified, and the build dates of the GeoLite2 databases,
+//  like {"records":{"asn":1,"blocks":2,"locations":3},"modified":"2024-01-02T00:00:00Z"}.
+//  The lookups use the previous data until the new ones are loaded, and
+//  the ServerWriteTimeout does not apply to this request. A
+//  reload already running is answered with a 409 status code, and a
+//  failed one with a 500, keeping the previous data. It is served under
+//  /admin/reload by NewGeoLocServer(), authenticated with AdminToken or
+//  AdminUser, for the AdminAllowed clients. Without any of them, it is
+//  answered with a 403 status code.
+func ServeReloadHttpRequest(writer http.ResponseWriter, request *http.Request) {
+
+	if !adminConfigured() {
+		writeJSONError(writer, http.StatusForbidden, "admin endpoints not configured")
+		return
+	}
+	if !adminAuthorized(writer, request) {
+		return
+	}
+	if request.Method != http.MethodPost {
+		writer.Header().Set("Allow", http.MethodPost)
+		writeJSONError(writer, http.StatusMethodNotAllowed, "POST only")
+		return
+	}
+
+	if !admin_reload_mu.TryLock() {
+		writeJSONError(writer, http.StatusConflict, "reload in progress")
+		return
+	}
+	// A reload takes longer than the ServerWriteTimeout, which would cut
+	// the connection before the response
+	http.NewResponseController(writer).SetWriteDeadline(time.Time{})
+	err := Reload()
+	admin_reload_mu.Unlock()
+	if err != nil {
+		writeJSONError(writer, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	response, _ := json.Marshal(default_db.snapshot().reloadResponse())
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(response)
+}
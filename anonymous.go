@@ -0,0 +1,191 @@
+
+package geoip
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+
+// This file provides the detection of anonymous IP addresses (VPNs,
+// Tor exit nodes, hosting providers and proxies), from a GeoIP2
+// Anonymous IP database and from public Tor exit lists.
+
+
+// Anonymity flags of an IP address, in the Anonymity of a GeoLocIp
+// when anonymous IP data are loaded (see SetAnonymousIPs()).
+type Anonymity struct {
+	IsAnonymous bool	// any of the others
+	IsTor bool			// Tor exit node
+	IsVPN bool			// anonymous VPN provider
+	IsHosting bool		// hosting or VPN provider
+	IsProxy bool		// public or residential proxy
+}
+
+
+// Anonymous IP data : a GeoIP2 (or GeoIP) Anonymous IP database, a
+// list of Tor exit nodes, or both.
+type AnonymousIPs struct {
+	mmdb *maxminddb.Reader
+	tor map[netip.Addr]bool
+}
+
+
+// The record of an address in an Anonymous IP database
+type mmdbAnonymous struct {
+	IsAnonymous bool `maxminddb:"is_anonymous"`
+	IsAnonymousVPN bool `maxminddb:"is_anonymous_vpn"`
+	IsHostingProvider bool `maxminddb:"is_hosting_provider"`
+	IsPublicProxy bool `maxminddb:"is_public_proxy"`
+	IsResidentialProxy bool `maxminddb:"is_residential_proxy"`
+	IsTorExitNode bool `maxminddb:"is_tor_exit_node"`
+}
+
+
+// Opens an Anonymous IP database (.mmdb file) and loads a Tor exit
+// list, one address per line like the one published by the Tor
+// Project (https://check.torproject.org/torbulkexitlist). Any of them
+// can be "".
+func OpenAnonymousIPs(mmdb_file string, tor_file string) (*AnonymousIPs, error) {
+
+	anonymous := &AnonymousIPs{}
+
+	if tor_file != "" {
+		file, err := os.Open(tor_file)
+		if err != nil {
+			log_geolocip.Err(fmt.Sprintf("Tor exit list error open file: %v", err))
+			return nil, err
+		}
+		defer file.Close()
+		anonymous.tor, err = LoadTorExitList(file)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if mmdb_file != "" {
+		mmdb, err := maxminddb.Open(mmdb_file)
+		if err != nil {
+			log_geolocip.Err(fmt.Sprintf("MMDB error open file: %v", err))
+			return nil, err
+		}
+		anonymous.mmdb = mmdb
+	}
+
+	return anonymous, nil
+}
+
+
+// Reads a Tor exit list, one address per line. Empty lines and
+// comments (starting with a '#') are ignored, and so are the lines
+// of the "ExitAddress 192.0.2.1 2024-01-01 00:00:00" form of the
+// exit-addresses list, except for their address.
+func LoadTorExitList(in io.Reader) (map[netip.Addr]bool, error) {
+
+	tor := make(map[netip.Addr]bool)
+	skipped := 0
+
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if fields := strings.Fields(line); len(fields) > 1 {
+			if fields[0] != "ExitAddress" {
+				continue
+			}
+			line = fields[1]
+		}
+		addr, err := netip.ParseAddr(line)
+		if err != nil {
+			skipped++
+			continue
+		}
+		tor[addr.Unmap()] = true
+	}
+	if err := scanner.Err(); err != nil {
+		log_geolocip.Err(fmt.Sprintf("Tor exit list error reading file: %v", err))
+		return nil, err
+	}
+	if skipped > 0 {
+		log_geolocip.Notice(fmt.Sprintf("Tor exit list: %d lines skipped, not an address", skipped))
+	}
+
+	return tor, nil
+}
+
+
+// Returns the Anonymity flags of an IP address. Addresses found
+// nowhere have all their flags false.
+func (anonymous *AnonymousIPs) Get(ip net.IP) (*Anonymity, error) {
+
+	anonymity := &Anonymity{}
+
+	if anonymous.mmdb != nil {
+		var record mmdbAnonymous
+		if err := anonymous.mmdb.Lookup(ip, &record); err != nil {
+			return nil, err
+		}
+		anonymity.IsTor = record.IsTorExitNode
+		anonymity.IsVPN = record.IsAnonymousVPN
+		anonymity.IsHosting = record.IsHostingProvider
+		anonymity.IsProxy = record.IsPublicProxy || record.IsResidentialProxy
+		anonymity.IsAnonymous = record.IsAnonymous
+	}
+
+	if addr, ok := netip.AddrFromSlice(ip); ok && anonymous.tor[addr.Unmap()] {
+		anonymity.IsTor = true
+	}
+
+	anonymity.IsAnonymous = anonymity.IsAnonymous || anonymity.IsTor || anonymity.IsVPN || anonymity.IsProxy
+	return anonymity, nil
+}
+
+
+// Closes the Anonymous IP database
+func (anonymous *AnonymousIPs) Close() error {
+	if anonymous.mmdb != nil {
+		return anonymous.mmdb.Close()
+	}
+	return nil
+}
+
+
+// Sets the anonymous IP data used by the lookups of the default DB,
+// see DB.SetAnonymousIPs().
+func SetAnonymousIPs(anonymous *AnonymousIPs) {
+	default_db.SetAnonymousIPs(anonymous)
+}
+
+
+// Sets the anonymous IP data used by the lookups of the DB : the
+// GeoLocIp they return then have an Anonymity. They are loaded by
+// the DB when given by Config.AnonymousIPFile or Config.TorExitFile.
+// With nil, the GeoLocIp have no Anonymity.
+func (db *DB) SetAnonymousIPs(anonymous *AnonymousIPs) {
+	db.update(func(data *snapshot) {
+		data.anonymous = anonymous
+	})
+}
+
+
+// Sets the Anonymity of the GeoLocIp found for an address, if there
+// are anonymous IP data, and returns them
+func (data *snapshot) withAnonymity(gli *GeoLocIp, err error) (*GeoLocIp, error) {
+	if gli == nil || data.anonymous == nil {
+		return gli, err
+	}
+	anonymity, anonymity_err := data.anonymous.Get(gli.Ip)
+	if anonymity_err != nil {
+		log_geolocip.Err(fmt.Sprintf("Cannot get anonymity of %v : %v", gli.Ip, anonymity_err))
+	}
+	gli.Anonymity = anonymity
+	return gli, err
+}
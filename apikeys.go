@@ -0,0 +1,212 @@
+
+package geoip
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+
+// This file provides the API keys of the REST API, with daily quotas of
+// requests : the lookup endpoints and the gRPC service require a key valid
+// for ValidateAPIKey, if set, and the usage of each key is returned by /status.
+
+
+// Validates the API keys of the lookup endpoints, returning the daily
+// quota of requests of a key (0 for unlimited), and if it is valid. No
+// key is required if nil. It can be the Validate() method of the keys of
+// a file, see ReadAPIKeys(), or any function, like one querying a database.
+var ValidateAPIKey func(key string) (daily_quota int, valid bool)
+
+
+// API keys, with their daily quota of requests, 0 for unlimited
+type APIKeyQuotas map[string]int
+
+
+// Returns the daily quota of an API key, and if it is one of the keys,
+// to be set as ValidateAPIKey
+func (keys APIKeyQuotas) Validate(key string) (int, bool) {
+	quota, found := keys[key]
+	return quota, found
+}
+
+
+// Reads the API keys of a file, one per line, followed by its daily
+// quota of requests if it has one, like :
+// 	# key quota
+// 	3f6c1a0e9b2d4c8e 10000
+// 	unlimited-internal-key
+// Empty lines and the lines starting with # are ignored.
+func ReadAPIKeys(path string) (APIKeyQuotas, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	keys := make(APIKeyQuotas)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		quota := 0
+		if len(fields) > 1 {
+			if quota, err = strconv.Atoi(fields[1]); err != nil || quota < 0 || len(fields) > 2 {
+				return nil, fmt.Errorf("Invalid API key line %d of %s", line, path)
+			}
+		}
+		keys[fields[0]] = quota
+	}
+	return keys, scanner.Err()
+}
+
+
+// Returns the identifier of an API key in the usage returned by /status :
+// the start of its SHA-256 in hexadecimal, so the keys are not disclosed
+func APIKeyID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:4])
+}
+
+
+// Requests of each API key on the current day (in UTC), and their quota
+type apiKeyUsage struct {
+	mu sync.Mutex
+	day string
+	requests map[string]int
+	quotas map[string]int
+}
+
+var api_key_usage = apiKeyUsage{ requests: make(map[string]int), quotas: make(map[string]int) }
+
+
+// Counts a request of an API key with a daily quota, unless the quota
+// is reached, and returns the remaining requests (-1 if unlimited)
+func (usage *apiKeyUsage) count(key string, quota int, now time.Time) (int, bool) {
+	usage.mu.Lock()
+	defer usage.mu.Unlock()
+
+	if day := now.UTC().Format(time.DateOnly); day != usage.day {
+		usage.day = day
+		clear(usage.requests)
+	}
+	usage.quotas[key] = quota
+	if quota == 0 {
+		usage.requests[key]++
+		return -1, true
+	}
+	if usage.requests[key] >= quota {
+		return 0, false
+	}
+	usage.requests[key]++
+	return quota - usage.requests[key], true
+}
+
+
+// Usage of an API key, as returned by /status
+type apiKeyUsageResponse struct {
+	Requests int `json:"requests_today"`
+	Quota int `json:"daily_quota,omitempty"`
+}
+
+
+// Returns the usage of the API keys on the current day, by APIKeyID()
+func (usage *apiKeyUsage) report(now time.Time) map[string]apiKeyUsageResponse {
+	usage.mu.Lock()
+	defer usage.mu.Unlock()
+
+	if usage.day != now.UTC().Format(time.DateOnly) {
+		return nil
+	}
+	report := make(map[string]apiKeyUsageResponse, len(usage.requests))
+	for key, requests := range usage.requests {
+		report[APIKeyID(key)] = apiKeyUsageResponse{ requests, usage.quotas[key] }
+	}
+	return report
+}
+
+
+// Returns the API key of a request, given by its api_key parameter, or
+// in an "Authorization: Bearer <key>" header (the authorization metadata
+// of the gRPC requests)
+func requestAPIKey(request *http.Request) string {
+	if key := request.URL.Query().Get("api_key"); key != "" {
+		return key
+	}
+	key, _ := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer ")
+	return strings.TrimSpace(key)
+}
+
+
+// Outcome of the check of the API key of a request, see checkAPIKey()
+type apiKeyCheck struct {
+	code int	// http.StatusOK if the request is allowed
+	message string
+	quota int	// 0 if unlimited
+	remaining int
+	retry_after int	// seconds, when the quota is exceeded
+}
+
+
+// Checks the API key of a request, if ValidateAPIKey is set, and counts
+// the request in its daily quota if it is allowed : the requests without
+// key get a 401 status code, the ones with an invalid key a 403, and the
+// ones beyond the quota a 429 until the next day (in UTC)
+func checkAPIKey(request *http.Request, now time.Time) apiKeyCheck {
+
+	validate := ValidateAPIKey
+	if validate == nil {
+		return apiKeyCheck{ code: http.StatusOK }
+	}
+	key := requestAPIKey(request)
+	if key == "" {
+		return apiKeyCheck{ code: http.StatusUnauthorized, message: "api key required" }
+	}
+	quota, valid := validate(key)
+	if !valid {
+		return apiKeyCheck{ code: http.StatusForbidden, message: "invalid api key" }
+	}
+
+	remaining, allowed := api_key_usage.count(key, quota, now)
+	if !allowed {
+		tomorrow := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+		return apiKeyCheck{ http.StatusTooManyRequests, "quota exceeded", quota, remaining, int(tomorrow.Sub(now).Seconds()) + 1 }
+	}
+	return apiKeyCheck{ code: http.StatusOK, quota: quota, remaining: remaining }
+}
+
+
+// Returns a handler serving the requests with an API key valid for
+// ValidateAPIKey, if set, and within its daily quota, with handler, see
+// checkAPIKey(). The X-Quota-Limit and X-Quota-Remaining headers give the
+// quota of the key and the requests left.
+func requireAPIKey(handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+
+		check := checkAPIKey(request, time.Now())
+		if check.quota > 0 {
+			writer.Header().Set("X-Quota-Limit", strconv.Itoa(check.quota))
+			writer.Header().Set("X-Quota-Remaining", strconv.Itoa(check.remaining))
+		}
+		switch check.code {
+		case http.StatusOK :
+			handler(writer, request)
+			return
+		case http.StatusUnauthorized :
+			writer.Header().Set("WWW-Authenticate", `Bearer realm="geoip"`)
+		case http.StatusTooManyRequests :
+			writer.Header().Set("Retry-After", strconv.Itoa(check.retry_after))
+		}
+		writeJSONError(writer, check.code, check.message)
+	}
+}
@@ -0,0 +1,264 @@
+
+package geoip
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+
+// This file provides the reading of the MaxMind archives, zip or tar.gz,
+// to extract their files, or to load them straight from the archives
+// without extracting them on disk (see Config.StreamArchives).
+
+
+// Error of an archive which cannot be read, as opposed to the errors
+// of the function reading its file, like a full disk
+type archiveError struct {
+	err error
+}
+
+func (e archiveError) Error() string {
+	return e.err.Error()
+}
+
+func (e archiveError) Unwrap() error {
+	return e.err
+}
+
+
+// Tells if an error comes from a corrupted or truncated archive or gzip
+// file : returned by the archive readers, or by the decompression of its
+// content while it was read
+func isCorruptedArchive(err error) bool {
+	var corrupt flate.CorruptInputError
+	return errors.As(err, &archiveError{}) || errors.As(err, &corrupt) ||
+		errors.Is(err, gzip.ErrChecksum) || errors.Is(err, gzip.ErrHeader) ||
+		errors.Is(err, zip.ErrChecksum) || errors.Is(err, zip.ErrFormat) ||
+		errors.Is(err, tar.ErrHeader) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+
+// Read the file with a given base name, whatever its directory, from
+// a zip or tar.gz archive, detected from its first bytes, with one of
+// the io.Reader loaders. A corrupted archive is removed, to be
+// downloaded again, but not when the read function fails, so a good
+// archive is kept when its file cannot be written or loaded.
+func readArchive(archive string, name string, read func(in io.Reader) error) error {
+
+	file, err := os.Open(archive)
+	if err != nil {
+		log_geolocip.Err(fmt.Sprintf("Cannot open %s: %v", archive, err))
+		return err
+	}
+	defer file.Close()
+
+	magic := make([]byte, 2)
+	found := false
+	if _, err = io.ReadFull(file, magic); err != nil {
+		err = archiveError{ err }
+	} else {
+		file.Seek(0, io.SeekStart)
+		if magic[0] == 0x1f && magic[1] == 0x8b {
+			found, err = readTarGz(file, name, read)
+		} else {
+			found, err = readZip(file, name, read)
+		}
+	}
+	if err != nil {
+		log_geolocip.Err(fmt.Sprintf("Error reading archive %s: %v", archive, err))
+		if isCorruptedArchive(err) {
+			os.Remove(archive)	// downloaded again next time
+		}
+		return err
+	}
+	if !found {
+		log_geolocip.Err(fmt.Sprintf("Bad content in %s, expected %s", archive, name))
+		return errors.New("Bad content")
+	}
+	return nil
+}
+
+
+// Read the file with a given base name from a zip archive, telling
+// if it was found
+func readZip(file *os.File, name string, read func(in io.Reader) error) (bool, error) {
+
+	fi, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	archive, err := zip.NewReader(file, fi.Size())
+	if err != nil {
+		return false, archiveError{ err }
+	}
+
+	for _, f := range archive.File {
+		if path.Base(f.Name) != name {
+			continue
+		}
+		in, err := f.Open()
+		if err != nil {
+			return true, archiveError{ err }
+		}
+		defer in.Close()
+		return true, read(in)
+	}
+	return false, nil
+}
+
+
+// Read the file with a given base name from a tar.gz archive, telling
+// if it was found
+func readTarGz(file *os.File, name string, read func(in io.Reader) error) (bool, error) {
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return false, archiveError{ err }
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, archiveError{ err }
+		}
+		if header.Typeflag == tar.TypeReg && path.Base(header.Name) == name {
+			return true, read(tr)
+		}
+	}
+}
+
+
+// Extract the file with a given base name from a zip or tar.gz archive
+// to a given filename, replaced only once fully extracted, see
+// readArchive()
+func extractArchiveFile(archive string, name string, out_file string) error {
+	err := readArchive(archive, name, func(in io.Reader) error {
+		return writeFileAtomic(out_file, in, nil)
+	})
+	if err != nil {
+		return err
+	}
+	log_geolocip.Notice(fmt.Sprintf("Extracted %s", out_file))
+	return nil
+}
+
+
+// Read a gzip compressed file with one of the io.Reader loaders
+func readGzip(gzfile string, read func(in io.Reader) error) error {
+
+	file, err := os.Open(gzfile)
+	if err != nil {
+		log_geolocip.Err(fmt.Sprintf("Error open file: %v", err))
+		return err
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		log_geolocip.Err(fmt.Sprintf("Error opening gzip file %s: %v", gzfile, err))
+		return err
+	}
+	defer gz.Close()
+
+	return read(gz)
+}
+
+
+// Loads the data not already loaded in the snapshot from the MaxMind
+// archives in dir, after downloading them if requested, without
+// extracting them
+func (data *snapshot) loadArchives(config Config, dir string) error {
+
+	var err error
+
+	if config.Download && config.ASNOnly {
+		var stale_err error
+		downloadMaxmindASNArchives(dir, &stale_err)
+	} else if config.Download {
+		var stale_err error
+		downloadMaxmindArchives(dir, &stale_err)
+		downloadMaxmindIPv6Archives(dir, &stale_err)
+	}
+
+	city_zipfile := filepath.Join(dir, zipfile_city)
+
+	// The locations file is iso8859-1 encoded
+	if data.locations == nil {
+		err = readArchive(city_zipfile, file_location, func(in io.Reader) error {
+			loc_list, err := config.loaderOptions().LoadLocations(NewLatin1Reader(in))
+			data.locations = LocationSlice(loc_list)
+			return err
+		})
+		if err != nil {
+			log_geolocip.Err(fmt.Sprintf("Cannot load locations file : %v", err))
+			return err
+		}
+	}
+	log_geolocip.Notice("Locations file loaded")
+
+	if data.blocks == nil {
+		err = readArchive(city_zipfile, file_blocks, func(in io.Reader) (err error) {
+			data.blocks, err = LoadBlocks(in)
+			return err
+		})
+		if err != nil {
+			log_geolocip.Err(fmt.Sprintf("Cannot load blocks file : %v", err))
+			return err
+		}
+		data.modified = fileModTime(city_zipfile)
+	}
+	log_geolocip.Notice("Blocks file loaded")
+
+	if data.asn_tree == nil {
+		err = readArchive(filepath.Join(dir, zipfile_asn), file_asn, func(in io.Reader) (err error) {
+			data.asn_tree, err = LoadASN(in)
+			return err
+		})
+		if err != nil {
+			log_geolocip.Err(fmt.Sprintf("Cannot load ASN file : %v", err))
+			return err
+		}
+	}
+	log_geolocip.Notice("ASN file loaded")
+
+	// Optional, like in loadIPv6()
+	if data.blocks6 == nil {
+		err = readGzip(filepath.Join(dir, gzfile_city6), func(in io.Reader) (err error) {
+			data.blocks6, err = config.loaderOptions().LoadBlocks6(NewLatin1Reader(in))
+			return err
+		})
+		if err != nil {
+			log_geolocip.Err(fmt.Sprintf("Cannot load IPv6 blocks file : %v", err))
+			return nil
+		}
+	}
+	log_geolocip.Notice("IPv6 blocks file loaded")
+
+	if data.asn6_tree == nil {
+		err = readArchive(filepath.Join(dir, zipfile_asn6), file_asn6, func(in io.Reader) (err error) {
+			data.asn6_tree, err = LoadASN6(in)
+			return err
+		})
+		if err != nil {
+			log_geolocip.Err(fmt.Sprintf("Cannot load IPv6 ASN file : %v", err))
+			return nil
+		}
+	}
+	log_geolocip.Notice("IPv6 ASN file loaded")
+
+	return nil
+}
@@ -5,8 +5,9 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"encoding/csv"
 	"strconv"
+	"strings"
+	"sort"
 	"github.com/google/btree"
 )
 
@@ -14,24 +15,88 @@ import (
 // This package provides function to manage the ASN file
 // from MaxMind LLC.
 
-// Default filename for the ASN file from MaxMind LLC
+// Former default filename for the ASN file from MaxMind LLC.
+//
+// Deprecated: the files are now in the data directory, see Config.Dir.
 const ASN_FILE = "/tmp/GeoIPASNum2.csv"
 
 
 // An ASN structure is a range of IP addresses (from LowIP
-// to HighIP) matching a given ASN information string. 
+// to HighIP) matching a given ASN information string, split
+// in the AS number and the organization name. 
 // ASN example : 
-// 	{ 16777216, 16777471, "AS15169 Google Inc." }
+// 	{ 16777216, 16777471, "AS15169 Google Inc.", 15169, "Google Inc." }
 type ASN struct {
 	LowIP uint32
 	HighIP uint32
 	ASN string
+	Number uint32
+	Organization string
 }
 
 
-// All ASNs are kept in memory as a BTree. ASNs is the
-// type for this btree.
-type ASNs btree.BTree
+// Returns an ASN for a range of IP addresses and an ASN information
+// string, like "AS15169 Google Inc.", with its number and organization
+func NewASN(low_ip uint32, high_ip uint32, asn string) ASN {
+	number, organization := splitASN(asn)
+	return ASN{ low_ip, high_ip, asn, number, organization }
+}
+
+
+// Splits an ASN information string, like "AS15169 Google Inc.", in
+// its number and organization name. The number is 0 if the string
+// does not start with one.
+func splitASN(asn string) (uint32, string) {
+	prefix, organization, _ := strings.Cut(asn, " ")
+	number, err := strconv.ParseUint(strings.TrimPrefix(prefix, "AS"), 10, 32)
+	if err != nil || !strings.HasPrefix(prefix, "AS") {
+		return 0, asn
+	}
+	return uint32(number), organization
+}
+
+
+// Returns the AS number and the organization name of the ASN, split
+// from its ASN string if they are not set (like for an ASN built by
+// a Locator with only the ASN string).
+func (asn *ASN) Parts() (uint32, string) {
+	if asn.Number == 0 && asn.Organization == "" {
+		return splitASN(asn.ASN)
+	}
+	return asn.Number, asn.Organization
+}
+
+
+// All ASNs are kept in memory in a slice sorted by IP, like
+// the Blocks.
+type ASNs []ASN
+
+
+// Returns the ASNs holding a given list of ASN, sorted by IP, like
+// NewBlocks().
+func NewASNs(list []ASN) *ASNs {
+
+	if !sort.SliceIsSorted(list, func(i, j int) bool { return list[i].LowIP < list[j].LowIP }) {
+		sort.SliceStable(list, func(i, j int) bool { return list[i].LowIP < list[j].LowIP })
+	}
+
+	kept := list[:0]
+	for _, asn := range list {
+		if n := len(kept); n > 0 && asn.LowIP <= kept[n-1].HighIP {
+			kept[n-1] = asn
+		} else {
+			kept = append(kept, asn)
+		}
+	}
+	asns := ASNs(kept)
+	return &asns
+}
+
+
+// Returns the number of ASN
+func (asns *ASNs) Len() int {
+	return len(*asns)
+}
 
 
 // Implements String() function to *ASN type, so it
@@ -43,7 +108,8 @@ func (asn *ASN) String() string {
 
 
 // Implements the Item interface from btree package for
-// the ASN type, so we can use them in a btree.
+// the ASN type, kept for the callers storing them in a btree,
+// though the ASNs are now a sorted slice.
 func (asn ASN)Less(than btree.Item) bool {
 
 	// Less tests whether the current item is less than the given argument.
@@ -52,8 +118,8 @@ func (asn ASN)Less(than btree.Item) bool {
 }
 
 
-// Read a MaxMind GeoIP ASN file in memory, as a BTree
-// of ASN structures.
+// Read a MaxMind GeoIP ASN file in memory, as a sorted
+// slice of ASN structures.
 func LoadASNFile(filename string) (*ASNs, error) {
     
     file, err := os.Open(filename)
@@ -63,56 +129,118 @@ func LoadASNFile(filename string) (*ASNs, error) {
     }
     defer file.Close()
 
-    t := btree.New(4)
+    return LoadASN(file)
+}
 
-    r := csv.NewReader(file)
-    r.FieldsPerRecord = -1
 
-    for {
-    
-    	values, err := r.Read()
-    	if err == io.EOF {
-    		break
-    	}    	
-    	if err != nil {
-    		log_geolocip.Err(fmt.Sprintf("ASN error reading file: %v", err))
-    		break
-    	}
-	
-		// Use only lines with 3 values
-	   	if len(values) == 3 {
-
-	   		low_ip, err := strconv.ParseUint(values[0], 10, 32)
-	   		if err != nil {
-	   			// fmt.Println("Line ignored, cannot read LowIP", err)
-	   			continue
-	   		}	   		
-	   		high_ip, err := strconv.ParseUint(values[1], 10, 32)
-	   		if err != nil {
-	   			// fmt.Println("Line ignored, cannot read HighIP", err)
-	   			continue
-	   		}	   		
-
-	   		// var asn = ASN{ uint32(low_ip), uint32(high_ip), values[2] }
-	   		// fmt.Println(&asn)
-	   		t.ReplaceOrInsert(ASN{ uint32(low_ip), uint32(high_ip), values[2] })
+// Read MaxMind GeoIP ASN from an io.Reader in memory, as a slice
+// of ASN structures sorted by IP, see ASNs. A leading utf-8 BOM is
+// skipped. Lines without 3 values are skipped.
+func LoadASN(in io.Reader) (*ASNs, error) {
+	return LoaderOptions{}.LoadASN(in)
+}
+
+
+// Same as the LoadASN() function, with the given loader options.
+func (opts LoaderOptions) LoadASN(in io.Reader) (*ASNs, error) {
 
+    var list []ASN
+
+    pool := internPool{}
+    readRows("ASN", opts, in, func(values []string) (ASN, bool) {
+
+		// Use only lines with 3 values
+	   	if len(values) != 3 {
+	   		return ASN{}, false
 	   	}
-    }
 
-    return (*ASNs)(t), nil
+   		low_ip, err := strconv.ParseUint(values[0], 10, 32)
+   		if err != nil {
+   			// fmt.Println("Line ignored, cannot read LowIP", err)
+   			return ASN{}, false
+   		}
+   		high_ip, err := strconv.ParseUint(values[1], 10, 32)
+   		if err != nil {
+   			// fmt.Println("Line ignored, cannot read HighIP", err)
+   			return ASN{}, false
+   		}
+
+   		return NewASN(uint32(low_ip), uint32(high_ip), pool.intern(values[2])), true
+
+    }, func(asn ASN) {
+    	list = append(list, asn)
+    })
+
+    return NewASNs(list), nil
 }
 
 
 // Returns ASN structure matching a given IP address.
 func (asns *ASNs)Get(IP uint32) *ASN {
-	tree := (*btree.BTree)(asns)
-	item := tree.Get(ASN{IP, IP, ""})
-	if item != nil {
-		asn := item.(ASN)
+	list := *asns
+	i := sort.Search(len(list), func(i int) bool { return list[i].HighIP >= IP })
+	if i < len(list) && list[i].LowIP <= IP {
+		asn := list[i]
 		return(&asn)
 	} else {
 		return(nil)
 	}
 }
 
+
+
+// Returns up to n consecutive asns, starting with the one matching
+// a given IP address, or with the first one after it if none matches.
+// The asns are appended to list[:0], to reuse its storage.
+func (asns *ASNs)getRange(IP uint32, n int, list []ASN) []ASN {
+	all := *asns
+	i := sort.Search(len(all), func(i int) bool { return all[i].HighIP >= IP })
+	if n > len(all) - i {
+		n = len(all) - i
+	}
+	return append(list[:0], all[i:i+n]...)
+}
+
+
+// An ASNSummary holds the total number of IPv4 addresses of
+// an AS, for all its ranges. Number is the AS number, like
+// "AS14618", and Name the rest of the ASN string.
+type ASNSummary struct {
+	Number string
+	Name string
+	Ranges int
+	Addresses uint64
+}
+
+
+// Returns the n ASs with the most IPv4 addresses, largest first,
+// or all of them if n <= 0.
+func (asns *ASNs)Top(n int) []ASNSummary {
+
+	by_number := make(map[string]*ASNSummary)
+	for _, asn := range *asns {
+		number, name, _ := strings.Cut(asn.ASN, " ")
+		summary, ok := by_number[number]
+		if !ok {
+			summary = &ASNSummary{ Number: number, Name: name }
+			by_number[number] = summary
+		}
+		summary.Ranges++
+		summary.Addresses += uint64(asn.HighIP - asn.LowIP) + 1
+	}
+
+	list := make([]ASNSummary, 0, len(by_number))
+	for _, summary := range by_number {
+		list = append(list, *summary)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Addresses != list[j].Addresses {
+			return list[i].Addresses > list[j].Addresses
+		}
+		return list[i].Number < list[j].Number
+	})
+	if n > 0 && n < len(list) {
+		list = list[:n]
+	}
+	return list
+}
@@ -0,0 +1,135 @@
+
+package geoip
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"net"
+	"bytes"
+	"github.com/google/btree"
+)
+
+
+// This package provides function to manage the IPv6 ASN file
+// from MaxMind LLC (GeoIPASNum2v6.csv) :
+// 	"AS2500 WIDE Project","2001:200::","2001:200:ffff:ffff:ffff:ffff:ffff:ffff",32
+
+// An ASN6 structure is a range of IPv6 addresses (from LowIP
+// to HighIP, in their 16 bytes form) matching a given ASN
+// information string.
+type ASN6 struct {
+	LowIP [16]byte
+	HighIP [16]byte
+	ASN string
+}
+
+
+// All IPv6 ASNs are kept in memory as a BTree. ASNs6 is the
+// type for this btree.
+type ASNs6 btree.BTree
+
+
+// Implements String() function to *ASN6 type, so it
+// implements the Stringer interface an can be Println().
+func (asn *ASN6) String() string {
+	return fmt.Sprintf("LowIP=%s, HighIP=%s, ASN=%q",
+		net.IP(asn.LowIP[:]), net.IP(asn.HighIP[:]), asn.ASN)
+}
+
+
+// Implements the Item interface from btree package for
+// the ASN6 type, so we can use them in a btree.
+func (asn ASN6)Less(than btree.Item) bool {
+
+	// Less tests whether the current item is less than the given argument.
+	low_ip := than.(ASN6).LowIP
+	return bytes.Compare(asn.HighIP[:], low_ip[:]) < 0
+
+}
+
+
+// Read a MaxMind GeoIP IPv6 ASN file in memory, as a BTree
+// of ASN6 structures.
+func LoadASN6File(filename string) (*ASNs6, error) {
+
+    file, err := os.Open(filename)
+    if err != nil {
+        log_geolocip.Err(fmt.Sprintf("ASN6 error open file: %v", err))
+        return nil, err
+    }
+    defer file.Close()
+
+    return LoadASN6(file)
+}
+
+
+// Read MaxMind GeoIP IPv6 ASN from an io.Reader in memory, as a
+// BTree of ASN6 structures. A leading utf-8 BOM is skipped. Lines
+// without 4 values are skipped.
+func LoadASN6(in io.Reader) (*ASNs6, error) {
+	return LoaderOptions{}.LoadASN6(in)
+}
+
+
+// Same as the LoadASN6() function, with the given loader options.
+func (opts LoaderOptions) LoadASN6(in io.Reader) (*ASNs6, error) {
+
+    t := btree.New(4)
+
+    r := opts.newCSVReader(in)
+    skipped := 0
+    pool := internPool{}
+
+    for {
+
+    	values, err := r.Read()
+    	if err == io.EOF {
+    		break
+    	}
+    	if err != nil {
+    		log_geolocip.Err(fmt.Sprintf("ASN6 error reading file: %v", err))
+    		break
+    	}
+    	if tooManyFields(values, &skipped) {
+    		continue
+    	}
+
+		// Use only lines with 4 values
+	   	if len(values) == 4 {
+
+	   		low_ip := net.ParseIP(values[1])
+	   		high_ip := net.ParseIP(values[2])
+	   		if low_ip == nil || high_ip == nil {
+	   			continue
+	   		}
+
+	   		asn := ASN6{ ASN: pool.intern(values[0]) }
+	   		copy(asn.LowIP[:], low_ip.To16())
+	   		copy(asn.HighIP[:], high_ip.To16())
+	   		t.ReplaceOrInsert(asn)
+
+	   	}
+    }
+
+    logTooManyFields("ASN6", skipped)
+
+    return (*ASNs6)(t), nil
+}
+
+
+// Returns ASN6 structure matching a given IPv6 address, in its
+// 16 bytes form.
+func (asns *ASNs6)Get(IP net.IP) *ASN6 {
+	var key ASN6
+	copy(key.LowIP[:], IP)
+	key.HighIP = key.LowIP
+	tree := (*btree.BTree)(asns)
+	item := tree.Get(key)
+	if item != nil {
+		asn := item.(ASN6)
+		return(&asn)
+	} else {
+		return(nil)
+	}
+}
@@ -0,0 +1,222 @@
+package geoip
+
+
+import (
+	"net"
+	"runtime"
+	"sync"
+)
+
+
+// This file provides a faster way to geolocate batches of IPv4
+// addresses sorted (or roughly sorted) by IP, like in log files.
+
+
+// Number of consecutive blocks and ASNs kept by a BatchLookup, and
+// maximum distance after the current window for an address to be
+// considered close enough to fetch a new window from it. Farther
+// addresses are searched with a plain Get().
+const (
+	BATCH_WINDOW = 8
+	BATCH_NEAR = 1 << 16
+)
+
+
+// Minimum number of addresses geolocated by each goroutine of
+// GeoLocIPv4Batch(), so small batches are not split
+const BATCH_CHUNK = 4096
+
+
+// A BatchLookup geolocates IPv4 addresses like GeoLocIPv4E(), but
+// remembers the last matched block and ASN, and the ones following
+// them once addresses are found to be increasing. When consecutive
+// addresses are close to each other, they are found in these windows
+// without a full binary search of the sorted blocks and ASNs.
+// A BatchLookup must not be used by several goroutines at once.
+type BatchLookup struct {
+	db *DB
+	source *Blocks
+	blocks []Block
+	asns []ASN
+}
+
+
+// Returns a new BatchLookup, with empty windows, using the data of
+// the default DB
+func NewBatchLookup() *BatchLookup {
+	return defaultDB().NewBatchLookup()
+}
+
+
+// Returns a new BatchLookup, with empty windows, using the data of
+// the DB
+func (db *DB) NewBatchLookup() *BatchLookup {
+	return &BatchLookup{ db: db }
+}
+
+
+// Returns the geolocation information for a given IPv4 address, with
+// the same results and errors as GeoLocIPv4E().
+func (bl *BatchLookup) GeoLocIPv4E(ip net.IP) (*GeoLocIp, error) {
+
+	if ip.To4() == nil {
+		return nil, ErrInvalidIP
+	}
+	ip = ip.To16()
+
+	data := bl.db.snapshot()
+	if gli := data.override(ip); gli != nil {
+		return data.enrich(gli, nil)
+	}
+	if data.locator != nil {
+		return data.enrich(data.locator.GeoLocIPv4E(ip))
+	}
+	if data.locations == nil || data.blocks == nil || data.asn_tree == nil {
+		return nil, ErrNotInitialized
+	}
+
+	addr := ipv4ToUint32(ip)
+
+	// The windows are emptied when the DB has been reloaded
+	if bl.source != data.blocks {
+		bl.blocks, bl.asns, bl.source = bl.blocks[:0], bl.asns[:0], data.blocks
+	}
+
+	if !blockWindowCovers(bl.blocks, addr) {
+		if n := len(bl.blocks); n > 0 && addr > bl.blocks[n-1].HighIP && addr - bl.blocks[n-1].HighIP <= BATCH_NEAR {
+			bl.blocks = data.blocks.getRange(addr, BATCH_WINDOW, bl.blocks)
+		} else {
+			bl.blocks = bl.blocks[:0]
+			if block := data.blocks.Get(addr); block != nil {
+				bl.blocks = append(bl.blocks, *block)
+			}
+		}
+	}
+	block := blockWindowGet(bl.blocks, addr)
+	if block == nil {
+		return nil, ErrNoBlock
+	}
+
+	if !asnWindowCovers(bl.asns, addr) {
+		if n := len(bl.asns); n > 0 && addr > bl.asns[n-1].HighIP && addr - bl.asns[n-1].HighIP <= BATCH_NEAR {
+			bl.asns = data.asn_tree.getRange(addr, BATCH_WINDOW, bl.asns)
+		} else {
+			bl.asns = bl.asns[:0]
+			if asn := data.asn_tree.Get(addr); asn != nil {
+				bl.asns = append(bl.asns, *asn)
+			}
+		}
+	}
+
+	return data.enrich(data.newGeoLocIp(ip, block, asnWindowGet(bl.asns, addr)), nil)
+}
+
+
+// Returns the geolocation information for the given IPv4 addresses,
+// using the default DB, see DB.GeoLocIPv4Batch().
+func GeoLocIPv4Batch(ips []net.IP) ([]*GeoLocIp, error) {
+	return defaultDB().GeoLocIPv4Batch(ips)
+}
+
+
+// Returns the geolocation information for the given IPv4 addresses,
+// in the same order, with a nil GeoLocIp for the addresses without
+// any (see GeoLocIPv4E()). The only error is ErrNotInitialized, if the
+// geoip data are not loaded. Large batches are split in consecutive
+// chunks, geolocated by several goroutines with a BatchLookup each,
+// so addresses sorted by IP are faster to geolocate.
+func (db *DB) GeoLocIPv4Batch(ips []net.IP) ([]*GeoLocIp, error) {
+
+	data := db.snapshot()
+	if data.locator == nil && (data.locations == nil || data.blocks == nil || data.asn_tree == nil) {
+		return nil, ErrNotInitialized
+	}
+
+	results := make([]*GeoLocIp, len(ips))
+	chunk := (len(ips) + runtime.GOMAXPROCS(0) - 1) / runtime.GOMAXPROCS(0)
+	if chunk < BATCH_CHUNK {
+		chunk = BATCH_CHUNK
+	}
+
+	var wg sync.WaitGroup
+	for start := 0; start < len(ips); start += chunk {
+		end := start + chunk
+		if end > len(ips) {
+			end = len(ips)
+		}
+		wg.Add(1)
+		go func(start int, end int) {
+			defer wg.Done()
+			bl := db.NewBatchLookup()
+			for i := start; i < end; i++ {
+				results[i], _ = bl.GeoLocIPv4E(ips[i])
+			}
+		}(start, end)
+	}
+	wg.Wait()
+
+	return results, nil
+}
+
+
+// Returns the geolocation information for the given IP addresses,
+// using the default DB, see DB.LookupBatch().
+func LookupBatch(ips []net.IP) []*GeoLocIp {
+	return defaultDB().LookupBatch(ips)
+}
+
+
+// Returns the geolocation information for the given IP addresses, IPv4
+// or IPv6, in the same order, with a nil GeoLocIp for the addresses
+// without any, or nil themselves. The IPv4 addresses are geolocated
+// with GeoLocIPv4Batch(), and the IPv6 ones with GeoLocIPv6E().
+func (db *DB) LookupBatch(ips []net.IP) []*GeoLocIp {
+	results, err := db.GeoLocIPv4Batch(ips)
+	if err != nil {
+		results = make([]*GeoLocIp, len(ips))
+	}
+	for i, ip := range ips {
+		if results[i] == nil && ip != nil && ip.To4() == nil {
+			results[i], _ = db.GeoLocIPv6E(ip)
+		}
+	}
+	return results
+}
+
+
+// Tells if an address is between the first and the last block of
+// a window. As the blocks are consecutive, an address falling between
+// two of them has no block.
+func blockWindowCovers(window []Block, addr uint32) bool {
+	return len(window) > 0 && window[0].LowIP <= addr && addr <= window[len(window)-1].HighIP
+}
+
+
+// Returns the block of a window matching an address, or nil
+func blockWindowGet(window []Block, addr uint32) *Block {
+	for i := range window {
+		if window[i].LowIP <= addr && addr <= window[i].HighIP {
+			block := window[i]
+			return &block
+		}
+	}
+	return nil
+}
+
+
+// Same as blockWindowCovers() for ASNs
+func asnWindowCovers(window []ASN, addr uint32) bool {
+	return len(window) > 0 && window[0].LowIP <= addr && addr <= window[len(window)-1].HighIP
+}
+
+
+// Same as blockWindowGet() for ASNs
+func asnWindowGet(window []ASN, addr uint32) *ASN {
+	for i := range window {
+		if window[i].LowIP <= addr && addr <= window[i].HighIP {
+			asn := window[i]
+			return &asn
+		}
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"net/http"
+)
+
+
+// This file provides the binary encodings of the responses of the lookup
+// and batch endpoints, for the high-QPS internal consumers : the protobuf
+// messages of geoip.proto, and MessagePack, negotiated with the Accept
+// header.
+
+
+// Content types of the binary responses
+const (
+	PROTOBUF_CONTENT_TYPE = "application/x-protobuf"
+	MSGPACK_CONTENT_TYPE = "application/msgpack"
+)
+
+
+// Returns the binary encoding asked by a request, "protobuf" or "msgpack",
+// or "" for the other ones. The format parameter takes precedence over the
+// Accept header.
+func requestBinary(request *http.Request) string {
+	if request.URL.Query().Get("format") != "" {
+		return ""
+	}
+	switch media := acceptedMedia(request); media {
+	case "protobuf", "msgpack" :
+		return media
+	}
+	return ""
+}
+
+
+// Writes a binary response, with the content type of its encoding, and
+// the protobuf message type, like "application/x-protobuf; messageType=geoip.GeoLoc"
+func writeBinary(writer http.ResponseWriter, encoding string, message_type string, body []byte) {
+	if encoding == "protobuf" {
+		writer.Header().Set("Content-Type", PROTOBUF_CONTENT_TYPE + "; messageType=" + message_type)
+	} else {
+		writer.Header().Set("Content-Type", MSGPACK_CONTENT_TYPE)
+	}
+	writer.Write(body)
+}
+
+
+// Returns the MessagePack encoding of a JSON document, with the objects
+// as maps whose keys are in the same order, and the numbers as integers
+// if they have no fraction, or else as float 64
+func jsonToMsgpack(encoded []byte) ([]byte, error) {
+
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.UseNumber()
+	var encode func(message []byte) ([]byte, error)
+	encode = func(message []byte) ([]byte, error) {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch value := token.(type) {
+		case json.Delim :
+			// The items are encoded first, as the header holds their number
+			var items []byte
+			count := 0
+			for ; decoder.More(); count++ {
+				if value == '{' {
+					key, err := decoder.Token()
+					if err != nil {
+						return nil, err
+					}
+					items = appendMsgpackString(items, key.(string))
+				}
+				if items, err = encode(items); err != nil {
+					return nil, err
+				}
+			}
+			if _, err := decoder.Token(); err != nil {	// closing delimiter
+				return nil, err
+			}
+			if value == '{' {
+				message = appendMsgpackHeader(message, count, 0x80, 0xde)
+			} else {
+				message = appendMsgpackHeader(message, count, 0x90, 0xdc)
+			}
+			return append(message, items...), nil
+		case string :
+			return appendMsgpackString(message, value), nil
+		case json.Number :
+			if integer, err := value.Int64(); err == nil {
+				return appendMsgpackInt(message, integer), nil
+			}
+			float, err := value.Float64()
+			if err != nil {
+				return nil, err
+			}
+			return binary.BigEndian.AppendUint64(append(message, 0xcb), math.Float64bits(float)), nil
+		case bool :
+			if value {
+				return append(message, 0xc3), nil
+			}
+			return append(message, 0xc2), nil
+		default :
+			return append(message, 0xc0), nil
+		}
+	}
+	return encode(nil)
+}
+
+
+// Appends the header of a MessagePack map or array of count items :
+// fixed if less than 16, and else with a 16 or 32 bits count, whose
+// type follows the one given
+func appendMsgpackHeader(message []byte, count int, fixed byte, type16 byte) []byte {
+	switch {
+	case count < 16 :
+		return append(message, fixed | byte(count))
+	case count <= math.MaxUint16 :
+		return binary.BigEndian.AppendUint16(append(message, type16), uint16(count))
+	default :
+		return binary.BigEndian.AppendUint32(append(message, type16 + 1), uint32(count))
+	}
+}
+
+
+// Appends a MessagePack string
+func appendMsgpackString(message []byte, value string) []byte {
+	switch length := len(value); {
+	case length < 32 :
+		message = append(message, 0xa0 | byte(length))
+	case length <= math.MaxUint8 :
+		message = append(message, 0xd9, byte(length))
+	case length <= math.MaxUint16 :
+		message = binary.BigEndian.AppendUint16(append(message, 0xda), uint16(length))
+	default :
+		message = binary.BigEndian.AppendUint32(append(message, 0xdb), uint32(length))
+	}
+	return append(message, value...)
+}
+
+
+// Appends a MessagePack integer, in its shortest encoding
+func appendMsgpackInt(message []byte, value int64) []byte {
+	switch {
+	case value >= 0 && value < 128 :
+		return append(message, byte(value))
+	case value >= -32 && value < 0 :
+		return append(message, byte(value))
+	case value >= 0 && value <= math.MaxUint8 :
+		return append(message, 0xcc, byte(value))
+	case value >= 0 && value <= math.MaxUint16 :
+		return binary.BigEndian.AppendUint16(append(message, 0xcd), uint16(value))
+	case value >= 0 && value <= math.MaxUint32 :
+		return binary.BigEndian.AppendUint32(append(message, 0xce), uint32(value))
+	case value >= 0 :
+		return binary.BigEndian.AppendUint64(append(message, 0xcf), uint64(value))
+	case value >= math.MinInt8 :
+		return append(message, 0xd0, byte(value))
+	case value >= math.MinInt16 :
+		return binary.BigEndian.AppendUint16(append(message, 0xd1), uint16(value))
+	case value >= math.MinInt32 :
+		return binary.BigEndian.AppendUint32(append(message, 0xd2), uint32(value))
+	default :
+		return binary.BigEndian.AppendUint64(append(message, 0xd3), uint64(value))
+	}
+}
@@ -4,8 +4,8 @@ package geoip
 import (
 	"fmt"
 	"os"
-	"encoding/csv"
 	"io"
+	"sort"
 	"strconv"
 	"github.com/google/btree"
 )
@@ -25,11 +25,42 @@ type Block struct {
 }
 
 
-// All blocks are stored in memory in a BTree.
-type Blocks btree.BTree
+// All blocks are stored in memory in a slice sorted by IP, searched
+// by dichotomy, much lighter than a BTree of the same blocks.
+type Blocks []Block
 
 
-// Default filename for the MaxMind LLC blocks file
+// Returns the Blocks holding a given list of blocks, sorted by IP.
+// Blocks overlapping the previous one replace it, so only one of them
+// is kept. The list is used as the storage of the Blocks.
+func NewBlocks(list []Block) *Blocks {
+
+	if !sort.SliceIsSorted(list, func(i, j int) bool { return list[i].LowIP < list[j].LowIP }) {
+		sort.SliceStable(list, func(i, j int) bool { return list[i].LowIP < list[j].LowIP })
+	}
+
+	kept := list[:0]
+	for _, block := range list {
+		if n := len(kept); n > 0 && block.LowIP <= kept[n-1].HighIP {
+			kept[n-1] = block
+		} else {
+			kept = append(kept, block)
+		}
+	}
+	blocks := Blocks(kept)
+	return &blocks
+}
+
+
+// Returns the number of blocks
+func (blocks *Blocks) Len() int {
+	return len(*blocks)
+}
+
+
+// Former default filename for the MaxMind LLC blocks file.
+//
+// Deprecated: the files are now in the data directory, see Config.Dir.
 const BLOCKS_FILE = "/tmp/GeoLiteCity-Blocks.csv"
 
 
@@ -42,7 +73,8 @@ func (block *Block) String() string {
 
 
 // Implements the Item interface from btree package for
-// the Block type, so we can use them in a btree.
+// the Block type, kept for the callers storing them in a btree,
+// though the Blocks are now a sorted slice.
 func (block Block)Less(than btree.Item) bool {
 
 	// Less tests whether the current item is less than the given argument.
@@ -53,7 +85,7 @@ func (block Block)Less(than btree.Item) bool {
 
 
 // Read a MaxMind GeoIP Blocks file in memory, as a
-// BTree of Blocks structures.
+// sorted slice of Blocks structures.
 func LoadBlocksFile(filename string) (*Blocks, error) {
     
     file, err := os.Open(filename)
@@ -63,61 +95,78 @@ func LoadBlocksFile(filename string) (*Blocks, error) {
     }
     defer file.Close()
 
-    t := btree.New(4)
+    return LoadBlocks(file)
+}
 
-    r := csv.NewReader(file)
-    r.FieldsPerRecord = -1
 
-    for {
-    
-    	values, err := r.Read()
-    	if err == io.EOF {
-    		break
-    	}    	
-    	if err != nil {
-    		log_geolocip.Err(fmt.Sprintf("Blocks error reading file: %v", err))
-    		break
-    	}
-	
-		// Use only lines with 3 values
-	   	if len(values) == 3 {
-
-	   		low_ip, err := strconv.ParseUint(values[0], 10, 32)
-	   		if err != nil {
-	   			// log.Println("Line ignored, cannot read LowIP", err)
-	   			continue
-	   		}	   		
-	   		high_ip, err := strconv.ParseUint(values[1], 10, 32)
-	   		if err != nil {
-	   			// log.Println("Line ignored, cannot read HighIP", err)
-	   			continue
-	   		}	   		
-	   		loc_id, err := strconv.ParseUint(values[2], 10, 32)
-	   		if err != nil {
-	   			// log.Println("Line ignored, cannot read LocId", err)
-	   			continue
-	   		}	   		
-
-	   		var block = Block{ uint32(low_ip), uint32(high_ip), uint32(loc_id) }
-	   		// fmt.Println(block)
-	   		t.ReplaceOrInsert(block)
+// Read MaxMind GeoIP Blocks from an io.Reader in memory, as a
+// slice of Block structures sorted by IP, see Blocks. A leading utf-8
+// BOM is skipped. Lines without 3 values are skipped.
+func LoadBlocks(in io.Reader) (*Blocks, error) {
+	return LoaderOptions{}.LoadBlocks(in)
+}
+
+
+// Same as the LoadBlocks() function, with the given loader options.
+func (opts LoaderOptions) LoadBlocks(in io.Reader) (*Blocks, error) {
+
+    var list []Block
+
+    readRows("Blocks", opts, in, func(values []string) (Block, bool) {
 
+		// Use only lines with 3 values
+	   	if len(values) != 3 {
+	   		return Block{}, false
 	   	}
-    }
 
-    return (*Blocks)(t), nil
+   		low_ip, err := strconv.ParseUint(values[0], 10, 32)
+   		if err != nil {
+   			// log.Println("Line ignored, cannot read LowIP", err)
+   			return Block{}, false
+   		}
+   		high_ip, err := strconv.ParseUint(values[1], 10, 32)
+   		if err != nil {
+   			// log.Println("Line ignored, cannot read HighIP", err)
+   			return Block{}, false
+   		}
+   		loc_id, err := strconv.ParseUint(values[2], 10, 32)
+   		if err != nil {
+   			// log.Println("Line ignored, cannot read LocId", err)
+   			return Block{}, false
+   		}
+
+   		return Block{ uint32(low_ip), uint32(high_ip), uint32(loc_id) }, true
+
+    }, func(block Block) {
+    	list = append(list, block)
+    })
+
+    return NewBlocks(list), nil
 }
 
 
 // Returns the Block structure matching a given IP address.
 func (blocks *Blocks)Get(IP uint32) *Block {
-	tree := (*btree.BTree)(blocks)
-	item := tree.Get(Block{IP, IP, 0}) // .(Block)
-	if item != nil {
-		block := item.(Block)
+	list := *blocks
+	i := sort.Search(len(list), func(i int) bool { return list[i].HighIP >= IP })
+	if i < len(list) && list[i].LowIP <= IP {
+		block := list[i]
 		return(&block)
 	} else {
 		return(nil)
 	}
 }
 
+
+
+// Returns up to n consecutive blocks, starting with the one matching
+// a given IP address, or with the first one after it if none matches.
+// The blocks are appended to list[:0], to reuse its storage.
+func (blocks *Blocks)getRange(IP uint32, n int, list []Block) []Block {
+	all := *blocks
+	i := sort.Search(len(all), func(i int) bool { return all[i].HighIP >= IP })
+	if n > len(all) - i {
+		n = len(all) - i
+	}
+	return append(list[:0], all[i:i+n]...)
+}
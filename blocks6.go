@@ -0,0 +1,153 @@
+
+package geoip
+
+import (
+	"fmt"
+	"os"
+	"io"
+	"net"
+	"bytes"
+	"github.com/google/btree"
+)
+
+
+// This package provides function to manage the GeoIP City IPv6 file
+// from MaxMind LLC (GeoLiteCityv6.csv). Unlike the IPv4 files, it
+// holds the location of each block on the same line :
+// 	"2001:200::", "2001:200:ffff:ffff:ffff:ffff:ffff:ffff", "42540528726795050063891204319802818560", "42540528806023212578155541913346719743", "JP", "", "", "", 36.0000, 138.0000, 0, 0
+
+
+// A Block6 is a range of IPv6 addresses (from LowIP to HighIP,
+// in their 16 bytes form) with its location. Blocks cannot overlap.
+type Block6 struct {
+	LowIP [16]byte
+	HighIP [16]byte
+	Location Location
+}
+
+
+// All IPv6 blocks are stored in memory in a BTree.
+type Blocks6 btree.BTree
+
+
+// Implements String() function to Block6 type, so it
+// implements the Stringer interface an can be Println().
+func (block *Block6) String() string {
+	return fmt.Sprintf("LowIP=%s, HighIP=%s, %s",
+		net.IP(block.LowIP[:]), net.IP(block.HighIP[:]), &block.Location)
+}
+
+
+// Implements the Item interface from btree package for
+// the Block6 type, so we can use them in a btree.
+func (block Block6)Less(than btree.Item) bool {
+
+	// Less tests whether the current item is less than the given argument.
+	low_ip := than.(Block6).LowIP
+	return bytes.Compare(block.HighIP[:], low_ip[:]) < 0
+
+}
+
+
+// Read a MaxMind GeoIP City IPv6 file in memory, as a
+// BTree of Block6 structures.
+func LoadBlocks6File(filename string) (*Blocks6, error) {
+	return LoaderOptions{}.LoadBlocks6File(filename)
+}
+
+
+// Same as the LoadBlocks6File() function, with the given loader options.
+func (opts LoaderOptions) LoadBlocks6File(filename string) (*Blocks6, error) {
+
+    file, err := os.Open(filename)
+    if err != nil {
+    	log_geolocip.Err(fmt.Sprintf("Blocks6 error open file: %v", err))
+        return nil, err
+    }
+    defer file.Close()
+
+    // The file is iso8859-1 encoded, like the IPv4 locations file
+    return opts.LoadBlocks6(newFileLatin1Reader(file))
+}
+
+
+// Read MaxMind GeoIP City IPv6 blocks from an io.Reader in memory,
+// as a BTree of Block6 structures. The content must be utf-8, see
+// LoadLocations(). Lines without 12 values are skipped.
+func LoadBlocks6(in io.Reader) (*Blocks6, error) {
+	return LoaderOptions{}.LoadBlocks6(in)
+}
+
+
+// Same as the LoadBlocks6() function, with the given loader options.
+func (opts LoaderOptions) LoadBlocks6(in io.Reader) (*Blocks6, error) {
+
+    t := btree.New(4)
+
+    r := opts.newCSVReader(in)
+    r.TrimLeadingSpace = true
+    skipped := 0
+    pool := internPool{}
+
+    for {
+
+    	values, err := r.Read()
+    	if err == io.EOF {
+    		break
+    	}
+    	if err != nil {
+    		log_geolocip.Err(fmt.Sprintf("Blocks6 error reading file: %v", err))
+    		break
+    	}
+    	if tooManyFields(values, &skipped) {
+    		continue
+    	}
+
+		// Use only lines with 12 values
+	   	if len(values) == 12 {
+
+	   		low_ip := net.ParseIP(values[0])
+	   		high_ip := net.ParseIP(values[1])
+	   		if low_ip == nil || high_ip == nil {
+	   			continue
+	   		}
+
+	   		block := Block6{ Location: Location {
+	   			Country: pool.intern(values[4]),
+	   			Region: pool.intern(values[5]),
+	   			City: pool.intern(values[6]),
+	   			Latitude: parseCoordinate(values[8], 90),
+	   			Longitude: parseCoordinate(values[9], 180),
+	   			TimeZone: countryTimeZone(values[4]),
+	   		}}
+	   		if !opts.SkipPostalFields {
+	   			block.Location.PostalCode, block.Location.MetroCode, block.Location.AreaCode = pool.intern(values[7]), parseCode(values[10]), parseCode(values[11])
+	   		}
+	   		copy(block.LowIP[:], low_ip.To16())
+	   		copy(block.HighIP[:], high_ip.To16())
+	   		t.ReplaceOrInsert(block)
+
+	   	}
+    }
+
+    logTooManyFields("Blocks6", skipped)
+
+    return (*Blocks6)(t), nil
+}
+
+
+// Returns the Block6 structure matching a given IPv6 address,
+// in its 16 bytes form.
+func (blocks *Blocks6)Get(IP net.IP) *Block6 {
+	var key Block6
+	copy(key.LowIP[:], IP)
+	key.HighIP = key.LowIP
+	tree := (*btree.BTree)(blocks)
+	item := tree.Get(key)
+	if item != nil {
+		block := item.(Block6)
+		return(&block)
+	} else {
+		return(nil)
+	}
+}
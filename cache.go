@@ -0,0 +1,144 @@
+
+package geoip
+
+import (
+	"container/list"
+	"net"
+	"sync"
+)
+
+
+// This file provides the LRU cache of the recent lookup results (see
+// Config.CacheSize), in front of the lookups in the loaded data, for
+// the servers receiving many requests from a small set of client IPs.
+
+
+// An LRU cache of GeoLocIp by IP address, in its 16 bytes form. It is
+// part of a snapshot, so it never holds results of previous data.
+type resultCache struct {
+	mu sync.Mutex
+	size int
+	entries map[string]*list.Element
+	recent list.List	// of *cacheEntry, most recently used first
+}
+
+
+// A result held by a resultCache
+type cacheEntry struct {
+	key string
+	gli *GeoLocIp
+}
+
+
+// Returns a new cache of a given number of results, or nil if size
+// is not positive
+func newResultCache(size int) *resultCache {
+	if size <= 0 {
+		return nil
+	}
+	return &resultCache{ size: size, entries: make(map[string]*list.Element, size) }
+}
+
+
+// Returns a new empty cache of the same size, or nil for a nil cache
+func (cache *resultCache) emptied() *resultCache {
+	if cache == nil {
+		return nil
+	}
+	return newResultCache(cache.size)
+}
+
+
+// Returns the result of a lookup of an IP address, in its 16 bytes
+// form, from the cache, or else from the lookup function, kept in the
+// cache if it succeeds. The caller gets its own copy of the GeoLocIp.
+func (cache *resultCache) lookup(ip net.IP, lookup func(ip net.IP) (*GeoLocIp, error)) (*GeoLocIp, error) {
+
+	if cache == nil {
+		return lookup(ip)
+	}
+
+	key := string(ip)
+	cache.mu.Lock()
+	if element, ok := cache.entries[key]; ok {
+		cache.recent.MoveToFront(element)
+		gli := cloneResult(key, element.Value.(*cacheEntry).gli)
+		cache.mu.Unlock()
+		return gli, nil
+	}
+	cache.mu.Unlock()
+
+	gli, err := lookup(ip)
+	if err != nil || gli == nil {
+		return gli, err
+	}
+	cached := cloneResult(key, gli)
+
+	cache.mu.Lock()
+	if _, ok := cache.entries[key]; !ok {
+		cache.entries[key] = cache.recent.PushFront(&cacheEntry{ key, cached })
+		if cache.recent.Len() > cache.size {
+			oldest := cache.recent.Back()
+			cache.recent.Remove(oldest)
+			delete(cache.entries, oldest.Value.(*cacheEntry).key)
+		}
+	}
+	cache.mu.Unlock()
+
+	return gli, nil
+}
+
+
+// Returns the number of results held by the cache
+func (cache *resultCache) len() int {
+	if cache == nil {
+		return 0
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return cache.recent.Len()
+}
+
+
+// Sets the size of the LRU cache of the recent lookup results of the
+// default DB, see DB.SetCacheSize().
+func SetCacheSize(size int) {
+	default_db.SetCacheSize(size)
+}
+
+
+// Sets the number of recent lookup results kept in an LRU cache by
+// the DB, like Config.CacheSize. The cache is emptied, and removed if
+// size is not positive.
+func (db *DB) SetCacheSize(size int) {
+	db.update(func(data *snapshot) {
+		data.cache = newResultCache(size)
+	})
+}
+
+
+// Returns a deep copy of a result of the cache, with the IP address
+// rebuilt from its key, so neither the cache nor its callers see the
+// changes made by the others to their GeoLocIp.
+func cloneResult(key string, gli *GeoLocIp) *GeoLocIp {
+	clone := *gli
+	clone.Ip = net.IP(key)
+	clone.Block = clonePointer(gli.Block)
+	clone.Location = clonePointer(gli.Location)
+	clone.Asn = clonePointer(gli.Asn)
+	clone.CountryName = clonePointer(gli.CountryName)
+	clone.RegionName = clonePointer(gli.RegionName)
+	clone.Anonymity = clonePointer(gli.Anonymity)
+	clone.InEuropeanUnion = clonePointer(gli.InEuropeanUnion)
+	return &clone
+}
+
+
+// Returns a pointer to a copy of the value pointed to, or nil
+func clonePointer[T any](p *T) *T {
+	if p == nil {
+		return nil
+	}
+	value := *p
+	return &value
+}
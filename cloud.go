@@ -0,0 +1,195 @@
+
+package geoip
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+)
+
+
+// This file provides the detection of the cloud providers addresses,
+// from the IP ranges they publish.
+
+
+// Names of the cloud providers, as given in the CloudProvider of
+// a GeoLocIp
+const (
+	CLOUD_AWS = "aws"
+	CLOUD_GCP = "gcp"
+	CLOUD_AZURE = "azure"
+)
+
+
+// IP ranges published by AWS and Google Cloud, downloaded by
+// DownloadCloudRangesTo(). Set them to download the ranges from a
+// mirror. The Azure ones are in the "Azure IP Ranges and Service Tags"
+// file of the Microsoft Download Center, whose URL changes every week.
+var AWS_IP_RANGES_URL = "https://ip-ranges.amazonaws.com/ip-ranges.json"
+var GCP_IP_RANGES_URL = "https://www.gstatic.com/ipranges/cloud.json"
+
+
+// IP ranges of cloud providers, giving the provider of an address.
+// Build them with OpenCloudRanges(), or Add() the ranges read by
+// LoadCloudRanges(). They must not be modified once used for lookups.
+type CloudRanges struct {
+	providers prefixMap[string]
+}
+
+
+// The IP ranges files of AWS, Google Cloud and Azure, only the
+// fields used
+type cloudFeed struct {
+	// AWS and Google Cloud
+	Prefixes []struct {
+		IPPrefix string `json:"ip_prefix"`
+		IPv4Prefix string `json:"ipv4Prefix"`
+		IPv6Prefix string `json:"ipv6Prefix"`
+	} `json:"prefixes"`
+	// AWS
+	IPv6Prefixes []struct {
+		IPv6Prefix string `json:"ipv6_prefix"`
+	} `json:"ipv6_prefixes"`
+	// Azure
+	Values []struct {
+		Properties struct {
+			AddressPrefixes []string `json:"addressPrefixes"`
+		} `json:"properties"`
+	} `json:"values"`
+}
+
+
+// Reads the IP ranges published by a cloud provider, in the format
+// of AWS (ip-ranges.json), Google Cloud (cloud.json) or Azure
+// (ServiceTags_Public.json). Invalid ranges are skipped.
+func LoadCloudRanges(in io.Reader) ([]netip.Prefix, error) {
+
+	var feed cloudFeed
+	if err := json.NewDecoder(in).Decode(&feed); err != nil {
+		log_geolocip.Err(fmt.Sprintf("Cloud IP ranges error reading file: %v", err))
+		return nil, err
+	}
+
+	var values []string
+	for _, prefix := range feed.Prefixes {
+		values = append(values, prefix.IPPrefix, prefix.IPv4Prefix, prefix.IPv6Prefix)
+	}
+	for _, prefix := range feed.IPv6Prefixes {
+		values = append(values, prefix.IPv6Prefix)
+	}
+	for _, value := range feed.Values {
+		values = append(values, value.Properties.AddressPrefixes...)
+	}
+
+	prefixes := []netip.Prefix{}
+	skipped := 0
+	for _, value := range values {
+		if value == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			skipped++
+			continue
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	if skipped > 0 {
+		log_geolocip.Notice(fmt.Sprintf("Cloud IP ranges: %d ranges skipped, not a prefix", skipped))
+	}
+
+	return prefixes, nil
+}
+
+
+// Opens the IP ranges files of cloud providers, given by provider
+// name (like CLOUD_AWS), see LoadCloudRanges().
+func OpenCloudRanges(files map[string]string) (*CloudRanges, error) {
+
+	cloud := &CloudRanges{}
+
+	for provider, filename := range files {
+		file, err := os.Open(filename)
+		if err != nil {
+			log_geolocip.Err(fmt.Sprintf("Cloud IP ranges error open file: %v", err))
+			return nil, err
+		}
+		prefixes, err := LoadCloudRanges(file)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+		cloud.Add(provider, prefixes)
+	}
+
+	return cloud, nil
+}
+
+
+// Downloads the IP ranges of AWS and Google Cloud in a directory, from
+// AWS_IP_RANGES_URL and GCP_IP_RANGES_URL with DownloadClient, and
+// returns the files by provider name, for OpenCloudRanges() or
+// Config.CloudRangesFiles. Like the MaxMind files, they are downloaded
+// again once older than DownloadMaxAge, if they changed, and a failed
+// download keeps the previous file : call it again to refresh them.
+func DownloadCloudRangesTo(dir string) (map[string]string, error) {
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log_geolocip.Err(fmt.Sprintf("Cannot create directory %s: %v", dir, err))
+		return nil, err
+	}
+
+	// Error of a failed download, whose previous file is used
+	var stale_err error
+
+	files := map[string]string{
+		CLOUD_AWS: filepath.Join(dir, "aws-ip-ranges.json"),
+		CLOUD_GCP: filepath.Join(dir, "gcp-cloud.json"),
+	}
+	urls := map[string]string{ CLOUD_AWS: AWS_IP_RANGES_URL, CLOUD_GCP: GCP_IP_RANGES_URL }
+	for provider, filename := range files {
+		if err := downloadOrKeep(urls[provider], "", filename, Credentials{}, &stale_err); err != nil {
+			return nil, err
+		}
+	}
+
+	return files, stale_err
+}
+
+
+// Adds the IP ranges of a cloud provider. When ranges of several
+// providers overlap, the most specific one wins.
+func (cloud *CloudRanges) Add(provider string, prefixes []netip.Prefix) {
+	for _, prefix := range prefixes {
+		cloud.providers.add(prefix, provider)
+	}
+}
+
+
+// Returns the cloud provider of an IP address, or "" if it is in
+// none of the ranges
+func (cloud *CloudRanges) Get(ip net.IP) string {
+	provider, _, _ := cloud.providers.get(ip)
+	return provider
+}
+
+
+// Sets the cloud IP ranges used by the lookups of the default DB,
+// see DB.SetCloudRanges().
+func SetCloudRanges(cloud *CloudRanges) {
+	default_db.SetCloudRanges(cloud)
+}
+
+
+// Sets the cloud IP ranges used by the lookups of the DB : the
+// GeoLocIp they return then have the CloudProvider of their address.
+// They are loaded by the DB when given by Config.CloudRangesFiles.
+func (db *DB) SetCloudRanges(cloud *CloudRanges) {
+	db.update(func(data *snapshot) {
+		data.cloud = cloud
+	})
+}
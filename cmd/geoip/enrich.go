@@ -0,0 +1,188 @@
+
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/kirabou/geoip"
+)
+
+
+// Number of addresses geolocated at once by enrich, with LookupBatch()
+const ENRICH_BATCH = 1000
+
+
+// Geolocation columns appended to the CSV rows by enrich
+var enrich_columns = []string{ "country_code", "region_code", "city", "postal_code", "latitude", "longitude", "time_zone", "asn", "organization", "country", "region", "network" }
+
+
+// Returns the values of the enrich_columns for the JSON fields of
+// a geolocation
+func enrichValues(fields geoip.GeoLocJSON) []string {
+	coordinate := func(value *float64) string {
+		if value == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*value, 'f', -1, 64)
+	}
+	var asn string
+	if fields.ASN != 0 {
+		asn = strconv.FormatUint(uint64(fields.ASN), 10)
+	}
+	return []string{ fields.CountryCode, fields.RegionCode, fields.City, fields.PostalCode, coordinate(fields.Latitude), coordinate(fields.Longitude), fields.TimeZone, asn, fields.Organization, fields.Country, fields.Region, fields.Network }
+}
+
+
+// Reads IP addresses from the standard input, one per line, or in the
+// given column of a CSV file with a header, and writes their geolocation
+// to the standard output as NDJSON (one JSON object per line), or as
+// the CSV rows with the geolocation columns appended. The addresses
+// without any give empty columns, or a JSON object with only the ip.
+func enrich(args []string) error {
+
+	flags := flag.NewFlagSet("enrich", flag.ExitOnError)
+	column := flags.String("column", "", "name of the IP column of a CSV input with a header, one IP per line if empty")
+	format := flags.String("format", "", "output format, json (NDJSON) or csv, csv for a CSV input and json otherwise")
+	lang := flags.String("lang", "", "language of the country and region names, like en")
+	flags.Parse(args)
+
+	if *format == "" {
+		*format = "json"
+		if *column != "" {
+			*format = "csv"
+		}
+	}
+	if *format != "json" && *format != "csv" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	if *lang != "" {
+		if err := geoip.SetLanguage(*lang); err != nil {
+			return err
+		}
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	enricher := &enricher{ format: *format, json: json.NewEncoder(out), csv: csv.NewWriter(out) }
+
+	if *column == "" {
+		if *format == "csv" {
+			enricher.writeHeader([]string{ "ip" })
+		}
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+			if err := enricher.add([]string{ line }, 0); err != nil {
+				return err
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+		return enricher.flush()
+	}
+
+	in := csv.NewReader(bufio.NewReader(os.Stdin))
+	in.FieldsPerRecord = -1
+	header, err := in.Read()
+	if err != nil {
+		return fmt.Errorf("cannot read the CSV header: %v", err)
+	}
+	index := -1
+	for i, name := range header {
+		if strings.TrimSpace(name) == *column {
+			index = i
+			break
+		}
+	}
+	if index == -1 {
+		return fmt.Errorf("no column %q in the CSV header", *column)
+	}
+	if *format == "csv" {
+		enricher.writeHeader(header)
+	}
+	for {
+		row, err := in.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if index >= len(row) {
+			row = append(row, make([]string, index + 1 - len(row))...)
+		}
+		if err := enricher.add(row, index); err != nil {
+			return err
+		}
+	}
+	return enricher.flush()
+}
+
+
+// Writes the rows read by enrich with their geolocation, looked up by
+// batches of ENRICH_BATCH addresses
+type enricher struct {
+	format string
+	json *json.Encoder
+	csv *csv.Writer
+	rows [][]string
+	ips []net.IP
+	addresses []string
+}
+
+
+// Writes the CSV header, with the geolocation columns appended
+func (e *enricher) writeHeader(header []string) {
+	e.csv.Write(append(append([]string{}, header...), enrich_columns...))
+}
+
+
+// Adds a row whose IP address is at a given index, written once its
+// batch is geolocated
+func (e *enricher) add(row []string, index int) error {
+	address := strings.TrimSpace(row[index])
+	e.rows = append(e.rows, row)
+	e.addresses = append(e.addresses, address)
+	e.ips = append(e.ips, net.ParseIP(address))
+	if len(e.ips) >= ENRICH_BATCH {
+		return e.flush()
+	}
+	return nil
+}
+
+
+// Geolocates the pending rows and writes them
+func (e *enricher) flush() error {
+
+	results := geoip.LookupBatch(e.ips)
+	for i, gli := range results {
+		fields := geoip.GeoLocJSON{ Ip: e.addresses[i] }
+		if gli != nil {
+			fields = gli.JSON(geoip.JSONOptions{})
+		}
+		if e.format == "json" {
+			if err := e.json.Encode(fields); err != nil {
+				return err
+			}
+		} else {
+			e.csv.Write(append(e.rows[i], enrichValues(fields)...))
+		}
+	}
+	e.rows, e.ips, e.addresses = e.rows[:0], e.ips[:0], e.addresses[:0]
+
+	e.csv.Flush()
+	return e.csv.Error()
+}
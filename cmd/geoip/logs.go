@@ -0,0 +1,119 @@
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/kirabou/geoip"
+)
+
+
+// Returns the client IP address of an access log line, found in its
+// field of a given number (from 1), the first one in the nginx and
+// Apache common and combined formats, like :
+// 	54.88.55.63 - - [25/Jan/2016:05:43:35 +0100] "GET / HTTP/1.1" 200 612
+// The address may be followed by a port, and an IPv6 one in brackets.
+func logClientIP(line string, field int) net.IP {
+	fields := strings.Fields(line)
+	if field < 1 || field > len(fields) {
+		return nil
+	}
+	address := strings.Trim(fields[field - 1], ",\"")
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		address = host
+	}
+	return net.ParseIP(strings.Trim(address, "[]"))
+}
+
+
+// Returns the fields appended to the access log lines for a geolocation :
+// the country code, the city and the ASN, quoted like the other fields
+// of the combined format, and "-" when unknown
+func logFields(gli *geoip.GeoLocIp) string {
+	quoted := func(value string) string {
+		if value == "" {
+			return `"-"`
+		}
+		return strconv.Quote(value)
+	}
+	var country, city, asn string
+	if gli != nil && gli.Location != nil {
+		country, city = gli.Location.Country, gli.Location.City
+	}
+	if gli != nil && gli.Asn != nil {
+		asn = gli.Asn.ASN
+	}
+	return quoted(country) + " " + quoted(city) + " " + quoted(asn)
+}
+
+
+// Rewrites nginx or Apache access logs, read from the given files or
+// the standard input, to the standard output, with the country code,
+// the city and the ASN of the client IP appended to each line. The
+// lines without a valid client IP get "-" fields, and the empty ones
+// are kept as is.
+func logs(args []string) error {
+
+	flags := flag.NewFlagSet("logs", flag.ExitOnError)
+	field := flags.Int("field", 1, "number of the whitespace-separated field holding the client IP, from 1")
+	flags.Parse(args)
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
+	if flags.NArg() == 0 {
+		return enrichLog(os.Stdin, out, *field)
+	}
+	for _, filename := range flags.Args() {
+		file, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		err = enrichLog(file, out, *field)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", filename, err)
+		}
+	}
+	return nil
+}
+
+
+// Writes the lines of an access log with their geolocation fields
+// appended, looked up by batches of ENRICH_BATCH addresses
+func enrichLog(in io.Reader, out *bufio.Writer, field int) error {
+
+	var lines []string
+	var ips []net.IP
+	flush := func() {
+		for i, gli := range geoip.LookupBatch(ips) {
+			out.WriteString(lines[i])
+			if lines[i] != "" {
+				out.WriteByte(' ')
+				out.WriteString(logFields(gli))
+			}
+			out.WriteByte('\n')
+		}
+		lines, ips = lines[:0], ips[:0]
+	}
+
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(nil, 1 << 20)	// long request lines and user agents
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		lines = append(lines, line)
+		ips = append(ips, logClientIP(line, field))
+		if len(ips) >= ENRICH_BATCH {
+			flush()
+		}
+	}
+	flush()
+	return scanner.Err()
+}
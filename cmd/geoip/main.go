@@ -0,0 +1,240 @@
+
+// Command geoip queries and manages the geoip data from the command
+// line, without writing Go :
+//
+// 	geoip lookup [-lang en] 54.88.55.63 2001:200::1
+// 	geoip serve [-port 9001 | -addr 127.0.0.1:9001 | -socket /run/geoip.sock] [-grpc-port 9002] [-cors-origins https://app.example.com] [-tls-cert cert.pem -tls-key key.pem]
+// 	geoip update
+// 	geoip enrich [-column ip] [-format json|csv] < addresses
+// 	geoip logs [-field 1] access.log
+//
+// lookup prints the JSON of the geolocation of each IP address, one per
+// line, and enrich does it for the addresses read from the standard
+// input, one per line or in a column of a CSV file, also writing CSV
+// (see enrich()). logs rewrites nginx or Apache access logs with the
+// country, city and ASN of the client IP appended (see logs()). serve
+// starts the REST API (and the gRPC service if a port is given for it),
+// and update downloads the MaxMind files again in the default data
+// directory, whatever their age. geoip serve -h lists all the flags of
+// serve : its timeouts and limits (-read-timeout, -max-concurrent, ...),
+// its rate limit (-rate-limit, -rate-burst, -rate-exempt), its API keys
+// (-api-keys) and the authentication of its admin endpoints (-admin-token,
+// -admin-user, -admin-allow). The files are downloaded by the other
+// commands too, if they are missing or too old.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/kirabou/geoip"
+)
+
+
+const usage = `Usage:
+	geoip lookup [-lang language] ip...
+	geoip serve [-port port | -addr address | -socket path] [-grpc-port port] [flag...]
+		(geoip serve -h lists the TLS, CORS, limits, rate limit, API keys and admin flags)
+	geoip update
+	geoip enrich [-column name] [-format json|csv] [-lang language] < input
+	geoip logs [-field number] [file...]
+`
+
+
+func main() {
+
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch command, args := os.Args[1], os.Args[2:]; command {
+	case "lookup" :
+		err = lookup(args)
+	case "serve" :
+		err = serve(args)
+	case "update" :
+		err = update(args)
+	case "enrich" :
+		err = enrich(args)
+	case "logs" :
+		err = logs(args)
+	case "help", "-h", "-help", "--help" :
+		fmt.Print(usage)
+	default :
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n%s", command, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "geoip %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+
+// Prints the JSON of the geolocation of each IP address given, failing
+// if one of them has none
+func lookup(args []string) error {
+
+	flags := flag.NewFlagSet("lookup", flag.ExitOnError)
+	lang := flags.String("lang", "", "language of the country and region names, like en")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		return fmt.Errorf("no IP address given")
+	}
+	if *lang != "" {
+		if err := geoip.SetLanguage(*lang); err != nil {
+			return err
+		}
+	}
+
+	var failed error
+	for _, address := range flags.Args() {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			failed = fmt.Errorf("%s: %v", address, geoip.ErrInvalidIP)
+			fmt.Fprintln(os.Stderr, failed)
+			continue
+		}
+		gli, err := geoip.Lookup(ip)
+		if err != nil {
+			failed = fmt.Errorf("%s: %v", address, err)
+			fmt.Fprintln(os.Stderr, failed)
+			continue
+		}
+		encoded, _ := gli.MarshalJSON()
+		fmt.Println(string(encoded))
+	}
+	return failed
+}
+
+
+// Serves the REST API, and the gRPC service if a port is given for
+// it, until one of the servers fails. The REST API is served on the
+// socket passed by systemd, if started by socket activation.
+func serve(args []string) error {
+
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: geoip serve [flag...]")
+		flags.PrintDefaults()
+	}
+	port := flags.Uint("port", 9001, "port of the REST API")
+	addr := flags.String("addr", "", "address of the REST API, like 127.0.0.1:9001, instead of -port")
+	socket := flags.String("socket", "", "path of a Unix socket to serve the REST API on, instead of -port")
+	grpc_port := flags.Uint("grpc-port", 0, "port of the gRPC service, none if 0")
+	cors_origins := flags.String("cors-origins", "", "comma separated origins allowed to call the REST API from browsers, * for any")
+	tls_cert := flags.String("tls-cert", "", "certificate file (PEM) of the REST API, served over HTTPS if given")
+	tls_key := flags.String("tls-key", "", "key file (PEM) of the certificate given by -tls-cert")
+	flags.DurationVar(&geoip.ServerReadTimeout, "read-timeout", geoip.ServerReadTimeout, "maximum duration of the reading of a request")
+	flags.DurationVar(&geoip.ServerWriteTimeout, "write-timeout", geoip.ServerWriteTimeout, "maximum duration of the writing of a response")
+	flags.DurationVar(&geoip.ServerIdleTimeout, "idle-timeout", geoip.ServerIdleTimeout, "maximum duration of an idle keep-alive connection")
+	flags.IntVar(&geoip.ServerMaxHeaderBytes, "max-header-bytes", geoip.ServerMaxHeaderBytes, "maximum size of the headers of a request")
+	flags.IntVar(&geoip.MaxConcurrentRequests, "max-concurrent", geoip.MaxConcurrentRequests, "maximum number of requests served at once, unlimited if 0")
+	flags.Float64Var(&geoip.RateLimitPerSecond, "rate-limit", 0, "requests per second allowed to each client IP, unlimited if 0")
+	flags.IntVar(&geoip.RateLimitBurst, "rate-burst", geoip.RateLimitBurst, "requests allowed at once to each client IP, with -rate-limit")
+	rate_exempt := flags.String("rate-exempt", "", "comma separated networks (CIDR) or addresses not limited by -rate-limit")
+	api_keys := flags.String("api-keys", "", "file of the API keys required by the lookups, one per line followed by its daily quota")
+	admin_token := flags.String("admin-token", "", "bearer token of /admin/reload and /status, the GEOIP_ADMIN_TOKEN environment variable if not given")
+	admin_user := flags.String("admin-user", "", "user of the basic authentication of /admin/reload and /status, with the GEOIP_ADMIN_PASSWORD environment variable")
+	admin_allow := flags.String("admin-allow", "", "comma separated networks (CIDR) or addresses allowed to use /admin/reload and /status")
+	flags.Parse(args)
+	if *port > 65535 || *grpc_port > 65535 {
+		return fmt.Errorf("invalid port")
+	}
+	if *api_keys != "" {
+		keys, err := geoip.ReadAPIKeys(*api_keys)
+		if err != nil {
+			return err
+		}
+		geoip.ValidateAPIKey = keys.Validate
+	}
+	// read after parsing, so the -h output does not show the token
+	geoip.AdminToken = *admin_token
+	if geoip.AdminToken == "" {
+		geoip.AdminToken = os.Getenv("GEOIP_ADMIN_TOKEN")
+	}
+	if *admin_user != "" {
+		geoip.AdminUser = *admin_user
+		geoip.AdminPassword = os.Getenv("GEOIP_ADMIN_PASSWORD")
+		if geoip.AdminPassword == "" {
+			return fmt.Errorf("GEOIP_ADMIN_PASSWORD is not set")
+		}
+	}
+	if *admin_allow != "" {
+		networks, err := geoip.ParseTrustedProxies(strings.Split(*admin_allow, ","))
+		if err != nil {
+			return err
+		}
+		geoip.AdminAllowed = networks
+	}
+	if *rate_exempt != "" {
+		networks, err := geoip.ParseTrustedProxies(strings.Split(*rate_exempt, ","))
+		if err != nil {
+			return err
+		}
+		geoip.RateLimitExempt = networks
+	}
+	if *cors_origins != "" {
+		for _, origin := range strings.Split(*cors_origins, ",") {
+			geoip.CORSOrigins = append(geoip.CORSOrigins, strings.TrimSpace(origin))
+		}
+	}
+
+	listeners, err := geoip.SystemdListeners()
+	if err != nil {
+		return err
+	}
+	var listener net.Listener
+	switch {
+	case len(listeners) > 0 :
+		listener = listeners[0]
+	case *socket != "" :
+		if listener, err = geoip.ListenUnixSocket(*socket); err != nil {
+			return err
+		}
+	default :
+		if *addr == "" {
+			*addr = fmt.Sprintf(":%d", *port)
+		}
+		if listener, err = net.Listen("tcp", *addr); err != nil {
+			return err
+		}
+	}
+
+	if *grpc_port != 0 {
+		go func() {
+			geoip.ServeGeoLocGRPC(uint16(*grpc_port))
+			os.Exit(1)
+		}()
+	}
+	if *tls_cert != "" || *tls_key != "" {
+		geoip.ServeGeoLocAPITLSListener(listener, *tls_cert, *tls_key)
+	} else {
+		geoip.ServeGeoLocAPIListener(listener)
+	}
+	return fmt.Errorf("server stopped")
+}
+
+
+// Downloads the MaxMind files again, whatever their age : they are
+// replaced only if they changed on the server
+func update(args []string) error {
+
+	flags := flag.NewFlagSet("update", flag.ExitOnError)
+	flags.Parse(args)
+
+	geoip.DownloadMaxAge = 0
+	if err := geoip.DownloadMaxmindFiles(); err != nil {
+		return err
+	}
+	// The GeoLite2 databases also hold the IPv6 data
+	if !geoip.CredentialsFromEnv().IsSet() {
+		return geoip.DownloadMaxmindIPv6Files()
+	}
+	return nil
+}
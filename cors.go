@@ -0,0 +1,84 @@
+
+package geoip
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+
+// This file provides the CORS headers of the REST API, so the single-page
+// applications allowed by CORSOrigins can call it directly from browsers.
+
+
+// Origins allowed to call the REST API from browsers, like
+// "https://app.example.com", or "*" for any origin. Empty by default :
+// no CORS headers are sent, and browsers refuse the cross-origin calls.
+var CORSOrigins []string
+
+
+// Methods and request headers allowed in the cross-origin requests, and
+// how long browsers can cache the answers to their preflight requests
+var (
+	CORSMethods = []string{ "GET", "POST" }
+	CORSHeaders = []string{ "Content-Type", "Authorization" }
+	CORSMaxAge = 10 * time.Minute
+)
+
+
+// Tells if an origin is allowed by CORSOrigins
+func corsAllowed(origin string) bool {
+	for _, allowed := range CORSOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+
+// Returns a handler adding the CORS headers to the responses of next for
+// the origins allowed by CORSOrigins, and answering the preflight requests
+// (OPTIONS requests with an Access-Control-Request-Method header) with a
+// 204 status code, with the allowed CORSMethods and CORSHeaders if the
+// origin and the method are allowed. The requests without an Origin header
+// are not changed. Handler() serves the REST API with it.
+func CORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+
+		origin := request.Header.Get("Origin")
+		if len(CORSOrigins) == 0 || origin == "" {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		header := writer.Header()
+		header.Add("Vary", "Origin")
+		allowed := corsAllowed(origin)
+		if allowed {
+			if slices.Contains(CORSOrigins, "*") {
+				header.Set("Access-Control-Allow-Origin", "*")
+			} else {
+				header.Set("Access-Control-Allow-Origin", origin)
+			}
+			header.Set("Access-Control-Expose-Headers", "Retry-After")
+		}
+
+		method := request.Header.Get("Access-Control-Request-Method")
+		if request.Method != http.MethodOptions || method == "" {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		// Preflight request
+		header.Add("Vary", "Access-Control-Request-Method")
+		header.Add("Vary", "Access-Control-Request-Headers")
+		if allowed && slices.Contains(CORSMethods, method) {
+			header.Set("Access-Control-Allow-Methods", strings.Join(CORSMethods, ", "))
+			header.Set("Access-Control-Allow-Headers", strings.Join(CORSHeaders, ", "))
+			header.Set("Access-Control-Max-Age", fmt.Sprint(int(CORSMaxAge.Seconds())))
+		}
+		writer.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -43,10 +43,24 @@ func (country Country)Less(than btree.Item) bool {
 
 
 // LoadCountries() loads the countries (as defined in the local 
-// countries constant) in a memory BTree
+// countries constant) in a memory BTree, with their French names
 func LoadCountries() (*Countries, error) {
+	return loadCountryList(countries_list)
+}
+
+
+// LoadCountriesEN() does the same as LoadCountries(), with the
+// English names of the countries
+func LoadCountriesEN() (*Countries, error) {
+	return loadCountryList(countries_en_list)
+}
+
+
+// Loads a local CSV list of country names and codes, separated by
+// a ';', in a memory BTree
+func loadCountryList(list string) (*Countries, error) {
 
-	r := csv.NewReader(strings.NewReader(countries_list))
+	r := csv.NewReader(strings.NewReader(list))
 	r.FieldsPerRecord = -1
     r.Comma = ';'
     
@@ -88,6 +102,36 @@ func (countries *Countries)Get(country_code string) *Country {
 }
 
 
+// Loads a local CSV list of country codes and values, separated
+// by a ';', in a map indexed by country code.
+func loadCountryTable(list string) map[string]string {
+	table := make(map[string]string)
+	for _, line := range strings.Split(list, "\n") {
+		if code, value, ok := strings.Cut(line, ";"); ok {
+			table[code] = value
+		}
+	}
+	return table
+}
+
+
+// ISO 3166-1 alpha 2 codes of the European Union member states
+var eu_countries = map[string]bool{
+	"AT": true, "BE": true, "BG": true, "CY": true, "CZ": true, "DE": true,
+	"DK": true, "EE": true, "ES": true, "FI": true, "FR": true, "GR": true,
+	"HR": true, "HU": true, "IE": true, "IT": true, "LT": true, "LU": true,
+	"LV": true, "MT": true, "NL": true, "PL": true, "PT": true, "RO": true,
+	"SE": true, "SI": true, "SK": true,
+}
+
+
+// IsEUCountry() tells if a country code is the one of an European
+// Union member state
+func IsEUCountry(country_code string) bool {
+	return eu_countries[country_code]
+}
+
+
 // CSV list of country names and ISO3661 codes
 const (
 	countries_list = `Afghanistan;AF
@@ -340,3 +384,256 @@ Zambie;ZM
 Zimbabwe;ZW`
 )
 
+
+// CSV list of English country names and ISO3661 codes
+const (
+	countries_en_list = `Aruba;AW
+Afghanistan;AF
+Angola;AO
+Anguilla;AI
+Åland Islands;AX
+Albania;AL
+Andorra;AD
+United Arab Emirates;AE
+Argentina;AR
+Armenia;AM
+American Samoa;AS
+Antarctica;AQ
+French Southern Territories;TF
+Antigua and Barbuda;AG
+Australia;AU
+Austria;AT
+Azerbaijan;AZ
+Burundi;BI
+Belgium;BE
+Benin;BJ
+Bonaire, Sint Eustatius, and Saba;BQ
+Burkina Faso;BF
+Bangladesh;BD
+Bulgaria;BG
+Bahrain;BH
+Bahamas;BS
+Bosnia and Herzegovina;BA
+Saint Barthélemy;BL
+Belarus;BY
+Belize;BZ
+Bermuda;BM
+Bolivia;BO
+Brazil;BR
+Barbados;BB
+Brunei;BN
+Bhutan;BT
+Bouvet Island;BV
+Botswana;BW
+Central African Republic;CF
+Canada;CA
+Cocos (Keeling) Islands;CC
+Switzerland;CH
+Chile;CL
+China;CN
+Ivory Coast;CI
+Cameroon;CM
+DR Congo;CD
+Congo Republic;CG
+Cook Islands;CK
+Colombia;CO
+Comoros;KM
+Cabo Verde;CV
+Costa Rica;CR
+Cuba;CU
+Curaçao;CW
+Christmas Island;CX
+Cayman Islands;KY
+Cyprus;CY
+Czechia;CZ
+Germany;DE
+Djibouti;DJ
+Dominica;DM
+Denmark;DK
+Dominican Republic;DO
+Algeria;DZ
+Ecuador;EC
+Egypt;EG
+Eritrea;ER
+Western Sahara;EH
+Spain;ES
+Estonia;EE
+Ethiopia;ET
+Finland;FI
+Fiji;FJ
+Falkland Islands;FK
+France;FR
+Faroe Islands;FO
+Micronesia;FM
+Gabon;GA
+United Kingdom;GB
+Georgia;GE
+Guernsey;GG
+Ghana;GH
+Gibraltar;GI
+Guinea;GN
+Guadeloupe;GP
+Gambia;GM
+Guinea-Bissau;GW
+Equatorial Guinea;GQ
+Greece;GR
+Grenada;GD
+Greenland;GL
+Guatemala;GT
+French Guiana;GF
+Guam;GU
+Guyana;GY
+Hong Kong;HK
+Heard Island and McDonald Islands;HM
+Honduras;HN
+Croatia;HR
+Haiti;HT
+Hungary;HU
+Indonesia;ID
+Isle of Man;IM
+India;IN
+British Indian Ocean Territory;IO
+Ireland;IE
+Iran;IR
+Iraq;IQ
+Iceland;IS
+Israel;IL
+Italy;IT
+Jamaica;JM
+Jersey;JE
+Jordan;JO
+Japan;JP
+Kazakhstan;KZ
+Kenya;KE
+Kyrgyzstan;KG
+Cambodia;KH
+Kiribati;KI
+Saint Kitts and Nevis;KN
+South Korea;KR
+Kuwait;KW
+Laos;LA
+Lebanon;LB
+Liberia;LR
+Libya;LY
+Saint Lucia;LC
+Liechtenstein;LI
+Sri Lanka;LK
+Lesotho;LS
+Lithuania;LT
+Luxembourg;LU
+Latvia;LV
+Macao;MO
+Saint Martin;MF
+Morocco;MA
+Monaco;MC
+Moldova;MD
+Madagascar;MG
+Maldives;MV
+Mexico;MX
+Marshall Islands;MH
+North Macedonia;MK
+Mali;ML
+Malta;MT
+Myanmar;MM
+Montenegro;ME
+Mongolia;MN
+Northern Mariana Islands;MP
+Mozambique;MZ
+Mauritania;MR
+Montserrat;MS
+Martinique;MQ
+Mauritius;MU
+Malawi;MW
+Malaysia;MY
+Mayotte;YT
+Namibia;NA
+New Caledonia;NC
+Niger;NE
+Norfolk Island;NF
+Nigeria;NG
+Nicaragua;NI
+Niue;NU
+Netherlands;NL
+Norway;NO
+Nepal;NP
+Nauru;NR
+New Zealand;NZ
+Oman;OM
+Pakistan;PK
+Panama;PA
+Pitcairn;PN
+Peru;PE
+Philippines;PH
+Palau;PW
+Papua New Guinea;PG
+Poland;PL
+Puerto Rico;PR
+North Korea;KP
+Portugal;PT
+Paraguay;PY
+Palestine;PS
+French Polynesia;PF
+Qatar;QA
+Réunion;RE
+Romania;RO
+Russia;RU
+Rwanda;RW
+Saudi Arabia;SA
+Sudan;SD
+Senegal;SN
+Singapore;SG
+South Georgia and the South Sandwich Islands;GS
+Saint Helena;SH
+Svalbard and Jan Mayen;SJ
+Solomon Islands;SB
+Sierra Leone;SL
+El Salvador;SV
+San Marino;SM
+Somalia;SO
+Saint Pierre and Miquelon;PM
+Serbia;RS
+South Sudan;SS
+Sao Tome and Principe;ST
+Suriname;SR
+Slovakia;SK
+Slovenia;SI
+Sweden;SE
+Eswatini;SZ
+Sint Maarten;SX
+Seychelles;SC
+Syria;SY
+Turks and Caicos Islands;TC
+Chad;TD
+Togo;TG
+Thailand;TH
+Tajikistan;TJ
+Tokelau;TK
+Turkmenistan;TM
+Timor-Leste;TL
+Tonga;TO
+Trinidad and Tobago;TT
+Tunisia;TN
+Türkiye;TR
+Tuvalu;TV
+Taiwan;TW
+Tanzania;TZ
+Uganda;UG
+Ukraine;UA
+U.S. Minor Outlying Islands;UM
+Uruguay;UY
+United States;US
+Uzbekistan;UZ
+Vatican City;VA
+Saint Vincent and the Grenadines;VC
+Venezuela;VE
+British Virgin Islands;VG
+U.S. Virgin Islands;VI
+Vietnam;VN
+Vanuatu;VU
+Wallis and Futuna;WF
+Samoa;WS
+Yemen;YE
+South Africa;ZA
+Zambia;ZM
+Zimbabwe;ZW`
+)
@@ -0,0 +1,85 @@
+
+package geoip
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+
+// This file provides the CSV and TSV output formats of the REST API, for
+// the users piping its responses into spreadsheets or awk : with the
+// format=csv and format=tsv parameters of the lookup and batch endpoints.
+
+
+// Columns of the CSV output : the fields of GeoLocJSON, in its order
+var csv_columns = func() []string {
+	var columns []string
+	fields := reflect.TypeFor[GeoLocJSON]()
+	for i := 0; i < fields.NumField(); i++ {
+		name, _, _ := strings.Cut(fields.Field(i).Tag.Get("json"), ",")
+		columns = append(columns, name)
+	}
+	return columns
+}()
+
+
+// Tells if a format parameter selects the CSV or TSV output
+func isCSVFormat(format string) bool {
+	return format == "csv" || format == "tsv"
+}
+
+
+// Returns the columns of the CSV output of a request : the known fields
+// selected by its fields parameter, once each, or else all csv_columns
+func csvColumns(request *http.Request) []string {
+	var columns []string
+	for _, field := range requestFields(request) {
+		if slices.Contains(csv_columns, field) && !slices.Contains(columns, field) {
+			columns = append(columns, field)
+		}
+	}
+	if len(columns) == 0 {
+		return csv_columns
+	}
+	return columns
+}
+
+
+// Returns the values of the given columns in a JSON object, empty for
+// the fields it does not have
+func csvRow(encoded []byte, columns []string) []string {
+	var fields map[string]any
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.UseNumber()
+	decoder.Decode(&fields)
+
+	row := make([]string, len(columns))
+	for i, column := range columns {
+		if value, found := fields[column]; found && value != nil {
+			row[i] = fmt.Sprint(value)
+		}
+	}
+	return row
+}
+
+
+// Writes a header with the columns and the rows, separated by commas
+// for the csv format, and by tabs for the tsv one
+func writeCSV(writer http.ResponseWriter, format string, columns []string, rows [][]string) {
+	out := csv.NewWriter(writer)
+	if format == "tsv" {
+		out.Comma = '\t'
+		writer.Header().Set("Content-Type", "text/tab-separated-values; charset=utf-8")
+	} else {
+		writer.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	}
+	out.Write(columns)
+	out.WriteAll(rows)
+}
@@ -0,0 +1,716 @@
+
+package geoip
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+	"github.com/google/btree"
+)
+
+
+// This file provides the DB type, holding all the geoip data in
+// memory, and the default DB used by the package-level functions.
+
+
+// Configuration of a DB returned by New(). The zero value loads the
+// MaxMind files already present in DefaultDataDir(), without
+// downloading them.
+type Config struct {
+	// Directory where the MaxMind files are downloaded and extracted,
+	// DefaultDataDir() if empty
+	Dir string
+
+	// File system where the files are read, instead of the OS one, like
+	// an embed.FS : Dir ("." if empty) and the file names are then
+	// slash-separated paths in it, and the files are not downloaded.
+	// Only the IP2Location file, the GeoLite2 databases (used if they
+	// are in Dir), the GeoLite Country file and the MaxMind CSV files
+	// are read from it, see UseFS().
+	FS fs.FS
+
+	// Download the MaxMind files in Dir before loading them, if the
+	// current ones are older than DownloadMaxAge (see DownloadMaxmindFilesTo())
+	Download bool
+
+	// Load the MaxMind CSV files straight from the archives downloaded
+	// in Dir, without extracting them : Dir then holds only the archives,
+	// and the files to load cannot be given
+	StreamArchives bool
+
+	// Files to load, the ones extracted in Dir if empty. The IPv6
+	// files are optional : IPv6 lookups fail with ErrNotInitialized
+	// if they cannot be loaded.
+	LocationsFile string
+	BlocksFile string
+	ASNFile string
+	Blocks6File string
+	ASN6File string
+
+	// IP2Location LITE DB11 CSV file, loaded in place of the MaxMind
+	// locations and blocks files if set, see LoadIP2LocationFile().
+	// It has no ASN : the ASN file is loaded only if ASNFile is set.
+	IP2LocationFile string
+
+	// Load only the GeoLite Country file (CountryFile, or the one
+	// extracted in Dir), or the GeoLite2 Country database, much smaller
+	// than the city ones : the lookups give only the country. Like for
+	// IP2Location, the ASN file is loaded only if ASNFile is set.
+	CountryOnly bool
+	CountryFile string
+
+	// MaxMind account ID and license key, the ones set in the
+	// environment if empty (see CredentialsFromEnv()). With them, the
+	// GeoLite2 databases are downloaded and used (see DownloadGeoLite2To()
+	// and OpenMMDB()) instead of the CSV files.
+	Credentials Credentials
+
+	// Reload the files at this interval, after downloading them if
+	// Download is set, see DB.StartRefresh(). No refresh if 0.
+	RefreshInterval time.Duration
+
+	// Language of the country and region names of the lookups, like
+	// "en", DEFAULT_LANGUAGE if empty or unknown (see NamesFor())
+	Language string
+
+	// Optional GeoIP2 Anonymous IP database and Tor exit list, giving
+	// the Anonymity of the lookups, see OpenAnonymousIPs()
+	AnonymousIPFile string
+	TorExitFile string
+
+	// Optional IP ranges files of cloud providers, by provider name
+	// (like CLOUD_AWS), giving the CloudProvider of the lookups, see
+	// OpenCloudRanges()
+	CloudRangesFiles map[string]string
+
+	// Optional binary snapshot file (see DB.Save()), loaded instead of
+	// the MaxMind CSV files if it comes from the current blocks file (or
+	// if there is none), and else written once they are loaded, for a
+	// fast startup. Not used with SkipASN, SkipPostalFields or ASNOnly.
+	SnapshotFile string
+
+	// Do not load the ASN files (or database), IPv4 and IPv6 : the
+	// lookups have no ASN, but use much less memory, like in a small
+	// container
+	SkipASN bool
+
+	// Drop the postal code, the metro code and the area code of the
+	// locations while loading them, see LoaderOptions.SkipPostalFields
+	SkipPostalFields bool
+
+	// Load only the MaxMind ASN files, IPv4 and IPv6, for the tools
+	// which only need the AS numbers and organizations : the blocks and
+	// locations are neither downloaded nor loaded, and the geolocation
+	// lookups fail with ErrNoBlock, see LookupASN(). The GeoLite2
+	// databases are not used.
+	ASNOnly bool
+
+	// Optional index file written by DB.WriteIndexFile(), memory-mapped
+	// and searched for the IPv4 lookups instead of loading the files in
+	// the Go heap, see OpenIndex(). Nothing else is loaded : IPv6
+	// lookups fail with ErrNotInitialized.
+	IndexFile string
+
+	// Optional user overrides file, giving the location of custom
+	// networks in priority over the geoip data, see LoadOverridesFile()
+	OverridesFile string
+
+	// Number of recent lookup results kept in an LRU cache, in front
+	// of the lookups in the data, for the servers hammered by a small
+	// set of client IPs. No cache if 0, see DB.SetCacheSize().
+	CacheSize int
+}
+
+
+// A DB holds the geoip data used for the lookups. It is returned by
+// New(), and can be used by several goroutines at once, even while
+// it is reloaded.
+type DB struct {
+	data atomic.Pointer[snapshot]
+	mu sync.Mutex	// held to replace data
+	config Config
+	stop chan struct{}
+	signals chan os.Signal	// watched by ReloadOnSignal()
+	last_load loadOutcome	// successful or not, see ServeStatusHttpRequest()
+}
+
+
+// The data of a DB at a given time. A snapshot is never modified once
+// stored in the DB : it is replaced all at once by Reload(), so lookups
+// use it without any lock, and never see partially loaded data.
+type snapshot struct {
+	locations LocationTable
+	blocks *Blocks
+	asn_tree *ASNs
+	blocks6 *Blocks6
+	asn6_tree *ASNs6
+	locator Locator
+	geolite2 *MMDB
+	index *Index
+	language string
+	anonymous *AnonymousIPs
+	cloud *CloudRanges
+	overrides *Overrides
+	cache *resultCache	// emptied each time the snapshot is replaced
+
+	// Modification time of the loaded blocks file (or GeoLite2 City
+	// database), telling how old the data are
+	modified time.Time
+
+	// When the data were loaded, and how long it took
+	loaded time.Time
+	load_duration time.Duration
+}
+
+
+// Snapshot of a DB not loaded yet
+var empty_snapshot = &snapshot{}
+
+
+// Returns the current data of the DB
+func (db *DB) snapshot() *snapshot {
+	if data := db.data.Load(); data != nil {
+		return data
+	}
+	return empty_snapshot
+}
+
+
+// Replaces the data of the DB by a modified copy of them, with an
+// empty cache of the lookup results
+func (db *DB) update(modify func(data *snapshot)) {
+	db.mu.Lock()
+	data := *db.snapshot()
+	modify(&data)
+	data.cache = data.cache.emptied()
+	db.data.Store(&data)
+	db.mu.Unlock()
+}
+
+
+// Returns the Locator set by SetLocator(), if any, and not the
+// GeoLite2 databases or the index file loaded by the DB
+func (data *snapshot) userLocator() Locator {
+	if data.geolite2 != nil && data.locator == Locator(data.geolite2) {
+		return nil
+	}
+	if data.index != nil && data.locator == Locator(data.index) {
+		return nil
+	}
+	return data.locator
+}
+
+
+// Returns the names in the language of the snapshot
+func (data *snapshot) names() NameTable {
+	return namesOrDefault(data.language)
+}
+
+
+// Completes the GeoLocIp found for an address with the optional data
+// of the snapshot : its Anonymity and its cloud provider
+func (data *snapshot) enrich(gli *GeoLocIp, err error) (*GeoLocIp, error) {
+	if gli != nil && gli.Network == "" {
+		gli.Network = blockNetwork(gli.Ip, gli.Block)
+	}
+	if gli != nil && data.cloud != nil {
+		gli.CloudProvider = data.cloud.Get(gli.Ip)
+	}
+	return data.withAnonymity(gli, err)
+}
+
+
+// Returns the number of records of each dataset loaded in the
+// snapshot, by name : locations, blocks, asn, blocks6 and asn6.
+func (data *snapshot) recordCounts() map[string]int {
+	counts := make(map[string]int)
+	switch locations := data.locations.(type) {
+	case LocationSlice :
+		counts["locations"] = len(locations)
+	case LocationMap :
+		counts["locations"] = len(locations)
+	}
+	if data.blocks != nil {
+		counts["blocks"] = data.blocks.Len()
+	}
+	if data.asn_tree != nil {
+		counts["asn"] = data.asn_tree.Len()
+	}
+	if data.blocks6 != nil {
+		counts["blocks6"] = (*btree.BTree)(data.blocks6).Len()
+	}
+	if data.asn6_tree != nil {
+		counts["asn6"] = (*btree.BTree)(data.asn6_tree).Len()
+	}
+	return counts
+}
+
+
+// Returns a new DB, holding the MaxMind files given in config. An
+// error is returned if the IPv4 locations, blocks or ASN file cannot
+// be loaded.
+func New(config Config) (*DB, error) {
+	start := time.Now()
+	data := &snapshot{}
+	if err := data.load(config); err != nil {
+		return nil, err
+	}
+	data.cache = newResultCache(config.CacheSize)
+	db := &DB{ config: config }
+	db.loaded(data, start, nil)
+	db.data.Store(data)
+	if config.RefreshInterval > 0 {
+		db.StartRefresh(config.RefreshInterval)
+	}
+	return db, nil
+}
+
+
+// Reloads the files of the default DB, see DB.Reload().
+func Reload() error {
+	return defaultDB().Reload()
+}
+
+
+// Downloads (if requested by its Config) and loads again the files
+// of the DB. The new data are loaded aside, and replace the current
+// ones all at once when they are fully loaded, so lookups running
+// meanwhile use the previous data. If the IPv4 files cannot be loaded,
+// the error is returned and the current data are kept. Locations set
+// by SetLocations() are replaced by the ones of the locations file.
+// The Provider set by SetProvider(), if any, is refreshed first.
+func (db *DB) Reload() error {
+
+	db.mu.Lock()
+	config := db.config
+	db.mu.Unlock()
+
+	db.snapshot().refreshProvider()
+
+	start := time.Now()
+	fresh := &snapshot{}
+	err := fresh.load(config)
+	db.mu.Lock()
+	db.loaded(fresh, start, err)
+	db.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// The previous GeoLite2 databases are not closed, as lookups may
+	// still use them : they are closed by the garbage collector (see
+	// maxminddb.Open())
+	db.update(func(data *snapshot) {
+		locator := data.userLocator()
+		anonymous, cloud, overrides, cache := data.anonymous, data.cloud, data.overrides, data.cache
+		*data = *fresh
+		data.cache = cache
+		if locator != nil {
+			data.locator = locator
+		}
+		// Set by SetAnonymousIPs(), SetCloudRanges() and SetOverrides()
+		if data.anonymous == nil {
+			data.anonymous = anonymous
+		}
+		if data.cloud == nil {
+			data.cloud = cloud
+		}
+		if data.overrides == nil {
+			data.overrides = overrides
+		}
+	})
+
+	log_geolocip.Notice("Files reloaded")
+	return nil
+}
+
+
+// Starts reloading the files of the default DB at the given
+// interval, see DB.StartRefresh().
+func StartRefresh(interval time.Duration) {
+	defaultDB().StartRefresh(interval)
+}
+
+
+// Starts a goroutine calling Reload() at the given interval, until
+// Close() is called. A refresh already started is stopped first.
+func (db *DB) StartRefresh(interval time.Duration) {
+
+	stop := make(chan struct{})
+	db.mu.Lock()
+	if db.stop != nil {
+		close(db.stop)
+	}
+	db.stop = stop
+	db.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C :
+				db.Reload()
+			case <-stop :
+				return
+			}
+		}
+	}()
+}
+
+
+// Stops the refresh started by StartRefresh() and the reloads started
+// by ReloadOnSignal(), if any, and closes the GeoLite2 databases and the
+// index file opened by the DB. The DB must not be used by lookups
+// running meanwhile.
+func (db *DB) Close() error {
+	db.mu.Lock()
+	if db.stop != nil {
+		close(db.stop)
+		db.stop = nil
+	}
+	db.stopSignals()
+	db.mu.Unlock()
+
+	var err error
+	db.update(func(data *snapshot) {
+		if data.geolite2 != nil {
+			err = data.geolite2.Close()
+			data.locator = data.userLocator()
+			data.geolite2 = nil
+		}
+		if data.index != nil {
+			if index_err := data.index.Close(); err == nil {
+				err = index_err
+			}
+			data.locator = data.userLocator()
+			data.index = nil
+		}
+	})
+	return err
+}
+
+
+// Returns value, or def if value is empty
+func orDefault(value string, def string) string {
+	if value == "" {
+		return def
+	}
+	return value
+}
+
+
+// Returns the options of the loaders selected by the config
+func (config Config) loaderOptions() LoaderOptions {
+	return LoaderOptions{ SkipPostalFields: config.SkipPostalFields }
+}
+
+
+// Sets empty ASN in the snapshot, so the ASN files are not loaded,
+// like when an IP2Location file is used without ASN file
+func (data *snapshot) skipASN() {
+	if data.asn_tree == nil {
+		data.asn_tree = &ASNs{}
+	}
+	if data.asn6_tree == nil {
+		data.asn6_tree = (*ASNs6)(btree.New(4))
+	}
+}
+
+
+// Sets empty locations and blocks in the snapshot, IPv4 and IPv6, so
+// only the ASN files are loaded
+func (data *snapshot) skipLocations() {
+	if data.locations == nil {
+		data.locations = LocationSlice{}
+	}
+	if data.blocks == nil {
+		data.blocks = &Blocks{}
+	}
+	if data.blocks6 == nil {
+		data.blocks6 = (*Blocks6)(btree.New(4))
+	}
+}
+
+
+// Loads the data not already loaded in the snapshot from the files
+// given in config, after downloading them if requested
+func (data *snapshot) load(config Config) error {
+
+	data.language = config.Language
+	if data.anonymous == nil && (config.AnonymousIPFile != "" || config.TorExitFile != "") {
+		// Optional, so lookups work without them
+		data.anonymous, _ = OpenAnonymousIPs(config.AnonymousIPFile, config.TorExitFile)
+	}
+	if data.cloud == nil && len(config.CloudRangesFiles) > 0 {
+		data.cloud, _ = OpenCloudRanges(config.CloudRangesFiles)
+	}
+	if data.overrides == nil && config.OverridesFile != "" {
+		data.overrides, _ = LoadOverridesFile(config.OverridesFile)
+	}
+	if config.SkipASN {
+		data.skipASN()
+	}
+	if config.ASNOnly {
+		data.skipLocations()
+	}
+	if config.IndexFile != "" {
+		return data.loadIndex(config)
+	}
+	if config.FS != nil {
+		return data.loadFS(config)
+	}
+	dir := orDefault(config.Dir, DefaultDataDir())
+
+	creds := config.Credentials
+	if !creds.IsSet() {
+		creds = CredentialsFromEnv()
+	}
+	if creds.IsSet() && !config.ASNOnly {
+		return data.loadGeoLite2(config, dir, creds)
+	}
+	if config.IP2LocationFile != "" {
+		return data.loadIP2Location(config)
+	}
+	if config.CountryOnly {
+		return data.loadCountry(config, dir)
+	}
+
+	if config.StreamArchives {
+		return data.loadArchives(config, dir)
+	}
+
+	if config.Download && config.ASNOnly {
+		DownloadMaxmindASNFilesTo(dir)
+	} else if config.Download {
+		DownloadMaxmindFilesTo(dir)
+		DownloadMaxmindIPv6FilesTo(dir)
+	}
+
+	blocks_file := orDefault(config.BlocksFile, filepath.Join(dir, file_blocks))
+	// The snapshot holds all the data, not the selected ones
+	snapshot_file := config.SnapshotFile
+	if config.SkipASN || config.SkipPostalFields || config.ASNOnly {
+		snapshot_file = ""
+	}
+	if snapshot_file != "" && data.locations == nil && data.blocks == nil && data.asn_tree == nil {
+		if data.loadSnapshotFile(snapshot_file, fileModTime(blocks_file)) {
+			return nil
+		}
+	}
+
+	// The files are loaded concurrently, as well as the optional IPv6
+	// files, each one with its own pipeline of goroutines (see readRows())
+	var wg sync.WaitGroup
+	var loc_err, blocks_err, asn_err error
+
+	if data.locations == nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			loc_list, err := config.loaderOptions().LoadLocFile(orDefault(config.LocationsFile, filepath.Join(dir, file_location)))
+			if err != nil {
+				loc_err = err
+				return
+			}
+			data.locations = LocationSlice(loc_list)
+		}()
+	}
+	if data.blocks == nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data.blocks, blocks_err = LoadBlocksFile(blocks_file)
+			data.modified = fileModTime(blocks_file)
+		}()
+	}
+	if data.asn_tree == nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data.asn_tree, asn_err = LoadASNFile(orDefault(config.ASNFile, filepath.Join(dir, file_asn)))
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		data.loadIPv6(config, dir)
+	}()
+	wg.Wait()
+
+	if loc_err != nil {
+		log_geolocip.Err(fmt.Sprintf("Cannot load locations file : %v", loc_err))
+		return loc_err
+	}
+	log_geolocip.Notice("Locations file loaded")
+
+	if blocks_err != nil {
+		log_geolocip.Err(fmt.Sprintf("Cannot load blocks file : %v", blocks_err))
+		return blocks_err
+	}
+	log_geolocip.Notice("Blocks file loaded")
+
+	if asn_err != nil {
+		log_geolocip.Err(fmt.Sprintf("Cannot load ASN file : %v", asn_err))
+		return asn_err
+	}
+	log_geolocip.Notice("ASN file loaded")
+
+	if snapshot_file != "" {
+		saved := &DB{}
+		saved.data.Store(data)
+		saved.SaveFile(snapshot_file)
+	}
+
+	return nil
+}
+
+
+// Loads the IP2Location file as the locations and blocks of the
+// snapshot, and the ASN file if one is given
+func (data *snapshot) loadIP2Location(config Config) error {
+
+	var err error
+
+	if data.blocks == nil {
+		var locations LocationMap
+		data.blocks, locations, err = config.loaderOptions().LoadIP2LocationFile(config.IP2LocationFile)
+		if err != nil {
+			log_geolocip.Err(fmt.Sprintf("Cannot load IP2Location file : %v", err))
+			return err
+		}
+		data.locations = locations
+		data.modified = fileModTime(config.IP2LocationFile)
+	}
+	log_geolocip.Notice("IP2Location file loaded")
+
+	return data.loadOptionalASN(config)
+}
+
+
+// Loads the ASN file given in config, for the datasets without ASN
+// (IP2Location, GeoLite Country), or sets empty ASN if there is none
+func (data *snapshot) loadOptionalASN(config Config) error {
+
+	var err error
+
+	if data.asn_tree == nil {
+		if config.ASNFile == "" {
+			data.asn_tree = &ASNs{}
+			return nil
+		}
+		data.asn_tree, err = LoadASNFile(config.ASNFile)
+		if err != nil {
+			log_geolocip.Err(fmt.Sprintf("Cannot load ASN file : %v", err))
+			return err
+		}
+	}
+	log_geolocip.Notice("ASN file loaded")
+
+	return nil
+}
+
+
+// Downloads (if requested) and opens the GeoLite2 databases, used as
+// the Locator of the snapshot unless one is already set
+func (data *snapshot) loadGeoLite2(config Config, dir string, creds Credentials) error {
+
+	if config.Download {
+		// Without a valid license key, the files already there are
+		// not the expected ones, so they are not used
+		download := DownloadGeoLite2To
+		if config.CountryOnly {
+			download = DownloadGeoLite2CountryTo
+		}
+		if err := download(dir, creds); err == ErrUnauthorized {
+			return err
+		}
+	}
+
+	city_file := filepath.Join(dir, edition_city + ".mmdb")
+	asn_file := filepath.Join(dir, edition_asn + ".mmdb")
+	if config.CountryOnly {
+		city_file = filepath.Join(dir, edition_country + ".mmdb")
+	}
+	if config.SkipASN || config.CountryOnly {
+		asn_file = ""
+	}
+	mmdb, err := OpenMMDB(city_file, asn_file)
+	if err != nil {
+		log_geolocip.Err(fmt.Sprintf("Cannot open GeoLite2 databases : %v", err))
+		return err
+	}
+	mmdb.language = config.Language
+	data.geolite2 = mmdb
+	data.modified = fileModTime(city_file)
+	if data.locator == nil {
+		data.locator = mmdb
+	}
+	log_geolocip.Notice("GeoLite2 databases loaded")
+
+	return nil
+}
+
+
+// Loads the IPv6 blocks and ASN. As the IPv6 files are optional,
+// IPv4 lookups keep working if they cannot be loaded.
+func (data *snapshot) loadIPv6(config Config, dir string) {
+
+	var err error
+
+	if data.blocks6 == nil {
+		data.blocks6, err = config.loaderOptions().LoadBlocks6File(orDefault(config.Blocks6File, filepath.Join(dir, file_city6)))
+		if err != nil {
+			log_geolocip.Err(fmt.Sprintf("Cannot load IPv6 blocks file : %v", err))
+			return
+		}
+	}
+	log_geolocip.Notice("IPv6 blocks file loaded")
+
+	if data.asn6_tree == nil {
+		data.asn6_tree, err = LoadASN6File(orDefault(config.ASN6File, filepath.Join(dir, file_asn6)))
+		if err != nil {
+			log_geolocip.Err(fmt.Sprintf("Cannot load IPv6 ASN file : %v", err))
+			return
+		}
+	}
+	log_geolocip.Notice("IPv6 ASN file loaded")
+
+}
+
+
+// The DB used by the package-level functions (GeoLocIPv4(), Lookup(),
+// ...). It is loaded the first time one of them is called, after
+// downloading the MaxMind files, and not when the package is imported.
+var default_db = &DB{}
+var default_once sync.Once
+
+
+// Returns the default DB, loading it the first time
+func defaultDB() *DB {
+	default_once.Do(func() {
+		loadDefault()
+	})
+	return default_db
+}
+
+
+// Loads the default DB, after downloading the MaxMind files
+func loadDefault() error {
+	default_db.mu.Lock()
+	default_db.config.Download = true
+	default_db.mu.Unlock()
+
+	// SetLocator() and SetLocations() may have been called before
+	var err error
+	default_db.update(func(data *snapshot) {
+		start := time.Now()
+		err = data.load(default_db.config)
+		default_db.loaded(data, start, err)
+	})
+	return err
+}
@@ -0,0 +1,167 @@
+
+package geoip
+
+import (
+	"fmt"
+	"os"
+	"io"
+	"net"
+	"sync/atomic"
+	"github.com/google/btree"
+)
+
+
+// This file provides a Provider using the IP to City Lite CSV file
+// from DB-IP.com (dbip-city-lite-2024-01.csv), with IPv4 and IPv6
+// ranges. Each line holds a range of addresses with its location :
+// 	1.0.0.0,1.0.0.255,OC,AU,Queensland,"South Brisbane",-27.4767,153.017
+
+
+// A DBIP holds the data of a DB-IP city lite file. It is a Provider,
+// to be used by the lookups through SetProvider(). It has no ASN.
+type DBIP struct {
+	filename string
+	data atomic.Pointer[dbipData]
+}
+
+
+// The data of a DBIP, replaced all at once by Refresh()
+type dbipData struct {
+	blocks *Blocks
+	locations LocationMap
+	blocks6 *Blocks6
+}
+
+
+// Opens a DB-IP city lite CSV file, loaded in memory, see LoadDBIP().
+func OpenDBIP(filename string) (*DBIP, error) {
+	dbip := &DBIP{ filename: filename }
+	if err := dbip.Refresh(); err != nil {
+		return nil, err
+	}
+	return dbip, nil
+}
+
+
+// Loads the file of the DBIP again. If it cannot be loaded, the error
+// is returned and the current data are kept.
+func (dbip *DBIP) Refresh() error {
+
+	file, err := os.Open(dbip.filename)
+	if err != nil {
+		log_geolocip.Err(fmt.Sprintf("DB-IP error open file: %v", err))
+		return err
+	}
+	defer file.Close()
+
+	blocks, locations, blocks6, err := LoadDBIP(file)
+	if err != nil {
+		return err
+	}
+	dbip.data.Store(&dbipData{ blocks, locations, blocks6 })
+	return nil
+}
+
+
+// Read a DB-IP city lite CSV file from an io.Reader in memory : its
+// IPv4 ranges as Blocks and the Locations they refer to, like the
+// MaxMind blocks and locations files, and its IPv6 ranges as Blocks6.
+// The content is utf-8. Lines without 8 values are skipped.
+func LoadDBIP(in io.Reader) (*Blocks, LocationMap, *Blocks6, error) {
+	return LoaderOptions{}.LoadDBIP(in)
+}
+
+
+// Same as the LoadDBIP() function, with the given loader options.
+func (opts LoaderOptions) LoadDBIP(in io.Reader) (*Blocks, LocationMap, *Blocks6, error) {
+
+	var list []Block
+	t6 := btree.New(4)
+	numbering := newLocationNumbering()
+
+	r := opts.newCSVReader(in)
+	skipped := 0
+	pool := internPool{}
+
+	for {
+
+		values, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log_geolocip.Err(fmt.Sprintf("DB-IP error reading file: %v", err))
+			break
+		}
+		if tooManyFields(values, &skipped) {
+			continue
+		}
+
+		// Use only lines with 8 values
+		if len(values) != 8 {
+			continue
+		}
+		low_ip := net.ParseIP(values[0])
+		high_ip := net.ParseIP(values[1])
+		if low_ip == nil || high_ip == nil {
+			continue
+		}
+
+		// The region is given by its name, and the continent (values[2])
+		// comes from the country
+		loc := Location {
+			Country: pool.intern(values[3]),
+			Region: pool.intern(RegionCode(values[3], values[4])),
+			City: pool.intern(values[5]),
+			Latitude: parseCoordinate(values[6], 90),
+			Longitude: parseCoordinate(values[7], 180),
+			TimeZone: countryTimeZone(values[3]),
+		}
+
+		if low_ip.To4() != nil && high_ip.To4() != nil {
+			list = append(list, Block{ ipv4ToUint32(low_ip), ipv4ToUint32(high_ip), numbering.id(loc) })
+			continue
+		}
+		block := Block6{ Location: loc }
+		copy(block.LowIP[:], low_ip.To16())
+		copy(block.HighIP[:], high_ip.To16())
+		t6.ReplaceOrInsert(block)
+	}
+
+	logTooManyFields("DB-IP", skipped)
+
+	loadNames()
+
+	return NewBlocks(list), numbering.locations, (*Blocks6)(t6), nil
+}
+
+
+// Returns the Location and Block of an IP address, so a DBIP is a
+// Provider. The Block is nil for IPv6 addresses.
+func (dbip *DBIP) LookupCity(ip net.IP) (*Location, *Block, error) {
+
+	data := dbip.data.Load()
+	if data == nil {
+		return nil, nil, ErrNotInitialized
+	}
+
+	if ip.To4() != nil {
+		block := data.blocks.Get(ipv4ToUint32(ip))
+		if block == nil {
+			return nil, nil, ErrNoBlock
+		}
+		return data.locations.Get(block.LocId), block, nil
+	}
+
+	block6 := data.blocks6.Get(ip.To16())
+	if block6 == nil {
+		return nil, nil, ErrNoBlock
+	}
+	return &block6.Location, nil, nil
+}
+
+
+// A DB-IP city lite file has no ASN : always returns nil.
+func (dbip *DBIP) LookupASN(ip net.IP) (*ASN, error) {
+	return nil, nil
+}
@@ -0,0 +1,49 @@
+package geoip
+
+
+import (
+	"errors"
+	"math"
+)
+
+
+// Mean radius of the Earth, in kilometres, used by DistanceKm()
+const EARTH_RADIUS_KM = 6371.0
+
+
+// Returns the latitude and longitude of a GeoLocIp, and false if
+// there is no location or if it has no coordinates (see
+// Location.HasCoordinates()).
+func (gli *GeoLocIp) Coordinates() (lat, lon float64, ok bool) {
+	if gli == nil || gli.Location == nil || !gli.Location.HasCoordinates() {
+		return 0, 0, false
+	}
+	return gli.Location.Latitude, gli.Location.Longitude, true
+}
+
+
+// Returns the great-circle distance, in kilometres, between the
+// locations of two GeoLocIp, using the Haversine formula. An error
+// is returned if one of them is nil, or has no valid coordinates.
+func DistanceKm(a, b *GeoLocIp) (float64, error) {
+
+	if a == nil || b == nil {
+		return 0, errors.New("Cannot compute distance : nil GeoLocIp")
+	}
+	lat1, lon1, ok := a.Coordinates()
+	if !ok {
+		return 0, errors.New("Cannot compute distance : no valid coordinates for " + a.Ip.String())
+	}
+	lat2, lon2, ok := b.Coordinates()
+	if !ok {
+		return 0, errors.New("Cannot compute distance : no valid coordinates for " + b.Ip.String())
+	}
+
+	to_rad := math.Pi / 180
+	dlat := (lat2 - lat1) * to_rad
+	dlon := (lon2 - lon1) * to_rad
+	h := math.Sin(dlat/2) * math.Sin(dlat/2) +
+		math.Cos(lat1 * to_rad) * math.Cos(lat2 * to_rad) * math.Sin(dlon/2) * math.Sin(dlon/2)
+
+	return 2 * EARTH_RADIUS_KM * math.Asin(math.Min(1, math.Sqrt(h))), nil
+}
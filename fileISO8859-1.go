@@ -6,6 +6,8 @@ package geoip
 import (
 	"os"
 	"io"
+	"bufio"
+	"compress/gzip"
 )
 
 
@@ -88,3 +90,141 @@ func (flr *fileLatin1Reader)Read(p []byte) (n int, err error) {
 	}
 }
 
+
+
+
+// Same as fileLatin1Reader, for any io.Reader (for example a network
+// stream), which cannot be rewinded like a file. If the content starts
+// with an utf-8 BOM, it is already utf-8 : the BOM is skipped, and the
+// content is not converted.
+type latin1Reader struct {
+	in *bufio.Reader
+	currentChar byte 		// 2nd byte of an utf-8 char not yet written
+	started bool			// The BOM has been checked
+	utf8 bool				// The content is already utf-8
+}
+
+
+// UTF-8 byte order mark, found at the start of some CSV exports
+const utf8_bom = "\xef\xbb\xbf"
+
+
+// Magic bytes at the start of a gzip stream
+const gzip_magic = "\x1f\x8b"
+
+
+// Returns a reader decompressing the content of a given reader if it
+// is gzip compressed, detected from its first bytes, or else reading
+// it as is
+func decompressed(in io.Reader) *bufio.Reader {
+	br := bufio.NewReader(in)
+	if start, err := br.Peek(len(gzip_magic)); err != nil || string(start) != gzip_magic {
+		return br
+	}
+	gz, err := gzip.NewReader(br)
+	if err != nil {
+		return bufio.NewReader(errorReader{ err })
+	}
+	return bufio.NewReader(gz)
+}
+
+
+// A reader always failing with the same error
+type errorReader struct {
+	err error
+}
+
+
+func (er errorReader) Read(p []byte) (int, error) {
+	return 0, er.err
+}
+
+
+// Tells if a file is gzip compressed, leaving its position unchanged
+func isGzipFile(file *os.File) bool {
+	start := make([]byte, len(gzip_magic))
+	n, _ := io.ReadFull(file, start)
+	file.Seek(int64(-n), 1)
+	return string(start[:n]) == gzip_magic
+}
+
+
+// Returns a reader skipping the utf-8 BOM at the start of a given
+// reader, if any. Gzip compressed content is decompressed.
+func skipBOM(in io.Reader) *bufio.Reader {
+	br := decompressed(in)
+	if start, err := br.Peek(len(utf8_bom)); err == nil && string(start) == utf8_bom {
+		br.Discard(len(utf8_bom))
+	}
+	return br
+}
+
+
+// Returns a reader converting the content of a iso8859-1 (latin1) file
+// to utf-8, starting at the current position. If the file starts with
+// an utf-8 BOM, it is already utf-8 : the BOM is skipped, and the file
+// is returned as is. A gzip compressed file is decompressed, see
+// NewLatin1Reader().
+func newFileLatin1Reader(file *os.File) io.Reader {
+	if isGzipFile(file) {
+		return NewLatin1Reader(file)
+	}
+	start := make([]byte, len(utf8_bom))
+	if n, _ := io.ReadFull(file, start); n == len(utf8_bom) && string(start) == utf8_bom {
+		return file
+	} else {
+		file.Seek(int64(-n), 1)
+	}
+	return &fileLatin1Reader{ file: file }
+}
+
+
+// Returns an io.Reader converting the iso8859-1 (latin1) content
+// of a given io.Reader to utf-8. Content starting with an utf-8 BOM
+// is returned as is, without the BOM. Gzip compressed content is
+// decompressed first.
+func NewLatin1Reader(in io.Reader) io.Reader {
+	return &latin1Reader{ in: decompressed(in) }
+}
+
+
+// Implements the reader interface, converting iso8859-1 (latin1)
+// to utf-8
+func (lr *latin1Reader)Read(p []byte) (n int, err error) {
+
+	if !lr.started {
+		lr.started = true
+		if start, err := lr.in.Peek(len(utf8_bom)); err == nil && string(start) == utf8_bom {
+			lr.in.Discard(len(utf8_bom))
+			lr.utf8 = true
+		}
+	}
+	if lr.utf8 {
+		return lr.in.Read(p)
+	}
+
+	for n < len(p) {
+		if lr.currentChar != 0 {
+			p[n] = lr.currentChar
+			n++
+			lr.currentChar = 0
+			continue
+		}
+		c, err := lr.in.ReadByte()
+		if err != nil {
+			if err == io.EOF && n > 0 {
+				return n, nil
+			}
+			return n, err
+		}
+		if c < 0x80 {
+			p[n] = c
+			n++
+		} else {
+			p[n] = 0xC0 | (c & 0xC0) >> 6
+			n++
+			lr.currentChar = 0x80 | (c & 0x3f)
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,201 @@
+
+package geoip
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+
+// This file provides the output formats of freegeoip.net and of its
+// successor ipstack, so the REST API can replace them : with the
+// format=freegeoip and format=ipstack parameters of the lookup endpoints.
+
+
+// The JSON encoding of a GeoLocIp by freegeoip.net, in English, with
+// all its fields, even empty
+type freegeoipJSON struct {
+	Ip string `json:"ip"`
+	CountryCode string `json:"country_code"`
+	CountryName string `json:"country_name"`
+	RegionCode string `json:"region_code"`
+	RegionName string `json:"region_name"`
+	City string `json:"city"`
+	ZipCode string `json:"zip_code"`
+	TimeZone string `json:"time_zone"`
+	Latitude float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	MetroCode int `json:"metro_code"`
+}
+
+
+// Returns the freegeoip.net encoding of the GeoLocIp
+func (gli *GeoLocIp) freegeoipJSON() freegeoipJSON {
+	fields := gli.JSON(JSONOptions{ Language: "en" })
+	freegeoip := freegeoipJSON{
+		Ip: fields.Ip,
+		CountryCode: fields.CountryCode,
+		CountryName: fields.CountryEN,
+		RegionCode: fields.RegionCode,
+		RegionName: fields.Region,
+		City: fields.City,
+		ZipCode: fields.PostalCode,
+		TimeZone: fields.TimeZone,
+		MetroCode: fields.MetroCode,
+	}
+	if fields.Latitude != nil && fields.Longitude != nil {
+		freegeoip.Latitude, freegeoip.Longitude = *fields.Latitude, *fields.Longitude
+	}
+	return freegeoip
+}
+
+
+// Writes the freegeoip.net geolocation of an IP address. Like freegeoip.net,
+// an invalid address is answered with a 404 status code, and an address
+// without information gets empty fields.
+func serveFreegeoip(writer http.ResponseWriter, request *http.Request, address string, ip net.IP) {
+
+	gli, err := apiLookup(ip)
+	switch {
+	case err == ErrInvalidIP :
+		http.Error(writer, "404 page not found", http.StatusNotFound)
+		return
+	case err == err_loading || err == ErrNotInitialized :
+		writer.Header().Set("Retry-After", fmt.Sprint(RETRY_AFTER_LOADING))
+		http.Error(writer, "Database loading", http.StatusServiceUnavailable)
+		return
+	case err == ErrNoBlock || gli == nil :
+		gli = &GeoLocIp{ Ip: normalizeIP(ip) }
+	}
+
+	body, _ := json.Marshal(gli.freegeoipJSON())
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(body)
+}
+
+
+// The JSON encoding of a GeoLocIp by ipstack, in English. The fields
+// unknown for the address are null, and the ones the REST API does not
+// have (like the capital and the languages of the country) are left out.
+type ipstackJSON struct {
+	Ip string `json:"ip"`
+	Type string `json:"type"`
+	ContinentCode *string `json:"continent_code"`
+	ContinentName *string `json:"continent_name"`
+	CountryCode *string `json:"country_code"`
+	CountryName *string `json:"country_name"`
+	RegionCode *string `json:"region_code"`
+	RegionName *string `json:"region_name"`
+	City *string `json:"city"`
+	Zip *string `json:"zip"`
+	Latitude *float64 `json:"latitude"`
+	Longitude *float64 `json:"longitude"`
+	Location *ipstackLocation `json:"location,omitempty"`
+	TimeZone *ipstackTimeZone `json:"time_zone,omitempty"`
+	Currency *ipstackCurrency `json:"currency,omitempty"`
+	Connection *ipstackConnection `json:"connection,omitempty"`
+}
+
+// Objects nested in ipstackJSON
+type ipstackLocation struct {
+	CountryFlagEmoji string `json:"country_flag_emoji"`
+	CountryFlagEmojiUnicode string `json:"country_flag_emoji_unicode"`
+	CallingCode string `json:"calling_code"`
+	IsEU bool `json:"is_eu"`
+}
+
+type ipstackTimeZone struct {
+	Id string `json:"id"`
+	CurrentTime string `json:"current_time"`
+	GMTOffset int `json:"gmt_offset"`
+	Code string `json:"code"`
+	IsDaylightSaving bool `json:"is_daylight_saving"`
+}
+
+type ipstackCurrency struct {
+	Code string `json:"code"`
+}
+
+type ipstackConnection struct {
+	ASN uint32 `json:"asn"`
+	ISP string `json:"isp"`
+}
+
+
+// Returns the ipstack encoding of the GeoLocIp. The time zone is given
+// only if the time zone database is available.
+func (gli *GeoLocIp) ipstackJSON() ipstackJSON {
+
+	fields := gli.JSON(JSONOptions{ Language: "en" })
+	ipstack := ipstackJSON{ Ip: fields.Ip, Type: "ipv6", Latitude: fields.Latitude, Longitude: fields.Longitude }
+	if gli.Ip.To4() != nil {
+		ipstack.Type = "ipv4"
+	}
+	orNull := func(value string) *string {
+		if value == "" {
+			return nil
+		}
+		return &value
+	}
+	ipstack.ContinentCode, ipstack.ContinentName = orNull(fields.ContinentCode), orNull(fields.Continent)
+	ipstack.CountryCode, ipstack.CountryName = orNull(fields.CountryCode), orNull(fields.CountryEN)
+	ipstack.RegionCode, ipstack.RegionName = orNull(fields.RegionCode), orNull(fields.Region)
+	ipstack.City, ipstack.Zip = orNull(fields.City), orNull(fields.PostalCode)
+
+	if code := fields.CountryCode; len(code) == 2 && code[0] >= 'A' && code[0] <= 'Z' && code[1] >= 'A' && code[1] <= 'Z' {
+		// The flag is the pair of regional indicator symbols of the code
+		first, second := rune(code[0]) - 'A' + 0x1F1E6, rune(code[1]) - 'A' + 0x1F1E6
+		calling_code, _ := CountryCallingCode(code)
+		ipstack.Location = &ipstackLocation{
+			CountryFlagEmoji: string([]rune{ first, second }),
+			CountryFlagEmojiUnicode: fmt.Sprintf("U+%X U+%X", first, second),
+			CallingCode: strings.TrimPrefix(calling_code, "+"),
+			IsEU: fields.IsInEuropeanUnion != nil && *fields.IsInEuropeanUnion,
+		}
+		if currency, found := CountryCurrency(code); found {
+			ipstack.Currency = &ipstackCurrency{ Code: currency }
+		}
+	}
+	if location, err := time.LoadLocation(fields.TimeZone); fields.TimeZone != "" && err == nil {
+		now := time.Now().In(location)
+		name, offset := now.Zone()
+		ipstack.TimeZone = &ipstackTimeZone{ fields.TimeZone, now.Format(time.RFC3339), offset, name, now.IsDST() }
+	}
+	if fields.ASN != 0 {
+		ipstack.Connection = &ipstackConnection{ ASN: fields.ASN, ISP: fields.Organization }
+	}
+	return ipstack
+}
+
+
+// Writes the ipstack geolocation of an IP address. Like ipstack, its
+// fields parameter selects the fields returned (see JSONOptions.Fields),
+// an invalid address is answered with a 200 status code and an error
+// object, and an address without information gets null fields.
+func serveIpstack(writer http.ResponseWriter, request *http.Request, address string, ip net.IP) {
+
+	var body []byte
+	gli, err := apiLookup(ip)
+	switch {
+	case err == ErrInvalidIP :
+		body = []byte(`{"success":false,"error":{"code":106,"type":"invalid_ip_address","info":"The IP Address supplied is invalid."}}`)
+	case err == err_loading || err == ErrNotInitialized :
+		writer.Header().Set("Retry-After", fmt.Sprint(RETRY_AFTER_LOADING))
+		writeJSONError(writer, http.StatusServiceUnavailable, "database loading")
+		return
+	case err == ErrNoBlock || gli == nil :
+		gli = &GeoLocIp{ Ip: normalizeIP(ip) }
+		fallthrough
+	default :
+		body, _ = json.Marshal(gli.ipstackJSON())
+		if fields := requestFields(request); len(fields) > 0 {
+			body, _ = selectJSONFields(body, fields)
+		}
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(body)
+}
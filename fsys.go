@@ -0,0 +1,193 @@
+
+package geoip
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"time"
+)
+
+
+// This file provides the loading of the geoip files from an fs.FS, like
+// an embed.FS, a zip archive (zip.Reader) or os.DirFS(), see Config.FS.
+// Files baked in the binary need neither network nor temporary files :
+// 	//go:embed data
+// 	var data embed.FS
+//
+// 	geoip.UseFS(data, "data")
+
+
+// Loads the default DB from the files of an fs.FS in dir, like an
+// embed.FS, instead of downloading them, see Config.FS. If it is
+// already loaded, it is reloaded from them.
+func UseFS(fsys fs.FS, dir string) error {
+	default_db.mu.Lock()
+	default_db.config.FS, default_db.config.Dir = fsys, dir
+	default_db.mu.Unlock()
+
+	loaded := false
+	var err error
+	default_once.Do(func() {
+		loaded = true
+		err = loadDefault()
+	})
+	if loaded {
+		return err
+	}
+	return default_db.Reload()
+}
+
+
+// Read a file of an fs.FS with one of the io.Reader loaders, and
+// returns its modification time
+func readFS(fsys fs.FS, name string, read func(in io.Reader) error) (time.Time, error) {
+
+	file, err := fsys.Open(name)
+	if err != nil {
+		log_geolocip.Err(fmt.Sprintf("Error open file %s: %v", name, err))
+		return time.Time{}, err
+	}
+	defer file.Close()
+
+	var modified time.Time
+	if fi, err := file.Stat(); err == nil {
+		modified = fi.ModTime()
+	}
+	return modified, read(file)
+}
+
+
+// Loads the data not already loaded in the snapshot from the files of
+// config.FS : the IP2Location file, or else the GeoLite2 databases if
+// they are in config.Dir, or else the GeoLite Country file or the
+// MaxMind CSV files. Nothing is downloaded.
+func (data *snapshot) loadFS(config Config) error {
+
+	fsys := config.FS
+	dir := orDefault(config.Dir, ".")
+	var err error
+
+	city_file := path.Join(dir, edition_city + ".mmdb")
+	if config.CountryOnly {
+		city_file = path.Join(dir, edition_country + ".mmdb")
+	}
+	if _, err := fs.Stat(fsys, city_file); err == nil && config.IP2LocationFile == "" && !config.ASNOnly {
+		asn_file := path.Join(dir, edition_asn + ".mmdb")
+		if _, err := fs.Stat(fsys, asn_file); err != nil || config.SkipASN || config.CountryOnly {
+			asn_file = ""
+		}
+		mmdb, err := OpenMMDBFS(fsys, city_file, asn_file)
+		if err != nil {
+			log_geolocip.Err(fmt.Sprintf("Cannot open GeoLite2 databases : %v", err))
+			return err
+		}
+		mmdb.language = config.Language
+		data.geolite2 = mmdb
+		if data.locator == nil {
+			data.locator = mmdb
+		}
+		log_geolocip.Notice("GeoLite2 databases loaded")
+		return nil
+	}
+
+	if config.IP2LocationFile != "" && data.blocks == nil {
+		data.modified, err = readFS(fsys, config.IP2LocationFile, func(in io.Reader) (err error) {
+			var locations LocationMap
+			data.blocks, locations, err = config.loaderOptions().LoadIP2Location(in)
+			data.locations = locations
+			return err
+		})
+		if err != nil {
+			log_geolocip.Err(fmt.Sprintf("Cannot load IP2Location file : %v", err))
+			return err
+		}
+	}
+	if config.CountryOnly && data.blocks == nil {
+		data.modified, err = readFS(fsys, orDefault(config.CountryFile, path.Join(dir, file_country)), func(in io.Reader) (err error) {
+			var locations LocationMap
+			data.blocks, locations, err = config.loaderOptions().LoadCountry(NewLatin1Reader(in))
+			data.locations = locations
+			return err
+		})
+		if err != nil {
+			log_geolocip.Err(fmt.Sprintf("Cannot load country file : %v", err))
+			return err
+		}
+	}
+	// They have no ASN, see loadOptionalASN()
+	no_asn := config.IP2LocationFile != "" || config.CountryOnly
+	if no_asn && config.ASNFile == "" && data.asn_tree == nil {
+		data.asn_tree = &ASNs{}
+	}
+
+	// The locations file is iso8859-1 encoded
+	if data.locations == nil {
+		_, err = readFS(fsys, orDefault(config.LocationsFile, path.Join(dir, file_location)), func(in io.Reader) error {
+			loc_list, err := config.loaderOptions().LoadLocations(NewLatin1Reader(in))
+			data.locations = LocationSlice(loc_list)
+			return err
+		})
+		if err != nil {
+			log_geolocip.Err(fmt.Sprintf("Cannot load locations file : %v", err))
+			return err
+		}
+	}
+	log_geolocip.Notice("Locations file loaded")
+
+	if data.blocks == nil {
+		data.modified, err = readFS(fsys, orDefault(config.BlocksFile, path.Join(dir, file_blocks)), func(in io.Reader) (err error) {
+			data.blocks, err = LoadBlocks(in)
+			return err
+		})
+		if err != nil {
+			log_geolocip.Err(fmt.Sprintf("Cannot load blocks file : %v", err))
+			return err
+		}
+	}
+	log_geolocip.Notice("Blocks file loaded")
+
+	if data.asn_tree == nil {
+		_, err = readFS(fsys, orDefault(config.ASNFile, path.Join(dir, file_asn)), func(in io.Reader) (err error) {
+			data.asn_tree, err = LoadASN(in)
+			return err
+		})
+		if err != nil {
+			log_geolocip.Err(fmt.Sprintf("Cannot load ASN file : %v", err))
+			return err
+		}
+	}
+	log_geolocip.Notice("ASN file loaded")
+
+	if no_asn {
+		return nil
+	}
+
+	// Optional, like in loadIPv6()
+	if data.blocks6 == nil {
+		_, err = readFS(fsys, orDefault(config.Blocks6File, path.Join(dir, file_city6)), func(in io.Reader) (err error) {
+			data.blocks6, err = config.loaderOptions().LoadBlocks6(NewLatin1Reader(in))
+			return err
+		})
+		if err != nil {
+			log_geolocip.Err(fmt.Sprintf("Cannot load IPv6 blocks file : %v", err))
+			return nil
+		}
+	}
+	log_geolocip.Notice("IPv6 blocks file loaded")
+
+	if data.asn6_tree == nil {
+		_, err = readFS(fsys, orDefault(config.ASN6File, path.Join(dir, file_asn6)), func(in io.Reader) (err error) {
+			data.asn6_tree, err = LoadASN6(in)
+			return err
+		})
+		if err != nil {
+			log_geolocip.Err(fmt.Sprintf("Cannot load IPv6 ASN file : %v", err))
+			return nil
+		}
+	}
+	log_geolocip.Notice("IPv6 ASN file loaded")
+
+	return nil
+}
@@ -3,22 +3,276 @@
 // structure.
 // 
 // All data are stored in memory for maximum speed. MaxMind files are automatically
-// downloaded if the current files are older than 8 days. Initialization is made
-// through init() and could take up to 30 seconds depending of your hardware configuration.
-// Around 500MB of memory are required to store all geoip data.
+// downloaded if the current files are older than DownloadMaxAge (8 days by default,
+// DisableDownloads turns them off) and changed on the server
+// (checked with a conditional request), in a geoip directory of the user cache
+// directory (see DefaultDataDir() and Config.Dir). Failed downloads are retried
+// DownloadRetries times, with an exponential backoff from DownloadBackoff, and the
+// stale files are kept when the server stays unreachable. They are downloaded by
+// DownloadClient, which can be replaced to use a proxy. They are loaded the first
+// time a package-level lookup function is called, or by New(), which could take up to
+// 30 seconds depending of your hardware configuration. Importing the package does not
+// load anything. The download URLs can be set to use a mirror, see MaxmindCityURL
+// and GeoLite2URL, including s3:// and gs:// URLs downloaded with the ambient AWS
+// or Google Cloud credentials. The MaxMind credentials are not sent to the mirrors,
+// see MaxmindCredentialHosts. Around 500MB of memory are required to store all geoip data.
 // 
 // 
 // Most useful functions 
 // 
+// New() returns a *DB holding the data of the given MaxMind files. Its methods are
+// the same as the package-level functions below, which use a default DB.
+// 
+// The loaders accept gzip compressed files (.csv.gz), detected from their first
+// bytes, so snapshots can be kept compressed on disk. LoadLocations(), LoadBlocks(),
+// LoadASN() and the other loaders read the files from an io.Reader, and Config.FS
+// makes New() read them from an fs.FS, like an embed.FS, a zip archive or
+// os.DirFS(). UseFS() loads the default DB from it, so a single binary can ship
+// a baked-in snapshot of the CSV files or GeoLite2 databases (see OpenMMDBFS()).
+// 
+// DB.Save() writes the parsed data as a compact binary snapshot, loaded by
+// LoadSnapshot() in a fraction of the time needed to parse the CSV files. With
+// Config.SnapshotFile, New() writes it once the CSV files are loaded, and loads it
+// instead of them while the blocks file is unchanged.
+// 
+// New() loads the locations, blocks and ASN files concurrently, and each loader
+// parses its file with a pipeline of goroutines (reading, CSV decoding, insertion),
+// so the initialization is much faster on multicore machines. The strings repeated
+// across rows, like the city, region and ASN names, are kept in memory only once.
+// 
+// Config.SkipASN skips the loading of the ASN files, and Config.SkipPostalFields
+// (or LoaderOptions.SkipPostalFields) drops the postal, metro and area codes of the
+// locations, for the users who only need the countries and cities, like in a 128MB
+// container.
+// 
+// DB.WriteIndexFile() writes the IPv4 data as an index file, which Config.IndexFile
+// (or OpenIndex()) memory-maps to search it by dichotomy, instead of loading
+// everything in the Go heap : the memory used is shared with the page cache, for
+// the memory-constrained deployments.
+// 
+// Config.CountryOnly loads only the GeoLite Country CSV file (LoadCountryFile()),
+// or the GeoLite2 Country database with MaxMind credentials, much smaller than the
+// city datasets : the lookups give only the country, which is enough for use cases
+// like traffic dashboards.
+// 
+// Conversely, Config.ASNOnly loads only the ASN files, IPv4 and IPv6, for the
+// network analysis tools which only need the AS numbers and organizations : the
+// blocks and locations are neither downloaded nor loaded, and LookupASN() gives the
+// ASN of an address.
+// 
+// Config.StreamArchives makes New() load the MaxMind CSV files straight from the
+// downloaded zip and gzip archives, without extracting them on disk. The archives
+// can be zip or tar.gz files, like the GeoLite2 CSV bundles, whose files are found
+// whatever their dated directory.
+// 
+// Config.CacheSize (or SetCacheSize()) keeps the recent lookup results in an LRU
+// cache, in front of the lookups in the data, which helps a lot when the HTTP API
+// is hammered by a small set of client IPs. The cache is emptied when the data
+// change.
+// 
+// Reload() loads the MaxMind files again, and StartRefresh() does it at a given
+// interval. ReloadOnSignal() does it on a signal, and the servers of
+// ServeGeoLocAPI() and ServeGeoLocGRPC() reload the data on SIGHUP, for fresh files
+// distributed by configuration management tools. Lookups use the previous data
+// until the new ones are fully loaded, and no connection is dropped.
+// 
+// DatabaseInfo() returns the metadata of the loaded data : the files, with their
+// modification time and size, the number of records of each dataset, an estimate
+// of the memory they use, and when they were loaded, for health checks.
+// 
 // GeoLocIPv4() returns a GeoLocIp structure for a given IPv4 address.
 // 
+// GeoLocIPv4E() does the same, but returns an error (ErrNotInitialized,
+// ErrInvalidIP or ErrNoBlock) telling why no information was found.
+// 
+// GeoLocIPv6() and GeoLocIPv6E() do the same for an IPv6 address, and Lookup()
+// for any IP address. LookupBatch() geolocates a list of addresses of both
+// families at once.
+// 
+// LookupAddr() does the same for a netip.Addr, and also returns the network of
+// the matching block as a netip.Prefix.
+// 
+// The Network of a GeoLocIp, and the "network" JSON field, give this network in
+// CIDR notation, like "54.88.0.0/14", so the results can be cached by network
+// rather than by IP.
+// 
+// NewBatchLookup() returns a *BatchLookup, whose GeoLocIPv4E() method is faster
+// than the package one for addresses sorted by IP, like in log files.
+// 
+// Country names are in French by default, and CountryNameEN() returns the
+// English one, also in the "country_en" JSON field. SetLanguage() or Config.Language
+// selects another language, like "en", and RegisterNames() adds the names of
+// new languages. The REST API also follows the lang parameter and the
+// Accept-Language header.
+// 
+// The Location of a GeoLocIp has a TimeZone, also in the "time_zone" JSON
+// field. It comes from the GeoLite2 databases, or from CountryTimeZone() for
+// the CSV files, which only knows the countries with a single time zone.
+// 
+// Continent() returns the continent of a GeoLocIp, also in the "continent_code"
+// and "continent" JSON fields, see CountryContinent().
+// 
+// IsEU() tells if an IP address is located in an European Union member state,
+// like the IsInEuropeanUnion() method of a GeoLocIp and the "is_in_european_union"
+// JSON field. The GeoLite2 databases give it, and IsEUCountry() otherwise.
+// 
+// SetAnonymousIPs() adds the Anonymity of the IP addresses to the lookups,
+// from a GeoIP2 Anonymous IP database and a list of Tor exit nodes opened by
+// OpenAnonymousIPs() (see also Config.AnonymousIPFile and Config.TorExitFile),
+// also in the "is_anonymous", "is_tor", "is_vpn", "is_hosting" and "is_proxy"
+// JSON fields.
+// 
+// SetCloudRanges() adds the CloudProvider of the IP addresses to the lookups,
+// also in the "cloud_provider" JSON field, from the IP ranges published by
+// AWS, Google Cloud and Azure and read by OpenCloudRanges() (see also
+// Config.CloudRangesFiles). DownloadCloudRangesTo() downloads the AWS and
+// Google Cloud ones.
+// 
+// DistanceKm() returns the great-circle distance between the locations of
+// two GeoLocIp.
+// 
+// SetOverrides() gives the location of custom networks, like the internal
+// ranges of a corporate network, in priority over the geoip data, from a CSV
+// or JSON file read by LoadOverridesFile() (see also Config.OverridesFile).
+// 
+// SetProvider() makes the lookups use another source of geoip data, any
+// Provider, like a DB or an MMDB, without changing the calling code. A Chain
+// of Providers looks up the addresses not found by one in the next one, and
+// records the name of the one that found them in the Source of the GeoLocIp
+// and the "source" JSON field.
+// 
+// UseMMDB() makes GeoLocIPv4() use the GeoLite2 City and ASN databases
+// (.mmdb files) instead of the discontinued CSV files.
+// 
+// DownloadGeoLite2To() downloads these databases with a MaxMind account ID and
+// license key. When they are set in Config.Credentials, or in the MAXMIND_ACCOUNT_ID
+// and MAXMIND_LICENSE_KEY environment variables, New() and the default DB download
+// and use them instead of the CSV files. Each download is checked against the SHA256
+// checksum published by MaxMind, and a corrupted one does not replace the current file.
+// 
+// LoadIP2LocationFile() loads an IP2Location LITE DB11 CSV file as the same
+// Blocks and Locations as the MaxMind files. Config.IP2LocationFile makes a DB
+// use it instead of them.
+// 
+// OpenDBIP() loads a DB-IP city lite CSV file, with IPv4 and IPv6 ranges, as a
+// DBIP, a Provider to be used through SetProvider().
+// 
 // ServeHttpRequest() provides a REST API, returning a JSON structure holding
-// the geolocation information for a given IPv4 address.
+// the geolocation information for a given IPv4 or IPv6 address, in the URL path,
+// in the ip query parameter (/?ip=2001:200::1) or in the JSON body of a POST
+// request ({"ip":"2001:200::1"}). The fields parameter (?fields=country_code,city)
+// selects the fields returned, for the bandwidth-sensitive clients.
+// 
+// Behind a reverse proxy, TrustedProxies (see ParseTrustedProxies()) lets
+// ServeHttpRequest() find the caller IP in the X-Forwarded-For, Forwarded or
+// X-Real-IP headers.
+// 
+// ServeGeoHttpRequest() does the same, but returns the coordinates as a
+// single "loc" field, like ipinfo.io.
+// 
+// The endpoints of Telize are served with its field names, so its clients can
+// use the REST API unchanged : ServeTelizeHttpRequest() under /geoip/{ip},
+// ServeTelizeIPHttpRequest() under /ip and ServeTelizeJSONIPHttpRequest() under
+// /jsonip. CountryCode3() returns the ISO 3166-1 alpha 3 code of a country.
+// 
+// ServeIPAPIHttpRequest() serves the output format of ip-api.com under /json/{ip},
+// with its field names and fields parameter, for the users migrating from it. The
+// other lookup endpoints return it with the format=ip-api parameter, and the
+// formats of freegeoip.net and ipstack with format=freegeoip and format=ipstack.
+// 
+// The lookup endpoints return the same fields as an XML document with the
+// format=xml parameter, or an Accept header asking for XML, for the consumers
+// which cannot read JSON. MarshalXMLWith() returns it for a GeoLocIp.
+// With the format=csv (or format=tsv) parameter, the lookup and batch endpoints
+// return a header and rows of comma (or tab) separated values instead, and with
+// format=geojson a GeoJSON Feature (or FeatureCollection), for Leaflet or Mapbox
+// maps. MarshalGeoJSONWith() returns this Feature for a GeoLocIp.
+// 
+// The high-QPS consumers can ask for binary responses in the Accept header :
+// application/x-protobuf for the GeoLoc and BatchLookupResponse messages of
+// geoip.proto, the schema of the gRPC service, and application/msgpack for
+// the fields of the JSON as MessagePack.
+// 
+// JSONP() wraps the JSON responses of a handler in the function given by the
+// callback parameter, for the browser clients which cannot make cross-origin
+// requests. Handler() and NewGeoLocServer() serve the REST API with it.
+// 
+// CORS() adds the CORS headers for the origins allowed by CORSOrigins, with
+// the CORSMethods and CORSHeaders, and answers the preflight requests, so
+// single-page applications can call the REST API directly from browsers.
+// 
+// The lookup endpoints require an API key, in their api_key parameter or an
+// "Authorization: Bearer" header, if ValidateAPIKey is set, like to the Validate()
+// method of the keys of a file read by ReadAPIKeys(), with daily quotas of
+// requests. ServeStatusHttpRequest() returns the usage of each key. The gRPC
+// service requires the keys too, in its authorization metadata.
+// 
+// Gzip() compresses the responses of at least GZIP_MIN_SIZE bytes for the
+// clients accepting gzip in their Accept-Encoding header, like the batches.
+// Handler() and NewGeoLocServer() serve the REST API with it.
+// 
+// ServeBatchHttpRequest() returns the geolocation information of a list of
+// IP addresses, sent as a JSON object by a POST request under /batch.
+// 
+// ServeMetricsHttpRequest() serves metrics of the REST API in the Prometheus text
+// format under /metrics.
+// 
+// ServeHealthHttpRequest() answers under /healthz while the process is alive, and
+// ServeReadyHttpRequest() under /readyz once the data are loaded and not older
+// than MaxReadyAge, so load balancers can wait for the initial load.
+// 
+// ServeStatusHttpRequest() describes the data under /status : their age, the URLs
+// or files they come from, their number of records, how long they took to load,
+// and the outcome of the last reload, so monitoring can detect failed updates.
+// 
+// ServeReloadHttpRequest() reloads the default DB on a POST request under
+// /admin/reload, after downloading the MaxMind files if they are old, and answers
+// with the number of records of each dataset and the dates of the data. It
+// requires an "Authorization: Bearer" header with AdminToken, if set, or the
+// basic authentication of AdminUser and AdminPassword, if set, and can be
+// restricted to the AdminAllowed networks. So is /status. Without any of them,
+// the reload is refused.
 // 
 // ServeGeoLocAPI() starts a dedicated http server that only provides the REST API.
 // 
+// NewGeoLocServer() returns an *http.Server serving the REST API, that can be
+// started with ListenAndServe() and stopped with Shutdown().
+// 
+// The timeouts and limits of the servers are set by ServerReadTimeout,
+// ServerWriteTimeout, ServerIdleTimeout, ServerMaxHeaderBytes, and
+// MaxConcurrentRequests, beyond which the requests are refused with a 503
+// status code, see LimitConcurrency(). RateLimitPerSecond and RateLimitBurst
+// limit the requests of each client IP with a token bucket, except for the
+// RateLimitExempt networks, answering the others with a 429 status code, see
+// RateLimit().
+// 
+// ServeGeoLocAPIAddr() binds a given address, like "127.0.0.1:9001" for the
+// loopback interface only, and ServeGeoLocAPIListener() serves an existing
+// net.Listener, like the ones of systemd socket activation (see SystemdListeners()).
+// ServeGeoLocAPIUnix() listens on a Unix domain socket, for the hosts fronting it
+// with nginx without exposing a TCP port, see ListenUnixSocket().
+// 
+// ServeGeoLocAPITLS() and NewGeoLocTLSServer() serve it over HTTPS, with the
+// certificate and key of PEM files, or the certificates given by TLSConfig,
+// like the ones of Let's Encrypt, so it can be exposed without a reverse proxy.
+// 
+// Handler() returns the http.Handler of the REST API, which can be mounted under
+// any prefix of an existing http.ServeMux with http.StripPrefix(), like
+// /api/geoip/{ip}, the IP address being routed as a path segment.
+// 
+// Middleware() wraps an http.Handler of an existing server, setting the
+// X-Geo-Country, X-Geo-City and X-Geo-ASN headers of the requests to the
+// geolocation of their client IP, for example to gate features by country.
+// 
+// ServeGeoLocGRPC() starts a gRPC server with the Lookup and BatchLookup methods
+// of the GeoIP service described in geoip.proto, for the internal services which
+// prefer protobuf messages to JSON. It is served over HTTP/2 without TLS by the
+// net/http server, without any gRPC library, and NewGeoLocGRPCServer() returns it
+// as an *http.Server.
+// 
 // MarshalJSON() implements the JSON Marshaler interface for the *GeoLocIp
-// type.
+// type, and UnmarshalJSON() decodes it back. GeoLocJSON is the flat structure
+// of this JSON.
 // 
 // 
 // Contact
@@ -28,14 +282,15 @@
 // 
 // Logging
 // 
-// Error and information messages are written to the local system log (syslog).
+// Error and information messages are written to the standard error. SetLogger()
+// sends them elsewhere, for example to a *log.Logger with NewStdLogger(), to a
+// *slog.Logger with NewSlogLogger(), or to the local system log (syslog) with
+// NewSyslogLogger().
 // 
 // 
 // Known limitations
 // 
-// Currently works with IPv4 addresses only.
-// 
-// Need to be restarted to reload GeoIP files from MaxMind.
+// IPv6 lookups do not return the matching block, and the ASN has no range.
 // 
 // 
 // License
@@ -47,32 +302,43 @@
 // 
 // GeoIP data provided by MaxMind LLC.
 // 
-// goggle/btree package used to store and search for data in memory.
+// goggle/btree package used to store and search for data in memory. The IPv4
+// blocks and ASNs are kept in sorted slices, searched by dichotomy, much lighter
+// for the memory and the garbage collector.
+// 
+// oschwald/maxminddb-golang package used to read the GeoLite2 databases.
 // 
 // 
 // Installing and testing
 //
 // The package can be installed using the following command : 
 //   go get github.com/kirabu/geoip 
-// It will install both the geoip package 
-// and the google/btree package.
+// It will install the geoip package and its dependencies,
+// the google/btree and oschwald/maxminddb-golang packages.
 //
 // The tests can be runned with
 //   go test github.com/kirabu/geoip 
-// If you check your system log (/var/log/syslog), you'll see the main
-// steps followed by geoip to download the MaxMind files and load
+// On the standard error, you'll see the main steps followed by geoip to download the MaxMind files and load
 // them into memory :
 // 
-//   Jan 25 05:43:35  geolocip[4204]: Starting
-//   Jan 25 05:43:35  geolocip[4204]: Download http://download.maxmind.com/download/geoip/database/asnum/GeoIPASNum2.zip
-//   Jan 25 05:43:37  geolocip[4204]: Extracted /tmp/GeoIPASNum2.csv
-//   Jan 25 05:43:37  geolocip[4204]: Download http://geolite.maxmind.com/download/geoip/database/GeoLiteCity_CSV/GeoLiteCity-latest.zip
-//   Jan 25 05:43:50  geolocip[4204]: Extracted /tmp/GeoLiteCity-Blocks.csv
-//   Jan 25 05:43:51  geolocip[4204]: Extracted /tmp/GeoLiteCity-Location.csv
-//   Jan 25 05:43:51  geolocip[4204]: Locations number of lines: 751379
-//   Jan 25 05:43:55  geolocip[4204]: Locations file loaded
-//   Jan 25 05:44:04  geolocip[4204]: Blocks file loaded
-//   Jan 25 05:44:05  geolocip[4204]: ASN file loaded
+//   geolocip: 2016/01/25 05:43:35 Download http://download.maxmind.com/download/geoip/database/asnum/GeoIPASNum2.zip
+//   geolocip: 2016/01/25 05:43:37 Extracted /home/user/.cache/geoip/GeoIPASNum2.csv
+//   geolocip: 2016/01/25 05:43:37 Download http://geolite.maxmind.com/download/geoip/database/GeoLiteCity_CSV/GeoLiteCity-latest.zip
+//   geolocip: 2016/01/25 05:43:50 Extracted /home/user/.cache/geoip/GeoLiteCity-Blocks.csv
+//   geolocip: 2016/01/25 05:43:51 Extracted /home/user/.cache/geoip/GeoLiteCity-Location.csv
+//   geolocip: 2016/01/25 05:43:51 Locations number of lines: 751379
+//   geolocip: 2016/01/25 05:43:55 Locations file loaded
+//   geolocip: 2016/01/25 05:44:04 Blocks file loaded
+//   geolocip: 2016/01/25 05:44:05 ASN file loaded
+// 
+// The geoip command (go install github.com/kirabou/geoip/cmd/geoip@latest)
+// queries and manages the data without writing Go :
+//   geoip lookup 54.88.55.63             # prints the JSON of each address given
+//   geoip serve --port 9001              # starts the REST API (--grpc-port for the gRPC service)
+//   geoip update                         # downloads the MaxMind files again, whatever their age
+//   geoip enrich < ips.txt               # prints the JSON of each address read, one per line (NDJSON)
+//   geoip enrich --column ip < logs.csv  # appends the geolocation columns to the CSV rows
+//   geoip logs access.log                # appends the country, city and ASN to nginx or Apache access logs
 // 
 // 
 // Examples
@@ -89,11 +355,17 @@
 // 	  "postal_code":"20147",
 // 	  "latitude":39.0335,
 // 	  "longitude":-77.4838,
-// 	  "metro_code":"511",
-// 	  "area_code":"703",
-// 	  "organization":"AS14618 Amazon.com, Inc.",
+// 	  "metro_code":511,
+// 	  "area_code":703,
+// 	  "asn":14618,
+// 	  "organization":"Amazon.com, Inc.",
+// 	  "as":"AS14618 Amazon.com, Inc.",
 // 	  "country":"États-Unis",
-// 	  "region":"Virginia" }
+// 	  "country_en":"United States",
+// 	  "region":"Virginia",
+// 	  "continent_code":"NA",
+// 	  "continent":"North America",
+// 	  "is_in_european_union":false }
 // 
 // Here the source code  :
 // 
@@ -141,27 +413,27 @@ package geoip
 
 
 import (
-	"log"
+	"bytes"
 	"fmt"
 	"net"
-	"bytes"
-	"bufio"
+	"encoding/binary"
 	"encoding/json"
+	"encoding/hex"
+	"crypto/sha256"
 	"net/http"
 	"path"
-	"log/syslog"
+	"path/filepath"
 	"os"
 	"io"
-	"archive/zip"
+	"compress/gzip"
 	"errors"
 	"time"
+	"strconv"
+	"math/rand"
+	"strings"
 )
 
 
-var locations []Location
-var blocks *Blocks
-var asn_tree *ASNs
-var log_geolocip *syslog.Writer
 
 
 // This is the structure type used to share
@@ -173,6 +445,11 @@ type GeoLocIp struct {
 	Asn *ASN
 	CountryName *string
 	RegionName *string
+	Anonymity *Anonymity	// nil without anonymous IP data
+	CloudProvider string	// like CLOUD_AWS, "" if none or without cloud IP ranges
+	Source string			// name of the Provider of a Chain that found it, or ""
+	Network string			// CIDR network of the matched block holding Ip, or "" if unknown
+	InEuropeanUnion *bool	// given by the GeoLite2 databases, nil for the other sources
 }
 
 
@@ -190,6 +467,39 @@ func (gli *GeoLocIp) String() string {
 
 
 
+// Returns the code and the English name of the continent of the
+// GeoLocIp, like "NA" and "North America", or "" if unknown. See
+// CountryContinent().
+func (gli *GeoLocIp) Continent() (string, string) {
+	if gli.Location == nil {
+		return "", ""
+	}
+	code, _ := CountryContinent(gli.Location.Country)
+	return code, ContinentName(code)
+}
+
+
+// Tells if the GeoLocIp is located in an European Union member state :
+// the value of the GeoLite2 databases if they give one, or else the one
+// of IsEUCountry().
+func (gli *GeoLocIp) IsInEuropeanUnion() bool {
+	if gli.InEuropeanUnion != nil {
+		return *gli.InEuropeanUnion
+	}
+	return gli.Location != nil && IsEUCountry(gli.Location.Country)
+}
+
+
+// Returns the English name of the country of the GeoLocIp, whatever
+// the language of its CountryName, or "" if unknown.
+func (gli *GeoLocIp) CountryNameEN() string {
+	if gli.Location == nil {
+		return ""
+	}
+	return gli.Location.CountryNameIn("en")
+}
+
+
 // Implements the json.Marshaler interface for the GeoLocIp, so it can
 // be used with the standard decoding functions from the json package.
 // Example of returned JSON for 54.88.55.63 :
@@ -201,330 +511,1600 @@ func (gli *GeoLocIp) String() string {
 //  	"postal_code":"20147",
 //  	"latitude":39.0335,
 //  	"longitude":-77.4838,
-//  	"metro_code":"511",
-//  	"area_code":"703",
-//  	"organization":"AS14618 Amazon.com, Inc.",
+//  	"metro_code":511,
+//  	"area_code":703,
+//  	"asn":14618,
+//  	"organization":"Amazon.com, Inc.",
+//  	"as":"AS14618 Amazon.com, Inc.",
 //  	"country":"États-Unis",
-//  	"region":"Virginia"
+//  	"country_en":"United States",
+//  	"region":"Virginia",
+//  	"continent_code":"NA",
+//  	"continent":"North America",
+//  	"is_in_european_union":false,
+//  	"network":"54.88.0.0/14"
 //  }
 //  
-// Not all fields are present, depending of available data.
+// Not all fields are present, depending of available data. Latitude
+// and longitude are omitted if they are unknown. See GeoLocJSON
+// for the list of fields.
 func (gli *GeoLocIp) MarshalJSON() ([]byte, error) {
+	return gli.MarshalJSONWith(JSONOptions{})
+}
 
-	var b bytes.Buffer
-    w := bufio.NewWriter(&b)
 
-    fmt.Fprintf(w, "{ \"ip\":%q", gli.Ip.String())
+// Options for the JSON encoding of a GeoLocIp, see MarshalJSONWith()
+type JSONOptions struct {
+	// Emit the coordinates as a single "loc" field, like
+	// "loc":"39.0335,-77.4838", instead of separate latitude
+	// and longitude fields
+	CombinedLoc bool
 
-    if gli.Location != nil {
-	    if gli.Location.Country != "" {
-		    fmt.Fprintf(w, ", \"country_code\":%q", gli.Location.Country)
-		}
-	    if gli.Location.Region != "" {
-		    fmt.Fprintf(w, ", \"region_code\":%q", gli.Location.Region)
+	// Also emit the fields derived from the country code : "calling_code"
+	// and "currency".
+	Verbose bool
+
+	// Language of the "country" and "region" names, see NamesFor().
+	// The CountryName and RegionName of the GeoLocIp if empty, or if
+	// there are no names for the location in this language.
+	Language string
+
+	// Only emit these fields, by JSON key (like "country_code" or
+	// "city"), in this order. The unknown ones are ignored. All the
+	// fields if empty.
+	Fields []string
+}
+
+
+// The JSON encoding of a GeoLocIp, as returned by MarshalJSON() and
+// the REST API. Empty fields are omitted. It can be used to decode the
+// JSON of the REST API without the nested structures of a GeoLocIp.
+type GeoLocJSON struct {
+	Ip string `json:"ip"`
+	CountryCode string `json:"country_code,omitempty"`
+	RegionCode string `json:"region_code,omitempty"`
+	CallingCode string `json:"calling_code,omitempty"`
+	Currency string `json:"currency,omitempty"`
+	City string `json:"city,omitempty"`
+	PostalCode string `json:"postal_code,omitempty"`
+	Latitude *float64 `json:"latitude,omitempty"`
+	Longitude *float64 `json:"longitude,omitempty"`
+	Loc string `json:"loc,omitempty"`
+	MetroCode int `json:"metro_code,omitempty"`
+	AreaCode int `json:"area_code,omitempty"`
+	TimeZone string `json:"time_zone,omitempty"`
+	ASN uint32 `json:"asn,omitempty"`
+	Organization string `json:"organization,omitempty"`
+	AS string `json:"as,omitempty"`
+	Country string `json:"country,omitempty"`
+	CountryEN string `json:"country_en,omitempty"`
+	Region string `json:"region,omitempty"`
+	ContinentCode string `json:"continent_code,omitempty"`
+	Continent string `json:"continent,omitempty"`
+	IsInEuropeanUnion *bool `json:"is_in_european_union,omitempty"`
+	IsAnonymous *bool `json:"is_anonymous,omitempty"`
+	IsTor *bool `json:"is_tor,omitempty"`
+	IsVPN *bool `json:"is_vpn,omitempty"`
+	IsHosting *bool `json:"is_hosting,omitempty"`
+	IsProxy *bool `json:"is_proxy,omitempty"`
+	CloudProvider string `json:"cloud_provider,omitempty"`
+	Source string `json:"source,omitempty"`
+	Network string `json:"network,omitempty"`
+}
+
+
+// Returns the GeoLocJSON encoding of the GeoLocIp, with the given
+// encoding options.
+func (gli *GeoLocIp) JSON(opts JSONOptions) GeoLocJSON {
+
+	fields := GeoLocJSON{ Ip: gli.Ip.String() }
+
+	if location := gli.Location; location != nil {
+		fields.CountryCode = location.Country
+		fields.RegionCode = location.Region
+		if opts.Verbose && location.Country != "" {
+			fields.CallingCode, _ = CountryCallingCode(location.Country)
+			fields.Currency, _ = CountryCurrency(location.Country)
 		}
-	    if gli.Location.City != "" {
-	    	if tmp, err := json.Marshal(gli.Location.City); err == nil {
-		    	fmt.Fprintf(w, ", \"city\":%s", tmp)
-		    }
-		}	
-	    if gli.Location.PostalCode != "" {
-	    	if tmp, err := json.Marshal(gli.Location.PostalCode); err == nil {
-			    fmt.Fprintf(w, ", \"postal_code\":%s", tmp)
-			}
-		}	
-	    if gli.Location.Latitude != "" {
-		    fmt.Fprintf(w, ", \"latitude\":%s", gli.Location.Latitude)
-		}	
-	    if gli.Location.Longitude != "" {
-		    fmt.Fprintf(w, ", \"longitude\":%s", gli.Location.Longitude)
-		}	
-	    if gli.Location.MetroCode != "" {
-	    	if tmp, err := json.Marshal(gli.Location.MetroCode); err == nil {
-			    fmt.Fprintf(w, ", \"metro_code\":%s", tmp)
+		fields.City = location.City
+		fields.PostalCode = location.PostalCode
+		if location.HasCoordinates() {
+			latitude, longitude := location.Latitude, location.Longitude
+			if opts.CombinedLoc {
+				fields.Loc = strconv.FormatFloat(latitude, 'f', -1, 64) + "," + strconv.FormatFloat(longitude, 'f', -1, 64)
+			} else {
+				fields.Latitude, fields.Longitude = &latitude, &longitude
 			}
-		}	
-	    if gli.Location.AreaCode != "" {
-		    if tmp, err := json.Marshal(gli.Location.AreaCode); err == nil {
-		   		fmt.Fprintf(w, ", \"area_code\":%s", tmp)
-		   	}
-		}	
+		}
+		fields.MetroCode = location.MetroCode
+		fields.AreaCode = location.AreaCode
+		fields.TimeZone = location.TimeZone
+	}
+	if gli.Asn != nil {
+		fields.ASN, fields.Organization = gli.Asn.Parts()
+		fields.AS = gli.Asn.ASN
 	}
-    if gli.Asn != nil && gli.Asn.ASN != "" {
-    	if tmp, err := json.Marshal(gli.Asn.ASN); err == nil {
-	    	fmt.Fprintf(w, ", \"organization\":%s", tmp)
-	    }
-	}	
-	if *(gli.CountryName) != "" {
-		if tmp, err := json.Marshal(*(gli.CountryName)); err == nil {
-	   		fmt.Fprintf(w, ", \"country\":%s", tmp)
-	   	}
+	if gli.CountryName != nil {
+		fields.Country = *gli.CountryName
 	}
-	if *(gli.RegionName) != "" {
-		if tmp, err := json.Marshal(*(gli.RegionName)); err == nil {
-	    	fmt.Fprintf(w, ", \"region\":%s", tmp)
-	    }
+	fields.CountryEN = gli.CountryNameEN()
+	if gli.RegionName != nil {
+		fields.Region = *gli.RegionName
+	}
+	fields.ContinentCode, fields.Continent = gli.Continent()
+	if anonymity := gli.Anonymity; anonymity != nil {
+		fields.IsAnonymous, fields.IsTor = &anonymity.IsAnonymous, &anonymity.IsTor
+		fields.IsVPN, fields.IsHosting, fields.IsProxy = &anonymity.IsVPN, &anonymity.IsHosting, &anonymity.IsProxy
+	}
+	fields.CloudProvider = gli.CloudProvider
+	fields.Source = gli.Source
+	fields.Network = gli.Network
+	if gli.Location != nil && gli.Location.Country != "" {
+		in_eu := gli.IsInEuropeanUnion()
+		fields.IsInEuropeanUnion = &in_eu
+	}
+	if names := NamesFor(opts.Language); names != nil && gli.Location != nil {
+		if country := names.CountryName(gli.Location.Country); country != "" {
+			fields.Country = country
+		}
+		if region := names.RegionName(gli.Location.Country, gli.Location.Region); region != "" {
+			fields.Region = region
+		}
 	}
 
-	fmt.Fprintf(w, " }\n")
-	w.Flush()
+	return fields
+}
+
 
-	return b.Bytes(), nil
+// Same as MarshalJSON(), with the given encoding options.
+func (gli *GeoLocIp) MarshalJSONWith(opts JSONOptions) ([]byte, error) {
+	encoded, err := json.Marshal(gli.JSON(opts))
+	if err != nil || len(opts.Fields) == 0 {
+		return encoded, err
+	}
+	return selectJSONFields(encoded, opts.Fields)
 }
 
 
-// Loads blocks, locations, ASN, countries and regions in memory
-func init() {
+// Returns a JSON object with only the given fields of an encoded one,
+// in the given order, see JSONOptions.Fields.
+func selectJSONFields(encoded []byte, fields []string) ([]byte, error) {
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(encoded, &all); err != nil {
+		return nil, err
+	}
+	var selected bytes.Buffer
+	selected.WriteByte('{')
+	for _, field := range fields {
+		value, found := all[field]
+		if !found {
+			continue
+		}
+		delete(all, field)	// once only
+		if selected.Len() > 1 {
+			selected.WriteByte(',')
+		}
+		key, _ := json.Marshal(field)
+		selected.Write(key)
+		selected.WriteByte(':')
+		selected.Write(value)
+	}
+	selected.WriteByte('}')
+	return selected.Bytes(), nil
+}
 
-	var err error
 
-	log_geolocip, err = syslog.New(syslog.LOG_NOTICE, "geolocip")
-	// What should we do if syslog.New() returns an error ??
-	if err != nil {
-			log.Println("Cannot open log :", err)
-			return
+// Returns the fields selected by the fields parameters of a request,
+// like "?fields=country_code,city,latitude", or nil for all of them
+func requestFields(request *http.Request) []string {
+	var fields []string
+	for _, value := range request.URL.Query()["fields"] {
+		for _, field := range strings.Split(value, ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				fields = append(fields, field)
+			}
 		}
+	}
+	return fields
+}
 
-	log_geolocip.Notice("Starting")
 
-	DownloadMaxmindFiles()
+// Encodings of the responses of the REST API, by the media types asking
+// for them in the Accept header
+var accept_media_types = map[string]string{
+	"application/json": "json",
+	"application/xml": "xml",
+	"text/xml": "xml",
+	"application/x-protobuf": "protobuf",
+	"application/protobuf": "protobuf",
+	"application/msgpack": "msgpack",
+	"application/x-msgpack": "msgpack",
+}
 
-	if locations == nil {
-		locations, err = LoadLocFile(LOCATIONS_FILE)
-		if err != nil {
-			log_geolocip.Err(fmt.Sprintf("Cannot load locations file : %v", err))
-			return
+
+// Returns the encoding asked by the Accept header of a request : the one
+// of the first media type it lists in accept_media_types, or ""
+func acceptedMedia(request *http.Request) string {
+	for _, value := range request.Header.Values("Accept") {
+		for _, media_type := range strings.Split(value, ",") {
+			media_type, _, _ = strings.Cut(media_type, ";")
+			if media, found := accept_media_types[strings.TrimSpace(media_type)]; found {
+				return media
+			}
 		}
 	}
-	log_geolocip.Notice("Locations file loaded")
+	return ""
+}
 
 
-	if blocks == nil {
-		blocks, err = LoadBlocksFile(BLOCKS_FILE)
-		if err != nil {
-			log_geolocip.Err(fmt.Sprintf("Cannot load blocks file : %v", err))
-			return
-		}
+// Implements the json.Unmarshaler interface for the GeoLocIp, so the
+// JSON returned by MarshalJSON() (and so by the REST API) can be decoded
+// back into a GeoLocIp. The Block is not part of the JSON, so it is
+// left nil.
+func (gli *GeoLocIp) UnmarshalJSON(data []byte) error {
+
+	var fields GeoLocJSON
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
 	}
-	log_geolocip.Notice("Blocks file loaded")
 
-	if asn_tree == nil {
-		asn_tree, err = LoadASNFile(ASN_FILE)
-		if err != nil {
-			log_geolocip.Err(fmt.Sprintf("Cannot load ASN file : %v", err))
-			return
-		}
+	ip := net.ParseIP(fields.Ip)
+	if ip == nil {
+		return fmt.Errorf("invalid ip %q", fields.Ip)
+	}
+
+	location := Location {
+		Country: fields.CountryCode,
+		Region: fields.RegionCode,
+		City: fields.City,
+		PostalCode: fields.PostalCode,
+		MetroCode: fields.MetroCode,
+		AreaCode: fields.AreaCode,
+		TimeZone: fields.TimeZone,
+	}
+	if fields.Latitude != nil && fields.Longitude != nil {
+		location.Latitude, location.Longitude = *fields.Latitude, *fields.Longitude
+	} else if latitude, longitude, found := strings.Cut(fields.Loc, ","); found {
+		location.Latitude, location.Longitude = parseCoordinate(latitude, 90), parseCoordinate(longitude, 180)
+	}
+
+	*gli = GeoLocIp{ Ip: ip, CountryName: &fields.Country, RegionName: &fields.Region }
+	if location != (Location{}) {
+		gli.Location = &location
+	}
+	switch {
+	case fields.AS != "" :
+		asn := NewASN(0, 0, fields.AS)
+		gli.Asn = &asn
+	case fields.ASN != 0 :
+		gli.Asn = &ASN{ ASN: fmt.Sprintf("AS%d %s", fields.ASN, fields.Organization), Number: fields.ASN, Organization: fields.Organization }
+	case fields.Organization != "" :
+		gli.Asn = &ASN{ ASN: fields.Organization, Organization: fields.Organization }
+	}
+	if fields.IsAnonymous != nil {
+		flag := func(value *bool) bool { return value != nil && *value }
+		gli.Anonymity = &Anonymity{ flag(fields.IsAnonymous), flag(fields.IsTor), flag(fields.IsVPN), flag(fields.IsHosting), flag(fields.IsProxy) }
 	}
-	log_geolocip.Notice("ASN file loaded")
+	gli.CloudProvider = fields.CloudProvider
+	gli.Source = fields.Source
+	gli.Network = fields.Network
 
+	return nil
 }
 
+
+// Errors returned by GeoLocIPv4E(), GeoLocIPv6E() and Lookup()
+var (
+	ErrNotInitialized = errors.New("geoip package not initialized")
+	ErrNoBlock = errors.New("No block found for IP")
+	ErrInvalidIP = errors.New("Not a valid IP address for this lookup")
+)
+
+
 // Returns the geolocation information for a given IPv4 address
 // aa a *GeoLocIP if found, or nil
 func GeoLocIPv4(ip net.IP) *GeoLocIp {
+	return defaultDB().GeoLocIPv4(ip)
+}
+
+
+// Same as the GeoLocIPv4() function, using the data of the DB.
+func (db *DB) GeoLocIPv4(ip net.IP) *GeoLocIp {
 
-	if locations == nil || blocks == nil || asn_tree == nil {
+	gli, err := db.GeoLocIPv4E(ip)
+	logLookupError(ip, err)
+	return gli
+}
+
+
+// Returns the geolocation information for a given IPv6 address
+// as a *GeoLocIP if found, or nil
+func GeoLocIPv6(ip net.IP) *GeoLocIp {
+	return defaultDB().GeoLocIPv6(ip)
+}
+
+
+// Same as the GeoLocIPv6() function, using the data of the DB.
+func (db *DB) GeoLocIPv6(ip net.IP) *GeoLocIp {
+
+	gli, err := db.GeoLocIPv6E(ip)
+	logLookupError(ip, err)
+	return gli
+}
+
+
+// Logs why no geolocation information was found for an IP address
+func logLookupError(ip net.IP, err error) {
+
+	switch err {
+	case nil :
+	case ErrNotInitialized :
 		log_geolocip.Err("geoloip package badly initialized")
-		return nil
+	case ErrNoBlock :
+		log_geolocip.Notice(fmt.Sprintf("No block found for IP %s", ip.String()))
+	case ErrInvalidIP :
+	default :
+		log_geolocip.Err(fmt.Sprintf("Lookup error for IP %s: %v", ip.String(), err))
 	}
+}
 
-	addr := uint32(ip[15])+256*(uint32(ip[14])+256*(uint32(ip[13])+256*uint32(ip[12])))
 
-	block := blocks.Get(addr)
-   	if block == nil {
-   		log_geolocip.Notice(fmt.Sprintf("No block found for IP %d %s", addr, ip.String()))
-   		return nil
-   	}
+// A Locator gives the geolocation information of IPv4 addresses,
+// whatever the format of the data it uses : the MaxMind GeoLite2
+// databases (see OpenMMDB()), or any other source.
+type Locator interface {
+	GeoLocIPv4E(ip net.IP) (*GeoLocIp, error)
+}
 
-   	location := &locations[block.LocId]
-   	country := location.GetCountry()
-   	region := location.GetRegion()
 
-   	return &(GeoLocIp{ip, block, location, asn_tree.Get(addr), &country, &region})
+// A Locator that also gives the geolocation information of IPv6
+// addresses, like an *MMDB. With a Locator that does not implement
+// it, IPv6 addresses are looked up in the MaxMind CSV files.
+type IPv6Locator interface {
+	GeoLocIPv6E(ip net.IP) (*GeoLocIp, error)
+}
+
 
+// Sets the Locator used by GeoLocIPv4() and GeoLocIPv4E(), for example
+// an *MMDB returned by OpenMMDB(). With a nil Locator, the MaxMind CSV
+// files of the default DB are used.
+func SetLocator(l Locator) {
+	default_db.SetLocator(l)
 }
 
 
-//  This serves an http request and returns the GeoLocIp information 
-//  as a JSON for the IP address given in the URL path. See ServeGeoLocAPI()
-//  and MarshalJSON(). If no IP address is given in the URL, this function
-//  will try to use the IP of the caller.
-func ServeHttpRequest(writer http.ResponseWriter, request *http.Request) {
-	base := path.Base(request.URL.Path)
-	var ip net.IP
-	if base == "/" {
-		host, _, _ := net.SplitHostPort(request.RemoteAddr)
-		if host != "" {
-			ip = net.ParseIP(host)
-		}
-	} else {
-		ip = net.ParseIP(path.Base(request.URL.Path))
-	}
-	if ip != nil {
-		json, _ := json.Marshal(GeoLocIPv4(ip))
-		fmt.Fprintf(writer, string(json))
-	}
+// Sets the Locator used by the lookups of the DB, like SetLocator().
+// With a nil Locator, the MaxMind CSV files of the DB are used.
+func (db *DB) SetLocator(l Locator) {
+	db.update(func(data *snapshot) {
+		data.locator = l
+	})
 }
 
 
-// Starts an HTTP server on a local port whose number is given as argument. 
-// It will serve requests for geolocation information of IP addresses. 
-// For example : "http:your_host/54.88.55.63".
-// See ServeHttpRequest() for a description of the returned JSON.
-func ServeGeoLocAPI(port uint16) {
-	http.HandleFunc("/", ServeHttpRequest)
-	if err := http.ListenAndServe(fmt.Sprintf(":%d", port), nil); err != nil {
-   		log_geolocip.Err(fmt.Sprintf("Cannot start http server: %v", err))
-    }
+// Returns the geolocation information for a given IPv4 address,
+// or an error telling why it cannot be found : ErrNotInitialized if
+// the geoip data are not loaded, ErrInvalidIP if ip is not an IPv4
+// address, and ErrNoBlock if the address does not match any block.
+// The address may be given in its 4 bytes form (as returned by To4()),
+// its 16 bytes form, or as an IPv4-mapped IPv6 address (::ffff:a.b.c.d) :
+// the Ip of the returned GeoLocIp is always in the 16 bytes form.
+// The data come from the Locator set by SetLocator(), if any, which
+// also receives the 16 bytes form.
+func GeoLocIPv4E(ip net.IP) (*GeoLocIp, error) {
+	return defaultDB().GeoLocIPv4E(ip)
 }
 
 
-// Download Maxmind files in /tmp
-func download(url string, filename string) error {
+// Same as the GeoLocIPv4E() function, using the data of the DB.
+func (db *DB) GeoLocIPv4E(ip net.IP) (*GeoLocIp, error) {
 
-	out, err := os.Create(filename)
-	if err != nil {
-		log_geolocip.Err(fmt.Sprintf("Cannot create %s: %v", filename, err))
-		return err
+	if ip.To4() == nil {
+		return nil, ErrInvalidIP
 	}
-	defer out.Close()
+	data := db.snapshot()
+	return data.cache.lookup(ip.To16(), data.geoLocIPv4E)
+}
 
-	in, err := http.Get(url)
-	if err != nil {
-		log_geolocip.Err(fmt.Sprintf("Cannot get URL %s: %v", url, err))
-		return err
+
+// Returns the geolocation information for a given IPv4 address, in
+// its 16 bytes form, from the snapshot, see GeoLocIPv4E()
+func (data *snapshot) geoLocIPv4E(ip net.IP) (*GeoLocIp, error) {
+
+	if gli := data.override(ip); gli != nil {
+		return data.enrich(gli, nil)
+	}
+	if data.locator != nil {
+		return data.enrich(data.locator.GeoLocIPv4E(ip))
 	}
-	defer in.Body.Close()
 
-	_, err = io.Copy(out, in.Body)
-	if err != nil {
-		log_geolocip.Err(fmt.Sprintf("Error downloading %s from %s: %v", filename, url, err))
-		return err
+	if data.locations == nil || data.blocks == nil || data.asn_tree == nil {
+		return nil, ErrNotInitialized
 	}
 
-	return nil
+	addr := ipv4ToUint32(ip)
+
+	block := data.blocks.Get(addr)
+   	if block == nil {
+   		return nil, ErrNoBlock
+   	}
+
+   	return data.enrich(data.newGeoLocIp(ip, block, data.asn_tree.Get(addr)), nil)
 
 }
 
 
-// Returns age of a given file in days, or -1 if not found
-// or error
-func ageFile(filename string) int {
-	fi, err := os.Stat(filename)
-	if err != nil {
-		return -1
-	}
-	return int(time.Since(fi.ModTime()).Hours()) / 24
+// Returns the geolocation information for a given IPv6 address,
+// or an error like GeoLocIPv4E(). ErrInvalidIP is returned for IPv4
+// addresses, including IPv4-mapped IPv6 addresses (::ffff:a.b.c.d).
+// The Block of the returned GeoLocIp is nil, and its Asn has no range.
+func GeoLocIPv6E(ip net.IP) (*GeoLocIp, error) {
+	return defaultDB().GeoLocIPv6E(ip)
 }
 
 
-// Extract file from a zip archive to a given filename
-func extractFile(in_file *zip.File, out_file string) error {
-	out, err := os.Create(out_file)
-	if err != nil {
-		log_geolocip.Err(fmt.Sprintf("Cannot create %s: %v", out_file, err))
-		return err
+// Same as the GeoLocIPv6E() function, using the data of the DB.
+func (db *DB) GeoLocIPv6E(ip net.IP) (*GeoLocIp, error) {
+	data := db.snapshot()
+	if len(ip) == net.IPv6len && ip.To4() == nil {
+		return data.cache.lookup(ip, data.geoLocIPv6E)
 	}
-	defer out.Close()
-	in, err := in_file.Open()
-    if err != nil {
-		log_geolocip.Err(fmt.Sprintf("Cannot open archive for reading: %v", err))
-		return err
-    }	
-    defer in.Close()
-    io.Copy(out, in)
-	log_geolocip.Notice(fmt.Sprintf("Extracted %s", out_file))
-	return nil
+	return data.geoLocIPv6E(ip)
 }
 
 
-// Pathname, name and URL for the Maxmind files
-const (
-	url_zipfile_asn = "http://download.maxmind.com/download/geoip/database/asnum/GeoIPASNum2.zip"
-	url_zipfile_city = "http://geolite.maxmind.com/download/geoip/database/GeoLiteCity_CSV/GeoLiteCity-latest.zip"
-	zipfile_asn = "/tmp/GeoIPASNum2.zip"
-	zipfile_city = "/tmp/GeoLiteCity-latest.zip"
-	file_asn = "GeoIPASNum2.csv"
-	file_blocks = "GeoLiteCity-Blocks.csv"
-	file_location = "GeoLiteCity-Location.csv"
-)
+// Returns the geolocation information for a given IPv6 address from
+// the snapshot, see GeoLocIPv6E()
+func (data *snapshot) geoLocIPv6E(ip net.IP) (*GeoLocIp, error) {
 
+	if len(ip) == net.IPv6len && ip.To4() == nil {
+		if gli := data.override(ip); gli != nil {
+			return data.enrich(gli, nil)
+		}
+	}
+	if l, ok := data.locator.(IPv6Locator); ok {
+		return data.enrich(l.GeoLocIPv6E(ip))
+	}
 
-// Download the Maxmind zip files if the current ones are older
-// than 8 days. Extract files from the downloaded zip files.
-func DownloadMaxmindFiles() error {
-	// err := download(url_zipfile_city, zipfile_city)
-
-	// ASN : check if file exists and is less than 8 days
-	age_asn := ageFile(zipfile_asn)
-	if age_asn == -1 || age_asn >= 8 {
-		log_geolocip.Notice(fmt.Sprintf("Download %s", url_zipfile_asn))
-		err := download(url_zipfile_asn, zipfile_asn)
-		if err != nil {
-			return err
-		}	
-	} else {
-		log_geolocip.Notice(fmt.Sprintf("%s is %d days old", zipfile_asn, age_asn))
+	if len(ip) != net.IPv6len || ip.To4() != nil {
+		return nil, ErrInvalidIP
 	}
 
-	asn_zip, err := zip.OpenReader(zipfile_asn)
-	if err != nil {
-		log_geolocip.Err(fmt.Sprintf("Error opening zip file %s: %v", zipfile_asn, err))
-		return err
-	} 
-	defer asn_zip.Close()
-	if asn_zip.File[0].Name != file_asn {
-		log_geolocip.Err(fmt.Sprintf("Bad content in %s, found %s, expected %s", zipfile_asn, asn_zip.File[0].Name, file_asn))
-		return errors.New("Bad content")		
+	if data.blocks6 == nil {
+		return nil, ErrNotInitialized
 	}
 
-	if extractFile(asn_zip.File[0], ASN_FILE) != nil {
-		return errors.New("Cannot extract ASN file")
+	block := data.blocks6.Get(ip)
+	if block == nil {
+		return nil, ErrNoBlock
 	}
 
-	// City : check if file exists and is less than 8 days
-	age_city := ageFile(zipfile_city)
-	if age_city == -1 || age_city >= 8 {
-		log_geolocip.Notice(fmt.Sprintf("Download %s", url_zipfile_city))
-		err := download(url_zipfile_city, zipfile_city)
-		if err != nil {
-			return err
-		}	
-	} else {
-		log_geolocip.Notice(fmt.Sprintf("%s is %d days old", zipfile_city, age_city))
+	var asn *ASN
+	if data.asn6_tree != nil {
+		if asn6 := data.asn6_tree.Get(ip); asn6 != nil {
+			asn_record := NewASN(0, 0, asn6.ASN)
+			asn = &asn_record
+		}
+	}
+
+	location := &block.Location
+	country := data.names().CountryName(location.Country)
+	region := data.names().RegionName(location.Country, location.Region)
+
+	return data.enrich(&GeoLocIp{ Ip: ip, Location: location, Asn: asn, CountryName: &country, RegionName: &region, Network: block6Network(ip, block) }, nil)
+}
+
+
+// Returns the geolocation information for a given IP address, with
+// GeoLocIPv4E() for IPv4 addresses and GeoLocIPv6E() for the others.
+func Lookup(ip net.IP) (*GeoLocIp, error) {
+	return defaultDB().Lookup(ip)
+}
+
+
+// Same as the Lookup() function, using the data of the DB.
+func (db *DB) Lookup(ip net.IP) (*GeoLocIp, error) {
+	if ip.To4() != nil {
+		return db.GeoLocIPv4E(ip)
+	}
+	return db.GeoLocIPv6E(ip)
+}
+
+
+// Returns an IPv4 address, in its 4 or 16 bytes form, as an uint32,
+// as used in the blocks and ASN files
+func ipv4ToUint32(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+
+// Builds the GeoLocIp for an IP address from its matching block and ASN
+func (data *snapshot) newGeoLocIp(ip net.IP, block *Block, asn *ASN) *GeoLocIp {
+
+   	var country, region string
+   	location := data.locations.Get(block.LocId)
+   	if location != nil {
+	   	country = data.names().CountryName(location.Country)
+	   	region = data.names().RegionName(location.Country, location.Region)
 	}
 
-	city_zip, err := zip.OpenReader(zipfile_city)
+   	return &GeoLocIp{ Ip: ip, Block: block, Location: location, Asn: asn, CountryName: &country, RegionName: &region }
+}
+
+
+// Tells if an IP address is located in an European Union member
+// state. The error is the one returned by Lookup().
+func IsEU(ip net.IP) (bool, error) {
+	return defaultDB().IsEU(ip)
+}
+
+
+// Same as the IsEU() function, using the data of the DB.
+func (db *DB) IsEU(ip net.IP) (bool, error) {
+	gli, err := db.Lookup(ip)
 	if err != nil {
-		log_geolocip.Err(fmt.Sprintf("Error opening zip file %s: %v", zipfile_city, err))
-		return err
-	} 
-	defer city_zip.Close()
-	for _, f := range city_zip.File {
-		switch path.Base(f.Name) {
-		case file_blocks :
-			if extractFile(f, BLOCKS_FILE) != nil {
-				return errors.New("Cannot extract Blocks file")
-			}
+		return false, err
+	}
+	return gli.IsInEuropeanUnion(), nil
+}
 
-		case file_location :
-			if extractFile(f, LOCATIONS_FILE) != nil {
-				return errors.New("Cannot extract Locations file")
-			}
-		}
+
+// Returns the n ASs with the most IPv4 addresses in the loaded
+// ASN file, largest first, or nil if it is not loaded. See ASNs.Top().
+func TopASNs(n int) []ASNSummary {
+	return defaultDB().TopASNs(n)
+}
+
+
+// Same as the TopASNs() function, using the data of the DB.
+func (db *DB) TopASNs(n int) []ASNSummary {
+	data := db.snapshot()
+	if data.asn_tree == nil {
+		return nil
 	}
+	return data.asn_tree.Top(n)
+}
 
-	return nil
+
+// Replaces the locations used by GeoLocIPv4(), for example with a
+// LocationMap loaded by LoadLocFileMap() for a sparse custom dataset.
+// When called before the first lookup, the locations file is not
+// loaded by the default DB.
+func SetLocations(table LocationTable) {
+	default_db.SetLocations(table)
+}
+
+
+// Same as the SetLocations() function, for the DB.
+func (db *DB) SetLocations(table LocationTable) {
+	db.update(func(data *snapshot) {
+		data.locations = table
+	})
+}
+
+
+//  This serves an http request and returns the GeoLocIp information 
+//  as a JSON for the IP address given in the URL path. See ServeGeoLocAPI()
+//  and MarshalJSON(). The address can also be given in the ip query
+//  parameter (like "/?ip=2001:200::1"), or in the JSON body of a POST
+//  request (like {"ip":"2001:200::1"}), for the clients which cannot put
+//  it in the path. If no IP address is given, this function
+//  will try to use the IP of the caller, taken from the X-Forwarded-For,
+//  Forwarded or X-Real-IP headers if the request comes from one of the
+//  TrustedProxies. Errors are returned as a JSON too, like {"error":"invalid ip"}
+//  with a 400 status code, {"error":"not found"} with a 404 if there is no
+//  information for the address, and a 503 while the data are loading.
+//  The country and region names are in the language given by the lang
+//  parameter (like "?lang=en"), or else by the Accept-Language header.
+//  The fields parameter (like "?fields=country_code,city,latitude") selects
+//  the fields returned, see JSONOptions.Fields. The format parameter selects
+//  another output format : "ip-api" for the one of ip-api.com (see
+//  ServeIPAPIHttpRequest()), "freegeoip" for the one of freegeoip.net, and
+//  "ipstack" for the one of ipstack, with its fields parameter, and "xml"
+//  for the same fields as XML (like <geoip><ip>54.88.55.63</ip>...</geoip>,
+//  and <error>invalid ip</error>), also returned if the Accept header
+//  lists application/xml or text/xml before application/json, and "csv"
+//  (or "tsv") for a header and a row of comma (or tab) separated values,
+//  with all the fields, or the selected ones, and "geojson" for a GeoJSON
+//  Feature (see MarshalGeoJSONWith()). Without a format parameter,
+//  the Accept header can ask for a binary encoding : application/x-protobuf
+//  for the GeoLoc message of geoip.proto, and application/msgpack for the
+//  fields of the JSON as a MessagePack map. Handler()
+//  wraps the responses in the function given by the callback parameter
+//  (like "?callback=fn"), see JSONP(). It expects to be served under "/" :
+//  see Handler() to mount the REST API under a prefix.
+func ServeHttpRequest(writer http.ResponseWriter, request *http.Request) {
+	serveJSON(writer, request, "/", JSONOptions{})
 }
 
 
+//  Same as ServeHttpRequest(), but the coordinates are returned as a
+//  single "loc" field (like "loc":"39.0335,-77.4838"), for compatibility
+//  with services like ipinfo.io. It is served under /geo/ by
+//  NewGeoLocServer().
+func ServeGeoHttpRequest(writer http.ResponseWriter, request *http.Request) {
+	serveJSON(writer, request, "/geo/", JSONOptions{ CombinedLoc: true })
+}
 
 
+// Returns an IPv4 address in its 16 bytes form, whatever the form
+// returned by the parsing, and other addresses as is, or nil.
+func normalizeIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.To16()
+	}
+	return ip.To16()
+}
 
 
+// Seconds after which clients are asked to retry while the default DB
+// is loading
+const RETRY_AFTER_LOADING = 30
 
 
+// Output formats of the lookup endpoints of the REST API other than
+// its JSON, selected by their format parameter (like "?format=ip-api"),
+// by name. Each one writes the response for an IP address, given as
+// address (empty for the caller IP), nil if it is invalid.
+var lookup_formats = map[string]func(writer http.ResponseWriter, request *http.Request, address string, ip net.IP){
+	"ip-api": serveIPAPI,
+	"freegeoip": serveFreegeoip,
+	"ipstack": serveIpstack,
+	"geojson": serveGeoJSON,
+}
 
 
+// Error of the lookups made by the API endpoints while the default DB
+// is loading, see apiLookup()
+var err_loading = errors.New("database loading")
 
 
+// Returns the geolocation information of an IP address for the API
+// endpoints, counted in their metrics. ErrInvalidIP is returned for a nil
+// address, and err_loading while the default DB is loading : the request
+// is not held until it is loaded.
+func apiLookup(ip net.IP) (*GeoLocIp, error) {
+	ip = normalizeIP(ip)
+	if ip == nil {
+		api_metrics.countLookup(ErrInvalidIP)
+		return nil, ErrInvalidIP
+	}
+	if default_db.snapshot().ready(0) != nil {
+		go defaultDB()
+		api_metrics.countLookup(ErrNotInitialized)
+		return nil, err_loading
+	}
+
+	start := time.Now()
+	gli, err := Lookup(ip)
+	api_metrics.observe(&api_metrics.lookup_duration, time.Since(start))
+	api_metrics.countLookup(err)
+	logLookupError(ip, err)
+	return gli, err
+}
+
+
+// Writes a JSON error, like {"error":"not found"}, with a status code
+func writeJSONError(writer http.ResponseWriter, code int, message string) {
+	body, _ := json.Marshal(struct {
+		Error string `json:"error"`
+	}{ message })
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(code)
+	writer.Write(body)
+}
+
+
+// Writes the GeoLocIp information as a JSON for the IP address found
+// in the last segment of the URL path after the given prefix, or for
+// the caller IP if there is none, see serveLookup()
+func serveJSON(writer http.ResponseWriter, request *http.Request, prefix string, opts JSONOptions) {
+	var address string
+	if ip_path := strings.TrimPrefix(request.URL.Path, prefix); ip_path != "" {
+		address = path.Base(ip_path)
+	}
+	serveLookup(writer, request, address, opts)
+}
+
+
+// Returns the IP address to look up given by a request without one in
+// its path : in its ip query parameter, like "?ip=54.88.55.63", or else
+// in the JSON body of a POST request, like {"ip":"54.88.55.63"}, or
+// "" for the caller IP. Answers the request with a 400 status code and
+// returns false if the body cannot be decoded.
+func requestAddress(writer http.ResponseWriter, request *http.Request) (string, bool) {
+	if address := request.URL.Query().Get("ip"); address != "" {
+		return address, true
+	}
+	if request.Method != http.MethodPost {
+		return "", true
+	}
+	var body struct {
+		IP string `json:"ip"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(writer, request.Body, 1024)).Decode(&body); err != nil && err != io.EOF {
+		writeJSONError(writer, http.StatusBadRequest, "bad json request")
+		return "", false
+	}
+	return body.IP, true
+}
+
+
+// Writes the GeoLocIp information as a JSON (or as XML, see requestXML())
+// for a given IP address, or else for the one given by requestAddress(),
+// or for the caller IP. Invalid addresses are answered with a 400 status
+// code, addresses without information with a 404, and all of them with a
+// 503 while the default DB is loading.
+func serveLookup(writer http.ResponseWriter, request *http.Request, address string, opts JSONOptions) {
+	if address == "" {
+		var ok bool
+		if address, ok = requestAddress(writer, request); !ok {
+			api_metrics.countLookup(ErrInvalidIP)
+			return
+		}
+	}
+	var ip net.IP
+	if address == "" {
+		ip = clientIP(request)
+	} else {
+		ip = net.ParseIP(address)
+	}
+
+	writer.Header().Add("Vary", "Accept")
+	format := request.URL.Query().Get("format")
+	as_xml, write_error := requestXML(request), writeJSONError
+	binary_encoding := requestBinary(request)
+	if as_xml {
+		write_error = writeXMLError
+	} else if format != "" && !isCSVFormat(format) {
+		serve, found := lookup_formats[format]
+		if !found {
+			writeJSONError(writer, http.StatusBadRequest, "unknown format")
+			return
+		}
+		serve(writer, request, address, ip)
+		return
+	}
+
+	gli, err := apiLookup(ip)
+	switch {
+	case err == ErrInvalidIP :
+		write_error(writer, http.StatusBadRequest, "invalid ip")
+	case err == err_loading :
+		writer.Header().Set("Retry-After", fmt.Sprint(RETRY_AFTER_LOADING))
+		write_error(writer, http.StatusServiceUnavailable, "database loading")
+	case err == ErrNotInitialized :
+		write_error(writer, http.StatusServiceUnavailable, "database not loaded")
+	case err == ErrNoBlock || gli == nil :
+		write_error(writer, http.StatusNotFound, "not found")
+	case binary_encoding == "protobuf" :
+		opts.Language = requestLanguage(request)
+		writeBinary(writer, binary_encoding, "geoip.GeoLoc", encodeGeoLoc(gli.JSON(opts)))
+	case binary_encoding == "msgpack" :
+		opts.Language, opts.Fields = requestLanguage(request), requestFields(request)
+		json, _ := gli.MarshalJSONWith(opts)
+		msgpack, _ := jsonToMsgpack(json)
+		writeBinary(writer, binary_encoding, "", msgpack)
+	case as_xml :
+		opts.Language, opts.Fields = requestLanguage(request), requestFields(request)
+		xml, _ := gli.MarshalXMLWith(opts)
+		writer.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		writer.Write(xml)
+	case isCSVFormat(format) :
+		opts.Language = requestLanguage(request)
+		json, _ := gli.MarshalJSONWith(opts)
+		columns := csvColumns(request)
+		writeCSV(writer, format, columns, [][]string{ csvRow(json, columns) })
+	default :
+		opts.Language, opts.Fields = requestLanguage(request), requestFields(request)
+		json, _ := gli.MarshalJSONWith(opts)
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Write(json)
+	}
+}
+
+
+// Maximum number of IP addresses accepted by ServeBatchHttpRequest()
+var MaxBatchSize = 1000
+
+
+//  This serves a POST request holding a JSON object with a list of IP
+//  addresses, like {"ips": ["54.88.55.63", "2001:200::1"]}, and returns
+//  a JSON array with the GeoLocIp information of each one, in the same
+//  order, or null for the addresses without any. Like ServeHttpRequest(),
+//  the fields parameter selects the fields returned, and the format=csv
+//  (or tsv) parameter returns a header and a row for each address, with
+//  only its ip column if there is no information. The Accept header can
+//  ask for the BatchLookupResponse message of geoip.proto, or for a
+//  MessagePack array, like ServeHttpRequest(), and format=geojson returns
+//  a GeoJSON FeatureCollection. Batches of more than
+//  MaxBatchSize addresses are refused. It is served under /batch by
+//  NewGeoLocServer().
+func ServeBatchHttpRequest(writer http.ResponseWriter, request *http.Request) {
+
+	if request.Method != http.MethodPost {
+		writer.Header().Set("Allow", http.MethodPost)
+		http.Error(writer, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var batch struct {
+		IPs []string `json:"ips"`
+	}
+	// An IP address is less than 64 bytes, with its quotes and comma
+	body := http.MaxBytesReader(writer, request.Body, int64(MaxBatchSize) * 64 + 1024)
+	if err := json.NewDecoder(body).Decode(&batch); err != nil {
+		http.Error(writer, "Bad JSON request", http.StatusBadRequest)
+		return
+	}
+	if len(batch.IPs) > MaxBatchSize {
+		http.Error(writer, fmt.Sprintf("More than %d IP addresses", MaxBatchSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	results := lookupBatch(batch.IPs)
+
+	if format := request.URL.Query().Get("format"); isCSVFormat(format) {
+		// The addresses without information get only their ip column
+		columns := csvColumns(request)
+		rows := make([][]string, len(results))
+		for i, gli := range results {
+			encoded, _ := json.Marshal(map[string]string{ "ip": batch.IPs[i] })
+			if gli != nil {
+				encoded, _ = gli.MarshalJSONWith(JSONOptions{ Language: requestLanguage(request) })
+			}
+			rows[i] = csvRow(encoded, columns)
+		}
+		writeCSV(writer, format, columns, rows)
+		return
+	}
+
+	opts := JSONOptions{ Language: requestLanguage(request), Fields: requestFields(request) }
+	if request.URL.Query().Get("format") == "geojson" {
+		writeGeoJSONCollection(writer, batch.IPs, results, opts)
+		return
+	}
+	binary_encoding := requestBinary(request)
+	if binary_encoding == "protobuf" {
+		writeBinary(writer, binary_encoding, "geoip.BatchLookupResponse", encodeBatchLookupResponse(batch.IPs, results, opts))
+		return
+	}
+
+	// The addresses without information are encoded as null
+	encoded := make([]json.RawMessage, len(results))
+	for i, gli := range results {
+		encoded[i] = json.RawMessage("null")
+		if gli != nil {
+			encoded[i], _ = gli.MarshalJSONWith(opts)
+		}
+	}
+	response, _ := json.Marshal(encoded)
+	if binary_encoding == "msgpack" {
+		msgpack, _ := jsonToMsgpack(response)
+		writeBinary(writer, binary_encoding, "", msgpack)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(response)
+}
+
+
+// Returns the GeoLocIp information of a list of IP addresses, in the
+// same order, or nil for the addresses without any, counted in the
+// metrics of the API
+func lookupBatch(addresses []string) []*GeoLocIp {
+
+	ips := make([]net.IP, len(addresses))
+	for i, ip := range addresses {
+		ips[i] = normalizeIP(net.ParseIP(ip))
+	}
+	start := time.Now()
+	results := LookupBatch(ips)
+	api_metrics.observe(&api_metrics.batch_duration, time.Since(start))
+	for i, gli := range results {
+		switch {
+		case gli != nil :
+			api_metrics.countLookup(nil)
+		case ips[i] == nil :
+			api_metrics.countLookup(ErrInvalidIP)
+		default :
+			api_metrics.countLookup(ErrNoBlock)
+		}
+	}
+	return results
+}
+
+
+// Default timeouts for the http server returned by NewGeoLocServer(), see
+// ServerReadTimeout and ServerWriteTimeout
+const (
+	SERVER_READ_TIMEOUT = 10 * time.Second
+	SERVER_WRITE_TIMEOUT = 10 * time.Second
+)
+
+
+// Returns an http.Handler serving the REST API, with its routes relative
+// to "/" : ServeHttpRequest() under /{ip} (and / for the caller IP),
+// ServeGeoHttpRequest() under /geo/{ip} (and /geo/), ServeBatchHttpRequest()
+// under /batch, the Telize endpoints (ServeTelizeHttpRequest() under /geoip/{ip}
+// and /geoip, ServeTelizeIPHttpRequest() under /ip and ServeTelizeJSONIPHttpRequest()
+// under /jsonip), ServeIPAPIHttpRequest() under /json/{ip} and /json, like
+// ip-api.com, ServeMetricsHttpRequest() under /metrics, ServeHealthHttpRequest()
+// under /healthz, ServeReadyHttpRequest() under /readyz, ServeStatusHttpRequest()
+// under /status and ServeReloadHttpRequest() under /admin/reload. It can be
+// mounted under any prefix of an existing http.ServeMux, stripped without
+// its trailing slash, like :
+// 	mux.Handle("/api/geoip/", http.StripPrefix("/api/geoip", geoip.Handler()))
+// The IP address is routed as a single segment of the path, and the other
+// paths are answered with a 404 status code, unlike ServeHttpRequest()
+// which takes the last segment of any path. The JSON responses of the
+// lookup endpoints are wrapped in the callback given by the callback
+// parameter, see JSONP(), and get the CORS headers for the CORSOrigins,
+// see CORS() : the other endpoints (/status, /metrics, /admin/...) are
+// not readable from other origins. The responses are compressed for the
+// clients accepting gzip, see Gzip().
+// The lookup endpoints require an API key if ValidateAPIKey is set.
+func Handler() http.Handler {
+	lookup := func(opts JSONOptions) http.HandlerFunc {
+		return func(writer http.ResponseWriter, request *http.Request) {
+			serveLookup(writer, request, request.PathValue("ip"), opts)
+		}
+	}
+	// The lookups require an API key, if ValidateAPIKey is set, and only
+	// they can be called from other origins, with CORS or JSONP : not the
+	// admin and monitoring endpoints
+	keyed := func(pattern string, handler http.HandlerFunc) http.Handler {
+		return CORS(JSONP(countRequests(pattern, requireAPIKey(handler))))
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/{$}", keyed("/", lookup(JSONOptions{})))
+	mux.Handle("/{ip}", keyed("/", lookup(JSONOptions{})))
+	mux.Handle("/geo/{$}", keyed("/geo/", lookup(JSONOptions{ CombinedLoc: true })))
+	mux.Handle("/geo/{ip}", keyed("/geo/", lookup(JSONOptions{ CombinedLoc: true })))
+	mux.Handle("/batch", keyed("/batch", ServeBatchHttpRequest))
+	telize := func(writer http.ResponseWriter, request *http.Request) {
+		serveTelize(writer, request, request.PathValue("ip"))
+	}
+	mux.Handle("/geoip", keyed("/geoip/", telize))
+	mux.Handle("/geoip/{$}", keyed("/geoip/", telize))
+	mux.Handle("/geoip/{ip}", keyed("/geoip/", telize))
+	ip_api := func(writer http.ResponseWriter, request *http.Request) {
+		address := request.PathValue("ip")
+		ip := clientIP(request)
+		if address != "" {
+			ip = net.ParseIP(address)
+		}
+		serveIPAPI(writer, request, address, ip)
+	}
+	mux.Handle("/json", keyed("/json/", ip_api))
+	mux.Handle("/json/{$}", keyed("/json/", ip_api))
+	mux.Handle("/json/{ip}", keyed("/json/", ip_api))
+	mux.Handle("/ip", keyed("/ip", ServeTelizeIPHttpRequest))
+	mux.Handle("/jsonip", keyed("/jsonip", ServeTelizeJSONIPHttpRequest))
+	mux.HandleFunc("/metrics", ServeMetricsHttpRequest)
+	mux.HandleFunc("/healthz", ServeHealthHttpRequest)
+	mux.HandleFunc("/readyz", ServeReadyHttpRequest)
+	mux.HandleFunc("/status", ServeStatusHttpRequest)
+	mux.Handle("/admin/reload", countRequests("/admin/reload", ServeReloadHttpRequest))
+	return Gzip(mux)
+}
+
+
+// Returns an http server listening on the given address (for example
+// ":9001" or "127.0.0.1:9001") and serving the REST API with Handler(),
+// not with the global http.DefaultServeMux. The server is not started :
+// the caller is expected to call ListenAndServe() on it, and can later
+// stop it cleanly with Shutdown(). Its timeouts and limits are given by
+// ServerReadTimeout, ServerWriteTimeout, ServerIdleTimeout,
+// ServerMaxHeaderBytes and MaxConcurrentRequests, and the rate of the
+// requests of each client by RateLimitPerSecond and RateLimitBurst.
+func NewGeoLocServer(addr string) *http.Server {
+	handler := Handler()
+	if MaxConcurrentRequests > 0 {
+		handler = LimitConcurrency(MaxConcurrentRequests, handler)
+	}
+	if RateLimitPerSecond > 0 {
+		handler = RateLimit(RateLimitPerSecond, RateLimitBurst, handler)
+	}
+	return &http.Server{
+		Addr: addr,
+		Handler: handler,
+		ReadTimeout: ServerReadTimeout,
+		WriteTimeout: ServerWriteTimeout,
+		IdleTimeout: ServerIdleTimeout,
+		MaxHeaderBytes: ServerMaxHeaderBytes,
+	}
+}
+
+
+// Starts an HTTP server on a local port whose number is given as argument. 
+// It will serve requests for geolocation information of IP addresses. 
+// For example : "http:your_host/54.88.55.63".
+// See ServeHttpRequest() for a description of the returned JSON, and
+// NewGeoLocServer() for a server that can be shut down. The default DB
+// is loaded while the server starts, and /readyz answers "ok" once done.
+// It is reloaded on SIGHUP, see ReloadOnSignal(). The server listens on
+// all the interfaces : see ServeGeoLocAPIAddr() to bind a given one.
+func ServeGeoLocAPI(port uint16) {
+	ServeGeoLocAPIAddr(fmt.Sprintf(":%d", port))
+}
+
+
+// Starts an HTTP server listening on the given TCP address, like
+// "127.0.0.1:9001" to bind the loopback interface only, or ":9001" for
+// all of them, like ServeGeoLocAPI().
+func ServeGeoLocAPIAddr(addr string) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log_geolocip.Err(fmt.Sprintf("Cannot start http server: %v", err))
+		return
+	}
+	ServeGeoLocAPIListener(listener)
+}
+
+
+// Loads the default DB in the background while a server starts, see
+// ServeReadyHttpRequest(). The returned channel is closed once it is
+// loaded : the servers wait for it before returning, so the load does
+// not outlive them.
+func loadDefaultInBackground() <-chan struct{} {
+	loaded := make(chan struct{})
+	go func() {
+		defaultDB()
+		close(loaded)
+	}()
+	return loaded
+}
+
+
+// Serves the REST API on an existing listener, like the ones passed by
+// systemd socket activation (see SystemdListeners()), until it fails or
+// is closed. Like ServeGeoLocAPI(), the default DB is loaded while the
+// server starts, and reloaded on SIGHUP.
+func ServeGeoLocAPIListener(listener net.Listener) {
+	loaded := loadDefaultInBackground()
+	defer func() { <-loaded }()
+	ReloadOnSignal(reload_signals...)
+	srv := NewGeoLocServer(listener.Addr().String())
+	if err := srv.Serve(listener); err != nil {
+		log_geolocip.Err(fmt.Sprintf("Cannot start http server: %v", err))
+	}
+}
+
+
+// HTTP client of the downloads. http.DefaultClient uses the proxy given
+// by the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables.
+// Replace it to use another proxy, or custom timeouts or TLS settings :
+// 	geoip.DownloadClient = &http.Client{
+// 		Timeout: 5 * time.Minute,
+// 		Transport: &http.Transport{ Proxy: http.ProxyURL(proxy_url) },
+// 	}
+var DownloadClient = http.DefaultClient
+
+
+// Sends a GET request, with basic authentication if credentials are
+// given and the given headers, and returns the response if its status
+// is 200, or 304 for a conditional request
+func httpGet(url string, creds Credentials, header http.Header) (*http.Response, error) {
+
+	request, err := newDownloadRequest(url)
+	if err != nil {
+		log_geolocip.Err(fmt.Sprintf("Cannot get URL %s: %v", url, err))
+		return nil, err
+	}
+	for key, values := range header {
+		request.Header[key] = values
+	}
+	if creds.IsSet() && request.Header.Get("Authorization") == "" && credentialsAllowed(request) {
+		request.SetBasicAuth(creds.AccountID, creds.LicenseKey)
+	}
+
+	client := DownloadClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	in, err := client.Do(request)
+	if err != nil {
+		log_geolocip.Err(fmt.Sprintf("Cannot get URL %s: %v", url, err))
+		return nil, err
+	}
+
+	switch {
+	case in.StatusCode == http.StatusUnauthorized :
+		in.Body.Close()
+		log_geolocip.Err(fmt.Sprintf("Cannot get URL %s: %v", url, ErrUnauthorized))
+		return nil, ErrUnauthorized
+	case in.StatusCode == http.StatusNotModified && len(header) > 0 :
+	case in.StatusCode != http.StatusOK :
+		in.Body.Close()
+		log_geolocip.Err(fmt.Sprintf("Cannot get URL %s: %s", url, in.Status))
+		return nil, &statusError{ url, in.Status, in.StatusCode }
+	}
+
+	return in, nil
+}
+
+
+// Age after which a downloaded MaxMind file is downloaded again, if it
+// changed on the server. MaxMind updates the GeoLite2 databases twice
+// a week : set it to a day for daily refreshes.
+var DownloadMaxAge = 8 * 24 * time.Hour
+
+
+// Disables the downloads : only the MaxMind files already there are
+// extracted and used, and ErrDownloadsDisabled is returned for the
+// missing ones. Config.Download disables them for a given DB.
+var DisableDownloads = false
+
+
+// Error returned when a MaxMind file is missing while downloads are
+// disabled (see DisableDownloads)
+var ErrDownloadsDisabled = errors.New("MaxMind file missing, and downloads are disabled")
+
+
+// Number of times a failed download is retried, when the error may be
+// transient : a network error, a server error (5xx), or too many
+// requests (429)
+var DownloadRetries = 3
+
+
+// Delay before the first retry of a failed download, doubled at each
+// retry. A random jitter of +/- 50% is applied to each delay.
+var DownloadBackoff = 2 * time.Second
+
+
+// Error of an HTTP request whose response status is not the expected one
+type statusError struct {
+	url string
+	status string
+	code int
+}
+
+
+func (err *statusError) Error() string {
+	return fmt.Sprintf("Cannot get URL %s: %s", err.url, err.status)
+}
+
+
+// Tells if a failed download may succeed if retried
+func isTransient(err error) bool {
+	if status, ok := err.(*statusError); ok {
+		return status.code >= 500 || status.code == http.StatusTooManyRequests
+	}
+	return err != ErrUnauthorized
+}
+
+
+// Download Maxmind files like downloadOnce(), retrying up to
+// DownloadRetries times on transient errors, with an exponential
+// backoff starting at DownloadBackoff
+func download(url string, checksum_url string, filename string, creds Credentials) error {
+	delay := DownloadBackoff
+	for retry := 0; ; retry++ {
+		err := downloadOnce(url, checksum_url, filename, creds)
+		if err == nil || retry >= DownloadRetries || !isTransient(err) {
+			return err
+		}
+		wait := delay
+		if delay > 0 {
+			wait = delay / 2 + time.Duration(rand.Int63n(int64(delay)))
+		}
+		log_geolocip.Notice(fmt.Sprintf("Download %s failed, retrying in %v", url, wait.Round(time.Millisecond)))
+		time.Sleep(wait)
+		delay *= 2
+	}
+}
+
+
+// Download Maxmind files, with basic authentication if credentials
+// are given. If a checksum URL is given, the file must match the SHA256
+// checksum published there. The file is downloaded aside, and replaces
+// the current one only once complete and checked, so a failed or
+// corrupted download keeps the current file. If the file already exists,
+// the request is conditional (see conditionalHeader()) : when the server
+// answers that it has not changed, only its modification time is updated.
+func downloadOnce(url string, checksum_url string, filename string, creds Credentials) error {
+
+	in, err := httpGet(url, creds, conditionalHeader(filename))
+	if err != nil {
+		return err
+	}
+	defer in.Body.Close()
+
+	if in.StatusCode == http.StatusNotModified {
+		log_geolocip.Notice(fmt.Sprintf("%s not modified", filename))
+		now := time.Now()
+		return os.Chtimes(filename, now, now)
+	}
+
+	var checksum string
+	if checksum_url != "" {
+		if checksum, err = downloadChecksum(checksum_url, creds); err != nil {
+			return err
+		}
+	}
+
+	hash := sha256.New()
+	err = writeFileAtomic(filename, io.TeeReader(in.Body, hash), func() error {
+		if checksum != "" && hex.EncodeToString(hash.Sum(nil)) != checksum {
+			return ErrChecksumMismatch
+		}
+		return nil
+	})
+	if err != nil {
+		log_geolocip.Err(fmt.Sprintf("Error downloading %s from %s: %v", filename, url, err))
+		return err
+	}
+
+	// Kept for the next conditional request
+	etag_file := filename + ".etag"
+	if etag := in.Header.Get("ETag"); etag != "" {
+		os.WriteFile(etag_file, []byte(etag), 0644)
+	} else {
+		os.Remove(etag_file)
+	}
+
+	return nil
+
+}
+
+
+// Returns the headers of a conditional request for a file already
+// downloaded : If-Modified-Since its modification time, and If-None-Match
+// the ETag of its download, if any. Returns nil if the file does not
+// exist.
+func conditionalHeader(filename string) http.Header {
+	modified := fileModTime(filename)
+	if modified.IsZero() {
+		return nil
+	}
+	header := http.Header{}
+	header.Set("If-Modified-Since", modified.UTC().Format(http.TimeFormat))
+	if etag, err := os.ReadFile(filename + ".etag"); err == nil && len(etag) > 0 {
+		header.Set("If-None-Match", string(etag))
+	}
+	return header
+}
+
+
+// Writes the content of a reader to a file through a temporary file,
+// renamed once complete, so the file is never seen truncated, even
+// after a crash, and the previous one stays valid for the readers that
+// opened it (like the memory mapped GeoLite2 databases). check, if not
+// nil, is called before the rename : the file is left unchanged if it
+// returns an error.
+func writeFileAtomic(filename string, in io.Reader, check func() error) error {
+
+	out, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename) + ".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp_file := out.Name()
+
+	err = out.Chmod(0644)
+	if err == nil {
+		_, err = io.Copy(out, in)
+	}
+	if close_err := out.Close(); err == nil {
+		err = close_err
+	}
+	if err == nil && check != nil {
+		err = check()
+	}
+	if err == nil {
+		err = os.Rename(tmp_file, filename)
+	}
+	if err != nil {
+		os.Remove(tmp_file)
+	}
+	return err
+}
+
+
+// Downloads a SHA256 checksum, published by MaxMind as a line like
+// "<checksum>  GeoLite2-City_20240101.tar.gz", and returns it in
+// lower case
+func downloadChecksum(url string, creds Credentials) (string, error) {
+
+	in, err := httpGet(url, creds, nil)
+	if err != nil {
+		return "", err
+	}
+	defer in.Body.Close()
+
+	content, err := io.ReadAll(io.LimitReader(in.Body, 1024))
+	if err != nil {
+		log_geolocip.Err(fmt.Sprintf("Error downloading checksum from %s: %v", url, err))
+		return "", err
+	}
+	fields := strings.Fields(string(content))
+	if len(fields) == 0 {
+		log_geolocip.Err(fmt.Sprintf("Bad checksum from %s", url))
+		return "", errors.New("Bad checksum")
+	}
+	checksum := strings.ToLower(fields[0])
+	if decoded, err := hex.DecodeString(checksum); err != nil || len(decoded) != sha256.Size {
+		log_geolocip.Err(fmt.Sprintf("Bad checksum from %s", url))
+		return "", errors.New("Bad checksum")
+	}
+
+	return checksum, nil
+}
+
+
+// Returns age of a given file in days, or -1 if not found
+// or error
+func ageFile(filename string) int {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return -1
+	}
+	return int(time.Since(fi.ModTime()).Hours()) / 24
+}
+
+
+// Returns the modification time of a given file, or the zero
+// time if not found or error
+func fileModTime(filename string) time.Time {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
+
+// URLs of the Maxmind files. Set them to download the files from a
+// mirror, like an internal artifact repository, with the same refresh
+// as from MaxMind (see DownloadMaxAge).
+var (
+	MaxmindASNURL = "http://download.maxmind.com/download/geoip/database/asnum/GeoIPASNum2.zip"
+	MaxmindCityURL = "http://geolite.maxmind.com/download/geoip/database/GeoLiteCity_CSV/GeoLiteCity-latest.zip"
+	MaxmindASN6URL = "http://download.maxmind.com/download/geoip/database/asnum/GeoIPASNum2v6.zip"
+	MaxmindCity6URL = "http://geolite.maxmind.com/download/geoip/database/GeoLiteCityv6-beta/GeoLiteCityv6.csv.gz"
+	MaxmindCountryURL = "http://geolite.maxmind.com/download/geoip/database/GeoIPCountryCSV.zip"
+)
+
+
+// Name of the Maxmind files, downloaded and extracted in the data
+// directory (see DefaultDataDir())
+const (
+	zipfile_asn = "GeoIPASNum2.zip"
+	zipfile_city = "GeoLiteCity-latest.zip"
+	file_asn = "GeoIPASNum2.csv"
+	file_blocks = "GeoLiteCity-Blocks.csv"
+	file_location = "GeoLiteCity-Location.csv"
+	zipfile_asn6 = "GeoIPASNum2v6.zip"
+	gzfile_city6 = "GeoLiteCityv6.csv.gz"
+	file_asn6 = "GeoIPASNum2v6.csv"
+	file_city6 = "GeoLiteCityv6.csv"
+	zipfile_country = "GeoIPCountryCSV.zip"
+	file_country = "GeoIPCountryWhois.csv"
+)
+
+
+// Returns the default directory where the Maxmind files are downloaded
+// and extracted : a geoip directory in the user cache directory (see
+// os.UserCacheDir()), or in the temporary directory if there is none.
+func DefaultDataDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "geoip")
+}
+
+
+// Download a Maxmind file if the current one does not exist or
+// is older than DownloadMaxAge, checking it against the SHA256 checksum
+// published at checksum_url if not "", see download(). An old file
+// is only downloaded again if it changed on the server.
+func downloadIfOld(url string, checksum_url string, filename string, creds Credentials) error {
+	age := ageFile(filename)
+	if DisableDownloads {
+		if age == -1 {
+			log_geolocip.Err(fmt.Sprintf("Cannot download %s: %v", filename, ErrDownloadsDisabled))
+			return ErrDownloadsDisabled
+		}
+		return nil
+	}
+	if age == -1 || time.Since(fileModTime(filename)) >= DownloadMaxAge {
+		log_geolocip.Notice(fmt.Sprintf("Download %s", url))
+		return download(url, checksum_url, filename, creds)
+	}
+	log_geolocip.Notice(fmt.Sprintf("%s is %d days old", filename, age))
+	return nil
+}
+
+
+// Download a Maxmind file like downloadIfOld(). If the download fails
+// but there is a previous one, it is kept to be used, even stale : the
+// error is then stored in stale_err, and nil is returned.
+func downloadOrKeep(url string, checksum_url string, filename string, creds Credentials, stale_err *error) error {
+	err := downloadIfOld(url, checksum_url, filename, creds)
+	if err == nil || err == ErrUnauthorized || ageFile(filename) == -1 {
+		return err
+	}
+	log_geolocip.Notice(fmt.Sprintf("Cannot download %s, using the current one", filename))
+	*stale_err = err
+	return nil
+}
+
+
+// Extract a gzip compressed file to a given filename, replaced only
+// once fully extracted. A corrupted archive is removed, to be
+// downloaded again.
+func gunzipFile(in_file string, out_file string) error {
+	in, err := os.Open(in_file)
+	if err != nil {
+		log_geolocip.Err(fmt.Sprintf("Cannot open %s: %v", in_file, err))
+		return err
+	}
+	defer in.Close()
+	gz, err := gzip.NewReader(in)
+	if err != nil {
+		log_geolocip.Err(fmt.Sprintf("Error opening gzip file %s: %v", in_file, err))
+		os.Remove(in_file)
+		return err
+	}
+	defer gz.Close()
+	if err := writeFileAtomic(out_file, gz, nil); err != nil {
+		log_geolocip.Err(fmt.Sprintf("Error extracting %s: %v", in_file, err))
+		if isCorruptedArchive(err) {
+			os.Remove(in_file)	// not when the output cannot be written
+		}
+		return err
+	}
+	log_geolocip.Notice(fmt.Sprintf("Extracted %s", out_file))
+	return nil
+}
+
+
+// Download the Maxmind zip files in the default data directory (see
+// DefaultDataDir()) if the current ones are older than DownloadMaxAge. Extract
+// files from the downloaded zip files. If MaxMind credentials are set
+// in the environment (see CredentialsFromEnv()), the GeoLite2 databases
+// are downloaded instead, see DownloadGeoLite2To().
+func DownloadMaxmindFiles() error {
+	if creds := CredentialsFromEnv(); creds.IsSet() {
+		return DownloadGeoLite2To(DefaultDataDir(), creds)
+	}
+	return DownloadMaxmindFilesTo(DefaultDataDir())
+}
+
+
+// Same as DownloadMaxmindFiles(), in a given directory, created if
+// it does not exist. When a download fails, after retries (see
+// DownloadRetries), the previous file is kept and extracted, even
+// stale, and the error is returned.
+func DownloadMaxmindFilesTo(dir string) error {
+
+	// Error of a failed download, whose previous file is used
+	var stale_err error
+	if err := downloadMaxmindArchives(dir, &stale_err); err != nil {
+		return err
+	}
+
+	if extractArchiveFile(filepath.Join(dir, zipfile_asn), file_asn, filepath.Join(dir, file_asn)) != nil {
+		return errors.New("Cannot extract ASN file")
+	}
+
+	city_zipfile := filepath.Join(dir, zipfile_city)
+	if extractArchiveFile(city_zipfile, file_blocks, filepath.Join(dir, file_blocks)) != nil {
+		return errors.New("Cannot extract Blocks file")
+	}
+	if extractArchiveFile(city_zipfile, file_location, filepath.Join(dir, file_location)) != nil {
+		return errors.New("Cannot extract Locations file")
+	}
+
+	return stale_err
+}
+
+
+// Download the Maxmind ASN and City zip files in a given directory,
+// created if it does not exist, without extracting them. The error
+// of a failed download whose previous file is kept is stored in
+// stale_err, see downloadOrKeep().
+func downloadMaxmindArchives(dir string, stale_err *error) error {
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log_geolocip.Err(fmt.Sprintf("Cannot create directory %s: %v", dir, err))
+		return err
+	}
+
+	// ASN : check if file exists and is less than DownloadMaxAge
+	if err := downloadOrKeep(MaxmindASNURL, "", filepath.Join(dir, zipfile_asn), Credentials{}, stale_err); err != nil {
+		return err
+	}
+
+	// City : check if file exists and is less than DownloadMaxAge
+	return downloadOrKeep(MaxmindCityURL, "", filepath.Join(dir, zipfile_city), Credentials{}, stale_err)
+}
+
+
+// Download the Maxmind IPv6 ASN and City files in the default data
+// directory if the current ones are older than DownloadMaxAge, and extract them.
+func DownloadMaxmindIPv6Files() error {
+	return DownloadMaxmindIPv6FilesTo(DefaultDataDir())
+}
+
+
+// Same as DownloadMaxmindIPv6Files(), in a given directory, created
+// if it does not exist.
+func DownloadMaxmindIPv6FilesTo(dir string) error {
+
+	// Error of a failed download, whose previous file is used
+	var stale_err error
+	if err := downloadMaxmindIPv6Archives(dir, &stale_err); err != nil {
+		return err
+	}
+
+	if extractArchiveFile(filepath.Join(dir, zipfile_asn6), file_asn6, filepath.Join(dir, file_asn6)) != nil {
+		return errors.New("Cannot extract IPv6 ASN file")
+	}
+
+	if err := gunzipFile(filepath.Join(dir, gzfile_city6), filepath.Join(dir, file_city6)); err != nil {
+		return err
+	}
+
+	return stale_err
+}
+
+
+// Download the Maxmind ASN zip files, IPv4 and IPv6, in a given
+// directory, created if it does not exist, if the current ones are older
+// than DownloadMaxAge, and extract them, without the blocks and locations
+// files, see Config.ASNOnly.
+func DownloadMaxmindASNFilesTo(dir string) error {
+
+	// Error of a failed download, whose previous file is used
+	var stale_err error
+	if err := downloadMaxmindASNArchives(dir, &stale_err); err != nil {
+		return err
+	}
+
+	if extractArchiveFile(filepath.Join(dir, zipfile_asn), file_asn, filepath.Join(dir, file_asn)) != nil {
+		return errors.New("Cannot extract ASN file")
+	}
+	if extractArchiveFile(filepath.Join(dir, zipfile_asn6), file_asn6, filepath.Join(dir, file_asn6)) != nil {
+		return errors.New("Cannot extract IPv6 ASN file")
+	}
+
+	return stale_err
+}
+
+
+// Download the Maxmind ASN zip files, IPv4 and IPv6, in a given
+// directory, created if it does not exist, without extracting them,
+// like downloadMaxmindArchives()
+func downloadMaxmindASNArchives(dir string, stale_err *error) error {
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log_geolocip.Err(fmt.Sprintf("Cannot create directory %s: %v", dir, err))
+		return err
+	}
+
+	if err := downloadOrKeep(MaxmindASNURL, "", filepath.Join(dir, zipfile_asn), Credentials{}, stale_err); err != nil {
+		return err
+	}
+
+	return downloadOrKeep(MaxmindASN6URL, "", filepath.Join(dir, zipfile_asn6), Credentials{}, stale_err)
+}
+
+
+// Download the Maxmind IPv6 ASN zip file and City gzip file in a
+// given directory, created if it does not exist, without extracting
+// them, like downloadMaxmindArchives()
+func downloadMaxmindIPv6Archives(dir string, stale_err *error) error {
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log_geolocip.Err(fmt.Sprintf("Cannot create directory %s: %v", dir, err))
+		return err
+	}
+
+	if err := downloadOrKeep(MaxmindASN6URL, "", filepath.Join(dir, zipfile_asn6), Credentials{}, stale_err); err != nil {
+		return err
+	}
+
+	return downloadOrKeep(MaxmindCity6URL, "", filepath.Join(dir, gzfile_city6), Credentials{}, stale_err)
+}
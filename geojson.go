@@ -0,0 +1,97 @@
+
+package geoip
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+
+// This file provides the GeoJSON output format of the REST API, so its
+// results can be dropped onto Leaflet or Mapbox maps : with the
+// format=geojson parameter of the lookup and batch endpoints.
+
+
+// Content type of the GeoJSON responses
+const GEOJSON_CONTENT_TYPE = "application/geo+json"
+
+
+// A GeoJSON Feature, with a Point geometry, null without coordinates
+type geoJSONFeature struct {
+	Type string `json:"type"`
+	Geometry *geoJSONPoint `json:"geometry"`
+	Properties json.RawMessage `json:"properties"`
+}
+
+type geoJSONPoint struct {
+	Type string `json:"type"`
+	Coordinates [2]float64 `json:"coordinates"`
+}
+
+
+// Returns the GeoJSON Feature of the GeoLocIp : a Point at its location,
+// whose properties are the fields of its JSON encoding with the given
+// options, like :
+// 	{"type":"Feature","geometry":{"type":"Point","coordinates":[-77.4838,39.0335]},
+// 	"properties":{"ip":"54.88.55.63","country_code":"US","city":"Ashburn",...}}
+// The geometry is null if the location is unknown.
+func (gli *GeoLocIp) MarshalGeoJSONWith(opts JSONOptions) ([]byte, error) {
+	properties, err := gli.MarshalJSONWith(opts)
+	if err != nil {
+		return nil, err
+	}
+	feature := geoJSONFeature{ Type: "Feature", Properties: properties }
+	if fields := gli.JSON(JSONOptions{}); fields.Latitude != nil && fields.Longitude != nil {
+		// GeoJSON positions are longitude first
+		feature.Geometry = &geoJSONPoint{ "Point", [2]float64{ *fields.Longitude, *fields.Latitude } }
+	}
+	return json.Marshal(feature)
+}
+
+
+// Writes the GeoJSON Feature of an IP address, see MarshalGeoJSONWith(),
+// with the same errors as ServeHttpRequest()
+func serveGeoJSON(writer http.ResponseWriter, request *http.Request, address string, ip net.IP) {
+
+	gli, err := apiLookup(ip)
+	switch {
+	case err == ErrInvalidIP :
+		writeJSONError(writer, http.StatusBadRequest, "invalid ip")
+	case err == err_loading :
+		writer.Header().Set("Retry-After", fmt.Sprint(RETRY_AFTER_LOADING))
+		writeJSONError(writer, http.StatusServiceUnavailable, "database loading")
+	case err == ErrNotInitialized :
+		writeJSONError(writer, http.StatusServiceUnavailable, "database not loaded")
+	case err == ErrNoBlock || gli == nil :
+		writeJSONError(writer, http.StatusNotFound, "not found")
+	default :
+		opts := JSONOptions{ Language: requestLanguage(request), Fields: requestFields(request) }
+		body, _ := gli.MarshalGeoJSONWith(opts)
+		writer.Header().Set("Content-Type", GEOJSON_CONTENT_TYPE)
+		writer.Write(body)
+	}
+}
+
+
+// Writes the GeoJSON FeatureCollection of the results of a batch of IP
+// addresses, in the same order, with a Feature with a null geometry and
+// only the ip property for the addresses without information
+func writeGeoJSONCollection(writer http.ResponseWriter, ips []string, results []*GeoLocIp, opts JSONOptions) {
+	features := make([]json.RawMessage, len(results))
+	for i, gli := range results {
+		if gli != nil {
+			features[i], _ = gli.MarshalGeoJSONWith(opts)
+		} else {
+			properties, _ := json.Marshal(map[string]string{ "ip": ips[i] })
+			features[i], _ = json.Marshal(geoJSONFeature{ Type: "Feature", Properties: properties })
+		}
+	}
+	body, _ := json.Marshal(struct {
+		Type string `json:"type"`
+		Features []json.RawMessage `json:"features"`
+	}{ "FeatureCollection", features })
+	writer.Header().Set("Content-Type", GEOJSON_CONTENT_TYPE)
+	writer.Write(body)
+}
@@ -0,0 +1,123 @@
+
+package geoip
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+
+// This file provides the download of the GeoLite2 databases from
+// MaxMind LLC, which requires a MaxMind account ID and license key.
+
+
+// MaxMind account ID and license key, required to download the
+// GeoLite2 databases. They are sent with HTTP basic authentication,
+// over HTTPS to the MaxmindCredentialHosts only.
+type Credentials struct {
+	AccountID string
+	LicenseKey string
+}
+
+
+// Returns the credentials set in the MAXMIND_ACCOUNT_ID and
+// MAXMIND_LICENSE_KEY environment variables, if any
+func CredentialsFromEnv() Credentials {
+	return Credentials{
+		AccountID: os.Getenv("MAXMIND_ACCOUNT_ID"),
+		LicenseKey: os.Getenv("MAXMIND_LICENSE_KEY"),
+	}
+}
+
+
+// Hosts receiving the MaxMind credentials, over HTTPS only : they are
+// not sent to the mirrors set in GeoLite2URL, unless their host is added
+// here, like for a caching proxy of MaxMind requiring them.
+var MaxmindCredentialHosts = []string{ "download.maxmind.com" }
+
+
+// Tells if the credentials can be sent with a request, see
+// MaxmindCredentialHosts
+func credentialsAllowed(request *http.Request) bool {
+	return request.URL.Scheme == "https" && slices.Contains(MaxmindCredentialHosts, request.URL.Host)
+}
+
+
+// Tells if the account ID and the license key are both set
+func (creds Credentials) IsSet() bool {
+	return creds.AccountID != "" && creds.LicenseKey != ""
+}
+
+
+// Error returned when MaxMind refuses the credentials (HTTP 401)
+var ErrUnauthorized = errors.New("MaxMind download unauthorized, check the account ID and license key")
+
+
+// Error returned when a downloaded file does not match the SHA256
+// checksum published by MaxMind
+var ErrChecksumMismatch = errors.New("MaxMind download does not match its SHA256 checksum")
+
+
+// Permalink of the GeoLite2 databases, for a given edition (%s). Their
+// SHA256 checksum is at the same URL followed by ".sha256". Set it to
+// download the databases from a mirror.
+var GeoLite2URL = "https://download.maxmind.com/geoip/databases/%s/download?suffix=tar.gz"
+
+
+// GeoLite2 editions downloaded by DownloadGeoLite2To(), each one
+// as a tar.gz archive holding an <edition>.mmdb file
+const (
+	edition_city = "GeoLite2-City"
+	edition_asn = "GeoLite2-ASN"
+	edition_country = "GeoLite2-Country"
+)
+
+
+// Download the GeoLite2 City and ASN databases in a given directory,
+// created if it does not exist, if the current ones are older than
+// DownloadMaxAge. They are extracted as GeoLite2-City.mmdb and GeoLite2-ASN.mmdb,
+// to be used with OpenMMDB(). ErrUnauthorized is returned if MaxMind
+// refuses the credentials, and ErrChecksumMismatch if a download does
+// not match its SHA256 checksum. When a download fails, after retries
+// (see DownloadRetries), the previous archive is kept and extracted,
+// even stale, and the error is returned.
+func DownloadGeoLite2To(dir string, creds Credentials) error {
+	return downloadGeoLite2Editions(dir, creds, edition_city, edition_asn)
+}
+
+
+// Same as DownloadGeoLite2To(), for the GeoLite2 Country database
+// only, extracted as GeoLite2-Country.mmdb, see Config.CountryOnly.
+func DownloadGeoLite2CountryTo(dir string, creds Credentials) error {
+	return downloadGeoLite2Editions(dir, creds, edition_country)
+}
+
+
+// Download and extract the given GeoLite2 editions, see DownloadGeoLite2To()
+func downloadGeoLite2Editions(dir string, creds Credentials, editions ...string) error {
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log_geolocip.Err(fmt.Sprintf("Cannot create directory %s: %v", dir, err))
+		return err
+	}
+
+	// Error of a failed download, whose previous archive is used
+	var stale_err error
+
+	for _, edition := range editions {
+		archive := filepath.Join(dir, edition + ".tar.gz")
+		url := fmt.Sprintf(GeoLite2URL, edition)
+		if err := downloadOrKeep(url, url + ".sha256", archive, creds, &stale_err); err != nil {
+			return err
+		}
+		if err := extractArchiveFile(archive, edition + ".mmdb", filepath.Join(dir, edition + ".mmdb")); err != nil {
+			return err
+		}
+	}
+
+	return stale_err
+}
@@ -0,0 +1,150 @@
+
+package geoip
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+
+// This file provides the country-only mode (see Config.CountryOnly),
+// loading the GeoLite Country CSV file from MaxMind LLC, much smaller
+// than the city files, as the same Blocks and Locations. The lookups
+// then give only the country. Each line holds a range of addresses
+// with its country :
+// 	"1.0.0.0","1.0.0.255","16777216","16777471","AU","Australia"
+
+
+// Read a GeoLite Country CSV file in memory, as Blocks and the
+// Locations they refer to, one for each country, with only the
+// country code and its time zone.
+func LoadCountryFile(filename string) (*Blocks, LocationMap, error) {
+
+	file, err := os.Open(filename)
+	if err != nil {
+		log_geolocip.Err(fmt.Sprintf("Country error open file: %v", err))
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	// The file is iso8859-1 encoded, like the locations file
+	return LoadCountry(newFileLatin1Reader(file))
+}
+
+
+// Read GeoLite Country CSV lines from an io.Reader in memory, like
+// LoadCountryFile(). The content must be utf-8, see LoadLocations().
+// Lines without 6 values are skipped.
+func LoadCountry(in io.Reader) (*Blocks, LocationMap, error) {
+	return LoaderOptions{}.LoadCountry(in)
+}
+
+
+// Same as the LoadCountry() function, with the given loader options.
+func (opts LoaderOptions) LoadCountry(in io.Reader) (*Blocks, LocationMap, error) {
+
+	var list []Block
+	numbering := newLocationNumbering()
+
+	type row struct {
+		low_ip, high_ip uint32
+		country string
+	}
+
+	pool := internPool{}
+	readRows("Country", opts, in, func(values []string) (row, bool) {
+
+		// Use only lines with 6 values
+		if len(values) != 6 {
+			return row{}, false
+		}
+		low_ip, err := strconv.ParseUint(values[2], 10, 32)
+		if err != nil {
+			return row{}, false
+		}
+		high_ip, err := strconv.ParseUint(values[3], 10, 32)
+		if err != nil {
+			return row{}, false
+		}
+		return row{ uint32(low_ip), uint32(high_ip), pool.intern(values[4]) }, true
+
+	}, func(r row) {
+		loc := Location{ Country: r.country, TimeZone: countryTimeZone(r.country) }
+		list = append(list, Block{ r.low_ip, r.high_ip, numbering.id(loc) })
+	})
+
+	loadNames()
+
+	return NewBlocks(list), numbering.locations, nil
+}
+
+
+// Download the GeoLite Country zip file in a given directory, created
+// if it does not exist, if the current one is older than DownloadMaxAge,
+// and extract the CSV file. When the download fails, after retries
+// (see DownloadRetries), the previous file is kept and extracted, even
+// stale, and the error is returned.
+func DownloadMaxmindCountryFileTo(dir string) error {
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log_geolocip.Err(fmt.Sprintf("Cannot create directory %s: %v", dir, err))
+		return err
+	}
+
+	// Error of a failed download, whose previous file is used
+	var stale_err error
+	zipfile := filepath.Join(dir, zipfile_country)
+	if err := downloadOrKeep(MaxmindCountryURL, "", zipfile, Credentials{}, &stale_err); err != nil {
+		return err
+	}
+
+	if extractArchiveFile(zipfile, file_country, filepath.Join(dir, file_country)) != nil {
+		return errors.New("Cannot extract Country file")
+	}
+
+	return stale_err
+}
+
+
+// Loads the GeoLite Country file as the locations and blocks of the
+// snapshot, after downloading it if requested, from its archive with
+// config.StreamArchives, and the ASN file if one is given
+func (data *snapshot) loadCountry(config Config, dir string) error {
+
+	var err error
+
+	if data.blocks == nil {
+		var locations LocationMap
+		if config.StreamArchives {
+			if config.Download {
+				var stale_err error
+				downloadOrKeep(MaxmindCountryURL, "", filepath.Join(dir, zipfile_country), Credentials{}, &stale_err)
+			}
+			zipfile := filepath.Join(dir, zipfile_country)
+			err = readArchive(zipfile, file_country, func(in io.Reader) (err error) {
+				data.blocks, locations, err = config.loaderOptions().LoadCountry(NewLatin1Reader(in))
+				return err
+			})
+			data.modified = fileModTime(zipfile)
+		} else {
+			if config.Download {
+				DownloadMaxmindCountryFileTo(dir)
+			}
+			country_file := orDefault(config.CountryFile, filepath.Join(dir, file_country))
+			data.blocks, locations, err = LoadCountryFile(country_file)
+			data.modified = fileModTime(country_file)
+		}
+		if err != nil {
+			log_geolocip.Err(fmt.Sprintf("Cannot load country file : %v", err))
+			return err
+		}
+		data.locations = locations
+	}
+	log_geolocip.Notice("Country file loaded")
+
+	return data.loadOptionalASN(config)
+}
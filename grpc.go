@@ -0,0 +1,383 @@
+
+package geoip
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+
+// This file provides the gRPC service described by geoip.proto, for
+// the internal services which prefer protobuf messages to the JSON of
+// the REST API. It is served over HTTP/2 without TLS (h2c, with prior
+// knowledge) by the net/http server, and the messages are encoded here,
+// so no gRPC library is needed. Compressed messages are not supported.
+
+
+// Full names of the methods of the GeoIP service
+const (
+	GRPC_LOOKUP_METHOD = "/geoip.GeoIP/Lookup"
+	GRPC_BATCH_LOOKUP_METHOD = "/geoip.GeoIP/BatchLookup"
+)
+
+
+// gRPC status codes of the responses
+const (
+	grpc_ok = 0
+	grpc_invalid_argument = 3
+	grpc_not_found = 5
+	grpc_permission_denied = 7
+	grpc_resource_exhausted = 8
+	grpc_unimplemented = 12
+	grpc_internal = 13
+	grpc_unavailable = 14
+	grpc_unauthenticated = 16
+)
+
+
+// Error of a protobuf message that cannot be decoded
+var errBadProtobuf = errors.New("Bad protobuf message")
+
+
+// A field of a protobuf message : its value for the varint and fixed
+// size wire types, or its data for the length-delimited one
+type protoField struct {
+	num int
+	wire int
+	value uint64
+	data []byte
+}
+
+
+// Returns the fields of a protobuf message, in their order
+func protoFields(message []byte) ([]protoField, error) {
+
+	var fields []protoField
+	for len(message) > 0 {
+		tag, n := binary.Uvarint(message)
+		if n <= 0 || tag >> 3 == 0 {
+			return nil, errBadProtobuf
+		}
+		message = message[n:]
+		field := protoField{ num: int(tag >> 3), wire: int(tag & 7) }
+		switch field.wire {
+		case 0 :
+			field.value, n = binary.Uvarint(message)
+			if n <= 0 {
+				return nil, errBadProtobuf
+			}
+			message = message[n:]
+		case 1 :
+			if len(message) < 8 {
+				return nil, errBadProtobuf
+			}
+			field.value, message = binary.LittleEndian.Uint64(message), message[8:]
+		case 2 :
+			length, n := binary.Uvarint(message)
+			if n <= 0 || uint64(len(message) - n) < length {
+				return nil, errBadProtobuf
+			}
+			field.data, message = message[n:n + int(length)], message[n + int(length):]
+		case 5 :
+			if len(message) < 4 {
+				return nil, errBadProtobuf
+			}
+			field.value, message = uint64(binary.LittleEndian.Uint32(message)), message[4:]
+		default :
+			return nil, errBadProtobuf
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+
+// Appends a string field to a protobuf message, if not empty
+func appendProtoString(message []byte, num int, value string) []byte {
+	if value == "" {
+		return message
+	}
+	message = binary.AppendUvarint(message, uint64(num) << 3 | 2)
+	message = binary.AppendUvarint(message, uint64(len(value)))
+	return append(message, value...)
+}
+
+
+// Appends a varint field to a protobuf message, if not 0 (negative
+// int32 values are given sign-extended, as encoded by protobuf)
+func appendProtoVarint(message []byte, num int, value uint64) []byte {
+	if value == 0 {
+		return message
+	}
+	message = binary.AppendUvarint(message, uint64(num) << 3)
+	return binary.AppendUvarint(message, value)
+}
+
+
+// Appends an optional bool field to a protobuf message, if set
+func appendProtoBool(message []byte, num int, value *bool) []byte {
+	if value == nil {
+		return message
+	}
+	message = binary.AppendUvarint(message, uint64(num) << 3)
+	if *value {
+		return append(message, 1)
+	}
+	return append(message, 0)
+}
+
+
+// Appends an optional double field to a protobuf message, if set
+func appendProtoDouble(message []byte, num int, value *float64) []byte {
+	if value == nil {
+		return message
+	}
+	message = binary.AppendUvarint(message, uint64(num) << 3 | 1)
+	return binary.LittleEndian.AppendUint64(message, math.Float64bits(*value))
+}
+
+
+// Returns the GeoLoc protobuf message of the JSON fields of a GeoLocIp,
+// see geoip.proto
+func encodeGeoLoc(fields GeoLocJSON) []byte {
+	var message []byte
+	message = appendProtoString(message, 1, fields.Ip)
+	message = appendProtoString(message, 2, fields.CountryCode)
+	message = appendProtoString(message, 3, fields.RegionCode)
+	message = appendProtoString(message, 4, fields.City)
+	message = appendProtoString(message, 5, fields.PostalCode)
+	message = appendProtoDouble(message, 6, fields.Latitude)
+	message = appendProtoDouble(message, 7, fields.Longitude)
+	message = appendProtoVarint(message, 8, uint64(int64(fields.MetroCode)))
+	message = appendProtoVarint(message, 9, uint64(int64(fields.AreaCode)))
+	message = appendProtoString(message, 10, fields.TimeZone)
+	message = appendProtoVarint(message, 11, uint64(fields.ASN))
+	message = appendProtoString(message, 12, fields.Organization)
+	message = appendProtoString(message, 13, fields.AS)
+	message = appendProtoString(message, 14, fields.Country)
+	message = appendProtoString(message, 15, fields.CountryEN)
+	message = appendProtoString(message, 16, fields.Region)
+	message = appendProtoString(message, 17, fields.ContinentCode)
+	message = appendProtoString(message, 18, fields.Continent)
+	message = appendProtoBool(message, 19, fields.IsInEuropeanUnion)
+	message = appendProtoBool(message, 20, fields.IsAnonymous)
+	message = appendProtoBool(message, 21, fields.IsTor)
+	message = appendProtoBool(message, 22, fields.IsVPN)
+	message = appendProtoBool(message, 23, fields.IsHosting)
+	message = appendProtoBool(message, 24, fields.IsProxy)
+	message = appendProtoString(message, 25, fields.CloudProvider)
+	message = appendProtoString(message, 26, fields.Source)
+	message = appendProtoString(message, 27, fields.Network)
+	message = appendProtoString(message, 29, fields.CallingCode)
+	message = appendProtoString(message, 30, fields.Currency)
+	message = appendProtoString(message, 31, fields.Loc)
+	return message
+}
+
+
+// Returns the BatchLookupResponse message of the results of a batch of
+// IP addresses, with a GeoLoc holding only the ip for the addresses
+// without information
+func encodeBatchLookupResponse(ips []string, results []*GeoLocIp, opts JSONOptions) []byte {
+	var response []byte
+	for i, gli := range results {
+		fields := GeoLocJSON{ Ip: ips[i] }
+		if gli != nil {
+			fields = gli.JSON(opts)
+		}
+		geoloc := encodeGeoLoc(fields)
+		response = binary.AppendUvarint(append(response, 1 << 3 | 2), uint64(len(geoloc)))
+		response = append(response, geoloc...)
+	}
+	return response
+}
+
+
+// Returns the IP addresses (field 1) and the language (field 2) of a
+// LookupRequest or BatchLookupRequest message
+func decodeLookupRequest(message []byte) ([]string, string, error) {
+	fields, err := protoFields(message)
+	if err != nil {
+		return nil, "", err
+	}
+	var ips []string
+	var language string
+	for _, field := range fields {
+		switch {
+		case field.num == 1 && field.wire == 2 :
+			ips = append(ips, string(field.data))
+		case field.num == 2 && field.wire == 2 :
+			language = string(field.data)
+		}
+	}
+	return ips, language, nil
+}
+
+
+// Returns the language of a lookup request, the one given in the
+// message if there are names in it, or else the one of its metadata
+func grpcLanguage(request *http.Request, language string) string {
+	if language != "" && NamesFor(language) != nil {
+		return language
+	}
+	return requestLanguage(request)
+}
+
+
+//  This serves the gRPC requests of the GeoIP service of geoip.proto,
+//  made over HTTP/2 : Lookup gives the geolocation of an IP address
+//  (or of the caller if none is given), and BatchLookup the ones of a
+//  list of at most MaxBatchSize addresses. The message fields are the
+//  ones of the JSON of the REST API. Like the REST API, it requires an
+//  API key if ValidateAPIKey is set, given in the authorization metadata
+//  ("Bearer <key>") and counted in its daily quota : the requests without
+//  key get an UNAUTHENTICATED status, the invalid keys PERMISSION_DENIED,
+//  and the requests beyond the quota RESOURCE_EXHAUSTED. It is served by
+//  NewGeoLocGRPCServer().
+func ServeGRPCRequest(writer http.ResponseWriter, request *http.Request) {
+
+	if request.Method != http.MethodPost || !strings.HasPrefix(request.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(writer, "gRPC only", http.StatusUnsupportedMediaType)
+		return
+	}
+	switch check := checkAPIKey(request, time.Now()); check.code {
+	case http.StatusUnauthorized :
+		writeGRPC(writer, nil, grpc_unauthenticated, check.message)
+		return
+	case http.StatusForbidden :
+		writeGRPC(writer, nil, grpc_permission_denied, check.message)
+		return
+	case http.StatusTooManyRequests :
+		writeGRPC(writer, nil, grpc_resource_exhausted, check.message)
+		return
+	}
+
+	// The request holds a single message, prefixed by its compression
+	// flag and its length. An IP address is less than 64 bytes.
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(request.Body, header); err != nil {
+		writeGRPC(writer, nil, grpc_invalid_argument, "missing message")
+		return
+	}
+	if header[0] != 0 {
+		writeGRPC(writer, nil, grpc_unimplemented, "compression not supported")
+		return
+	}
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > uint32(MaxBatchSize) * 64 + 1024 {
+		writeGRPC(writer, nil, grpc_resource_exhausted, "message too large")
+		return
+	}
+	message := make([]byte, length)
+	if _, err := io.ReadFull(request.Body, message); err != nil {
+		writeGRPC(writer, nil, grpc_invalid_argument, "truncated message")
+		return
+	}
+	ips, language, err := decodeLookupRequest(message)
+	if err != nil {
+		writeGRPC(writer, nil, grpc_invalid_argument, err.Error())
+		return
+	}
+	opts := JSONOptions{ Language: grpcLanguage(request, language) }
+
+	switch request.URL.Path {
+	case GRPC_LOOKUP_METHOD :
+		response, status, status_message := grpcLookup(request, ips, opts)
+		writeGRPC(writer, response, status, status_message)
+	case GRPC_BATCH_LOOKUP_METHOD :
+		if len(ips) > MaxBatchSize {
+			writeGRPC(writer, nil, grpc_resource_exhausted, fmt.Sprintf("More than %d IP addresses", MaxBatchSize))
+			return
+		}
+		writeGRPC(writer, encodeBatchLookupResponse(ips, lookupBatch(ips), opts), grpc_ok, "")
+	default :
+		writeGRPC(writer, nil, grpc_unimplemented, "unknown method")
+	}
+}
+
+
+// Returns the GeoLoc message of the address of a Lookup request, or
+// of the caller, with the gRPC status of the response and its message
+func grpcLookup(request *http.Request, ips []string, opts JSONOptions) ([]byte, int, string) {
+
+	var ip net.IP
+	if len(ips) == 0 || ips[len(ips) - 1] == "" {
+		ip = clientIP(request)
+	} else {
+		ip = net.ParseIP(ips[len(ips) - 1])
+	}
+	gli, err := apiLookup(ip)
+	switch {
+	case err == ErrInvalidIP :
+		return nil, grpc_invalid_argument, "invalid ip"
+	case err == err_loading :
+		return nil, grpc_unavailable, "database loading"
+	case err == ErrNotInitialized :
+		return nil, grpc_unavailable, "database not loaded"
+	case err == ErrNoBlock || gli == nil :
+		return nil, grpc_not_found, "not found"
+	case err != nil :
+		return nil, grpc_internal, err.Error()
+	}
+	return encodeGeoLoc(gli.JSON(opts)), grpc_ok, ""
+}
+
+
+// Writes a gRPC response, with its message if the status is OK, and
+// the status in the trailers
+func writeGRPC(writer http.ResponseWriter, message []byte, status int, status_message string) {
+	writer.Header().Set("Content-Type", "application/grpc")
+	writer.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	writer.WriteHeader(http.StatusOK)
+	if status == grpc_ok {
+		frame := make([]byte, 5, 5 + len(message))
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+		writer.Write(append(frame, message...))
+	}
+	writer.Header().Set("Grpc-Status", strconv.Itoa(status))
+	if status_message != "" {
+		writer.Header().Set("Grpc-Message", status_message)
+	}
+}
+
+
+// Returns an http server listening on the given address (for example
+// ":9002") and serving the gRPC service with ServeGRPCRequest(), over
+// HTTP/2 without TLS. Like NewGeoLocServer(), the server is not started.
+// The API keys are checked like by the REST API, but the requests are not
+// limited by RateLimitPerSecond nor MaxConcurrentRequests : without API
+// keys, the port should not be exposed to untrusted clients.
+func NewGeoLocGRPCServer(addr string) *http.Server {
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	return &http.Server{
+		Addr: addr,
+		Handler: http.HandlerFunc(ServeGRPCRequest),
+		Protocols: &protocols,
+		ReadTimeout: ServerReadTimeout,
+		WriteTimeout: ServerWriteTimeout,
+		IdleTimeout: ServerIdleTimeout,
+	}
+}
+
+
+// Starts a gRPC server on a local port whose number is given as
+// argument, see NewGeoLocGRPCServer(). The default DB is loaded while
+// the server starts, and reloaded on SIGHUP, like with ServeGeoLocAPI().
+func ServeGeoLocGRPC(port uint16) {
+	loaded := loadDefaultInBackground()
+	defer func() { <-loaded }()
+	ReloadOnSignal(reload_signals...)
+	srv := NewGeoLocGRPCServer(fmt.Sprintf(":%d", port))
+	if err := srv.ListenAndServe(); err != nil {
+		log_geolocip.Err(fmt.Sprintf("Cannot start gRPC server: %v", err))
+	}
+}
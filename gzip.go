@@ -0,0 +1,138 @@
+
+package geoip
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+
+// This file provides the gzip compression of the responses of the REST
+// API, for the clients sending an Accept-Encoding header : it matters for
+// the batch endpoint, returning thousands of records.
+
+
+// Responses smaller than this size (in bytes) are not compressed, as it
+// would hardly save anything
+const GZIP_MIN_SIZE = 1024
+
+
+// gzip writers reused by the responses
+var gzip_writers = sync.Pool{ New: func() any { return gzip.NewWriter(io.Discard) } }
+
+
+// Tells if a request accepts gzip compressed responses, in its
+// Accept-Encoding header, unless with a 0 quality, like "gzip;q=0"
+func acceptsGzip(request *http.Request) bool {
+	for _, value := range request.Header.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(value, ",") {
+			coding, params, _ := strings.Cut(coding, ";")
+			if coding = strings.TrimSpace(coding); coding != "gzip" && coding != "*" {
+				continue
+			}
+			if quality, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+				if q, err := strconv.ParseFloat(quality, 64); err == nil && q == 0 {
+					continue
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+
+// Buffers the start of a response, up to GZIP_MIN_SIZE, to decide if it
+// is compressed, and then compresses it while it is written
+type gzipWriter struct {
+	http.ResponseWriter
+	code int
+	buffer []byte
+	started bool
+	gz *gzip.Writer
+}
+
+func (w *gzipWriter) WriteHeader(code int) {
+	if !w.started {
+		w.code = code
+	}
+}
+
+func (w *gzipWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *gzipWriter) Write(data []byte) (int, error) {
+	switch {
+	case w.gz != nil :
+		return w.gz.Write(data)
+	case w.started :
+		return w.ResponseWriter.Write(data)
+	}
+	w.buffer = append(w.buffer, data...)
+	if len(w.buffer) >= GZIP_MIN_SIZE {
+		if err := w.start(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
+
+
+// Writes the status code and the buffered start of the response, to be
+// compressed if asked and it is not encoded already
+func (w *gzipWriter) start(compress bool) error {
+	w.started = true
+	header := w.Header()
+	if compress && header.Get("Content-Encoding") == "" {
+		header.Set("Content-Encoding", "gzip")
+		header.Del("Content-Length")
+		w.gz = gzip_writers.Get().(*gzip.Writer)
+		w.gz.Reset(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(w.code)
+	var err error
+	if w.gz != nil {
+		_, err = w.gz.Write(w.buffer)
+	} else {
+		_, err = w.ResponseWriter.Write(w.buffer)
+	}
+	w.buffer = nil
+	return err
+}
+
+
+// Ends the response : writes it uncompressed if it is smaller than
+// GZIP_MIN_SIZE, or else the end of its compressed stream
+func (w *gzipWriter) close() {
+	if !w.started {
+		w.start(false)
+	}
+	if w.gz != nil {
+		w.gz.Close()
+		gzip_writers.Put(w.gz)
+		w.gz = nil
+	}
+}
+
+
+// Returns a handler compressing the responses of next with gzip, for the
+// requests accepting it in their Accept-Encoding header, if they are at
+// least GZIP_MIN_SIZE bytes long. Handler() serves the REST API with it.
+func Gzip(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+
+		writer.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(request) {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		compressed := &gzipWriter{ ResponseWriter: writer, code: http.StatusOK }
+		defer compressed.close()
+		next.ServeHTTP(compressed, request)
+	})
+}
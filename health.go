@@ -0,0 +1,57 @@
+
+package geoip
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+
+// This file provides the health and readiness endpoints of the REST
+// API, served under /healthz and /readyz by NewGeoLocServer().
+
+
+// Maximum age of the loaded data files for /readyz to report the API
+// as ready. No limit if 0.
+var MaxReadyAge = 30 * 24 * time.Hour
+
+
+// Tells why the data of the snapshot cannot serve lookups yet : not
+// loaded, or older than max_age (if not 0). Returns nil when they can.
+func (data *snapshot) ready(max_age time.Duration) error {
+	if data.locator == nil && (data.locations == nil || data.blocks == nil || data.asn_tree == nil) {
+		return ErrNotInitialized
+	}
+	if max_age > 0 && !data.modified.IsZero() {
+		if age := time.Since(data.modified); age > max_age {
+			return fmt.Errorf("Data files are %v old, more than %v", age.Round(time.Second), max_age)
+		}
+	}
+	return nil
+}
+
+
+//  This answers "ok" as long as the process is alive, whatever the state
+//  of the data. It is served under /healthz by NewGeoLocServer().
+func ServeHealthHttpRequest(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	writer.Write([]byte("ok\n"))
+}
+
+
+//  This answers "ok" once the default DB is loaded, and its data files
+//  are not older than MaxReadyAge. Otherwise, it answers with a 503
+//  status code and the reason. It does not wait for the DB to be loaded,
+//  nor starts loading it : ServeGeoLocAPI() does it in the background,
+//  and users of NewGeoLocServer(), where it is served under /readyz, can
+//  call Reload() in a goroutine.
+func ServeReadyHttpRequest(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err := default_db.snapshot().ready(MaxReadyAge); err != nil {
+		writer.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(writer, "%v\n", err)
+		return
+	}
+	writer.Write([]byte("ok\n"))
+}
@@ -0,0 +1,403 @@
+
+package geoip
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"runtime"
+	"sort"
+	"time"
+)
+
+
+// This file provides an on-disk lookup mode for memory-constrained
+// deployments : the locations, blocks and ASN are written once in an
+// index file (see DB.WriteIndexFile()), which is then memory-mapped
+// (see OpenIndex() and Config.IndexFile), and searched by dichotomy
+// in the mapping, without loading anything in the Go heap. The pages
+// of the file are loaded by the OS when needed, and shared by all the
+// processes using the same file.
+//
+// The index file holds, with little endian integers :
+// 	a header : INDEX_MAGIC, the number of blocks, ASN and locations,
+// 	  the size of the strings and the modification time of the data
+// 	the blocks sorted by IP : low IP, high IP and location id
+// 	the ASN sorted by IP : low IP, high IP and offset of the ASN string
+// 	the locations sorted by id : id, offsets of the country, region,
+// 	  city, postal code and time zone, latitude, longitude, metro code
+// 	  and area code
+// 	the strings, each one with its length as an uvarint
+
+
+// Magic bytes at the start of an index file, changed with its format
+const INDEX_MAGIC = "GEOIPIX1"
+
+
+// Size of the header, and of the records of an index file
+const (
+	index_header_size = 8 + 4 * 4 + 8
+	index_block_size = 3 * 4
+	index_asn_size = 3 * 4
+	index_location_size = 6 * 4 + 2 * 8 + 2 * 4
+)
+
+
+// Error returned when a file is not a valid index file
+var ErrBadIndex = errors.New("Not a valid geoip index file")
+
+
+// An Index holds a memory-mapped index file. It implements the Locator
+// interface, for the IPv4 lookups : use it with Config.IndexFile, or
+// SetLocator(). It can be used by several goroutines at once.
+type Index struct {
+	data []byte		// the whole mapping
+	blocks []byte
+	asns []byte
+	locations []byte
+	string_data []byte
+	modified time.Time
+	language string
+}
+
+
+// Writes the locations, blocks and ASN of the default DB as an index
+// file, see DB.WriteIndex().
+func WriteIndex(out io.Writer) error {
+	return defaultDB().WriteIndex(out)
+}
+
+
+// Writes the locations, blocks and ASN of the DB, loaded from the CSV
+// files, as an index file to be used by OpenIndex(). ErrNotInitialized
+// is returned if the DB has no such data, like when it uses GeoLite2
+// databases.
+func (db *DB) WriteIndex(out io.Writer) error {
+
+	data := db.snapshot()
+	if data.locations == nil || data.blocks == nil || data.asn_tree == nil {
+		return ErrNotInitialized
+	}
+
+	var loc_ids []uint32
+	var locations []Location
+	switch table := data.locations.(type) {
+	case LocationSlice :
+		for loc_id, loc := range table {
+			if loc != (Location{}) {
+				loc_ids = append(loc_ids, uint32(loc_id))
+				locations = append(locations, loc)
+			}
+		}
+	case LocationMap :
+		for loc_id := range table {
+			loc_ids = append(loc_ids, loc_id)
+		}
+		sort.Slice(loc_ids, func(i, j int) bool { return loc_ids[i] < loc_ids[j] })
+		for _, loc_id := range loc_ids {
+			locations = append(locations, table[loc_id])
+		}
+	default :
+		return errors.New("Index of custom locations not supported")
+	}
+
+	// The strings are written once, the empty one first at offset 0
+	var string_data []byte
+	offsets := map[string]uint32{}
+	offset := func(s string) uint32 {
+		if o, ok := offsets[s]; ok {
+			return o
+		}
+		o := uint32(len(string_data))
+		offsets[s] = o
+		string_data = binary.AppendUvarint(string_data, uint64(len(s)))
+		string_data = append(string_data, s...)
+		return o
+	}
+	offset("")
+
+	w := bufio.NewWriter(out)
+	record := make([]byte, index_location_size)
+	le := binary.LittleEndian
+
+	var asn_records []byte
+	for _, asn := range *data.asn_tree {
+		asn_records = le.AppendUint32(asn_records, asn.LowIP)
+		asn_records = le.AppendUint32(asn_records, asn.HighIP)
+		asn_records = le.AppendUint32(asn_records, offset(asn.ASN))
+	}
+	var location_records []byte
+	for i, loc := range locations {
+		le.PutUint32(record[0:], loc_ids[i])
+		le.PutUint32(record[4:], offset(loc.Country))
+		le.PutUint32(record[8:], offset(loc.Region))
+		le.PutUint32(record[12:], offset(loc.City))
+		le.PutUint32(record[16:], offset(loc.PostalCode))
+		le.PutUint32(record[20:], offset(loc.TimeZone))
+		le.PutUint64(record[24:], math.Float64bits(loc.Latitude))
+		le.PutUint64(record[32:], math.Float64bits(loc.Longitude))
+		le.PutUint32(record[40:], uint32(int32(loc.MetroCode)))
+		le.PutUint32(record[44:], uint32(int32(loc.AreaCode)))
+		location_records = append(location_records, record...)
+	}
+
+	header := []byte(INDEX_MAGIC)
+	header = le.AppendUint32(header, uint32(len(*data.blocks)))
+	header = le.AppendUint32(header, uint32(len(*data.asn_tree)))
+	header = le.AppendUint32(header, uint32(len(locations)))
+	header = le.AppendUint32(header, uint32(len(string_data)))
+	var modified int64
+	if !data.modified.IsZero() {
+		modified = data.modified.UnixNano()
+	}
+	header = le.AppendUint64(header, uint64(modified))
+	w.Write(header)
+
+	for _, block := range *data.blocks {
+		le.PutUint32(record[0:], block.LowIP)
+		le.PutUint32(record[4:], block.HighIP)
+		le.PutUint32(record[8:], block.LocId)
+		w.Write(record[:index_block_size])
+	}
+	w.Write(asn_records)
+	w.Write(location_records)
+	w.Write(string_data)
+
+	if err := w.Flush(); err != nil {
+		log_geolocip.Err(fmt.Sprintf("Cannot write index: %v", err))
+		return err
+	}
+	return nil
+}
+
+
+// Writes an index file of the DB, replaced only once fully written,
+// see DB.WriteIndex().
+func (db *DB) WriteIndexFile(filename string) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(db.WriteIndex(pw))
+	}()
+	err := writeFileAtomic(filename, pr, nil)
+	pr.Close()
+	return err
+}
+
+
+// Opens an index file written by DB.WriteIndexFile(), memory-mapped
+// (or read in memory on the systems without mmap). It is unmapped by
+// Close(), or else once it is not used anymore.
+func OpenIndex(filename string) (*Index, error) {
+
+	file, err := os.Open(filename)
+	if err != nil {
+		log_geolocip.Err(fmt.Sprintf("Index error open file: %v", err))
+		return nil, err
+	}
+	defer file.Close()
+
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() < index_header_size || fi.Size() > math.MaxInt32 {
+		log_geolocip.Err(fmt.Sprintf("Index %s: bad size %d", filename, fi.Size()))
+		return nil, ErrBadIndex
+	}
+
+	data, err := mapFile(file, int(fi.Size()))
+	if err != nil {
+		log_geolocip.Err(fmt.Sprintf("Cannot map index %s: %v", filename, err))
+		return nil, err
+	}
+
+	ix, err := newIndex(data)
+	if err != nil {
+		unmapFile(data)
+		log_geolocip.Err(fmt.Sprintf("Index %s: %v", filename, err))
+		return nil, err
+	}
+	runtime.SetFinalizer(ix, (*Index).Close)
+	return ix, nil
+}
+
+
+// Returns the Index of the content of an index file, checking its size
+func newIndex(data []byte) (*Index, error) {
+
+	le := binary.LittleEndian
+	if string(data[:len(INDEX_MAGIC)]) != INDEX_MAGIC {
+		return nil, ErrBadIndex
+	}
+	header := data[len(INDEX_MAGIC):]
+	n_blocks, n_asns, n_locations := int64(le.Uint32(header)), int64(le.Uint32(header[4:])), int64(le.Uint32(header[8:]))
+	strings_size := int64(le.Uint32(header[12:]))
+
+	ix := &Index{ data: data }
+	if modified := int64(le.Uint64(header[16:])); modified != 0 {
+		ix.modified = time.Unix(0, modified)
+	}
+	start := int64(index_header_size)
+	section := func(size int64) []byte {
+		if start + size > int64(len(data)) {
+			return nil
+		}
+		start += size
+		return data[start - size:start:start]
+	}
+	ix.blocks = section(n_blocks * index_block_size)
+	ix.asns = section(n_asns * index_asn_size)
+	ix.locations = section(n_locations * index_location_size)
+	ix.string_data = section(strings_size)
+	if ix.blocks == nil || ix.asns == nil || ix.locations == nil || ix.string_data == nil || start != int64(len(data)) {
+		return nil, ErrBadIndex
+	}
+	return ix, nil
+}
+
+
+// Unmaps the index file. The Index must not be used anymore.
+func (ix *Index) Close() error {
+	runtime.SetFinalizer(ix, nil)
+	data := ix.data
+	*ix = Index{}
+	return unmapFile(data)
+}
+
+
+// Returns the modification time of the data of the index
+func (ix *Index) Modified() time.Time {
+	return ix.modified
+}
+
+
+// Returns the string at a given offset of the strings section, copied
+// out of the mapping, or "" if the offset is not valid
+func (ix *Index) getString(offset uint32) string {
+	if int64(offset) >= int64(len(ix.string_data)) {
+		return ""
+	}
+	length, n := binary.Uvarint(ix.string_data[offset:])
+	if n <= 0 || uint64(len(ix.string_data) - int(offset) - n) < length {
+		return ""
+	}
+	start := int(offset) + n
+	return string(ix.string_data[start:start + int(length)])
+}
+
+
+// Returns the record of a section of fixed size records whose range
+// (its 2 first values) holds a given address, or nil
+func searchRange(section []byte, size int, addr uint32) []byte {
+	le := binary.LittleEndian
+	n := len(section) / size
+	i := sort.Search(n, func(i int) bool { return le.Uint32(section[i * size + 4:]) >= addr })
+	if i < n && le.Uint32(section[i * size:]) <= addr {
+		return section[i * size:(i + 1) * size]
+	}
+	return nil
+}
+
+
+// Returns the block of the index matching a given IPv4 address, or nil
+func (ix *Index) block(addr uint32) *Block {
+	defer runtime.KeepAlive(ix)
+	if record := searchRange(ix.blocks, index_block_size, addr); record != nil {
+		le := binary.LittleEndian
+		return &Block{ le.Uint32(record), le.Uint32(record[4:]), le.Uint32(record[8:]) }
+	}
+	return nil
+}
+
+
+// Returns the ASN of the index matching a given IPv4 address, or nil
+func (ix *Index) asn(addr uint32) *ASN {
+	defer runtime.KeepAlive(ix)
+	if record := searchRange(ix.asns, index_asn_size, addr); record != nil {
+		le := binary.LittleEndian
+		asn := NewASN(le.Uint32(record), le.Uint32(record[4:]), ix.getString(le.Uint32(record[8:])))
+		return &asn
+	}
+	return nil
+}
+
+
+// Returns the location of the index with a given id, or nil
+func (ix *Index) location(loc_id uint32) *Location {
+	defer runtime.KeepAlive(ix)
+	le := binary.LittleEndian
+	n := len(ix.locations) / index_location_size
+	i := sort.Search(n, func(i int) bool { return le.Uint32(ix.locations[i * index_location_size:]) >= loc_id })
+	if i == n {
+		return nil
+	}
+	record := ix.locations[i * index_location_size:(i + 1) * index_location_size]
+	if le.Uint32(record) != loc_id {
+		return nil
+	}
+	return &Location {
+		Country: ix.getString(le.Uint32(record[4:])),
+		Region: ix.getString(le.Uint32(record[8:])),
+		City: ix.getString(le.Uint32(record[12:])),
+		PostalCode: ix.getString(le.Uint32(record[16:])),
+		TimeZone: ix.getString(le.Uint32(record[20:])),
+		Latitude: math.Float64frombits(le.Uint64(record[24:])),
+		Longitude: math.Float64frombits(le.Uint64(record[32:])),
+		MetroCode: int(int32(le.Uint32(record[40:]))),
+		AreaCode: int(int32(le.Uint32(record[44:]))),
+	}
+}
+
+
+// Returns the geolocation information for a given IPv4 address, like
+// the GeoLocIPv4E() function, with the names in the language of the
+// DB which opened the index.
+func (ix *Index) GeoLocIPv4E(ip net.IP) (*GeoLocIp, error) {
+
+	if ip.To4() == nil {
+		return nil, ErrInvalidIP
+	}
+	ip = ip.To16()
+	addr := ipv4ToUint32(ip)
+
+	block := ix.block(addr)
+	if block == nil {
+		return nil, ErrNoBlock
+	}
+
+	var country, region string
+	location := ix.location(block.LocId)
+	if location != nil {
+		names := namesOrDefault(ix.language)
+		country = names.CountryName(location.Country)
+		region = names.RegionName(location.Country, location.Region)
+	}
+
+	return &GeoLocIp{ Ip: ip, Block: block, Location: location, Asn: ix.asn(addr), CountryName: &country, RegionName: &region }, nil
+}
+
+
+// Opens the index file given in config, used as the Locator of the
+// snapshot unless one is already set
+func (data *snapshot) loadIndex(config Config) error {
+
+	ix, err := OpenIndex(config.IndexFile)
+	if err != nil {
+		log_geolocip.Err(fmt.Sprintf("Cannot open index file : %v", err))
+		return err
+	}
+	ix.language = config.Language
+	data.index = ix
+	data.modified = ix.modified
+	if data.locator == nil {
+		data.locator = ix
+	}
+	log_geolocip.Notice("Index file mapped")
+
+	return nil
+}
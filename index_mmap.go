@@ -0,0 +1,23 @@
+//go:build unix
+
+package geoip
+
+import (
+	"os"
+	"syscall"
+)
+
+
+// Maps a file of a given size in memory, read-only
+func mapFile(file *os.File, size int) ([]byte, error) {
+	return syscall.Mmap(int(file.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+
+// Unmaps a file mapped by mapFile()
+func unmapFile(data []byte) error {
+	if data == nil {
+		return nil
+	}
+	return syscall.Munmap(data)
+}
@@ -0,0 +1,24 @@
+//go:build !unix
+
+package geoip
+
+import (
+	"io"
+	"os"
+)
+
+
+// Reads a file of a given size in memory, on the systems without mmap
+func mapFile(file *os.File, size int) ([]byte, error) {
+	data := make([]byte, size)
+	if _, err := io.ReadFull(file, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+
+// Releases a file read by mapFile()
+func unmapFile(data []byte) error {
+	return nil
+}
@@ -0,0 +1,226 @@
+
+package geoip
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+	"unsafe"
+
+	"github.com/google/btree"
+)
+
+
+// A file loaded by a DB, see DBInfo
+type DatasetFile struct {
+	Path string		// in Config.FS if set
+	URL string		// downloaded from, if Config.Download is set
+	Modified time.Time
+	Size int64
+}
+
+
+// Metadata of the data loaded by a DB, returned by DatabaseInfo(),
+// for applications to report them in their own health checks
+type DBInfo struct {
+
+	// Files loaded, by dataset : locations, blocks, asn, blocks6 and asn6
+	// for the MaxMind CSV files, city and asn for the GeoLite2 databases,
+	// country, ip2location, or index for an index file
+	Files map[string]DatasetFile
+
+	// Number of records of each dataset, see ServeStatusHttpRequest()
+	Records map[string]int
+
+	// Modification time of the blocks file (or GeoLite2 City database),
+	// and build dates of the GeoLite2 databases, by database type
+	Modified time.Time
+	BuildDates map[string]time.Time
+
+	// Estimated memory used by the data, in bytes, including the GeoLite2
+	// databases and the index file, mapped in memory
+	MemoryBytes int64
+
+	// When the data were loaded, and how long it took
+	Loaded time.Time
+	LoadDuration time.Duration
+}
+
+
+// Returns the metadata of the data of the default DB, see DB.DatabaseInfo().
+func DatabaseInfo() DBInfo {
+	return defaultDB().DatabaseInfo()
+}
+
+
+// Returns the metadata of the data of the DB : the files loaded, with
+// their modification time and size, the number of records of each dataset
+// and an estimate of the memory they use. Data set by SetLocations() and
+// the like have no file.
+func (db *DB) DatabaseInfo() DBInfo {
+
+	db.mu.Lock()
+	config := db.config
+	db.mu.Unlock()
+	data := db.snapshot()
+
+	info := DBInfo{
+		Records: data.recordCounts(),
+		Modified: data.modified,
+		Loaded: data.loaded,
+		LoadDuration: data.load_duration,
+	}
+	if data.geolite2 != nil {
+		info.BuildDates = data.geolite2.buildDates()
+	}
+	if data.loaded.IsZero() {
+		return info
+	}
+
+	info.Files = data.files(config)
+	for dataset, file := range info.Files {
+		var stat fs.FileInfo
+		var err error
+		if config.FS != nil {
+			stat, err = fs.Stat(config.FS, file.Path)
+		} else {
+			stat, err = os.Stat(file.Path)
+		}
+		if err == nil {
+			file.Modified, file.Size = stat.ModTime(), stat.Size()
+			info.Files[dataset] = file
+		}
+	}
+
+	info.MemoryBytes = data.memoryEstimate()
+	// Mapped in memory, or read in it from config.FS
+	if data.geolite2 != nil {
+		info.MemoryBytes += info.Files["city"].Size + info.Files["asn"].Size
+	}
+	if data.index != nil {
+		info.MemoryBytes += int64(len(data.index.data))
+	}
+	return info
+}
+
+
+// Returns the files the data of the snapshot are loaded from, by dataset
+// (see DBInfo.Files), with the URLs they are downloaded from if
+// config.Download is set, following the choices of load()
+func (data *snapshot) files(config Config) map[string]DatasetFile {
+
+	if data.index != nil {
+		return map[string]DatasetFile{ "index": { Path: config.IndexFile } }
+	}
+	dir := orDefault(config.Dir, DefaultDataDir())
+	join := filepath.Join
+	if config.FS != nil {
+		// Nothing is downloaded, see loadFS()
+		dir = orDefault(config.Dir, ".")
+		join = path.Join
+		config.Download = false
+	}
+	file := func(url string, file string, default_file string) DatasetFile {
+		dataset_file := DatasetFile{ Path: orDefault(file, join(dir, default_file)) }
+		if config.Download {
+			dataset_file.URL = url
+		}
+		return dataset_file
+	}
+
+	files := make(map[string]DatasetFile)
+	switch {
+	case data.geolite2 != nil :
+		city := edition_city
+		if config.CountryOnly {
+			city = edition_country
+		}
+		files["city"] = file(fmt.Sprintf(GeoLite2URL, city), "", city + ".mmdb")
+		if data.geolite2.asn != nil {
+			files["asn"] = file(fmt.Sprintf(GeoLite2URL, edition_asn), "", edition_asn + ".mmdb")
+		}
+		return files
+	case config.IP2LocationFile != "" :
+		files["ip2location"] = DatasetFile{ Path: config.IP2LocationFile }
+	case config.CountryOnly && config.StreamArchives :
+		files["country"] = file(MaxmindCountryURL, "", zipfile_country)
+	case config.CountryOnly :
+		files["country"] = file(MaxmindCountryURL, config.CountryFile, file_country)
+	case config.ASNOnly :
+	case config.StreamArchives :
+		files["locations"] = file(MaxmindCityURL, "", zipfile_city)
+		files["blocks"] = files["locations"]
+	default :
+		files["locations"] = file(MaxmindCityURL, config.LocationsFile, file_location)
+		files["blocks"] = file(MaxmindCityURL, config.BlocksFile, file_blocks)
+	}
+	if data.blocks6 != nil && config.StreamArchives {
+		files["blocks6"] = file(MaxmindCity6URL, "", gzfile_city6)
+	} else if data.blocks6 != nil {
+		files["blocks6"] = file(MaxmindCity6URL, config.Blocks6File, file_city6)
+	}
+	if data.asn_tree != nil && config.StreamArchives {
+		files["asn"] = file(MaxmindASNURL, "", zipfile_asn)
+	} else if data.asn_tree != nil {
+		files["asn"] = file(MaxmindASNURL, config.ASNFile, file_asn)
+	}
+	if data.asn6_tree != nil && config.StreamArchives {
+		files["asn6"] = file(MaxmindASN6URL, "", zipfile_asn6)
+	} else if data.asn6_tree != nil {
+		files["asn6"] = file(MaxmindASN6URL, config.ASN6File, file_asn6)
+	}
+	return files
+}
+
+
+// Size of an item in the nodes of a btree, not counting the value it
+// points to
+const btree_item_size = unsafe.Sizeof(btree.Item(nil))
+
+
+// Returns an estimate of the memory used by the records of the snapshot,
+// in bytes, counting the strings as if none of them were shared, except
+// the ones of the IPv6 blocks, interned when they are loaded
+func (data *snapshot) memoryEstimate() int64 {
+
+	var size uintptr
+	location := func(location *Location) {
+		size += unsafe.Sizeof(*location) + uintptr(len(location.Country) + len(location.Region) + len(location.City) + len(location.PostalCode) + len(location.TimeZone))
+	}
+	switch locations := data.locations.(type) {
+	case LocationSlice :
+		for i := range locations {
+			location(&locations[i])
+		}
+	case LocationMap :
+		for _, value := range locations {
+			location(&value)
+			size += unsafe.Sizeof(uint32(0))
+		}
+	}
+	if data.blocks != nil {
+		size += uintptr(data.blocks.Len()) * unsafe.Sizeof(Block{})
+	}
+	if data.asn_tree != nil {
+		for _, asn := range *data.asn_tree {
+			size += unsafe.Sizeof(asn) + uintptr(len(asn.ASN) + len(asn.Organization))
+		}
+	}
+	if data.blocks6 != nil {
+		(*btree.BTree)(data.blocks6).Ascend(func(item btree.Item) bool {
+			size += btree_item_size + unsafe.Sizeof(item.(Block6))
+			return true
+		})
+	}
+	if data.asn6_tree != nil {
+		(*btree.BTree)(data.asn6_tree).Ascend(func(item btree.Item) bool {
+			asn := item.(ASN6)
+			size += btree_item_size + unsafe.Sizeof(asn) + uintptr(len(asn.ASN))
+			return true
+		})
+	}
+	return int64(size)
+}
@@ -0,0 +1,132 @@
+
+package geoip
+
+import (
+	"fmt"
+	"os"
+	"io"
+	"strconv"
+)
+
+
+// This file provides functions to load the IP2Location LITE DB11 CSV
+// files from IP2Location.com (IP2LOCATION-LITE-DB11.CSV), as the same
+// Blocks and Locations as the MaxMind files. Each line holds a range
+// of addresses with its location :
+// 	"16777216","16777471","US","United States of America","California","Los Angeles","34.052230","-118.243680","90001","-07:00"
+
+
+// Offset of the IPv4-mapped IPv6 addresses (::ffff:0.0.0.0), whose
+// ranges hold the IPv4 addresses in the IPv6 DB11 file
+const ip2location_ipv4_mapped = 0xFFFF00000000
+
+
+// Read an IP2Location LITE DB11 CSV file in memory, as Blocks and
+// the Locations they refer to, like the MaxMind blocks and locations
+// files. Only the IPv4 addresses are loaded, from the IPv4 or the IPv6
+// file.
+func LoadIP2LocationFile(filename string) (*Blocks, LocationMap, error) {
+	return LoaderOptions{}.LoadIP2LocationFile(filename)
+}
+
+
+// Same as the LoadIP2LocationFile() function, with the given loader options.
+func (opts LoaderOptions) LoadIP2LocationFile(filename string) (*Blocks, LocationMap, error) {
+
+	file, err := os.Open(filename)
+	if err != nil {
+		log_geolocip.Err(fmt.Sprintf("IP2Location error open file: %v", err))
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	return opts.LoadIP2Location(file)
+}
+
+
+// Read IP2Location LITE DB11 CSV lines from an io.Reader in memory,
+// like LoadIP2LocationFile(). The content is utf-8. Lines without 10
+// values, or with the "-" country of unallocated ranges, are skipped.
+func LoadIP2Location(in io.Reader) (*Blocks, LocationMap, error) {
+	return LoaderOptions{}.LoadIP2Location(in)
+}
+
+
+// Same as the LoadIP2Location() function, with the given loader options.
+func (opts LoaderOptions) LoadIP2Location(in io.Reader) (*Blocks, LocationMap, error) {
+
+	var list []Block
+	numbering := newLocationNumbering()
+
+	r := opts.newCSVReader(in)
+	skipped := 0
+	pool := internPool{}
+
+	for {
+
+		values, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log_geolocip.Err(fmt.Sprintf("IP2Location error reading file: %v", err))
+			break
+		}
+		if tooManyFields(values, &skipped) {
+			continue
+		}
+
+		// Use only lines with 10 values
+		if len(values) != 10 || values[2] == "-" {
+			continue
+		}
+		low_ip, ok := parseIP2LocationIP(values[0])
+		if !ok {
+			continue
+		}
+		high_ip, ok := parseIP2LocationIP(values[1])
+		if !ok {
+			continue
+		}
+
+		// The time zone of the file is an UTC offset, like "-07:00",
+		// so the one of the country is used, like with the MaxMind files
+		loc := Location {
+			Country: pool.intern(values[2]),
+			Region: pool.intern(RegionCode(values[2], values[4])),
+			City: pool.intern(values[5]),
+			PostalCode: pool.intern(values[8]),
+			Latitude: parseCoordinate(values[6], 90),
+			Longitude: parseCoordinate(values[7], 180),
+			TimeZone: countryTimeZone(values[2]),
+		}
+		if loc.PostalCode == "-" || opts.SkipPostalFields {
+			loc.PostalCode = ""
+		}
+
+		list = append(list, Block{ low_ip, high_ip, numbering.id(loc) })
+	}
+
+	logTooManyFields("IP2Location", skipped)
+
+	loadNames()
+
+	return NewBlocks(list), numbering.locations, nil
+}
+
+
+// Returns an IPv4 address of an IP2Location file, given as a number,
+// from the IPv4 file or as an IPv4-mapped address of the IPv6 file
+func parseIP2LocationIP(value string) (uint32, bool) {
+	ip, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	if ip >= ip2location_ipv4_mapped && ip - ip2location_ipv4_mapped <= 0xFFFFFFFF {
+		ip -= ip2location_ipv4_mapped
+	}
+	if ip > 0xFFFFFFFF {
+		return 0, false
+	}
+	return uint32(ip), true
+}
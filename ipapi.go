@@ -0,0 +1,193 @@
+
+package geoip
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+
+// This file provides the output format of ip-api.com, so its users can
+// migrate to the REST API : under /json/{ip}, or with the format=ip-api
+// parameter of the other lookup endpoints.
+
+
+// The JSON encoding of a GeoLocIp by ip-api.com, with all the fields it
+// has, in its order. The selected ones are returned, see ipAPIFields().
+type ipAPIJSON struct {
+	Status string `json:"status"`
+	Message string `json:"message"`
+	Continent string `json:"continent"`
+	ContinentCode string `json:"continentCode"`
+	Country string `json:"country"`
+	CountryCode string `json:"countryCode"`
+	Region string `json:"region"`
+	RegionName string `json:"regionName"`
+	City string `json:"city"`
+	Zip string `json:"zip"`
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+	Timezone string `json:"timezone"`
+	Offset int `json:"offset"`
+	Currency string `json:"currency"`
+	ISP string `json:"isp"`
+	Org string `json:"org"`
+	AS string `json:"as"`
+	Proxy bool `json:"proxy"`
+	Hosting bool `json:"hosting"`
+	Query string `json:"query"`
+}
+
+
+// Fields of ip-api.com, in the order of its JSON, with their value in
+// the numeric form of its fields parameter. The ones it has and not the
+// REST API (district, mobile, asname and reverse) are left out.
+var ip_api_fields = []struct {
+	name string
+	value uint64
+}{
+	{ "status", 16384 }, { "message", 32768 }, { "continent", 1048576 }, { "continentCode", 2097152 },
+	{ "country", 1 }, { "countryCode", 2 }, { "region", 4 }, { "regionName", 8 }, { "city", 16 },
+	{ "zip", 32 }, { "lat", 64 }, { "lon", 128 }, { "timezone", 256 }, { "offset", 33554432 },
+	{ "currency", 8388608 }, { "isp", 512 }, { "org", 1024 }, { "as", 2048 }, { "proxy", 131072 },
+	{ "hosting", 16777216 }, { "query", 8192 },
+}
+
+
+// Fields returned by ip-api.com when none are selected
+const ip_api_default_fields = "status,message,country,countryCode,region,regionName,city,zip,lat,lon,timezone,isp,org,as,query"
+
+
+// Returns the fields selected by the fields parameter of a request,
+// like ip-api.com : a list of names ("?fields=status,country,query"), or
+// the sum of their values ("?fields=16387"), in the order of ip_api_fields
+func ipAPIFields(request *http.Request) []string {
+
+	selected := make(map[string]bool)
+	param := orDefault(request.URL.Query().Get("fields"), ip_api_default_fields)
+	if value, err := strconv.ParseUint(param, 10, 64); err == nil {
+		for _, field := range ip_api_fields {
+			selected[field.name] = value & field.value != 0
+		}
+	} else {
+		for _, name := range strings.Split(param, ",") {
+			selected[strings.TrimSpace(name)] = true
+		}
+	}
+
+	var fields []string
+	for _, field := range ip_api_fields {
+		if selected[field.name] {
+			fields = append(fields, field.name)
+		}
+	}
+	return fields
+}
+
+
+// Returns the ip-api.com encoding of the GeoLocIp, with the names in a
+// given language, English if empty. The offset is the current offset of
+// its time zone from UTC in seconds, if the time zone database is available.
+func (gli *GeoLocIp) ipAPIJSON(language string) ipAPIJSON {
+
+	fields := gli.JSON(JSONOptions{ Language: orDefault(language, "en") })
+	ip_api := ipAPIJSON{
+		Status: "success",
+		Continent: fields.Continent,
+		ContinentCode: fields.ContinentCode,
+		Country: fields.Country,
+		CountryCode: fields.CountryCode,
+		Region: fields.RegionCode,
+		RegionName: fields.Region,
+		City: fields.City,
+		Zip: fields.PostalCode,
+		Timezone: fields.TimeZone,
+		ISP: fields.Organization,
+		Org: fields.Organization,
+		AS: fields.AS,
+		Query: fields.Ip,
+	}
+	if fields.Latitude != nil && fields.Longitude != nil {
+		ip_api.Lat, ip_api.Lon = *fields.Latitude, *fields.Longitude
+	}
+	if location, err := time.LoadLocation(fields.TimeZone); fields.TimeZone != "" && err == nil {
+		_, ip_api.Offset = time.Now().In(location).Zone()
+	}
+	ip_api.Currency, _ = CountryCurrency(fields.CountryCode)
+	if anonymity := gli.Anonymity; anonymity != nil {
+		ip_api.Proxy, ip_api.Hosting = anonymity.IsProxy || anonymity.IsVPN || anonymity.IsTor, anonymity.IsHosting
+	}
+	return ip_api
+}
+
+
+//  This serves the geolocation of the IP address given in the URL path
+//  after /json/, or of the caller, like ip-api.com, with its field names,
+//  like :
+//  	{"status":"success","country":"United States","countryCode":"US",
+//  	"region":"VA","regionName":"Virginia","city":"Ashburn","zip":"20147",
+//  	"lat":39.0335,"lon":-77.4838,"timezone":"America/New_York",
+//  	"isp":"Amazon.com, Inc.","org":"Amazon.com, Inc.",
+//  	"as":"AS14618 Amazon.com, Inc.","query":"54.88.55.63"}
+//  Like ip-api.com, its fields parameter selects the fields returned, by
+//  name or number, its lang parameter the language of the names (English
+//  by default), and the failures are answered with a 200 status code, like
+//  {"status":"fail","message":"invalid query","query":"foo"}, the addresses
+//  without information being a "private range" or a "reserved range". It is
+//  served under /json/ by NewGeoLocServer(), and by the other lookup
+//  endpoints with the format=ip-api parameter.
+func ServeIPAPIHttpRequest(writer http.ResponseWriter, request *http.Request) {
+	var address string
+	if ip_path := strings.TrimPrefix(strings.TrimPrefix(request.URL.Path, "/json"), "/"); ip_path != "" {
+		address = path.Base(ip_path)
+	}
+	ip := clientIP(request)
+	if address != "" {
+		ip = net.ParseIP(address)
+	}
+	serveIPAPI(writer, request, address, ip)
+}
+
+
+// Writes the ip-api.com geolocation of an IP address, given as address
+// (or the caller one if empty), see ServeIPAPIHttpRequest()
+func serveIPAPI(writer http.ResponseWriter, request *http.Request, address string, ip net.IP) {
+
+	gli, err := apiLookup(ip)
+	var ip_api ipAPIJSON
+	switch {
+	case err == ErrInvalidIP :
+		ip_api = ipAPIJSON{ Status: "fail", Message: "invalid query", Query: address }
+	case err == err_loading || err == ErrNotInitialized :
+		writer.Header().Set("Retry-After", fmt.Sprint(RETRY_AFTER_LOADING))
+		writeJSONError(writer, http.StatusServiceUnavailable, "database loading")
+		return
+	case err == ErrNoBlock || gli == nil :
+		ip_api = ipAPIJSON{ Status: "fail", Message: "reserved range", Query: ip.String() }
+		if ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+			ip_api.Message = "private range"
+		}
+	default :
+		ip_api = gli.ipAPIJSON(requestLanguage(request))
+	}
+
+	// Like ip-api.com, only the status, message and query on failures,
+	// and the message only on failures
+	var fields []string
+	for _, field := range ipAPIFields(request) {
+		if ip_api.Status == "fail" && (field == "status" || field == "message" || field == "query") ||
+			ip_api.Status != "fail" && field != "message" {
+			fields = append(fields, field)
+		}
+	}
+	encoded, _ := json.Marshal(ip_api)
+	body, _ := selectJSONFields(encoded, fields)
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+	writer.Write(body)
+}
@@ -0,0 +1,84 @@
+
+package geoip
+
+import (
+	"bytes"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+
+// This file provides the JSONP responses of the REST API, for the
+// browser clients which cannot make cross-origin requests otherwise.
+
+
+// Names of the JSONP callbacks : JavaScript identifiers, possibly
+// separated by dots, like "fn" or "app.onGeoIP"
+var jsonp_callback = regexp.MustCompile(`^[A-Za-z_$][0-9A-Za-z_$]*(\.[A-Za-z_$][0-9A-Za-z_$]*)*$`)
+
+
+// Maximum length of the name of a JSONP callback
+const JSONP_CALLBACK_MAX_LENGTH = 128
+
+
+// Buffers the response of a handler, to wrap it in a JSONP callback
+type jsonpWriter struct {
+	http.ResponseWriter
+	code int
+	body bytes.Buffer
+}
+
+func (w *jsonpWriter) WriteHeader(code int) {
+	w.code = code
+}
+
+func (w *jsonpWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *jsonpWriter) Write(data []byte) (int, error) {
+	return w.body.Write(data)
+}
+
+
+// Returns a handler answering the requests with a callback parameter,
+// like "?callback=fn", with the JSON (and GeoJSON) responses of next
+// wrapped in a call to this function, like fn({"ip":"54.88.55.63", ...}),
+// as text/javascript, like Telize did. The status code is kept, and the other responses are
+// not changed. An invalid callback name is answered with a 400 status code.
+// Handler() serves the REST API with it.
+func JSONP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+
+		callback := request.URL.Query().Get("callback")
+		if callback == "" {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		if len(callback) > JSONP_CALLBACK_MAX_LENGTH || !jsonp_callback.MatchString(callback) {
+			writeJSONError(writer, http.StatusBadRequest, "invalid callback")
+			return
+		}
+
+		buffered := &jsonpWriter{ ResponseWriter: writer, code: http.StatusOK }
+		next.ServeHTTP(buffered, request)
+
+		header := writer.Header()
+		content_type := header.Get("Content-Type")
+		if !strings.HasPrefix(content_type, "application/json") && !strings.HasPrefix(content_type, GEOJSON_CONTENT_TYPE) {
+			writer.WriteHeader(buffered.code)
+			writer.Write(buffered.body.Bytes())
+			return
+		}
+		// The comment keeps the response from starting with the
+		// callback name, which could be read as another file format
+		header.Set("Content-Type", "text/javascript; charset=utf-8")
+		header.Set("X-Content-Type-Options", "nosniff")
+		header.Del("Content-Length")
+		writer.WriteHeader(buffered.code)
+		writer.Write([]byte("/**/" + callback + "("))
+		writer.Write(buffered.body.Bytes())
+		writer.Write([]byte(");"))
+	})
+}
@@ -0,0 +1,158 @@
+
+package geoip
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+
+// This file provides the limits of the servers of the REST API, to harden
+// it when it is exposed publicly : of the concurrent requests, and of the
+// rate of the requests of each client, against the abusive scrapers.
+
+
+// Default limits of the http servers returned by NewGeoLocServer()
+const (
+	SERVER_IDLE_TIMEOUT = 60 * time.Second
+	SERVER_MAX_HEADER_BYTES = 64 << 10
+)
+
+
+// Timeouts, maximum size of the request headers and maximum number of
+// requests served at once by the servers returned by NewGeoLocServer()
+// (and NewGeoLocGRPCServer() for the timeouts), set before creating them.
+// MaxConcurrentRequests is not limited if 0, see LimitConcurrency().
+var (
+	ServerReadTimeout = SERVER_READ_TIMEOUT
+	ServerWriteTimeout = SERVER_WRITE_TIMEOUT
+	ServerIdleTimeout = SERVER_IDLE_TIMEOUT
+	ServerMaxHeaderBytes = SERVER_MAX_HEADER_BYTES
+	MaxConcurrentRequests = 0
+)
+
+
+// Delay in seconds after which the requests refused by LimitConcurrency()
+// can be sent again, in their Retry-After header
+const RETRY_AFTER_BUSY = 1
+
+
+// Returns a handler serving at most max requests at once with next : the
+// other ones are answered at once with a 503 status code, and a Retry-After
+// header, rather than queued. NewGeoLocServer() serves the REST API with
+// it, at most MaxConcurrentRequests.
+func LimitConcurrency(max int, next http.Handler) http.Handler {
+	slots := make(chan struct{}, max)
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		select {
+		case slots <- struct{}{} :
+			defer func() { <-slots }()
+			next.ServeHTTP(writer, request)
+		default :
+			writer.Header().Set("Retry-After", fmt.Sprint(RETRY_AFTER_BUSY))
+			writeJSONError(writer, http.StatusServiceUnavailable, "too many requests")
+		}
+	})
+}
+
+
+// Requests per second and burst allowed to each client IP (see TrustedProxies)
+// by the servers returned by NewGeoLocServer(), not limited if RateLimitPerSecond
+// is 0, except for the clients of the RateLimitExempt networks (which can be
+// parsed by ParseTrustedProxies()), see RateLimit()
+var (
+	RateLimitPerSecond float64
+	RateLimitBurst = 20
+	RateLimitExempt []*net.IPNet
+)
+
+
+// Interval between the removals of the buckets of the clients which
+// have not sent requests for a while, see rateLimiter.allow()
+const RATE_LIMIT_CLEANUP = time.Minute
+
+
+// Token buckets of the clients of RateLimit(), by IP address
+type rateLimiter struct {
+	mu sync.Mutex
+	rate float64
+	burst float64
+	buckets map[string]*tokenBucket
+	cleaned time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	updated time.Time
+}
+
+
+// Tells if a client can send a request now, taking a token of its bucket,
+// or else returns the delay after which it can
+func (limiter *rateLimiter) allow(client string, now time.Time) (bool, time.Duration) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	// The buckets full again are removed, as they are like new ones
+	if now.Sub(limiter.cleaned) >= RATE_LIMIT_CLEANUP {
+		for key, bucket := range limiter.buckets {
+			if bucket.tokens + now.Sub(bucket.updated).Seconds() * limiter.rate >= limiter.burst {
+				delete(limiter.buckets, key)
+			}
+		}
+		limiter.cleaned = now
+	}
+
+	bucket, found := limiter.buckets[client]
+	if !found {
+		bucket = &tokenBucket{ tokens: limiter.burst, updated: now }
+		limiter.buckets[client] = bucket
+	}
+	bucket.tokens = min(limiter.burst, bucket.tokens + now.Sub(bucket.updated).Seconds() * limiter.rate)
+	bucket.updated = now
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / limiter.rate * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+
+// Returns the key of the bucket of a client IP : its /64 network for an
+// IPv6 address, as a client usually has one
+func rateLimitKey(ip net.IP) string {
+	if ip.To4() == nil && len(ip) == net.IPv6len {
+		return ip.Mask(net.CIDRMask(64, 128)).String()
+	}
+	return ip.String()
+}
+
+
+// Returns a handler allowing each client IP (see TrustedProxies) to send
+// rate requests per second to next, and up to burst at once, with a token
+// bucket. The other requests are answered with a 429 status code, and a
+// Retry-After header. The clients of the RateLimitExempt networks are not
+// limited. NewGeoLocServer() serves the REST API with it, if RateLimitPerSecond
+// is set.
+func RateLimit(rate float64, burst int, next http.Handler) http.Handler {
+	limiter := &rateLimiter{ rate: rate, burst: float64(max(burst, 1)), buckets: make(map[string]*tokenBucket) }
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+
+		ip := clientIP(request)
+		if ip == nil || slices.ContainsFunc(RateLimitExempt, func(network *net.IPNet) bool { return network.Contains(ip) }) {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		if allowed, delay := limiter.allow(rateLimitKey(ip), time.Now()); !allowed {
+			writer.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(delay.Seconds()))))
+			writeJSONError(writer, http.StatusTooManyRequests, "too many requests")
+			return
+		}
+		next.ServeHTTP(writer, request)
+	})
+}
@@ -0,0 +1,268 @@
+package geoip
+
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"encoding/csv"
+)
+
+
+// This file holds the settings and the pipeline shared by the CSV
+// loaders of the blocks, locations and ASN files.
+
+
+// Maximum number of fields tolerated in a CSV row by the loaders.
+// The MaxMind files have 3 or 9 fields per row : rows with more than
+// this number of fields come from a malformed file, and are skipped.
+// It is a sanity check only : the row is already split in fields when
+// it is counted, and MaxCSVLineLength bounds the memory it takes.
+var MaxCSVFields = 32
+
+
+// Maximum length of a line of the CSV files read by the loaders, in
+// bytes. The lines of the MaxMind files are less than 200 bytes long :
+// a longer line comes from a malformed file, and ends its loading with
+// ErrLineTooLong, before the CSV reader holds it whole in memory.
+var MaxCSVLineLength = 64 << 10
+
+
+// Error of a CSV line longer than MaxCSVLineLength
+var ErrLineTooLong = errors.New("CSV line too long")
+
+
+// A reader failing with ErrLineTooLong once a line of its input is
+// longer than MaxCSVLineLength, and for all the reads after
+type lineLimitReader struct {
+	r io.Reader
+	length int	// of the current line so far
+	too_long bool
+}
+
+func (l *lineLimitReader) Read(p []byte) (int, error) {
+	if l.too_long {
+		return 0, ErrLineTooLong
+	}
+	n, err := l.r.Read(p)
+	for data := p[:n]; ; {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			l.length += len(data)
+			break
+		}
+		if l.length + i > MaxCSVLineLength {
+			l.too_long = true
+			return 0, ErrLineTooLong
+		}
+		l.length, data = 0, data[i + 1:]
+	}
+	if l.length > MaxCSVLineLength {
+		l.too_long = true
+		return 0, ErrLineTooLong
+	}
+	return n, err
+}
+
+
+// Options for the CSV loaders. The zero value gives the default
+// behavior, where header and copyright lines are skipped because
+// they cannot be parsed as data. The loaders are available as
+// methods, for example :
+// 	blocks, err := LoaderOptions{ SkipRows: 2 }.LoadBlocks(r)
+type LoaderOptions struct {
+	// Number of leading lines to skip, like the copyright and header
+	// lines of the MaxMind files, or the preamble of a custom dataset
+	SkipRows int
+
+	// If not 0, lines starting with this character are ignored
+	Comment rune
+
+	// Drop the postal code, the metro code and the area code of the
+	// locations, to spare memory when only the country and the city
+	// are needed
+	SkipPostalFields bool
+}
+
+
+// Returns a CSV reader for the loaders, with the given options applied,
+// and its lines limited to MaxCSVLineLength, the skipped ones included
+func (opts LoaderOptions) newCSVReader(in io.Reader) *csv.Reader {
+
+	br := bufio.NewReader(&lineLimitReader{ r: skipBOM(in) })
+	for i := 0; i < opts.SkipRows; i++ {
+		if _, err := br.ReadString('\n'); err != nil {
+			break
+		}
+	}
+
+	r := csv.NewReader(br)
+	r.FieldsPerRecord = -1
+	r.ReuseRecord = true
+	r.Comment = opts.Comment
+	return r
+}
+
+
+// Tells if a CSV row has too many fields, and counts it in skipped
+func tooManyFields(values []string, skipped *int) bool {
+	if len(values) > MaxCSVFields {
+		*skipped++
+		return true
+	}
+	return false
+}
+
+
+// Logs the number of rows skipped by a loader because they had too
+// many fields, if any
+func logTooManyFields(name string, skipped int) {
+	if skipped > 0 {
+		log_geolocip.Notice(fmt.Sprintf("%s: %d rows skipped, more than %d fields", name, skipped, MaxCSVFields))
+	}
+}
+
+
+// Number of parsed rows handed over at once by the goroutine decoding
+// the CSV rows of a loader to the one inserting them, see readRows()
+const LOADER_BATCH = 1024
+
+
+// Size of the chunks of input read ahead by a loader
+const loader_chunk = 64 << 10
+
+
+// Reads the rows of a CSV input with a pipeline of goroutines : the
+// input is read ahead by one goroutine (including its decompression
+// and latin1 conversion), the rows are decoded and parsed by another
+// one, and the parsed rows are inserted by the calling goroutine, so
+// a loader keeps up to 3 cores busy. Rows for which parse returns
+// false are skipped. Errors are logged with the given name, and end
+// the reading.
+func readRows[T any](name string, opts LoaderOptions, in io.Reader, parse func(values []string) (T, bool), insert func(row T)) {
+
+	ahead := newReadAhead(in)
+	defer ahead.Close()
+	r := opts.newCSVReader(ahead)
+
+	batches := make(chan []T, 4)
+	go func() {
+		defer close(batches)
+		skipped := 0
+		batch := make([]T, 0, LOADER_BATCH)
+		for {
+			values, err := r.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				log_geolocip.Err(fmt.Sprintf("%s error reading file: %v", name, err))
+				break
+			}
+			if tooManyFields(values, &skipped) {
+				continue
+			}
+			if row, ok := parse(values); ok {
+				batch = append(batch, row)
+				if len(batch) == LOADER_BATCH {
+					batches <- batch
+					batch = make([]T, 0, LOADER_BATCH)
+				}
+			}
+		}
+		if len(batch) > 0 {
+			batches <- batch
+		}
+		logTooManyFields(name, skipped)
+	}()
+
+	for batch := range batches {
+		for _, row := range batch {
+			insert(row)
+		}
+	}
+}
+
+
+// A reader reading its input ahead in a goroutine, by chunks, so the
+// next chunks are read while the previous ones are parsed
+type readAhead struct {
+	chunks chan []byte
+	done chan struct{}		// closed by Close()
+	finished chan struct{}	// closed when the goroutine returns
+	current []byte
+	err error
+}
+
+
+// Returns a readAhead reading a given reader, to be closed once read
+func newReadAhead(in io.Reader) *readAhead {
+
+	ra := &readAhead{ chunks: make(chan []byte, 4), done: make(chan struct{}), finished: make(chan struct{}) }
+	go func() {
+		defer close(ra.finished)
+		defer close(ra.chunks)
+		for {
+			chunk := make([]byte, loader_chunk)
+			n, err := in.Read(chunk)
+			if n > 0 {
+				select {
+				case ra.chunks <- chunk[:n] :
+				case <-ra.done :
+					return
+				}
+			}
+			if err != nil {
+				ra.err = err
+				return
+			}
+		}
+	}()
+	return ra
+}
+
+
+// Implements the reader interface, returning the chunks read ahead
+func (ra *readAhead) Read(p []byte) (int, error) {
+	if len(ra.current) == 0 {
+		chunk, ok := <-ra.chunks
+		if !ok {
+			return 0, ra.err
+		}
+		ra.current = chunk
+	}
+	n := copy(p, ra.current)
+	ra.current = ra.current[n:]
+	return n, nil
+}
+
+
+// Stops reading ahead, and waits for the goroutine to return, so the
+// input is not used anymore once the loader returns
+func (ra *readAhead) Close() error {
+	close(ra.done)
+	<-ra.finished
+	return nil
+}
+
+
+// A pool of strings, so the loaders keep a single copy of the strings
+// repeated across rows, like the country, region, city and ASN names.
+// A pool is used by a single goroutine, and dropped once loaded.
+type internPool map[string]string
+
+
+// Returns the copy of a string kept by the pool. As the fields of a
+// CSV row share the memory of the whole row, the string is cloned when
+// added, so the rows are not kept in memory.
+func (pool internPool) intern(s string) string {
+	if interned, ok := pool[s]; ok {
+		return interned
+	}
+	s = strings.Clone(s)
+	pool[s] = s
+	return s
+}
@@ -8,71 +8,179 @@ package geoip
 import (
 	"fmt"
 	"os"
-	"encoding/csv"
 	"io"
 	"bufio"
 	"strconv"
+	"sync"
 )
 
 
 // This the type to hold all information about a location.
 // Country and Region are 2 characters string as defined in
-// ISO 3661-1 alpha 2. 
+// ISO 3661-1 alpha 2. Coordinates are 0 when unknown (see
+// HasCoordinates()), and so are metro and area codes. TimeZone is
+// an IANA time zone, like "America/New_York", or "" when unknown.
 // Example : 
-// 	location[718]= { "US","MA","Medway","02053","42.1556","-71.4268","506","508" }
+// 	location[718]= { "US","MA","Medway","02053",42.1556,-71.4268,506,508,"" }
 type Location struct {
 	Country string	
 	Region string
 	City string
 	PostalCode string
-	Latitude string
-	Longitude string
-	MetroCode string
-	AreaCode string
+	Latitude float64
+	Longitude float64
+	MetroCode int
+	AreaCode int
+	TimeZone string
 }
 
 
-// Default path to MaxMind locations file
+// Tells if the location has coordinates, that is valid ones other
+// than 0,0
+func (loc *Location) HasCoordinates() bool {
+	return (loc.Latitude != 0 || loc.Longitude != 0) &&
+		loc.Latitude >= -90 && loc.Latitude <= 90 && loc.Longitude >= -180 && loc.Longitude <= 180
+}
+
+
+// Returns a latitude or longitude read from a file, or 0 if it is
+// not a number between -limit and limit
+func parseCoordinate(value string, limit float64) float64 {
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0
+	}
+	return checkCoordinate(f, limit)
+}
+
+
+// Returns a latitude or longitude, or 0 if it is not between -limit
+// and limit
+func checkCoordinate(f float64, limit float64) float64 {
+	if !(f >= -limit && f <= limit) {
+		return 0
+	}
+	return f
+}
+
+
+// Returns the time zone of a location of a MaxMind CSV file, known
+// only for the countries with a single time zone
+func countryTimeZone(country_code string) string {
+	time_zone, _ := CountryTimeZone(country_code)
+	return time_zone
+}
+
+
+// Returns a metro or area code read from a file, or 0 if it is
+// not a number
+func parseCode(value string) int {
+	code, err := strconv.Atoi(value)
+	if err != nil {
+		return 0
+	}
+	return code
+}
+
+
+// Former default path to MaxMind locations file.
+//
+// Deprecated: the files are now in the data directory, see Config.Dir.
 const LOCATIONS_FILE = "/tmp/GeoLiteCity-Location.csv"
 
 
-var regions_tree *Regions
-var countries_tree *Countries
+// A LocationTable gives the Location matching a location id, or
+// nil if there is none. Locations are either stored in a slice
+// (LocationSlice, see LoadLocFile) or in a map (LocationMap, see
+// LoadLocFileMap).
+type LocationTable interface {
+	Get(loc_id uint32) *Location
+}
 
 
-// Returns country name of a given Location or ""
-func (loc *Location)GetCountry() string {
+// LocationSlice holds the locations in a slice indexed by location id.
+type LocationSlice []Location
+
+
+// LocationMap holds the locations in a map indexed by location id.
+type LocationMap map[uint32]Location
 
-	if countries_tree == nil {
-		return ""
+
+// Returns the Location matching a given location id, or nil
+func (ls LocationSlice) Get(loc_id uint32) *Location {
+	if int(loc_id) >= len(ls) {
+		return nil
 	}
+	return &ls[loc_id]
+}
 
-	country := countries_tree.Get(loc.Country)
-	if country == nil {
-		return ""
-	} else {
-		return country.Name
+
+// Returns the Location matching a given location id, or nil
+func (lm LocationMap) Get(loc_id uint32) *Location {
+	loc, ok := lm[loc_id]
+	if !ok {
+		return nil
 	}
+	return &loc
+}
+
+
+// Countries and regions names, loaded once by loadNames() before
+// being read, so they are never seen half loaded by concurrent lookups
+var regions_tree *Regions
+var countries_tree *Countries
+var countries_en_tree *Countries
+var names_once sync.Once
+
+
+// Loads the countries and regions names, the first time it is called
+func loadNames() {
+	names_once.Do(func() {
+		countries_tree, _ = LoadCountries()
+		countries_en_tree, _ = LoadCountriesEN()
+		regions_tree, _ = LoadRegions()
+	})
+}
+
 
+// Returns the French country name of a given Location or "", see
+// CountryNameIn() for other languages
+func (loc *Location)GetCountry() string {
+	return localNames{}.CountryName(loc.Country)
 }
 
 
-// Returns region name of a given location or ""
+// Returns region name of a given location or "", see RegionNameIn()
+// for other languages
 func (loc *Location)GetRegion() string {
+	return localNames{}.RegionName(loc.Country, loc.Region)
+}
 
-	if regions_tree == nil {
-		return ""
-	}
 
-	code := fmt.Sprintf("%s%s", loc.Country, loc.Region)
+// Numbers the locations of the datasets that hold them on the line of
+// each block, without location id, giving the same id to identical
+// locations
+type locationNumbering struct {
+	ids map[Location]uint32
+	locations LocationMap
+}
 
-	region := regions_tree.Get(code)
-	if region == nil {
-		return ""
-	} else {
-		return region.Name
-	}
 
+// Returns a new empty locationNumbering
+func newLocationNumbering() *locationNumbering {
+	return &locationNumbering{ make(map[Location]uint32), make(LocationMap) }
+}
+
+
+// Returns the id of a location, numbered from 1
+func (numbering *locationNumbering) id(loc Location) uint32 {
+	loc_id, found := numbering.ids[loc]
+	if !found {
+		loc_id = uint32(len(numbering.ids) + 1)
+		numbering.ids[loc] = loc_id
+		numbering.locations[loc_id] = loc
+	}
+	return loc_id
 }
 
 
@@ -83,8 +191,8 @@ func (loc *Location) String() string {
 	// fmt.Println("Country:", country)
 	region := loc.GetRegion()
 	// fmt.Println("Region:", region)
-	return fmt.Sprintf("Country=%q (%s), Region=%q (%s), City=%q, PostalCode=%q, Latitude=%q, Longitude=%q, MetroCode=%q, AreaCode=%q",
-			loc.Country, country, loc.Region, region, loc.City, loc.PostalCode, loc.Latitude, loc.Longitude, loc.MetroCode, loc.AreaCode)
+	return fmt.Sprintf("Country=%q (%s), Region=%q (%s), City=%q, PostalCode=%q, Latitude=%g, Longitude=%g, MetroCode=%d, AreaCode=%d, TimeZone=%q",
+			loc.Country, country, loc.Region, region, loc.City, loc.PostalCode, loc.Latitude, loc.Longitude, loc.MetroCode, loc.AreaCode, loc.TimeZone)
 }
 
 
@@ -105,7 +213,13 @@ func countLine(io io.Reader) int {
 // slice of Location structures. For a known location_id,
 // the location information will be found at Location[location_id].
 func LoadLocFile(filename string) ([]Location, error) {
-    
+	return LoaderOptions{}.LoadLocFile(filename)
+}
+
+
+// Same as the LoadLocFile() function, with the given loader options.
+func (opts LoaderOptions) LoadLocFile(filename string) ([]Location, error) {
+
     file, err := os.Open(filename)
     if err != nil {
 		log_geolocip.Err(fmt.Sprintf("Locations error open file: %v", err))
@@ -113,68 +227,149 @@ func LoadLocFile(filename string) ([]Location, error) {
     }
     defer file.Close()
 
-    // Build a slice big enough to hold all the locations
-    line_count := countLine(file)
-    loc_list := make([]Location, line_count)
-
-    // Reset file position after counting the lines
-    file.Seek(0, 0)
-
-    // Use a CSV scanner to read file. Because the MaxMind files are
-    // iso8859-1 encoded, we are using a fileLatin1Reader to convert
-    // the read content to utf-8
-    flr := fileLatin1Reader{ file: file }
-    r := csv.NewReader(&flr)
-    r.FieldsPerRecord = -1
-
-    for {
-    
-    	values, err := r.Read()
-    	if err == io.EOF {
-    		break
+    // Build a slice big enough to hold all the locations, unless the
+    // file is compressed : the slice is then grown while reading
+    line_count := 0
+    if !isGzipFile(file) {
+        line_count = countLine(file)
+
+        // Reset file position after counting the lines
+        file.Seek(0, 0)
+    }
+
+    // Because the MaxMind files are iso8859-1 encoded, we are using
+    // a fileLatin1Reader to convert the read content to utf-8
+    return opts.loadLocations(newFileLatin1Reader(file), line_count), nil
+}
+
+
+// Read MaxMind GeoIP Locations from an io.Reader in memory, as
+// a slice of Location structures, like LoadLocFile(). The content
+// must be utf-8 : use NewLatin1Reader() to read an iso8859-1 encoded
+// MaxMind file. A leading utf-8 BOM is skipped. Lines without 9 values
+// are skipped.
+func LoadLocations(in io.Reader) ([]Location, error) {
+	return LoaderOptions{}.LoadLocations(in)
+}
+
+
+// Same as the LoadLocations() function, with the given loader options.
+func (opts LoaderOptions) LoadLocations(in io.Reader) ([]Location, error) {
+	return opts.loadLocations(in, 0), nil
+}
+
+
+// Highest location_id loaded in the slice of LoadLocFile() and
+// LoadLocations(), whose memory is proportional to the highest id : the
+// MaxMind ids are below 1 million. Locations with a larger id are skipped
+// and logged, use LoadLocFileMap() or LoadLocationsMap() for a sparse
+// dataset with large location ids.
+var MaxLocationId uint32 = 1 << 24
+
+
+// Read the locations in a slice, whose initial size is given, and
+// which is grown when a larger location_id is found, up to MaxLocationId.
+func (opts LoaderOptions) loadLocations(in io.Reader, size int) []Location {
+
+    loc_list := make([]Location, size)
+    skipped := 0
+    opts.readLocations(in, func(loc_id uint32, loc Location) {
+    	if loc_id > MaxLocationId {
+    		skipped++
+    		return
     	}
-    	if err != nil {
-			log_geolocip.Err(fmt.Sprintf("Locations error reading file: %v", err))
-    		break
+    	if int(loc_id) >= len(loc_list) {
+    		loc_list = append(loc_list, make([]Location, int(loc_id) + 1 - len(loc_list))...)
     	}
-	
-		// Use only lines with 9 values
-	   	if len(values) == 9 {
-
-	   		locId, err := strconv.Atoi(values[0])
-	   		if err != nil {
-	   			// log.Println("Line ignored, cannot read LocId", err)
-	   			continue
-	   		}	   		
-
-	   		loc_list[locId] = Location {
-	   			Country: values[1],
-	   			Region: values[2],
-	   			City: values[3],
-	   			PostalCode: values[4],
-	   			Latitude: values[5],
-	   			Longitude: values[6],
-	   			MetroCode: values[7],
-	   			AreaCode: values[8],
-	   		}
-
-	   	}
+   		loc_list[loc_id] = loc
+    })
+    if skipped > 0 {
+    	log_geolocip.Err(fmt.Sprintf("Locations: %d locations skipped, location_id above %d, use LoadLocFileMap() for sparse location ids", skipped, MaxLocationId))
     }
 
-    countries_tree, _ = LoadCountries()
-    regions_tree, _ = LoadRegions()
+    return loc_list
+}
+
+
+// Read a MaxMind GeoIP Location file in memory, as a map of
+// Location structures indexed by location_id. Unlike LoadLocFile(),
+// the memory used is proportional to the number of locations
+// actually read, and not to the highest location_id, so this
+// is better suited to sparse datasets with large location ids.
+// Lookups are a little slower than with a slice.
+func LoadLocFileMap(filename string) (LocationMap, error) {
+
+    file, err := os.Open(filename)
+    if err != nil {
+		log_geolocip.Err(fmt.Sprintf("Locations error open file: %v", err))
+        return LocationMap{}, err
+    }
+    defer file.Close()
 
-    return loc_list, nil
+    return LoadLocationsMap(newFileLatin1Reader(file))
 }
 
 
+// Read MaxMind GeoIP Locations from an io.Reader in memory, as
+// a map of Location structures, like LoadLocFileMap(). The content
+// must be utf-8, see LoadLocations().
+func LoadLocationsMap(in io.Reader) (LocationMap, error) {
+	return LoaderOptions{}.LoadLocationsMap(in)
+}
 
 
+// Same as the LoadLocationsMap() function, with the given loader options.
+func (opts LoaderOptions) LoadLocationsMap(in io.Reader) (LocationMap, error) {
 
+    loc_map := make(LocationMap)
+    opts.readLocations(in, func(loc_id uint32, loc Location) {
+    	loc_map[loc_id] = loc
+    })
 
+    return loc_map, nil
+}
 
 
+// Parse MaxMind GeoIP Locations, and call store() for each valid
+// location found. Also loads the countries and regions names, if
+// not already done.
+func (opts LoaderOptions) readLocations(in io.Reader, store func(loc_id uint32, loc Location)) {
 
+    type row struct {
+    	loc_id uint32
+    	loc Location
+    }
 
+    pool := internPool{}
+    readRows("Locations", opts, in, func(values []string) (row, bool) {
 
+		// Use only lines with 9 values
+	   	if len(values) != 9 {
+	   		return row{}, false
+	   	}
 
+   		locId, err := strconv.ParseUint(values[0], 10, 32)
+   		if err != nil {
+   			// log.Println("Line ignored, cannot read LocId", err)
+   			return row{}, false
+   		}
+
+   		loc := Location {
+   			Country: pool.intern(values[1]),
+   			Region: pool.intern(values[2]),
+   			City: pool.intern(values[3]),
+   			Latitude: parseCoordinate(values[5], 90),
+   			Longitude: parseCoordinate(values[6], 180),
+   			TimeZone: countryTimeZone(values[1]),
+   		}
+   		if !opts.SkipPostalFields {
+   			loc.PostalCode, loc.MetroCode, loc.AreaCode = pool.intern(values[4]), parseCode(values[7]), parseCode(values[8])
+   		}
+   		return row{ uint32(locId), loc }, true
+
+    }, func(r row) {
+    	store(r.loc_id, r.loc)
+    })
+
+    loadNames()
+}
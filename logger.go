@@ -0,0 +1,89 @@
+
+package geoip
+
+import (
+	"log"
+	"log/slog"
+	"os"
+)
+
+
+// This file provides the logging of the package, to the standard
+// error by default.
+
+
+// A Logger receives the error and information messages of the package.
+// A *syslog.Writer is a Logger, and NewStdLogger() and NewSlogLogger()
+// adapt the loggers of the standard library.
+type Logger interface {
+	Err(m string) error
+	Notice(m string) error
+}
+
+
+// The Logger used by the package, see SetLogger()
+var log_geolocip Logger = NewStdLogger(log.New(os.Stderr, "geolocip: ", log.LstdFlags))
+
+
+// Sets the Logger used by the package. It should be called before any
+// other function of the package. With a nil Logger, messages are
+// discarded.
+func SetLogger(l Logger) {
+	if l == nil {
+		l = discardLogger{}
+	}
+	log_geolocip = l
+}
+
+
+// A Logger writing to a *log.Logger
+type stdLogger struct {
+	l *log.Logger
+}
+
+
+// Returns a Logger writing to a *log.Logger. Error messages are
+// prefixed by "error: ".
+func NewStdLogger(l *log.Logger) Logger {
+	return stdLogger{ l }
+}
+
+func (s stdLogger) Err(m string) error {
+	s.l.Print("error: " + m)
+	return nil
+}
+
+func (s stdLogger) Notice(m string) error {
+	s.l.Print(m)
+	return nil
+}
+
+
+// A Logger writing to a *slog.Logger
+type slogLogger struct {
+	l *slog.Logger
+}
+
+
+// Returns a Logger writing to a *slog.Logger, error messages at the
+// error level, and information messages at the info level.
+func NewSlogLogger(l *slog.Logger) Logger {
+	return slogLogger{ l }
+}
+
+func (s slogLogger) Err(m string) error {
+	s.l.Error(m)
+	return nil
+}
+
+func (s slogLogger) Notice(m string) error {
+	s.l.Info(m)
+	return nil
+}
+
+
+// A Logger discarding all messages
+type discardLogger struct{}
+
+func (discardLogger) Err(m string) error { return nil }
+func (discardLogger) Notice(m string) error { return nil }
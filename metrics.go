@@ -0,0 +1,187 @@
+
+package geoip
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+
+// This file provides the metrics of the REST API, served in the
+// Prometheus text format under /metrics by NewGeoLocServer().
+
+
+// Upper bounds, in seconds, of the buckets of the lookup duration
+// histograms
+var lookup_buckets = []float64{ 0.00001, 0.00005, 0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5 }
+
+
+// A histogram of durations, with the lookup_buckets bounds
+type histogram struct {
+	counts [11]uint64	// per bucket, the last one for +Inf
+	count uint64
+	sum float64
+}
+
+
+// Metrics of the REST API, all protected by mu
+type apiMetrics struct {
+	mu sync.Mutex
+	requests map[[2]string]uint64	// by handler pattern and status code
+	lookups map[string]uint64	// by result : hit, miss, invalid or error
+	lookup_duration histogram
+	batch_duration histogram
+}
+
+
+// The metrics of the handlers registered by NewGeoLocServer()
+var api_metrics = &apiMetrics{
+	requests: make(map[[2]string]uint64),
+	lookups: make(map[string]uint64),
+}
+
+
+// Counts a request served by the handler registered with a given pattern
+func (m *apiMetrics) countRequest(pattern string, code int) {
+	m.mu.Lock()
+	m.requests[[2]string{ pattern, strconv.Itoa(code) }]++
+	m.mu.Unlock()
+}
+
+
+// Counts a lookup, by the error it returned
+func (m *apiMetrics) countLookup(err error) {
+	result := "error"
+	switch err {
+	case nil :
+		result = "hit"
+	case ErrNoBlock :
+		result = "miss"
+	case ErrInvalidIP :
+		result = "invalid"
+	}
+	m.mu.Lock()
+	m.lookups[result]++
+	m.mu.Unlock()
+}
+
+
+// Adds a duration to a histogram
+func (m *apiMetrics) observe(h *histogram, d time.Duration) {
+	seconds := d.Seconds()
+	i := sort.SearchFloat64s(lookup_buckets, seconds)
+	m.mu.Lock()
+	h.counts[i]++
+	h.count++
+	h.sum += seconds
+	m.mu.Unlock()
+}
+
+
+// A ResponseWriter remembering the status code of the response
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+
+// Returns a handler counting the requests served by a handler function
+// registered with a given pattern, by status code
+func countRequests(pattern string, handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		recorder := &statusRecorder{ writer, http.StatusOK }
+		handler(recorder, request)
+		api_metrics.countRequest(pattern, recorder.code)
+	})
+}
+
+
+//  This serves the metrics of the REST API in the Prometheus text format :
+//  requests by handler and status code, lookups by result (hit, miss,
+//  invalid or error), lookup and batch durations, number of records of
+//  each dataset, and age of the data. It is served under /metrics by
+//  NewGeoLocServer().
+func ServeMetricsHttpRequest(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	api_metrics.write(writer, defaultDB().snapshot())
+}
+
+
+// Writes the metrics, and the ones of the given data
+func (m *apiMetrics) write(w io.Writer, data *snapshot) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP geoip_http_requests_total Requests served by the REST API.\n")
+	fmt.Fprintf(w, "# TYPE geoip_http_requests_total counter\n")
+	requests := make([][2]string, 0, len(m.requests))
+	for key := range m.requests {
+		requests = append(requests, key)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		if requests[i][0] != requests[j][0] {
+			return requests[i][0] < requests[j][0]
+		}
+		return requests[i][1] < requests[j][1]
+	})
+	for _, key := range requests {
+		fmt.Fprintf(w, "geoip_http_requests_total{handler=%q,code=%q} %d\n", key[0], key[1], m.requests[key])
+	}
+
+	fmt.Fprintf(w, "# HELP geoip_lookups_total Lookups made by the REST API, by result.\n")
+	fmt.Fprintf(w, "# TYPE geoip_lookups_total counter\n")
+	for _, result := range []string{ "hit", "miss", "invalid", "error" } {
+		fmt.Fprintf(w, "geoip_lookups_total{result=%q} %d\n", result, m.lookups[result])
+	}
+
+	m.lookup_duration.write(w, "geoip_lookup_duration_seconds", "Duration of the lookups of single addresses.")
+	m.batch_duration.write(w, "geoip_batch_lookup_duration_seconds", "Duration of the lookups of batches of addresses.")
+
+	fmt.Fprintf(w, "# HELP geoip_database_records Records loaded, by dataset.\n")
+	fmt.Fprintf(w, "# TYPE geoip_database_records gauge\n")
+	counts := data.recordCounts()
+	datasets := make([]string, 0, len(counts))
+	for dataset := range counts {
+		datasets = append(datasets, dataset)
+	}
+	sort.Strings(datasets)
+	for _, dataset := range datasets {
+		fmt.Fprintf(w, "geoip_database_records{dataset=%q} %d\n", dataset, counts[dataset])
+	}
+
+	if !data.modified.IsZero() {
+		fmt.Fprintf(w, "# HELP geoip_database_age_seconds Age of the loaded data files.\n")
+		fmt.Fprintf(w, "# TYPE geoip_database_age_seconds gauge\n")
+		fmt.Fprintf(w, "geoip_database_age_seconds %g\n", time.Since(data.modified).Seconds())
+	}
+}
+
+
+// Writes a histogram with a given name and help text
+func (h *histogram) write(w io.Writer, name string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	var cumulative uint64
+	for i, bound := range lookup_buckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, bound, cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n", name, h.sum)
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
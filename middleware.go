@@ -0,0 +1,74 @@
+
+package geoip
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+)
+
+
+// This file provides an http.Handler middleware adding the geolocation
+// of the client to the requests, for existing servers.
+
+
+// Headers set on the requests by Middleware() : the country code, the
+// city and the AS number of the client, like "US", "Ashburn" and "14618"
+const (
+	GEO_COUNTRY_HEADER = "X-Geo-Country"
+	GEO_CITY_HEADER = "X-Geo-City"
+	GEO_ASN_HEADER = "X-Geo-ASN"
+)
+
+
+// Returns a handler setting the geolocation headers of the client IP
+// on the requests, using the default DB, before passing them to next.
+// The requests are not held while the default DB is loading : they get
+// no headers meanwhile. See DB.Middleware().
+func Middleware(next http.Handler) http.Handler {
+	return geoHeaders(next, func(ip net.IP) (*GeoLocIp, error) {
+		if default_db.snapshot().ready(0) != nil {
+			go defaultDB()
+			return nil, ErrNotInitialized
+		}
+		return default_db.Lookup(ip)
+	})
+}
+
+
+// Returns a handler setting the GEO_COUNTRY_HEADER, GEO_CITY_HEADER and
+// GEO_ASN_HEADER headers of the requests to the geolocation of their
+// client IP (see TrustedProxies), before passing them to next, for
+// example to gate features by country. The headers sent by the clients
+// are removed, and the ones unknown for the client IP are not set.
+func (db *DB) Middleware(next http.Handler) http.Handler {
+	return geoHeaders(next, db.Lookup)
+}
+
+
+// Returns a handler setting the geolocation headers of the requests,
+// found by a lookup function, see DB.Middleware()
+func geoHeaders(next http.Handler, lookup func(ip net.IP) (*GeoLocIp, error)) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+
+		request.Header.Del(GEO_COUNTRY_HEADER)
+		request.Header.Del(GEO_CITY_HEADER)
+		request.Header.Del(GEO_ASN_HEADER)
+
+		if ip := normalizeIP(clientIP(request)); ip != nil {
+			if gli, err := lookup(ip); err == nil && gli != nil {
+				if gli.Location != nil && gli.Location.Country != "" {
+					request.Header.Set(GEO_COUNTRY_HEADER, gli.Location.Country)
+				}
+				if gli.Location != nil && gli.Location.City != "" {
+					request.Header.Set(GEO_CITY_HEADER, gli.Location.City)
+				}
+				if gli.Asn != nil && gli.Asn.Number != 0 {
+					request.Header.Set(GEO_ASN_HEADER, strconv.FormatUint(uint64(gli.Asn.Number), 10))
+				}
+			}
+		}
+
+		next.ServeHTTP(writer, request)
+	})
+}
@@ -0,0 +1,281 @@
+package geoip
+
+
+import (
+	"fmt"
+	"net"
+	"encoding/binary"
+	"io/fs"
+	"time"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+
+// This file provides lookups in the GeoLite2 databases from MaxMind
+// LLC (GeoLite2-City.mmdb and GeoLite2-ASN.mmdb), which replace the
+// discontinued GeoLite City and ASN CSV files.
+
+
+// Default filenames for the GeoLite2 databases
+const (
+	MMDB_CITY_FILE = "/tmp/GeoLite2-City.mmdb"
+	MMDB_ASN_FILE = "/tmp/GeoLite2-ASN.mmdb"
+)
+
+
+// Record of the GeoLite2 City database, limited to the fields
+// used to build a GeoLocIp.
+type mmdbCity struct {
+	City struct {
+		GeoNameID uint32 `maxminddb:"geoname_id"`
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+		Names map[string]string `maxminddb:"names"`
+		IsInEuropeanUnion bool `maxminddb:"is_in_european_union"`	// omitted if false
+	} `maxminddb:"country"`
+	Location struct {
+		Latitude *float64 `maxminddb:"latitude"`
+		Longitude *float64 `maxminddb:"longitude"`
+		MetroCode uint `maxminddb:"metro_code"`
+		TimeZone string `maxminddb:"time_zone"`
+	} `maxminddb:"location"`
+	Postal struct {
+		Code string `maxminddb:"code"`
+	} `maxminddb:"postal"`
+	Subdivisions []struct {
+		ISOCode string `maxminddb:"iso_code"`
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"subdivisions"`
+}
+
+
+// Record of the GeoLite2 ASN database
+type mmdbASN struct {
+	Number uint `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+
+// An MMDB holds the GeoLite2 City and ASN databases. It implements
+// the Locator interface, so it can be used by GeoLocIPv4() through
+// SetLocator(), or directly.
+type MMDB struct {
+	city *maxminddb.Reader
+	asn *maxminddb.Reader
+	language string	// of the names, DEFAULT_LANGUAGE if empty
+}
+
+
+// Opens the GeoLite2 City and ASN databases. asn_file can be "",
+// in which case no ASN information is returned.
+func OpenMMDB(city_file string, asn_file string) (*MMDB, error) {
+
+	city, err := maxminddb.Open(city_file)
+	if err != nil {
+		log_geolocip.Err(fmt.Sprintf("MMDB error open file: %v", err))
+		return nil, err
+	}
+
+	db := &MMDB{ city: city }
+	if asn_file != "" {
+		db.asn, err = maxminddb.Open(asn_file)
+		if err != nil {
+			log_geolocip.Err(fmt.Sprintf("MMDB error open file: %v", err))
+			city.Close()
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+
+// Opens the GeoLite2 City and ASN databases of an fs.FS, like an
+// embed.FS, like OpenMMDB(). They are read in memory.
+func OpenMMDBFS(fsys fs.FS, city_file string, asn_file string) (*MMDB, error) {
+
+	content, err := fs.ReadFile(fsys, city_file)
+	if err != nil {
+		log_geolocip.Err(fmt.Sprintf("MMDB error open file: %v", err))
+		return nil, err
+	}
+	city, err := maxminddb.FromBytes(content)
+	if err != nil {
+		log_geolocip.Err(fmt.Sprintf("MMDB error open file %s: %v", city_file, err))
+		return nil, err
+	}
+
+	db := &MMDB{ city: city }
+	if asn_file != "" {
+		if content, err = fs.ReadFile(fsys, asn_file); err == nil {
+			db.asn, err = maxminddb.FromBytes(content)
+		}
+		if err != nil {
+			log_geolocip.Err(fmt.Sprintf("MMDB error open file %s: %v", asn_file, err))
+			city.Close()
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+
+// Opens the GeoLite2 City and ASN databases, and uses them
+// for the next calls to GeoLocIPv4() and GeoLocIPv4E().
+func UseMMDB(city_file string, asn_file string) error {
+	db, err := OpenMMDB(city_file, asn_file)
+	if err != nil {
+		return err
+	}
+	SetLocator(db)
+	return nil
+}
+
+
+// Closes the databases
+func (db *MMDB) Close() error {
+	err := db.city.Close()
+	if db.asn != nil {
+		if asn_err := db.asn.Close(); err == nil {
+			err = asn_err
+		}
+	}
+	return err
+}
+
+
+// Returns the build dates of the databases, by database type, like
+// "GeoLite2-City"
+func (db *MMDB) buildDates() map[string]time.Time {
+	dates := map[string]time.Time{}
+	for _, reader := range []*maxminddb.Reader{ db.city, db.asn } {
+		if reader != nil {
+			dates[reader.Metadata.DatabaseType] = time.Unix(int64(reader.Metadata.BuildEpoch), 0).UTC()
+		}
+	}
+	return dates
+}
+
+
+// Returns the geolocation information for a given IPv4 address,
+// like the GeoLocIPv4E() function. The Block is the network of the
+// address in the City database, and its LocId the GeoNames id of
+// the city.
+func (db *MMDB) GeoLocIPv4E(ip net.IP) (*GeoLocIp, error) {
+
+	if ip.To4() == nil {
+		return nil, ErrInvalidIP
+	}
+	return db.lookup(ip.To16(), true)
+}
+
+
+// Same as GeoLocIPv4E() for an IPv6 address. ErrInvalidIP is returned
+// for IPv4 addresses. Like with the CSV files, the Block of the returned
+// GeoLocIp is nil, and its Asn has no range.
+func (db *MMDB) GeoLocIPv6E(ip net.IP) (*GeoLocIp, error) {
+
+	if len(ip) != net.IPv6len || ip.To4() != nil {
+		return nil, ErrInvalidIP
+	}
+	return db.lookup(ip, false)
+}
+
+
+// Looks up an IP address, in its 16 bytes form, in the databases.
+// Blocks and ASN ranges are only set for IPv4 addresses.
+func (db *MMDB) lookup(ip net.IP, ipv4 bool) (*GeoLocIp, error) {
+
+	var record mmdbCity
+	network, ok, err := db.city.LookupNetwork(ip, &record)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrNoBlock
+	}
+	var block *Block
+	if ipv4 {
+		low_ip, high_ip := networkRange(network)
+		block = &Block{ low_ip, high_ip, record.City.GeoNameID }
+	}
+
+	location := &Location {
+		Country: record.Country.ISOCode,
+		City: record.City.Names["en"],
+		PostalCode: record.Postal.Code,
+	}
+	if record.Location.Latitude != nil && record.Location.Longitude != nil {
+		location.Latitude = *record.Location.Latitude
+		location.Longitude = *record.Location.Longitude
+	}
+	location.MetroCode = int(record.Location.MetroCode)
+	location.TimeZone = record.Location.TimeZone
+
+	// Country names come from the local table, like with the CSV files,
+	// and region names from the database, as its region codes are
+	// ISO 3166-2 codes, not the FIPS codes of the local table. They are
+	// in English unless another language is set.
+	lang := orDefault(db.language, DEFAULT_LANGUAGE)
+	var region string
+	if len(record.Subdivisions) > 0 {
+		location.Region = record.Subdivisions[0].ISOCode
+		region = record.Subdivisions[0].Names["en"]
+		if name := record.Subdivisions[0].Names[lang]; db.language != "" && name != "" {
+			region = name
+		}
+	}
+	country := location.CountryNameIn(lang)
+	if country == "" {
+		country = record.Country.Names[lang]
+	}
+
+	asn, err := db.lookupASN(ip, ipv4)
+	if err != nil {
+		return nil, err
+	}
+
+	var in_eu *bool
+	if location.Country != "" {
+		in_eu = &record.Country.IsInEuropeanUnion
+	}
+	return &GeoLocIp{ Ip: ip, Block: block, Location: location, Asn: asn, CountryName: &country, RegionName: &region, InEuropeanUnion: in_eu }, nil
+}
+
+
+// Looks up an IP address, in its 16 bytes form, in the ASN database.
+// Returns nil if there is no ASN database, or no ASN for the address.
+func (db *MMDB) lookupASN(ip net.IP, ipv4 bool) (*ASN, error) {
+
+	if db.asn == nil {
+		return nil, nil
+	}
+	var asn_record mmdbASN
+	network, ok, err := db.asn.LookupNetwork(ip, &asn_record)
+	if err != nil || !ok {
+		return nil, err
+	}
+	asn := &ASN{
+		ASN: fmt.Sprintf("AS%d %s", asn_record.Number, asn_record.Organization),
+		Number: uint32(asn_record.Number),
+		Organization: asn_record.Organization,
+	}
+	if ipv4 {
+		asn.LowIP, asn.HighIP = networkRange(network)
+	}
+	return asn, nil
+}
+
+
+// Returns the first and last addresses of an IPv4 network. For an
+// IPv6 database whose IPv4 subtree is a single record, the network is
+// an IPv6 one, covering all the IPv4 addresses.
+func networkRange(network *net.IPNet) (uint32, uint32) {
+	ones, bits := network.Mask.Size()
+	if bits != 32 {
+		return 0, 0xFFFFFFFF
+	}
+	low_ip := binary.BigEndian.Uint32(network.IP.To4())
+	return low_ip, low_ip | (uint32(1) << (32 - ones) - 1)
+}
@@ -0,0 +1,496 @@
+package geoip
+
+import (
+	"testing"
+	"testing/fstest"
+	"net"
+	"os"
+	"bytes"
+	"math"
+	"encoding/binary"
+	"path/filepath"
+	"archive/tar"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+	"sync"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+)
+
+
+// Encodes a value in the MaxMind DB data section format, see
+// https://maxmind.github.io/MaxMind-DB/
+func encodeMMDB(value interface{}) []byte {
+
+	var b bytes.Buffer
+	control := func(data_type int, size int) {
+		extended := data_type > 7
+		first := data_type << 5
+		if extended {
+			first = 0
+		}
+		var size_bytes []byte
+		switch {
+		case size < 29 :
+			first |= size
+		case size < 285 :
+			first |= 29
+			size_bytes = []byte{ byte(size - 29) }
+		default :
+			first |= 30
+			size_bytes = []byte{ byte((size - 285) >> 8), byte(size - 285) }
+		}
+		b.WriteByte(byte(first))
+		if extended {
+			b.WriteByte(byte(data_type - 7))
+		}
+		b.Write(size_bytes)
+	}
+	unsigned := func(data_type int, n uint64) {
+		var buf [8]byte
+		binary.BigEndian.PutUint64(buf[:], n)
+		trimmed := bytes.TrimLeft(buf[:], "\x00")
+		control(data_type, len(trimmed))
+		b.Write(trimmed)
+	}
+
+	switch v := value.(type) {
+	case string :
+		control(2, len(v))
+		b.WriteString(v)
+	case float64 :
+		control(3, 8)
+		binary.Write(&b, binary.BigEndian, math.Float64bits(v))
+	case uint16 :
+		unsigned(5, uint64(v))
+	case uint32 :
+		unsigned(6, uint64(v))
+	case uint64 :
+		unsigned(9, v)
+	case bool :
+		size := 0
+		if v {
+			size = 1
+		}
+		control(14, size)
+	case map[string]interface{} :
+		control(7, len(v))
+		for key, item := range v {
+			b.Write(encodeMMDB(key))
+			b.Write(encodeMMDB(item))
+		}
+	case []interface{} :
+		control(11, len(v))
+		for _, item := range v {
+			b.Write(encodeMMDB(item))
+		}
+	default :
+		panic("unsupported MMDB type")
+	}
+	return b.Bytes()
+}
+
+
+// Writes a minimal IPv6 MaxMind DB file, holding the given records
+// indexed by network. IPv4 networks are stored in the ::/96 subtree,
+// like in the MaxMind databases.
+func writeTestMMDB(t testing.TB, filename string, database_type string, records map[string]map[string]interface{}) {
+
+	var data bytes.Buffer
+	nodes := [][2]int{ { -1, -1 } }	// -1 for empty, -2-offset for data
+
+	for cidr, record := range records {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatalf("Bad test network %s: %v", cidr, err)
+		}
+		ones, bits := network.Mask.Size()
+		ip := network.IP.To16()
+		if bits == 32 {
+			ip = append(make(net.IP, 12), network.IP.To4()...)
+			ones += 96
+		}
+		offset := data.Len()
+		data.Write(encodeMMDB(record))
+
+		node := 0
+		for i := 0; i < ones; i++ {
+			bit := (ip[i/8] >> (7 - uint(i%8))) & 1
+			if i == ones-1 {
+				nodes[node][bit] = -2 - offset
+				break
+			}
+			if nodes[node][bit] == -1 {
+				nodes = append(nodes, [2]int{ -1, -1 })
+				nodes[node][bit] = len(nodes) - 1
+			}
+			node = nodes[node][bit]
+		}
+	}
+
+	var b bytes.Buffer
+	node_count := len(nodes)
+	for _, node := range nodes {
+		for _, record := range node {
+			value := record
+			switch {
+			case record == -1 :
+				value = node_count
+			case record < -1 :
+				value = node_count + 16 + (-2 - record)
+			}
+			b.Write([]byte{ byte(value >> 16), byte(value >> 8), byte(value) })
+		}
+	}
+	b.Write(make([]byte, 16))
+	b.Write(data.Bytes())
+	b.WriteString("\xab\xcd\xefMaxMind.com")
+	b.Write(encodeMMDB(map[string]interface{}{
+		"node_count": uint32(node_count),
+		"record_size": uint16(24),
+		"ip_version": uint16(6),
+		"database_type": database_type,
+		"languages": []interface{}{ "en" },
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch": uint64(1700000000),
+		"description": map[string]interface{}{ "en": "geoip test database" },
+	}))
+
+	if err := os.WriteFile(filename, b.Bytes(), 0644); err != nil {
+		t.Fatalf("Cannot write %s: %v", filename, err)
+	}
+}
+
+
+// Writes test GeoLite2 City and ASN databases in a temporary
+// directory, and returns their filenames
+func writeTestGeoLite2(t testing.TB) (string, string) {
+
+	dir := t.TempDir()
+	city_file := filepath.Join(dir, "GeoLite2-City.mmdb")
+	asn_file := filepath.Join(dir, "GeoLite2-ASN.mmdb")
+
+	writeTestMMDB(t, city_file, "GeoLite2-City", map[string]map[string]interface{}{
+		"54.88.0.0/14": {
+			"city": map[string]interface{}{ "geoname_id": uint32(4744870), "names": map[string]interface{}{ "en": "Ashburn" } },
+			"country": map[string]interface{}{ "iso_code": "US", "names": map[string]interface{}{ "en": "United States", "fr": "États-Unis" } },
+			"location": map[string]interface{}{ "latitude": 39.0335, "longitude": -77.4838, "metro_code": uint16(511), "time_zone": "America/New_York" },
+			"postal": map[string]interface{}{ "code": "20147" },
+			"subdivisions": []interface{}{ map[string]interface{}{ "iso_code": "VA", "names": map[string]interface{}{ "en": "Virginia" } } },
+		},
+		"81.7.0.0/24": {
+			"city": map[string]interface{}{ "geoname_id": uint32(2988507), "names": map[string]interface{}{ "en": "Paris" } },
+			"country": map[string]interface{}{ "iso_code": "FR", "names": map[string]interface{}{ "en": "France", "fr": "France" } },
+			"location": map[string]interface{}{ "latitude": 48.8667, "longitude": 2.3333 },
+			"subdivisions": []interface{}{ map[string]interface{}{ "iso_code": "IDF", "names": map[string]interface{}{ "en": "Île-de-France" } } },
+		},
+		"2001:200::/32": {
+			"country": map[string]interface{}{ "iso_code": "JP", "names": map[string]interface{}{ "en": "Japan", "fr": "Japon" } },
+			"location": map[string]interface{}{ "latitude": 35.69, "longitude": 139.69 },
+		},
+	})
+	writeTestMMDB(t, asn_file, "GeoLite2-ASN", map[string]map[string]interface{}{
+		"54.88.0.0/14": { "autonomous_system_number": uint32(14618), "autonomous_system_organization": "Amazon.com, Inc." },
+		"2001:200::/32": { "autonomous_system_number": uint32(2500), "autonomous_system_organization": "WIDE Project" },
+	})
+	return city_file, asn_file
+}
+
+
+func TestMMDB(t *testing.T) {
+	city_file, asn_file := writeTestGeoLite2(t)
+
+	db, err := OpenMMDB(city_file, asn_file)
+	if err != nil {
+		t.Fatalf("Cannot open test databases: %v", err)
+	}
+	defer db.Close()
+
+	gli, err := db.GeoLocIPv4E(net.ParseIP("54.88.55.63"))
+	if err != nil {
+		t.Fatalf("Lookup error: %v", err)
+	}
+	expected := Location{ "US", "VA", "Ashburn", "20147", 39.0335, -77.4838, 511, 0, "America/New_York" }
+	if *gli.Location != expected || *gli.CountryName != "États-Unis" || *gli.RegionName != "Virginia" {
+		t.Errorf("Location does not match: %v", gli)
+	}
+	if *gli.Block != (Block{ 911736832, 911998975, 4744870 }) {
+		t.Errorf("Block does not match: %v", gli.Block)
+	}
+	if gli.Asn == nil || gli.Asn.ASN != "AS14618 Amazon.com, Inc." {
+		t.Errorf("ASN does not match: %v", gli.Asn)
+	}
+
+	gli, err = db.GeoLocIPv4E(net.ParseIP("81.7.0.1"))
+	if err != nil || *gli.CountryName != "France" || *gli.RegionName != "Île-de-France" || gli.Asn != nil {
+		t.Errorf("Paris does not match: %v, %v", gli, err)
+	}
+	if _, err := db.GeoLocIPv4E(net.ParseIP("10.0.0.1")); err != ErrNoBlock {
+		t.Errorf("Expected ErrNoBlock, got %v", err)
+	}
+
+	gli, err = db.GeoLocIPv6E(net.ParseIP("2001:200::1"))
+	if err != nil || gli.Location.Country != "JP" || gli.Block != nil || gli.Asn == nil || *gli.Asn != (ASN{ ASN: "AS2500 WIDE Project", Number: 2500, Organization: "WIDE Project" }) {
+		t.Errorf("IPv6 lookup does not match: %v, %v", gli, err)
+	}
+	if _, err := db.GeoLocIPv6E(net.ParseIP("54.88.55.63")); err != ErrInvalidIP {
+		t.Errorf("Expected ErrInvalidIP, got %v", err)
+	}
+	if dates := db.buildDates(); len(dates) != 2 || !dates["GeoLite2-City"].Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("Unexpected build dates: %v", dates)
+	}
+
+	// The package functions use the databases through SetLocator()
+	if err := UseMMDB(city_file, ""); err != nil {
+		t.Fatalf("Cannot use test databases: %v", err)
+	}
+	defer SetLocator(nil)
+	if gli := GeoLocIPv4(net.ParseIP("54.88.55.63")); gli == nil || gli.Location.City != "Ashburn" || gli.Asn != nil {
+		t.Errorf("GeoLocIPv4() does not use the MMDB locator: %v", gli)
+	}
+	if gli, err := Lookup(net.ParseIP("2001:200::1")); err != nil || gli.Location.Country != "JP" {
+		t.Errorf("Lookup() does not use the MMDB locator for IPv6: %v, %v", gli, err)
+	}
+
+	// The European Union membership is the one of the database, like for
+	// the United Kingdom before 2020
+	old_file := filepath.Join(t.TempDir(), "GeoLite2-City.mmdb")
+	writeTestMMDB(t, old_file, "GeoLite2-City", map[string]map[string]interface{}{
+		"81.2.69.0/24": { "country": map[string]interface{}{ "iso_code": "GB", "is_in_european_union": true } },
+		"81.7.0.0/24": { "country": map[string]interface{}{ "iso_code": "FR" } },
+	})
+	old_db, err := OpenMMDB(old_file, "")
+	if err != nil {
+		t.Fatalf("Cannot open test database: %v", err)
+	}
+	defer old_db.Close()
+	if gli, err := old_db.GeoLocIPv4E(net.ParseIP("81.2.69.1")); err != nil || !gli.IsInEuropeanUnion() {
+		t.Errorf("Expected the United Kingdom in the EU of the database: %v, %v", gli, err)
+	}
+	if gli, err := old_db.GeoLocIPv4E(net.ParseIP("81.7.0.1")); err != nil || gli.IsInEuropeanUnion() {
+		t.Errorf("Expected France outside the EU without the field: %v, %v", gli, err)
+	}
+}
+
+
+func TestMMDBFS(t *testing.T) {
+	city_file, asn_file := writeTestGeoLite2(t)
+
+	fsys := fstest.MapFS{}
+	for name, filename := range map[string]string{ "data/GeoLite2-City.mmdb": city_file, "data/GeoLite2-ASN.mmdb": asn_file } {
+		content, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatalf("Cannot read %s: %v", filename, err)
+		}
+		fsys[name] = &fstest.MapFile{ Data: content }
+	}
+
+	db, err := New(Config{ FS: fsys, Dir: "data", Language: "fr" })
+	if err != nil {
+		t.Fatalf("Cannot create DB from the embedded databases: %v", err)
+	}
+	defer db.Close()
+	gli, err := db.GeoLocIPv4E(net.ParseIP("54.88.55.63"))
+	if err != nil || gli.Location.City != "Ashburn" || *gli.CountryName != "États-Unis" || gli.Asn == nil || gli.Asn.Number != 14618 {
+		t.Errorf("Lookup does not match: %v, %v", gli, err)
+	}
+
+	if _, err := OpenMMDBFS(fsys, "data/missing.mmdb", ""); err == nil {
+		t.Errorf("Expected an error for a missing database")
+	}
+	fsys["data/GeoLite2-ASN.mmdb"] = &fstest.MapFile{ Data: []byte("not a database") }
+	if _, err := New(Config{ FS: fsys, Dir: "data" }); err == nil {
+		t.Errorf("Expected an error for a corrupted database")
+	}
+}
+
+
+// Returns a tar.gz archive holding the given files, by name, like the
+// GeoLite2 archives holding their files in a dated directory
+func tarGz(t testing.TB, files map[string]string) []byte {
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	tw := tar.NewWriter(gz)
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{ Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg }); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+	gz.Close()
+	return b.Bytes()
+}
+
+
+func TestDownloadGeoLite2(t *testing.T) {
+	city_file, asn_file := writeTestGeoLite2(t)
+	archives := map[string][]byte{}
+	for edition, filename := range map[string]string{ "GeoLite2-City": city_file, "GeoLite2-ASN": asn_file } {
+		content, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatalf("Cannot read %s: %v", filename, err)
+		}
+		archives["/" + edition] = tarGz(t, map[string]string{ edition + "_20240102/" + edition + ".mmdb": string(content) })
+	}
+	for _, name := range []string{ "/GeoLite2-City", "/GeoLite2-ASN" } {
+		sum := sha256.Sum256(archives[name])
+		archives[name + ".sha256"] = []byte(hex.EncodeToString(sum[:]) + "  " + name[1:] + "_20240101.tar.gz\n")
+	}
+	var mu sync.Mutex
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id, key, ok := r.BasicAuth(); !ok || id != "42" || key != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		w.Write(archives[r.URL.Path])
+	}))
+	defer server.Close()
+	saved_url, saved_client, saved_hosts := GeoLite2URL, DownloadClient, MaxmindCredentialHosts
+	defer func() { GeoLite2URL, DownloadClient, MaxmindCredentialHosts = saved_url, saved_client, saved_hosts }()
+	GeoLite2URL = server.URL + "/%s"
+	DownloadClient = server.Client()
+
+	// The credentials are not sent to a mirror
+	if _, err := New(Config{ Dir: t.TempDir(), Download: true, Credentials: Credentials{ "42", "secret" } }); err != ErrUnauthorized {
+		t.Errorf("Expected ErrUnauthorized from a mirror, got %v", err)
+	}
+	MaxmindCredentialHosts = append(MaxmindCredentialHosts, strings.TrimPrefix(server.URL, "https://"))
+
+	db, err := New(Config{ Dir: t.TempDir(), Download: true, Credentials: Credentials{ "42", "secret" } })
+	if err != nil {
+		t.Fatalf("Cannot create DB: %v", err)
+	}
+	defer db.Close()
+	if gli, err := db.GeoLocIPv4E(net.ParseIP("54.88.55.63")); err != nil || gli.Location.City != "Ashburn" || gli.Asn == nil {
+		t.Errorf("Lookup in downloaded databases failed: %v, %v", gli, err)
+	}
+	if err := db.Reload(); err != nil {
+		t.Errorf("Cannot reload: %v", err)
+	}
+	if gli, err := db.Lookup(net.ParseIP("2001:200::1")); err != nil || gli.Location.Country != "JP" {
+		t.Errorf("Lookup after reload failed: %v, %v", gli, err)
+	}
+
+	if _, err := New(Config{ Dir: t.TempDir(), Download: true, Credentials: Credentials{ "42", "wrong" } }); err != ErrUnauthorized {
+		t.Errorf("Expected ErrUnauthorized, got %v", err)
+	}
+
+	// A corrupted download does not replace the current archive
+	dir := t.TempDir()
+	if err := DownloadGeoLite2To(dir, Credentials{ "42", "secret" }); err != nil {
+		t.Fatalf("Cannot download: %v", err)
+	}
+	archive := filepath.Join(dir, "GeoLite2-City.tar.gz")
+	old := time.Now().Add(-10 * 24 * time.Hour)
+	os.Chtimes(archive, old, old)
+	mu.Lock()
+	city_archive := archives["/GeoLite2-City"]
+	archives["/GeoLite2-City"] = city_archive[:100]
+	mu.Unlock()
+	if err := DownloadGeoLite2To(dir, Credentials{ "42", "secret" }); err != ErrChecksumMismatch {
+		t.Errorf("Expected ErrChecksumMismatch, got %v", err)
+	}
+	if content, err := os.ReadFile(archive); err != nil || len(content) <= 100 {
+		t.Errorf("The current archive should be kept: %d bytes, %v", len(content), err)
+	}
+	if tmp_files, _ := filepath.Glob(filepath.Join(dir, "*.tmp")); len(tmp_files) != 0 {
+		t.Errorf("The corrupted download should be removed: %v", tmp_files)
+	}
+
+	// A truncated archive left by a crash is removed, and downloaded
+	// again the next time
+	mu.Lock()
+	archives["/GeoLite2-City"] = city_archive
+	mu.Unlock()
+	asn_archive := filepath.Join(dir, "GeoLite2-ASN.tar.gz")
+	if err := os.WriteFile(asn_archive, []byte("truncated"), 0644); err != nil {
+		t.Fatalf("Cannot write archive: %v", err)
+	}
+	mmdb_file := filepath.Join(dir, "GeoLite2-ASN.mmdb")
+	before, _ := os.ReadFile(mmdb_file)
+	if err := DownloadGeoLite2To(dir, Credentials{ "42", "secret" }); err == nil {
+		t.Errorf("Expected an error for a truncated archive")
+	}
+	if after, _ := os.ReadFile(mmdb_file); !bytes.Equal(before, after) {
+		t.Errorf("The extracted database should be kept")
+	}
+	if _, err := os.Stat(asn_archive); !os.IsNotExist(err) {
+		t.Errorf("The truncated archive should be removed: %v", err)
+	}
+	if err := DownloadGeoLite2To(dir, Credentials{ "42", "secret" }); err != nil {
+		t.Errorf("Cannot download again: %v", err)
+	}
+
+	// Nor over plain HTTP, even to the allowed hosts
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, _, ok := r.BasicAuth(); ok {
+			t.Errorf("Credentials sent over plain HTTP")
+		}
+	}))
+	defer plain.Close()
+	MaxmindCredentialHosts = append(MaxmindCredentialHosts, strings.TrimPrefix(plain.URL, "http://"))
+	if in, err := httpGet(plain.URL, Credentials{ "42", "secret" }, nil); err == nil {
+		in.Body.Close()
+	}
+}
+
+
+func TestAnonymousIPs(t *testing.T) {
+	useTestData(t)
+
+	dir := t.TempDir()
+	mmdb_file := filepath.Join(dir, "GeoIP2-Anonymous-IP.mmdb")
+	writeTestMMDB(t, mmdb_file, "GeoIP2-Anonymous-IP", map[string]map[string]interface{}{
+		"54.88.0.0/14": { "is_anonymous": true, "is_anonymous_vpn": true, "is_hosting_provider": true },
+	})
+	tor_file := filepath.Join(dir, "torbulkexitlist")
+	if err := os.WriteFile(tor_file, []byte("# Tor exits\n81.7.0.1\nExitAddress 81.7.0.2 2024-01-01 00:00:00\nnot an address\n\n"), 0644); err != nil {
+		t.Fatalf("Cannot write Tor exit list: %v", err)
+	}
+
+	anonymous, err := OpenAnonymousIPs(mmdb_file, tor_file)
+	if err != nil {
+		t.Fatalf("OpenAnonymousIPs() failed: %v", err)
+	}
+	defer anonymous.Close()
+
+	// Without anonymous IP data, there is no Anonymity
+	if gli, err := GeoLocIPv4E(net.ParseIP("54.88.55.63")); err != nil || gli.Anonymity != nil {
+		t.Errorf("Unexpected Anonymity: %v, %v", gli, err)
+	}
+
+	SetAnonymousIPs(anonymous)
+	tests := []struct {
+		ip string
+		expected Anonymity
+	}{
+		{ "54.88.55.63", Anonymity{ IsAnonymous: true, IsVPN: true, IsHosting: true } },
+		{ "81.7.0.1", Anonymity{ IsAnonymous: true, IsTor: true } },
+		{ "81.7.0.2", Anonymity{ IsAnonymous: true, IsTor: true } },
+		{ "81.7.0.3", Anonymity{} },
+	}
+	for _, test := range tests {
+		gli, err := Lookup(net.ParseIP(test.ip))
+		if err != nil || gli.Anonymity == nil || *gli.Anonymity != test.expected {
+			t.Errorf("%s: expected %+v, got %v, %v", test.ip, test.expected, gli, err)
+		}
+	}
+
+	gli, _ := GeoLocIPv4E(net.ParseIP("81.7.0.1"))
+	buf, _ := json.Marshal(gli)
+	if !strings.Contains(string(buf), `"is_anonymous":true,"is_tor":true,"is_vpn":false,"is_hosting":false,"is_proxy":false`) {
+		t.Errorf("Unexpected anonymity in JSON: %s", buf)
+	}
+	var decoded GeoLocIp
+	if err := json.Unmarshal(buf, &decoded); err != nil || decoded.Anonymity == nil || *decoded.Anonymity != *gli.Anonymity {
+		t.Errorf("Decoded Anonymity does not match: %v, %v", &decoded, err)
+	}
+}
@@ -0,0 +1,200 @@
+
+package geoip
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+
+// This file provides the names of the countries and regions in several
+// languages : French (the default) and English from the local tables,
+// and any other language registered with RegisterNames().
+
+
+// A NameTable gives the names of the countries and regions in a given
+// language, or "" when unknown. Country codes are ISO 3166-1 alpha 2
+// codes, and region codes the ones of the MaxMind files.
+type NameTable interface {
+	CountryName(country_code string) string
+	RegionName(country_code string, region_code string) string
+}
+
+
+// Language of the names used when none is given, as the local tables
+// were first only in French
+const DEFAULT_LANGUAGE = "fr"
+
+
+// The names of the local tables. Region names are in English in both
+// languages, as in the MaxMind files.
+type localNames struct {
+	english bool
+}
+
+func (names localNames) CountryName(country_code string) string {
+	loadNames()
+	tree := countries_tree
+	if names.english {
+		tree = countries_en_tree
+	}
+	if tree == nil {
+		return ""
+	}
+	if country := tree.Get(country_code); country != nil {
+		return country.Name
+	}
+	return ""
+}
+
+func (names localNames) RegionName(country_code string, region_code string) string {
+	loadNames()
+	if regions_tree == nil {
+		return ""
+	}
+	if region := regions_tree.Get(country_code + region_code); region != nil {
+		return region.Name
+	}
+	return ""
+}
+
+
+// The name tables by language, protected by name_tables_mu
+var name_tables = map[string]NameTable{
+	"fr": localNames{},
+	"en": localNames{ english: true },
+}
+var name_tables_mu sync.RWMutex
+
+
+// Registers the names of a language, like "de" or "pt-BR", replacing
+// the local tables for French and English if given for them. This
+// can be used to plug CLDR-based tables.
+func RegisterNames(lang string, table NameTable) {
+	name_tables_mu.Lock()
+	name_tables[strings.ToLower(lang)] = table
+	name_tables_mu.Unlock()
+}
+
+
+// Returns the names of a language, or nil if it is unknown. A language
+// with a region (like "en-US") falls back to the language alone ("en").
+func NamesFor(lang string) NameTable {
+	lang = strings.ToLower(strings.TrimSpace(lang))
+	name_tables_mu.RLock()
+	defer name_tables_mu.RUnlock()
+	if table, ok := name_tables[lang]; ok {
+		return table
+	}
+	if base, _, found := strings.Cut(lang, "-"); found {
+		return name_tables[base]
+	}
+	return nil
+}
+
+
+// Returns the names of a language, or the ones of DEFAULT_LANGUAGE if
+// it is unknown
+func namesOrDefault(lang string) NameTable {
+	if table := NamesFor(lang); table != nil {
+		return table
+	}
+	return NamesFor(DEFAULT_LANGUAGE)
+}
+
+
+// Returns the country name of a Location in a given language, or ""
+func (loc *Location) CountryNameIn(lang string) string {
+	return namesOrDefault(lang).CountryName(loc.Country)
+}
+
+
+// Returns the region name of a Location in a given language, or ""
+func (loc *Location) RegionNameIn(lang string) string {
+	return namesOrDefault(lang).RegionName(loc.Country, loc.Region)
+}
+
+
+// Error returned by SetLanguage() for a language without names
+var ErrUnknownLanguage = errors.New("No names for this language")
+
+
+// Sets the language of the names returned by the lookups of the
+// default DB, see DB.SetLanguage().
+func SetLanguage(lang string) error {
+	return default_db.SetLanguage(lang)
+}
+
+
+// Sets the language of the CountryName and RegionName of the GeoLocIp
+// returned by the lookups of the DB, like Config.Language.
+// ErrUnknownLanguage is returned if there are no names for it.
+func (db *DB) SetLanguage(lang string) error {
+	if NamesFor(lang) == nil {
+		return ErrUnknownLanguage
+	}
+	db.mu.Lock()
+	db.config.Language = lang
+	db.mu.Unlock()
+	db.update(func(data *snapshot) {
+		data.language = lang
+		// The GeoLite2 databases are shared with a copy using the language
+		if data.geolite2 != nil {
+			mmdb := *data.geolite2
+			mmdb.language = lang
+			if data.locator == Locator(data.geolite2) {
+				data.locator = &mmdb
+			}
+			data.geolite2 = &mmdb
+		}
+		if pl, ok := data.locator.(*providerLocator); ok {
+			data.locator = &providerLocator{ pl.provider, lang }
+		}
+	})
+	return nil
+}
+
+
+// Returns the first language of a request with known names, given by
+// its lang parameter, or else by its Accept-Language header, the most
+// preferred first (by their q-values), or ""
+func requestLanguage(request *http.Request) string {
+	if lang := request.URL.Query().Get("lang"); lang != "" && NamesFor(lang) != nil {
+		return lang
+	}
+
+	// Languages of the header, with their q-value, 1 if not given
+	type accepted struct {
+		lang string
+		q float64
+	}
+	var langs []accepted
+	for _, value := range request.Header.Values("Accept-Language") {
+		for _, entry := range strings.Split(value, ",") {
+			lang, params, _ := strings.Cut(entry, ";")
+			q := 1.0
+			if q_value, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+				var err error
+				if q, err = strconv.ParseFloat(q_value, 64); err != nil {
+					continue
+				}
+			}
+			if lang = strings.TrimSpace(lang); lang != "*" && q > 0 {
+				langs = append(langs, accepted{ lang, q })
+			}
+		}
+	}
+	// Stable, so the languages of a same q-value keep their order
+	sort.SliceStable(langs, func(i, j int) bool { return langs[i].q > langs[j].q })
+
+	for _, candidate := range langs {
+		if NamesFor(candidate.lang) != nil {
+			return candidate.lang
+		}
+	}
+	return ""
+}
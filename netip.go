@@ -0,0 +1,184 @@
+
+package geoip
+
+import (
+	"net"
+	"net/netip"
+	"sort"
+)
+
+
+// This file provides lookups of netip.Addr addresses, returning the
+// network of the matched block as a netip.Prefix.
+
+
+// Returns the geolocation information for a given IP address, like
+// Lookup(), and the network of the matching block, see DB.LookupAddr().
+func LookupAddr(addr netip.Addr) (*GeoLocIp, netip.Prefix, error) {
+	return defaultDB().LookupAddr(addr)
+}
+
+
+// Same as Lookup(), for a netip.Addr, using the data of the DB. The
+// prefix returned with the geolocation information is the largest
+// network holding the address within the matching block, as a block of
+// the MaxMind files is a range that is not always a CIDR network. It is
+// the zero Prefix when the block is unknown, for example for the IPv6
+// addresses found by a Locator. IPv4-mapped IPv6 addresses are looked
+// up as IPv4 addresses.
+func (db *DB) LookupAddr(addr netip.Addr) (*GeoLocIp, netip.Prefix, error) {
+
+	if !addr.IsValid() {
+		return nil, netip.Prefix{}, ErrInvalidIP
+	}
+	addr = addr.Unmap().WithZone("")
+
+	if addr.Is4() {
+		ip4 := addr.As4()
+		gli, err := db.GeoLocIPv4E(net.IP(ip4[:]))
+		if err != nil || gli.Block == nil || gli.Block.LowIP > gli.Block.HighIP {
+			return gli, netip.Prefix{}, err
+		}
+		return gli, rangePrefix(addr, uint32ToAddr(gli.Block.LowIP), uint32ToAddr(gli.Block.HighIP)), nil
+	}
+
+	ip6 := addr.As16()
+	gli, err := db.GeoLocIPv6E(net.IP(ip6[:]))
+	if err != nil {
+		return nil, netip.Prefix{}, err
+	}
+
+	// GeoLocIPv6E() does not return the block, found again here
+	data := db.snapshot()
+	if gli.Source == OVERRIDE_SOURCE && data.overrides != nil {
+		_, prefix := data.overrides.Get(net.IP(ip6[:]))
+		return gli, prefix, nil
+	}
+	if _, ok := data.locator.(IPv6Locator); ok || data.blocks6 == nil {
+		return gli, netip.Prefix{}, nil
+	}
+	block := data.blocks6.Get(net.IP(ip6[:]))
+	if block == nil {
+		return gli, netip.Prefix{}, nil
+	}
+	return gli, rangePrefix(addr, netip.AddrFrom16(block.LowIP), netip.AddrFrom16(block.HighIP)), nil
+}
+
+
+// Returns the network of an IPv4 block holding an IP address, in CIDR
+// notation, see rangePrefix(), or "" if there is no such block
+func blockNetwork(ip net.IP, block *Block) string {
+	ip4 := ip.To4()
+	if ip4 == nil || block == nil || block.LowIP > block.HighIP {
+		return ""
+	}
+	addr := netip.AddrFrom4([4]byte(ip4))
+	low, high := uint32ToAddr(block.LowIP), uint32ToAddr(block.HighIP)
+	if addr.Compare(low) < 0 || high.Compare(addr) < 0 {
+		return ""
+	}
+	return rangePrefix(addr, low, high).String()
+}
+
+
+// Same as blockNetwork(), for an IPv6 address in its 16 bytes form and
+// its block
+func block6Network(ip net.IP, block *Block6) string {
+	addr := netip.AddrFrom16([16]byte(ip))
+	return rangePrefix(addr, netip.AddrFrom16(block.LowIP), netip.AddrFrom16(block.HighIP)).String()
+}
+
+
+// Returns an IPv4 address stored as an uint32 in the blocks and ASN
+// files as a netip.Addr
+func uint32ToAddr(addr uint32) netip.Addr {
+	return netip.AddrFrom4([4]byte{ byte(addr >> 24), byte(addr >> 16), byte(addr >> 8), byte(addr) })
+}
+
+
+// Returns the largest network holding addr whose addresses are all
+// between low and high
+func rangePrefix(addr netip.Addr, low netip.Addr, high netip.Addr) netip.Prefix {
+	for bits := 0; bits < addr.BitLen(); bits++ {
+		prefix, _ := addr.Prefix(bits)
+		if low.Compare(prefix.Addr()) <= 0 && lastAddr(prefix).Compare(high) <= 0 {
+			return prefix
+		}
+	}
+	return netip.PrefixFrom(addr, addr.BitLen())
+}
+
+
+// Returns the last address of a network
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	ip := prefix.Addr().As16()
+	offset := 0
+	if prefix.Addr().Is4() {
+		offset = 96
+	}
+	for bit := offset + prefix.Bits(); bit < 128; bit++ {
+		ip[bit / 8] |= 0x80 >> (bit % 8)
+	}
+	last := netip.AddrFrom16(ip)
+	if prefix.Addr().Is4() {
+		return last.Unmap()
+	}
+	return last
+}
+
+
+// A map of values by network, looked up by longest prefix match. IPv4
+// networks are stored as IPv4-mapped IPv6 ones, so the addresses are
+// looked up in their 16 bytes form.
+type prefixMap[V any] struct {
+	values map[netip.Prefix]V
+	lengths []int	// prefix lengths found, longest first
+}
+
+
+// Adds a network with its value, replacing the one of the same network
+func (pm *prefixMap[V]) add(prefix netip.Prefix, value V) {
+
+	if pm.values == nil {
+		pm.values = make(map[netip.Prefix]V)
+	}
+	prefix = prefix.Masked()
+	if prefix.Addr().Is4() {
+		prefix = netip.PrefixFrom(netip.AddrFrom16(prefix.Addr().As16()), prefix.Bits() + 96)
+	}
+	pm.values[prefix] = value
+
+	// Records the prefix length, keeping them sorted longest first
+	bits := prefix.Bits()
+	i := sort.Search(len(pm.lengths), func(i int) bool { return pm.lengths[i] <= bits })
+	if i < len(pm.lengths) && pm.lengths[i] == bits {
+		return
+	}
+	pm.lengths = append(pm.lengths, 0)
+	copy(pm.lengths[i+1:], pm.lengths[i:])
+	pm.lengths[i] = bits
+}
+
+
+// Returns the value of the most specific network holding an IP
+// address, with this network, and false if there is none
+func (pm *prefixMap[V]) get(ip net.IP) (V, netip.Prefix, bool) {
+
+	var none V
+	addr, ok := netip.AddrFromSlice(ip.To16())
+	if !ok {
+		return none, netip.Prefix{}, false
+	}
+	for _, bits := range pm.lengths {
+		prefix, _ := addr.Prefix(bits)
+		if value, ok := pm.values[prefix]; ok {
+			// An IPv4 network, unless an IPv6 one shorter than /96
+			// holds the address
+			if addr.Is4In6() && bits >= 96 {
+				prefix = netip.PrefixFrom(addr.Unmap(), bits - 96).Masked()
+			}
+			return value, prefix, true
+		}
+	}
+	return none, netip.Prefix{}, false
+}
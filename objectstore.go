@@ -0,0 +1,260 @@
+
+package geoip
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+
+// This file provides the downloads from s3:// and gs:// URLs, like
+// s3://bucket/geoip/GeoLiteCity-latest.zip, with the ambient
+// credentials, so the download URLs (see MaxmindCityURL and GeoLite2URL)
+// can point at archives staged in Amazon S3 or Google Cloud Storage.
+//
+// The S3 requests are signed (AWS Signature Version 4) with the
+// credentials of the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN environment variables, or else of the instance
+// role (EC2 instance metadata), in the AWS_REGION or AWS_DEFAULT_REGION
+// region (us-east-1 by default). AWS_ENDPOINT_URL_S3 or AWS_ENDPOINT_URL
+// give another endpoint, like a MinIO server.
+//
+// The Cloud Storage requests use the access token of the service account
+// of the instance (GCE metadata server), or none for public buckets.
+// STORAGE_EMULATOR_HOST gives another endpoint.
+
+
+// Instance metadata servers of AWS and Google Cloud
+var (
+	aws_metadata_url = "http://169.254.169.254"
+	gcp_metadata_url = "http://metadata.google.internal"
+)
+
+
+// HTTP client of the instance metadata servers, without proxy
+var metadata_client = &http.Client{ Timeout: 2 * time.Second, Transport: &http.Transport{} }
+
+
+// AWS credentials
+type awsCredentials struct {
+	AccessKeyId string
+	SecretAccessKey string
+	Token string
+}
+
+
+// Returns the GET request of a download URL : s3:// and gs:// URLs
+// are turned into requests to the S3 and Cloud Storage APIs, with the
+// ambient credentials
+func newDownloadRequest(url string) (*http.Request, error) {
+	switch {
+	case strings.HasPrefix(url, "s3://") :
+		return newS3Request(url)
+	case strings.HasPrefix(url, "gs://") :
+		return newGCSRequest(url)
+	}
+	return http.NewRequest("GET", url, nil)
+}
+
+
+// Returns the bucket and the object key of a s3:// or gs:// URL
+func splitBucketURL(url string) (string, string, error) {
+	_, path, _ := strings.Cut(url, "://")
+	bucket, key, _ := strings.Cut(path, "/")
+	if bucket == "" || key == "" {
+		return "", "", errors.New("Not a valid bucket URL: " + url)
+	}
+	return bucket, key, nil
+}
+
+
+// Returns the signed GET request of a s3:// URL
+func newS3Request(url string) (*http.Request, error) {
+
+	bucket, key, err := splitBucketURL(url)
+	if err != nil {
+		return nil, err
+	}
+	region := orDefault(os.Getenv("AWS_REGION"), orDefault(os.Getenv("AWS_DEFAULT_REGION"), "us-east-1"))
+
+	// Path-style requests to a custom endpoint, or to buckets whose
+	// name does not fit in the certificate of the virtual host
+	var request *http.Request
+	path := "/" + awsEscape(key)
+	if endpoint := orDefault(os.Getenv("AWS_ENDPOINT_URL_S3"), os.Getenv("AWS_ENDPOINT_URL")); endpoint != "" {
+		path = "/" + bucket + path
+		request, err = http.NewRequest("GET", strings.TrimSuffix(endpoint, "/") + path, nil)
+	} else if strings.Contains(bucket, ".") {
+		path = "/" + bucket + path
+		request, err = http.NewRequest("GET", fmt.Sprintf("https://s3.%s.amazonaws.com%s", region, path), nil)
+	} else {
+		request, err = http.NewRequest("GET", fmt.Sprintf("https://%s.s3.%s.amazonaws.com%s", bucket, region, path), nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	creds, err := awsAmbientCredentials()
+	if err != nil {
+		log_geolocip.Err(fmt.Sprintf("No AWS credentials for %s: %v", url, err))
+		return nil, err
+	}
+	signS3Request(request, creds, region, time.Now())
+	return request, nil
+}
+
+
+// Returns the AWS credentials set in the environment, or else the
+// ones of the EC2 instance role (IMDSv2)
+func awsAmbientCredentials() (awsCredentials, error) {
+
+	creds := awsCredentials{ os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"), os.Getenv("AWS_SESSION_TOKEN") }
+	if creds.AccessKeyId != "" && creds.SecretAccessKey != "" {
+		return creds, nil
+	}
+
+	request, _ := http.NewRequest("PUT", aws_metadata_url + "/latest/api/token", nil)
+	request.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "300")
+	token, err := metadataGet(request)
+	if err != nil {
+		return creds, err
+	}
+
+	request, _ = http.NewRequest("GET", aws_metadata_url + "/latest/meta-data/iam/security-credentials/", nil)
+	request.Header.Set("X-aws-ec2-metadata-token", string(token))
+	role, err := metadataGet(request)
+	if err != nil {
+		return creds, err
+	}
+
+	request, _ = http.NewRequest("GET", aws_metadata_url + "/latest/meta-data/iam/security-credentials/" + strings.TrimSpace(string(role)), nil)
+	request.Header.Set("X-aws-ec2-metadata-token", string(token))
+	content, err := metadataGet(request)
+	if err != nil {
+		return creds, err
+	}
+	err = json.Unmarshal(content, &creds)
+	return creds, err
+}
+
+
+// Signs a S3 GET request with AWS Signature Version 4, without signing
+// the payload
+func signS3Request(request *http.Request, creds awsCredentials, region string, now time.Time) {
+
+	amz_date := now.UTC().Format("20060102T150405Z")
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", amz_date[:8], region)
+
+	request.Header.Set("X-Amz-Date", amz_date)
+	request.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+	if creds.Token != "" {
+		request.Header.Set("X-Amz-Security-Token", creds.Token)
+	}
+
+	signed := []string{ "host" }
+	canonical_headers := "host:" + request.URL.Host + "\n"
+	names := []string{}
+	for name := range request.Header {
+		if strings.HasPrefix(strings.ToLower(name), "x-amz-") {
+			names = append(names, strings.ToLower(name))
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		signed = append(signed, name)
+		canonical_headers += name + ":" + strings.TrimSpace(request.Header.Get(name)) + "\n"
+	}
+	signed_headers := strings.Join(signed, ";")
+
+	canonical := strings.Join([]string{ "GET", request.URL.EscapedPath(), request.URL.RawQuery, canonical_headers, signed_headers, "UNSIGNED-PAYLOAD" }, "\n")
+	hash := sha256.Sum256([]byte(canonical))
+	to_sign := "AWS4-HMAC-SHA256\n" + amz_date + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{ amz_date[:8], region, "s3", "aws4_request", to_sign } {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyId, scope, signed_headers, hex.EncodeToString(key)))
+}
+
+
+// Escapes an object key as required by the AWS signature : all the
+// bytes but the unreserved characters and '/' are percent-encoded
+func awsEscape(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-._~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+
+// Returns the GET request of a gs:// URL, with the access token of the
+// instance service account if there is one
+func newGCSRequest(url string) (*http.Request, error) {
+
+	bucket, key, err := splitBucketURL(url)
+	if err != nil {
+		return nil, err
+	}
+	endpoint := "https://storage.googleapis.com"
+	if host := os.Getenv("STORAGE_EMULATOR_HOST"); host != "" {
+		endpoint = strings.TrimSuffix(host, "/")
+		if !strings.Contains(endpoint, "://") {
+			endpoint = "http://" + endpoint
+		}
+	}
+
+	path := "/" + bucket + "/" + awsEscape(key)
+	request, err := http.NewRequest("GET", endpoint + path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata, _ := http.NewRequest("GET", gcp_metadata_url + "/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	metadata.Header.Set("Metadata-Flavor", "Google")
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if content, err := metadataGet(metadata); err != nil {
+		log_geolocip.Notice(fmt.Sprintf("No Google Cloud credentials for %s, public bucket expected: %v", url, err))
+	} else if err := json.Unmarshal(content, &token); err == nil && token.AccessToken != "" {
+		request.Header.Set("Authorization", "Bearer " + token.AccessToken)
+	}
+
+	return request, nil
+}
+
+
+// Sends a request to an instance metadata server, and returns the
+// content of the response
+func metadataGet(request *http.Request) ([]byte, error) {
+	in, err := metadata_client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Body.Close()
+	if in.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Metadata server %s: %s", request.URL, in.Status)
+	}
+	return io.ReadAll(io.LimitReader(in.Body, 1 << 16))
+}
@@ -0,0 +1,218 @@
+
+package geoip
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+)
+
+
+// This file provides the user overrides, giving the location of custom
+// networks, like the internal ranges of a corporate network or its
+// office public ranges, in priority over the geoip data.
+
+
+// Source of the GeoLocIp found in the user overrides
+const OVERRIDE_SOURCE = "override"
+
+
+// User overrides : locations by network, looked up by longest prefix
+// match. Build them with LoadOverridesFile(), or Add() networks. They
+// must not be modified once used for lookups.
+type Overrides struct {
+	locations prefixMap[*Location]
+}
+
+
+// An override of the JSON overrides files
+type overrideJSON struct {
+	Network string `json:"network"`
+	Country string `json:"country_code"`
+	Region string `json:"region_code"`
+	City string `json:"city"`
+	PostalCode string `json:"postal_code"`
+	Latitude float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	TimeZone string `json:"time_zone"`
+}
+
+
+// Read a user overrides file, in CSV or JSON, see LoadOverrides().
+func LoadOverridesFile(filename string) (*Overrides, error) {
+
+	file, err := os.Open(filename)
+	if err != nil {
+		log_geolocip.Err(fmt.Sprintf("Overrides error open file: %v", err))
+		return nil, err
+	}
+	defer file.Close()
+
+	return LoadOverrides(file)
+}
+
+
+// Read user overrides from an io.Reader. They are either a JSON array
+// of objects with the network and the fields of its location, like :
+// 	[{"network":"10.0.0.0/8","country_code":"FR","region_code":"A8","city":"Paris HQ","latitude":48.8667,"longitude":2.3333}]
+// or CSV lines with the network, country code, region code, city,
+// postal code, latitude, longitude and time zone, the last ones being
+// optional :
+// 	10.0.0.0/8,FR,A8,Paris HQ,75001,48.8667,2.3333,Europe/Paris
+// The CSV lines whose first field is not a network, like a header,
+// are skipped.
+func LoadOverrides(in io.Reader) (*Overrides, error) {
+
+	br := skipBOM(in)
+	for {
+		c, _, err := br.ReadRune()
+		if err != nil {
+			return &Overrides{}, nil
+		}
+		if c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+			br.UnreadRune()
+			if c == '[' {
+				return loadOverridesJSON(br)
+			}
+			return loadOverridesCSV(br)
+		}
+	}
+}
+
+
+// Read JSON user overrides
+func loadOverridesJSON(in io.Reader) (*Overrides, error) {
+
+	var list []overrideJSON
+	if err := json.NewDecoder(in).Decode(&list); err != nil {
+		log_geolocip.Err(fmt.Sprintf("Overrides error reading file: %v", err))
+		return nil, err
+	}
+
+	overrides := &Overrides{}
+	for _, override := range list {
+		prefix, err := netip.ParsePrefix(override.Network)
+		if err != nil {
+			log_geolocip.Err(fmt.Sprintf("Overrides error : %v", err))
+			return nil, err
+		}
+		overrides.Add(prefix, Location {
+			Country: override.Country,
+			Region: override.Region,
+			City: override.City,
+			PostalCode: override.PostalCode,
+			Latitude: checkCoordinate(override.Latitude, 90),
+			Longitude: checkCoordinate(override.Longitude, 180),
+			TimeZone: orDefault(override.TimeZone, countryTimeZone(override.Country)),
+		})
+	}
+
+	return overrides, nil
+}
+
+
+// Read CSV user overrides
+func loadOverridesCSV(in *bufio.Reader) (*Overrides, error) {
+
+	overrides := &Overrides{}
+
+	r := LoaderOptions{ Comment: '#' }.newCSVReader(in)
+	for {
+
+		values, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log_geolocip.Err(fmt.Sprintf("Overrides error reading file: %v", err))
+			return nil, err
+		}
+
+		prefix, err := netip.ParsePrefix(values[0])
+		if err != nil {
+			continue
+		}
+		// Missing fields are empty
+		for len(values) < 8 {
+			values = append(values, "")
+		}
+		overrides.Add(prefix, Location {
+			Country: values[1],
+			Region: values[2],
+			City: values[3],
+			PostalCode: values[4],
+			Latitude: parseCoordinate(values[5], 90),
+			Longitude: parseCoordinate(values[6], 180),
+			TimeZone: orDefault(values[7], countryTimeZone(values[1])),
+		})
+	}
+
+	return overrides, nil
+}
+
+
+// Adds the location of a network. When networks overlap, the most
+// specific one wins.
+func (overrides *Overrides) Add(prefix netip.Prefix, loc Location) {
+	overrides.locations.add(prefix, &loc)
+}
+
+
+// Returns the Location of the most specific network holding an IP
+// address, with this network, or nil if there is none
+func (overrides *Overrides) Get(ip net.IP) (*Location, netip.Prefix) {
+	loc, prefix, _ := overrides.locations.get(ip)
+	return loc, prefix
+}
+
+
+// Sets the user overrides used by the lookups of the default DB,
+// see DB.SetOverrides().
+func SetOverrides(overrides *Overrides) {
+	default_db.SetOverrides(overrides)
+}
+
+
+// Sets the user overrides used by the lookups of the DB : the
+// addresses they hold get their location, whatever the geoip data
+// (or Provider) of the DB, with OVERRIDE_SOURCE as Source. Their ASN
+// still comes from the ASN file. They are loaded by the DB when given
+// by Config.OverridesFile.
+func (db *DB) SetOverrides(overrides *Overrides) {
+	db.update(func(data *snapshot) {
+		data.overrides = overrides
+	})
+}
+
+
+// Returns the GeoLocIp of an IP address, in its 16 bytes form, from
+// the user overrides, or nil if they do not hold it
+func (data *snapshot) override(ip net.IP) *GeoLocIp {
+
+	if data.overrides == nil {
+		return nil
+	}
+	location, prefix := data.overrides.Get(ip)
+	if location == nil {
+		return nil
+	}
+
+	var block *Block
+	var asn *ASN
+	if prefix.Addr().Is4() {
+		block = &Block{ ipv4ToUint32(prefix.Addr().AsSlice()), ipv4ToUint32(lastAddr(prefix).AsSlice()), 0 }
+		if data.asn_tree != nil {
+			asn = data.asn_tree.Get(ipv4ToUint32(ip))
+		}
+	}
+
+	country := data.names().CountryName(location.Country)
+	region := data.names().RegionName(location.Country, location.Region)
+
+	return &GeoLocIp{ Ip: ip, Block: block, Location: location, Asn: asn, CountryName: &country, RegionName: &region,
+		Source: OVERRIDE_SOURCE, Network: prefix.Masked().String() }
+}
@@ -0,0 +1,312 @@
+
+package geoip
+
+import (
+	"fmt"
+	"net"
+)
+
+
+// This file provides the Provider interface, implemented by the
+// sources of geoip data, so they can be swapped or combined without
+// changing the code calling the lookups.
+
+
+// A Provider is a source of geoip data : the MaxMind CSV files (a DB),
+// the GeoLite2 databases (an MMDB), or any other backend. It is used
+// by the lookups through SetProvider().
+type Provider interface {
+	// Returns the Location of an IP address, given in its 16 bytes
+	// form, and its Block if known (always nil for IPv6 addresses).
+	// The Location is nil if the block has no known location. The
+	// errors are the ones of GeoLocIPv4E(), like ErrNoBlock.
+	LookupCity(ip net.IP) (*Location, *Block, error)
+
+	// Returns the ASN of an IP address, given in its 16 bytes form,
+	// or nil if it is unknown
+	LookupASN(ip net.IP) (*ASN, error)
+
+	// Loads the data again, if they changed. Called by DB.Reload().
+	Refresh() error
+}
+
+
+// The Locator using a Provider, set by SetProvider()
+type providerLocator struct {
+	provider Provider
+	language string	// of the names, DEFAULT_LANGUAGE if empty
+}
+
+
+// Sets the Provider used by the lookups of the default DB, see
+// DB.SetProvider().
+func SetProvider(p Provider) {
+	default_db.SetProvider(p)
+}
+
+
+// Sets the Provider used by the lookups of the DB, for IPv4 and IPv6
+// addresses, in place of its MaxMind files. The names of the countries
+// and regions come from the NameTable of the language of the DB. The
+// Provider is refreshed by Reload(), and replaced by SetLocator(). With
+// a nil Provider, the MaxMind CSV files of the DB are used. A DB must
+// not be its own Provider.
+func (db *DB) SetProvider(p Provider) {
+	db.update(func(data *snapshot) {
+		data.locator = nil
+		if p != nil {
+			data.locator = &providerLocator{ p, data.language }
+		}
+	})
+}
+
+
+// Returns the Provider set by SetProvider(), or nil
+func (data *snapshot) provider() Provider {
+	if pl, ok := data.locator.(*providerLocator); ok {
+		return pl.provider
+	}
+	return nil
+}
+
+
+// Refreshes the Provider set by SetProvider(), if any
+func (data *snapshot) refreshProvider() {
+	if p := data.provider(); p != nil {
+		if err := p.Refresh(); err != nil {
+			log_geolocip.Err(fmt.Sprintf("Cannot refresh provider : %v", err))
+		}
+	}
+}
+
+
+// Returns the geolocation information for a given IPv4 address,
+// like the GeoLocIPv4E() function
+func (pl *providerLocator) GeoLocIPv4E(ip net.IP) (*GeoLocIp, error) {
+	if ip.To4() == nil {
+		return nil, ErrInvalidIP
+	}
+	return pl.lookup(ip.To16())
+}
+
+
+// Returns the geolocation information for a given IPv6 address,
+// like the GeoLocIPv6E() function
+func (pl *providerLocator) GeoLocIPv6E(ip net.IP) (*GeoLocIp, error) {
+	if len(ip) != net.IPv6len || ip.To4() != nil {
+		return nil, ErrInvalidIP
+	}
+	return pl.lookup(ip)
+}
+
+
+// Builds the GeoLocIp of an IP address, in its 16 bytes form, from
+// the data of the Provider
+func (pl *providerLocator) lookup(ip net.IP) (*GeoLocIp, error) {
+
+	var source string
+	var location *Location
+	var block *Block
+	var err error
+	if sp, ok := pl.provider.(sourceProvider); ok {
+		source, location, block, err = sp.lookupCitySource(ip)
+	} else {
+		location, block, err = pl.provider.LookupCity(ip)
+	}
+	if err != nil {
+		return nil, err
+	}
+	asn, err := pl.provider.LookupASN(ip)
+	if err != nil {
+		return nil, err
+	}
+
+	var country, region string
+	if location != nil {
+		names := namesOrDefault(pl.language)
+		country = names.CountryName(location.Country)
+		region = names.RegionName(location.Country, location.Region)
+	}
+
+	return &GeoLocIp{ Ip: ip, Block: block, Location: location, Asn: asn, CountryName: &country, RegionName: &region, Source: source }, nil
+}
+
+
+// Returns the Location and Block of an IP address found by Lookup(),
+// so a DB is a Provider.
+func (db *DB) LookupCity(ip net.IP) (*Location, *Block, error) {
+	gli, err := db.Lookup(ip)
+	if err != nil {
+		return nil, nil, err
+	}
+	return gli.Location, gli.Block, nil
+}
+
+
+// Returns the ASN of an IP address, using the default DB, see
+// DB.LookupASN().
+func LookupASN(ip net.IP) (*ASN, error) {
+	return defaultDB().LookupASN(ip)
+}
+
+
+// Returns the ASN of an IP address found by Lookup(), or nil, so a
+// DB is a Provider. The ASN of an address without block is found in
+// the ASN files, like when only them are loaded (see Config.ASNOnly).
+func (db *DB) LookupASN(ip net.IP) (*ASN, error) {
+	gli, err := db.Lookup(ip)
+	if err == ErrNoBlock {
+		return db.snapshot().lookupASN(ip), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return gli.Asn, nil
+}
+
+
+// Returns the ASN of an IP address in the ASN files of the snapshot,
+// or nil
+func (data *snapshot) lookupASN(ip net.IP) *ASN {
+	if ip4 := ip.To4(); ip4 != nil {
+		if data.asn_tree == nil {
+			return nil
+		}
+		return data.asn_tree.Get(ipv4ToUint32(ip4))
+	}
+	if data.asn6_tree == nil {
+		return nil
+	}
+	if asn6 := data.asn6_tree.Get(ip.To16()); asn6 != nil {
+		asn := NewASN(0, 0, asn6.ASN)
+		return &asn
+	}
+	return nil
+}
+
+
+// Reloads the files of the DB, so a DB is a Provider, see Reload().
+func (db *DB) Refresh() error {
+	return db.Reload()
+}
+
+
+// Returns the Location and Block of an IP address, so an MMDB is a
+// Provider. Region names are not available through a Provider, as
+// the region codes of the GeoLite2 databases are not the ones of the
+// local names.
+func (db *MMDB) LookupCity(ip net.IP) (*Location, *Block, error) {
+	gli, err := db.lookup(ip.To16(), ip.To4() != nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return gli.Location, gli.Block, nil
+}
+
+
+// Returns the ASN of an IP address, or nil, so an MMDB is a Provider.
+func (db *MMDB) LookupASN(ip net.IP) (*ASN, error) {
+	return db.lookupASN(ip.To16(), ip.To4() != nil)
+}
+
+
+// The GeoLite2 databases are memory mapped, and are not modified once
+// opened : an MMDB has nothing to refresh. Open the new databases with
+// OpenMMDB() instead.
+func (db *MMDB) Refresh() error {
+	return nil
+}
+
+
+// A Provider of a Chain, with the name of its source, like "geolite2"
+type NamedProvider struct {
+	Name string
+	Provider Provider
+}
+
+
+// A Chain is an ordered list of Providers, itself a Provider : an
+// address not found by a Provider (ErrNoBlock or ErrNotInitialized)
+// is looked up in the next one, so a commercial database can be used
+// first, then GeoLite2, then user overrides. The Source of the GeoLocIp
+// returned by the lookups is the name of the Provider that found it.
+// For example :
+// 	SetProvider(Chain{ { "commercial", city }, { "geolite2", geolite2 } })
+type Chain []NamedProvider
+
+
+// A Provider telling the name of the source of the locations it
+// returns, like a Chain
+type sourceProvider interface {
+	lookupCitySource(ip net.IP) (string, *Location, *Block, error)
+}
+
+
+// Tells if a Provider error means the address should be looked up in
+// the next Provider of a Chain
+func isMiss(err error) bool {
+	return err == ErrNoBlock || err == ErrNotInitialized
+}
+
+
+// Returns the Location and Block of an IP address from the first
+// Provider of the Chain that finds it, or ErrNoBlock
+func (chain Chain) LookupCity(ip net.IP) (*Location, *Block, error) {
+	_, location, block, err := chain.lookupCitySource(ip)
+	return location, block, err
+}
+
+
+// Same as LookupCity(), also returning the name of the Provider that
+// found the address, or the one of the source it found it in for a
+// Provider that is itself a Chain
+func (chain Chain) lookupCitySource(ip net.IP) (string, *Location, *Block, error) {
+	for _, named := range chain {
+		source := named.Name
+		var location *Location
+		var block *Block
+		var err error
+		if sp, ok := named.Provider.(sourceProvider); ok {
+			source, location, block, err = sp.lookupCitySource(ip)
+		} else {
+			location, block, err = named.Provider.LookupCity(ip)
+		}
+		if isMiss(err) {
+			continue
+		}
+		return source, location, block, err
+	}
+	return "", nil, nil, ErrNoBlock
+}
+
+
+// Returns the first ASN of an IP address found by the Providers of
+// the Chain, or nil
+func (chain Chain) LookupASN(ip net.IP) (*ASN, error) {
+	for _, named := range chain {
+		asn, err := named.Provider.LookupASN(ip)
+		if isMiss(err) {
+			continue
+		}
+		if err != nil || asn != nil {
+			return asn, err
+		}
+	}
+	return nil, nil
+}
+
+
+// Refreshes all the Providers of the Chain, and returns the first
+// error, if any
+func (chain Chain) Refresh() error {
+	var first_err error
+	for _, named := range chain {
+		if err := named.Provider.Refresh(); err != nil {
+			log_geolocip.Err(fmt.Sprintf("Cannot refresh provider %s : %v", named.Name, err))
+			if first_err == nil {
+				first_err = err
+			}
+		}
+	}
+	return first_err
+}
@@ -0,0 +1,135 @@
+
+package geoip
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+
+// This file provides the extraction of the client IP address of the
+// requests received through trusted reverse proxies, from their
+// X-Forwarded-For, Forwarded or X-Real-IP headers.
+
+
+// Networks of the reverse proxies whose headers are trusted to give the
+// client IP address, when the REST API looks up the caller IP. Empty by
+// default : the headers are ignored, and the address of the connection
+// is used. See ParseTrustedProxies(). The requests received on a Unix
+// domain socket (see ServeGeoLocAPIUnix()) always come from a proxy, and
+// their headers are trusted.
+var TrustedProxies []*net.IPNet
+
+
+// Returns the networks given in CIDR notation ("10.0.0.0/8") or as
+// single addresses ("127.0.0.1", "::1"), to be set in TrustedProxies.
+func ParseTrustedProxies(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, errors.New("Not a valid IP address or network: " + cidr)
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+
+// Tells if an address belongs to one of the TrustedProxies
+func isTrustedProxy(ip net.IP) bool {
+	for _, network := range TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+
+// Returns the IP address of the caller of a request, or nil. When the
+// request comes from one of the TrustedProxies, the client address is
+// taken from the X-Forwarded-For header, then the Forwarded one, then
+// the X-Real-IP one : the addresses of the chain are read from the
+// last one, and the first not trusted is the client. The requests
+// received on a Unix domain socket are handled like the ones of trusted
+// proxies.
+func clientIP(request *http.Request) net.IP {
+	host, _, _ := net.SplitHostPort(request.RemoteAddr)
+	ip := net.ParseIP(host)
+	if !fromUnixSocket(request) && (ip == nil || !isTrustedProxy(ip)) {
+		return ip
+	}
+
+	if chain := forwardedFor(request.Header); len(chain) > 0 {
+		for i := len(chain) - 1; i >= 0; i-- {
+			hop := parseHop(chain[i])
+			if hop == nil {
+				return ip
+			}
+			ip = hop
+			if !isTrustedProxy(hop) {
+				break
+			}
+		}
+		return ip
+	}
+
+	if real_ip := parseHop(request.Header.Get("X-Real-IP")); real_ip != nil {
+		return real_ip
+	}
+	return ip
+}
+
+
+// Returns the chain of addresses of the X-Forwarded-For headers, or of
+// the "for" parameters of the Forwarded headers (RFC 7239) if there are
+// none, from the client to the last proxy
+func forwardedFor(header http.Header) []string {
+	var chain []string
+	for _, value := range header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(value, ",") {
+			chain = append(chain, strings.TrimSpace(hop))
+		}
+	}
+	if len(chain) > 0 {
+		return chain
+	}
+	for _, value := range header.Values("Forwarded") {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				name, hop, found := strings.Cut(strings.TrimSpace(pair), "=")
+				if found && strings.EqualFold(name, "for") {
+					chain = append(chain, hop)
+				}
+			}
+		}
+	}
+	return chain
+}
+
+
+// Returns the address of a hop of a forwarding header, which may be
+// quoted, and followed by a port ("192.0.2.1:4711", "[2001:db8::1]:4711"),
+// or nil
+func parseHop(hop string) net.IP {
+	hop = strings.Trim(strings.TrimSpace(hop), `"`)
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		hop = host
+	}
+	return net.ParseIP(strings.Trim(hop, "[]"))
+}
@@ -7,6 +7,7 @@ import (
 	"io"
 	"encoding/csv"
 	"strings"
+	"sync"
 	"github.com/google/btree"
 )
 
@@ -88,6 +89,33 @@ func (regions *Regions)Get(region_code string) *Region {
 }
 
 
+// Index of the region codes by country code and lower case region
+// name, built the first time RegionCode() is called
+var region_codes map[string]string
+var region_codes_once sync.Once
+
+
+// Returns the code of a region from its name, like "CA" for the
+// "California" region of "US", or "" if it is unknown. The name is
+// not case sensitive. Used to load the datasets giving region names
+// only, like the IP2Location files.
+func RegionCode(country_code string, name string) string {
+	region_codes_once.Do(func() {
+		loadNames()
+		region_codes = make(map[string]string)
+		if regions_tree == nil {
+			return
+		}
+		(*btree.BTree)(regions_tree).Ascend(func(item btree.Item) bool {
+			region := item.(Region)
+			region_codes[region.Code[:2] + strings.ToLower(region.Name)] = region.Code[2:]
+			return true
+		})
+	})
+	return region_codes[country_code + strings.ToLower(name)]
+}
+
+
 // Local constant holding the regions info
 const (
 	regions_list = `AD,02,"Canillo"
@@ -0,0 +1,236 @@
+
+package geoip
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+	"github.com/google/btree"
+)
+
+
+// This file provides binary snapshots of the loaded geoip data, much
+// faster to load than the CSV files, as they are already parsed.
+
+
+// Version of the binary snapshots format, changed when it is not
+// compatible anymore
+const SNAPSHOT_VERSION = 1
+
+
+// Error returned when a binary snapshot was written by another version
+// of the package, in an incompatible format
+var ErrSnapshotVersion = errors.New("Binary snapshot of an unsupported version")
+
+
+// Error returned when the data of a binary snapshot are inconsistent,
+// like ids not matching its locations
+var ErrSnapshotCorrupted = errors.New("Binary snapshot corrupted")
+
+
+// Error of a binary snapshot whose data do not come from the current
+// blocks file
+var errStaleSnapshot = errors.New("Binary snapshot older than the blocks file")
+
+
+// A binary snapshot is made of a header and the data, encoded with
+// encoding/gob, so the header is checked before decoding the data
+type snapshotHeader struct {
+	Version int
+	Modified time.Time	// of the blocks file the data come from
+}
+
+
+// Data of a binary snapshot
+type snapshotFile struct {
+	LocIds []uint32		// of the Locations, if held in a LocationMap
+	Locations []Location
+	Blocks []Block
+	ASNs []ASN
+	Blocks6 []Block6
+	ASNs6 []ASN6
+}
+
+
+// Writes the locations, blocks and ASN of the default DB as a binary
+// snapshot, see DB.Save().
+func Save(out io.Writer) error {
+	return defaultDB().Save(out)
+}
+
+
+// Writes the locations, blocks and ASN of the DB, loaded from the CSV
+// files, as a binary snapshot, to be loaded by LoadSnapshot(). The IPv6
+// data are included if they are loaded. ErrNotInitialized is returned
+// if the DB has no such data, like when it uses GeoLite2 databases.
+func (db *DB) Save(out io.Writer) error {
+
+	data := db.snapshot()
+	if data.locations == nil || data.blocks == nil || data.asn_tree == nil {
+		return ErrNotInitialized
+	}
+
+	content := snapshotFile{}
+	switch locations := data.locations.(type) {
+	case LocationSlice :
+		content.Locations = locations
+	case LocationMap :
+		for loc_id, loc := range locations {
+			content.LocIds = append(content.LocIds, loc_id)
+			content.Locations = append(content.Locations, loc)
+		}
+	default :
+		return errors.New("Binary snapshot of custom locations not supported")
+	}
+
+	content.Blocks, content.ASNs = *data.blocks, *data.asn_tree
+	if data.blocks6 != nil {
+		(*btree.BTree)(data.blocks6).Ascend(func(item btree.Item) bool {
+			content.Blocks6 = append(content.Blocks6, item.(Block6))
+			return true
+		})
+	}
+	if data.asn6_tree != nil {
+		(*btree.BTree)(data.asn6_tree).Ascend(func(item btree.Item) bool {
+			content.ASNs6 = append(content.ASNs6, item.(ASN6))
+			return true
+		})
+	}
+
+	encoder := gob.NewEncoder(out)
+	err := encoder.Encode(&snapshotHeader{ SNAPSHOT_VERSION, data.modified })
+	if err == nil {
+		err = encoder.Encode(&content)
+	}
+	if err != nil {
+		log_geolocip.Err(fmt.Sprintf("Cannot write binary snapshot: %v", err))
+		return err
+	}
+	return nil
+}
+
+
+// Writes a binary snapshot of the DB to a file, replaced only once
+// fully written, see DB.Save().
+func (db *DB) SaveFile(filename string) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(db.Save(pw))
+	}()
+	err := writeFileAtomic(filename, pr, nil)
+	pr.Close()
+	return err
+}
+
+
+// Returns a new DB holding the data of a binary snapshot written by
+// DB.Save(). It has no Config : Reload() loads the MaxMind files of
+// the default data directory.
+func LoadSnapshot(in io.Reader) (*DB, error) {
+	data := &snapshot{}
+	if err := data.readSnapshot(in, time.Time{}); err != nil {
+		return nil, err
+	}
+	db := &DB{}
+	db.data.Store(data)
+	return db, nil
+}
+
+
+// Same as LoadSnapshot(), from a file.
+func LoadSnapshotFile(filename string) (*DB, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		log_geolocip.Err(fmt.Sprintf("Binary snapshot error open file: %v", err))
+		return nil, err
+	}
+	defer file.Close()
+	return LoadSnapshot(file)
+}
+
+
+// Reads a binary snapshot in the snapshot. If modified is not zero,
+// the data must come from a blocks file modified at this time, or
+// errStaleSnapshot is returned.
+func (data *snapshot) readSnapshot(in io.Reader, modified time.Time) error {
+
+	decoder := gob.NewDecoder(in)
+	var header snapshotHeader
+	if err := decoder.Decode(&header); err != nil {
+		log_geolocip.Err(fmt.Sprintf("Binary snapshot error reading file: %v", err))
+		return err
+	}
+	if header.Version != SNAPSHOT_VERSION {
+		log_geolocip.Err(fmt.Sprintf("Binary snapshot version %d, expected %d", header.Version, SNAPSHOT_VERSION))
+		return ErrSnapshotVersion
+	}
+	if !modified.IsZero() && !header.Modified.Equal(modified) {
+		return errStaleSnapshot
+	}
+
+	var content snapshotFile
+	if err := decoder.Decode(&content); err != nil {
+		log_geolocip.Err(fmt.Sprintf("Binary snapshot error reading file: %v", err))
+		return err
+	}
+
+	if content.LocIds == nil {
+		data.locations = LocationSlice(content.Locations)
+	} else {
+		if len(content.LocIds) != len(content.Locations) {
+			log_geolocip.Err(fmt.Sprintf("Binary snapshot error: %d location ids for %d locations", len(content.LocIds), len(content.Locations)))
+			return ErrSnapshotCorrupted
+		}
+		locations := make(LocationMap, len(content.LocIds))
+		for i, loc_id := range content.LocIds {
+			locations[loc_id] = content.Locations[i]
+		}
+		data.locations = locations
+	}
+
+	data.blocks = NewBlocks(content.Blocks)
+	data.asn_tree = NewASNs(content.ASNs)
+
+	if len(content.Blocks6) > 0 {
+		t := btree.New(4)
+		for _, block := range content.Blocks6 {
+			t.ReplaceOrInsert(block)
+		}
+		data.blocks6 = (*Blocks6)(t)
+	}
+	if len(content.ASNs6) > 0 {
+		t := btree.New(4)
+		for _, asn := range content.ASNs6 {
+			t.ReplaceOrInsert(asn)
+		}
+		data.asn6_tree = (*ASNs6)(t)
+	}
+
+	data.modified = header.Modified
+	return nil
+}
+
+
+// Loads the snapshot from a binary snapshot file, if it was written
+// from the data of a blocks file modified at the given time, telling
+// if it was loaded
+func (data *snapshot) loadSnapshotFile(filename string, modified time.Time) bool {
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	fresh := &snapshot{}
+	if err := fresh.readSnapshot(file, modified); err != nil {
+		return false
+	}
+	data.locations, data.blocks, data.asn_tree = fresh.locations, fresh.blocks, fresh.asn_tree
+	data.blocks6, data.asn6_tree, data.modified = fresh.blocks6, fresh.asn6_tree, fresh.modified
+	log_geolocip.Notice(fmt.Sprintf("Binary snapshot %s loaded", filename))
+	return true
+}
@@ -0,0 +1,60 @@
+
+package geoip
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+)
+
+
+// This file provides the reload of the data on a signal, like SIGHUP,
+// for the users who distribute fresh files with configuration management
+// tools : the servers started by ServeGeoLocAPI() and ServeGeoLocGRPC()
+// reload the default DB on SIGHUP, without dropping any connection.
+
+
+// Reloads the default DB each time one of the given signals is
+// received, see DB.ReloadOnSignal().
+func ReloadOnSignal(signals ...os.Signal) {
+	default_db.ReloadOnSignal(signals...)
+}
+
+
+// Calls Reload() each time one of the given signals is received, like
+// syscall.SIGHUP, until Close() is called. The lookups use the previous
+// data until the new ones are loaded. The signals given by a previous
+// call are not watched anymore, and none is watched without signals.
+func (db *DB) ReloadOnSignal(signals ...os.Signal) {
+
+	var received chan os.Signal
+	if len(signals) > 0 {
+		received = make(chan os.Signal, 1)
+		signal.Notify(received, signals...)
+	}
+	db.mu.Lock()
+	db.stopSignals()
+	db.signals = received
+	db.mu.Unlock()
+	if received == nil {
+		return
+	}
+
+	go func() {
+		for sig := range received {
+			log_geolocip.Notice(fmt.Sprintf("Reload on signal %v", sig))
+			db.Reload()
+		}
+	}()
+}
+
+
+// Stops watching the signals given to ReloadOnSignal(), if any. db.mu
+// must be held.
+func (db *DB) stopSignals() {
+	if db.signals != nil {
+		signal.Stop(db.signals)
+		close(db.signals)
+		db.signals = nil
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !js
+
+package geoip
+
+import (
+	"os"
+	"syscall"
+)
+
+
+// Signals making the servers reload the default DB, see ServeGeoLocAPI()
+var reload_signals = []os.Signal{ syscall.SIGHUP }
@@ -0,0 +1,11 @@
+//go:build js
+
+package geoip
+
+import (
+	"os"
+)
+
+
+// No signal makes the servers reload the default DB on this system
+var reload_signals []os.Signal
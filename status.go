@@ -0,0 +1,135 @@
+
+package geoip
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+
+// This file provides the status endpoint of the REST API, served under
+// /status by NewGeoLocServer(), describing the data of the default DB
+// for monitoring.
+
+
+// Outcome of a load of the files of a DB, by New(), Reload() or the
+// first lookup of the default DB
+type loadOutcome struct {
+	time time.Time
+	duration time.Duration
+	err error
+}
+
+
+// Records the outcome of a load of the files of the DB started at a
+// given time, and the load time and duration of its data if it succeeded.
+// db.mu must be held.
+func (db *DB) loaded(data *snapshot, start time.Time, err error) {
+	db.last_load = loadOutcome{ start, time.Since(start), err }
+	if err == nil {
+		data.loaded, data.load_duration = start, db.last_load.duration
+	}
+}
+
+
+// Returns where the data of the snapshot come from, by dataset : the
+// URLs they are downloaded from if config.Download is set, or else the
+// files they are loaded from (in config.FS if set), see files()
+func (data *snapshot) sources(config Config) map[string]string {
+	sources := make(map[string]string)
+	for dataset, file := range data.files(config) {
+		sources[dataset] = orDefault(file.URL, file.Path)
+	}
+	return sources
+}
+
+
+// Outcome of the last load of the files, as returned by /status
+type lastLoadResponse struct {
+	Time time.Time `json:"time"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	OK bool `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+
+// Status of the default DB, as returned by /status
+type statusResponse struct {
+	Ready bool `json:"ready"`
+	Error string `json:"error,omitempty"`
+	reloadResponse
+	Ages map[string]float64 `json:"age_seconds,omitempty"`
+	Sources map[string]string `json:"sources,omitempty"`
+	Loaded *time.Time `json:"loaded,omitempty"`
+	LoadDurationSeconds float64 `json:"load_duration_seconds,omitempty"`
+	LastLoad *lastLoadResponse `json:"last_load,omitempty"`
+	APIKeys map[string]apiKeyUsageResponse `json:"api_keys,omitempty"`
+}
+
+
+// Returns the status of the DB, see ServeStatusHttpRequest()
+func (db *DB) status() statusResponse {
+
+	db.mu.Lock()
+	config, last_load := db.config, db.last_load
+	db.mu.Unlock()
+	data := db.snapshot()
+
+	response := statusResponse{ reloadResponse: data.reloadResponse(), Ages: make(map[string]float64) }
+	if err := data.ready(MaxReadyAge); err != nil {
+		response.Error = err.Error()
+	} else {
+		response.Ready = true
+	}
+	if response.Modified != nil {
+		response.Ages["modified"] = time.Since(*response.Modified).Seconds()
+	}
+	for name, build_date := range response.BuildDates {
+		response.Ages[name] = time.Since(build_date).Seconds()
+	}
+	// Data set by SetLocations() and the like have no source
+	if !data.loaded.IsZero() {
+		response.Sources = data.sources(config)
+		loaded := data.loaded
+		response.Loaded = &loaded
+		response.LoadDurationSeconds = data.load_duration.Seconds()
+	}
+	if !last_load.time.IsZero() {
+		response.LastLoad = &lastLoadResponse{ Time: last_load.time, DurationSeconds: last_load.duration.Seconds(), OK: last_load.err == nil }
+		if last_load.err != nil {
+			response.LastLoad.Error = last_load.err.Error()
+		}
+	}
+	return response
+}
+
+
+//  This serves the status of the default DB as a JSON object, for
+//  monitoring to detect stale data or failed updates : if it is ready
+//  (see ServeReadyHttpRequest()), the number of records of each dataset,
+//  the modification time of the files and the build dates of the GeoLite2
+//  databases with their age in seconds, the URLs or files the data come
+//  from, when and how fast they were loaded, and the outcome of the last
+//  load or reload (see Reload()), even if it failed and the previous data
+//  were kept, like :
+//  	{"ready":true,"records":{"asn":1,"blocks":2,"locations":3},
+//  	"modified":"2024-01-02T00:00:00Z","age_seconds":{"modified":86400},
+//  	"sources":{"asn":"http://...","blocks":"http://...","locations":"http://..."},
+//  	"loaded":"2024-01-03T00:00:00Z","load_duration_seconds":2.5,
+//  	"last_load":{"time":"2024-01-03T00:00:00Z","duration_seconds":2.5,"ok":true}}
+//  The requests of each API key on the current day (see ValidateAPIKey)
+//  are given by APIKeyID(), like "api_keys":{"5e884898":{"requests_today":
+//  12,"daily_quota":10000}}. Like ServeReadyHttpRequest(), it does not load
+//  the DB. It is served under /status by NewGeoLocServer(), authenticated
+//  like the admin endpoints, see ServeReloadHttpRequest().
+func ServeStatusHttpRequest(writer http.ResponseWriter, request *http.Request) {
+	if !adminAuthorized(writer, request) {
+		return
+	}
+	status := default_db.status()
+	status.APIKeys = api_key_usage.report(time.Now())
+	response, _ := json.Marshal(status)
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(response)
+}
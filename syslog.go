@@ -0,0 +1,19 @@
+//go:build !windows && !plan9
+
+package geoip
+
+import (
+	"log/syslog"
+)
+
+
+// Returns a Logger writing to the local system log (syslog) with the
+// given tag, like "geolocip", or the error returned by syslog.New().
+// Use it with SetLogger().
+func NewSyslogLogger(tag string) (Logger, error) {
+	w, err := syslog.New(syslog.LOG_NOTICE, tag)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
@@ -0,0 +1,57 @@
+
+package geoip
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+
+// This file provides the listeners of systemd socket activation, so the
+// REST API can be started by a socket unit, see ServeGeoLocAPIListener().
+
+
+// First file descriptor passed by systemd socket activation
+const SYSTEMD_LISTEN_FDS_START = 3
+
+
+// Returns the listeners passed by systemd socket activation, in the order
+// of the sockets of the unit, or none if the process was not started this
+// way. The LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES environment variables
+// are unset, so they are not used by the child processes.
+func SystemdListeners() ([]net.Listener, error) {
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := make([]net.Listener, 0, count)
+	for i := 0; i < count; i++ {
+		name := "LISTEN_FD_" + strconv.Itoa(SYSTEMD_LISTEN_FDS_START + i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		file := os.NewFile(uintptr(SYSTEMD_LISTEN_FDS_START + i), name)
+		listener, err := net.FileListener(file)
+		file.Close()	// the listener has its own copy of the descriptor
+		if err != nil {
+			for _, listener := range listeners {
+				listener.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
@@ -0,0 +1,175 @@
+
+package geoip
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+
+// This file provides the endpoints of the Telize API, which inspired
+// this package, so its clients can use the REST API unchanged : /ip,
+// /jsonip and /geoip/{ip}, served by NewGeoLocServer().
+
+
+// The JSON encoding of a GeoLocIp by the Telize API, in English. Empty
+// fields are omitted.
+type telizeJSON struct {
+	Ip string `json:"ip"`
+	CountryCode string `json:"country_code,omitempty"`
+	CountryCode3 string `json:"country_code3,omitempty"`
+	Country string `json:"country,omitempty"`
+	RegionCode string `json:"region_code,omitempty"`
+	Region string `json:"region,omitempty"`
+	City string `json:"city,omitempty"`
+	PostalCode string `json:"postal_code,omitempty"`
+	ContinentCode string `json:"continent_code,omitempty"`
+	Latitude *float64 `json:"latitude,omitempty"`
+	Longitude *float64 `json:"longitude,omitempty"`
+	DMACode string `json:"dma_code,omitempty"`
+	AreaCode string `json:"area_code,omitempty"`
+	ASN string `json:"asn,omitempty"`
+	ISP string `json:"isp,omitempty"`
+	Timezone string `json:"timezone,omitempty"`
+	Offset string `json:"offset,omitempty"`
+}
+
+
+// Returns the Telize encoding of the GeoLocIp : the AS number is like
+// "AS14618", and the offset is the current offset of the time zone from
+// UTC in hours, like "-4", if the time zone database is available.
+func (gli *GeoLocIp) telizeJSON() telizeJSON {
+
+	fields := gli.JSON(JSONOptions{ Language: "en" })
+	telize := telizeJSON{
+		Ip: fields.Ip,
+		CountryCode: fields.CountryCode,
+		Country: fields.CountryEN,
+		RegionCode: fields.RegionCode,
+		Region: fields.Region,
+		City: fields.City,
+		PostalCode: fields.PostalCode,
+		ContinentCode: fields.ContinentCode,
+		Latitude: fields.Latitude,
+		Longitude: fields.Longitude,
+		ISP: fields.Organization,
+		Timezone: fields.TimeZone,
+	}
+	telize.CountryCode3, _ = CountryCode3(fields.CountryCode)
+	if fields.MetroCode != 0 {
+		telize.DMACode = strconv.Itoa(fields.MetroCode)
+	}
+	if fields.AreaCode != 0 {
+		telize.AreaCode = strconv.Itoa(fields.AreaCode)
+	}
+	if fields.ASN != 0 {
+		telize.ASN = fmt.Sprintf("AS%d", fields.ASN)
+	}
+	if location, err := time.LoadLocation(fields.TimeZone); fields.TimeZone != "" && err == nil {
+		_, offset := time.Now().In(location).Zone()
+		telize.Offset = strconv.FormatFloat(float64(offset) / 3600, 'f', -1, 64)
+	}
+	return telize
+}
+
+
+// Writes an error of the Telize API, like {"code":401,"message":"Input
+// string is not a valid IP address"}, with a status code
+func writeTelizeError(writer http.ResponseWriter, status int, code int, message string) {
+	body, _ := json.Marshal(struct {
+		Code int `json:"code"`
+		Message string `json:"message"`
+	}{ code, message })
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	writer.Write(body)
+}
+
+
+//  This serves the IP address of the caller as plain text, like the /ip
+//  endpoint of Telize, under which it is served by NewGeoLocServer(). See
+//  TrustedProxies.
+func ServeTelizeIPHttpRequest(writer http.ResponseWriter, request *http.Request) {
+	ip := clientIP(request)
+	if ip == nil {
+		http.Error(writer, "Cannot find the IP address", http.StatusBadRequest)
+		return
+	}
+	writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(writer, "%s\n", ip)
+}
+
+
+//  This serves the IP address of the caller as a JSON, like {"ip":"54.88.55.63"},
+//  like the /jsonip endpoint of Telize, under which it is served by
+//  NewGeoLocServer(). See TrustedProxies.
+func ServeTelizeJSONIPHttpRequest(writer http.ResponseWriter, request *http.Request) {
+	ip := clientIP(request)
+	if ip == nil {
+		writeTelizeError(writer, http.StatusBadRequest, 401, "Input string is not a valid IP address")
+		return
+	}
+	body, _ := json.Marshal(struct {
+		Ip string `json:"ip"`
+	}{ ip.String() })
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(body)
+}
+
+
+//  This serves the geolocation of the IP address given in the URL path
+//  after /geoip/, or of the caller, with the field names of the /geoip
+//  endpoint of Telize, in English, like :
+//  	{"ip":"54.88.55.63","country_code":"US","country_code3":"USA",
+//  	"country":"United States","region_code":"VA","region":"Virginia",
+//  	"city":"Ashburn","postal_code":"20147","continent_code":"NA",
+//  	"latitude":39.0335,"longitude":-77.4838,"dma_code":"511","area_code":"703",
+//  	"asn":"AS14618","isp":"Amazon.com, Inc.","timezone":"America/New_York",
+//  	"offset":"-4"}
+//  Like Telize, an address without information gets only its "ip" field,
+//  and an invalid one a 400 status code with {"code":401,"message":"Input
+//  string is not a valid IP address"}. It is served under /geoip/ by
+//  NewGeoLocServer().
+func ServeTelizeHttpRequest(writer http.ResponseWriter, request *http.Request) {
+	var address string
+	if ip_path := strings.TrimPrefix(strings.TrimPrefix(request.URL.Path, "/geoip"), "/"); ip_path != "" {
+		address = path.Base(ip_path)
+	}
+	serveTelize(writer, request, address)
+}
+
+
+// Writes the Telize geolocation of an IP address, or of the caller IP
+// if it is empty, see ServeTelizeHttpRequest()
+func serveTelize(writer http.ResponseWriter, request *http.Request, address string) {
+	ip := clientIP(request)
+	if address != "" {
+		ip = net.ParseIP(address)
+	}
+
+	gli, err := apiLookup(ip)
+	switch {
+	case err == ErrInvalidIP :
+		writeTelizeError(writer, http.StatusBadRequest, 401, "Input string is not a valid IP address")
+		return
+	case err == err_loading :
+		writer.Header().Set("Retry-After", fmt.Sprint(RETRY_AFTER_LOADING))
+		writeTelizeError(writer, http.StatusServiceUnavailable, http.StatusServiceUnavailable, "Database loading")
+		return
+	case err == ErrNotInitialized :
+		writeTelizeError(writer, http.StatusServiceUnavailable, http.StatusServiceUnavailable, "Database not loaded")
+		return
+	case err == ErrNoBlock || gli == nil :
+		gli = &GeoLocIp{ Ip: normalizeIP(ip) }
+	}
+
+	body, _ := json.Marshal(gli.telizeJSON())
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(body)
+}
@@ -0,0 +1,92 @@
+
+package geoip
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+
+// This file provides the HTTPS servers of the REST API, so it can be
+// exposed directly, without a reverse proxy terminating TLS.
+
+
+// TLS configuration of the servers returned by NewGeoLocTLSServer(), nil
+// for the default one (TLS 1.2 at least). Its GetCertificate function can
+// provide the certificates instead of files, for example to get them from
+// Let's Encrypt with golang.org/x/crypto/acme/autocert :
+// 	manager := &autocert.Manager{
+// 		Prompt: autocert.AcceptTOS,
+// 		HostPolicy: autocert.HostWhitelist("geoip.example.com"),
+// 		Cache: autocert.DirCache("/var/cache/geoip-certs"),
+// 	}
+// 	geoip.TLSConfig = manager.TLSConfig()
+// 	geoip.ServeGeoLocAPITLS(443, "", "")
+var TLSConfig *tls.Config
+
+
+// Error of a TLS server without any certificate, see NewGeoLocTLSServer()
+var ErrNoCertificate = errors.New("No TLS certificate")
+
+
+// Returns an https server listening on the given address (for example
+// ":443") and serving the REST API like NewGeoLocServer(), with the
+// certificate and key of the given PEM files, and the TLSConfig. The files
+// can be empty if the TLSConfig provides the certificates. The server is
+// not started : the caller is expected to call ListenAndServeTLS("", "")
+// on it.
+func NewGeoLocTLSServer(addr string, cert_file string, key_file string) (*http.Server, error) {
+
+	srv := NewGeoLocServer(addr)
+	srv.TLSConfig = &tls.Config{ MinVersion: tls.VersionTLS12 }
+	if TLSConfig != nil {
+		srv.TLSConfig = TLSConfig.Clone()
+	}
+	if cert_file != "" || key_file != "" {
+		certificate, err := tls.LoadX509KeyPair(cert_file, key_file)
+		if err != nil {
+			return nil, err
+		}
+		srv.TLSConfig.Certificates = append(srv.TLSConfig.Certificates, certificate)
+	}
+	if len(srv.TLSConfig.Certificates) == 0 && srv.TLSConfig.GetCertificate == nil {
+		return nil, ErrNoCertificate
+	}
+	return srv, nil
+}
+
+
+// Starts an HTTPS server on a local port whose number is given as
+// argument, with the certificate and key of the given PEM files, see
+// NewGeoLocTLSServer(). Like ServeGeoLocAPI(), the default DB is loaded
+// while the server starts, and reloaded on SIGHUP.
+func ServeGeoLocAPITLS(port uint16, cert_file string, key_file string) {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		log_geolocip.Err(fmt.Sprintf("Cannot start https server: %v", err))
+		return
+	}
+	ServeGeoLocAPITLSListener(listener, cert_file, key_file)
+}
+
+
+// Serves the REST API over HTTPS on an existing listener, with the
+// certificate and key of the given PEM files, like ServeGeoLocAPITLS()
+// and ServeGeoLocAPIListener()
+func ServeGeoLocAPITLSListener(listener net.Listener, cert_file string, key_file string) {
+	srv, err := NewGeoLocTLSServer(listener.Addr().String(), cert_file, key_file)
+	if err != nil {
+		log_geolocip.Err(fmt.Sprintf("Cannot start https server: %v", err))
+		listener.Close()
+		return
+	}
+	loaded := loadDefaultInBackground()
+	defer func() { <-loaded }()
+	ReloadOnSignal(reload_signals...)
+	if err := srv.ServeTLS(listener, "", ""); err != nil {
+		log_geolocip.Err(fmt.Sprintf("Cannot start https server: %v", err))
+	}
+}
@@ -0,0 +1,64 @@
+
+package geoip
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+)
+
+
+// This file provides the Unix domain sockets of the REST API, for the
+// hosts where it is fronted by nginx without exposing a TCP port.
+
+
+// Permissions of the sockets created by ListenUnixSocket(), so the group
+// of the process (like the one of nginx) can connect to them
+var UnixSocketMode os.FileMode = 0660
+
+
+// Returns a listener on a Unix domain socket, created at the given path
+// with the UnixSocketMode. A socket left there by a previous process is
+// replaced, but no other kind of file. The socket is removed when the
+// listener is closed.
+func ListenUnixSocket(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().Type() != os.ModeSocket {
+			return nil, errors.New("Not a socket: " + path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, UnixSocketMode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+
+// Tells if a request was received on a Unix domain socket
+func fromUnixSocket(request *http.Request) bool {
+	addr, ok := request.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return ok && addr.Network() == "unix"
+}
+
+
+// Starts an HTTP server listening on a Unix domain socket, created at
+// the given path, see ListenUnixSocket() and ServeGeoLocAPIListener().
+// The caller IP is taken from the headers of the proxy, see TrustedProxies.
+func ServeGeoLocAPIUnix(path string) {
+	listener, err := ListenUnixSocket(path)
+	if err != nil {
+		log_geolocip.Err(fmt.Sprintf("Cannot start http server: %v", err))
+		return
+	}
+	ServeGeoLocAPIListener(listener)
+}
@@ -0,0 +1,112 @@
+
+package geoip
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+)
+
+
+// This file provides the XML output format of the lookup endpoints, for
+// the consumers which cannot read JSON : with the format=xml parameter,
+// or an Accept header asking for XML.
+
+
+// Name of the root element of the XML documents of the REST API
+const XML_ROOT = "geoip"
+
+
+// Returns the XML encoding of the GeoLocIp, with the same elements as
+// the fields of its JSON encoding with the given options, in the same
+// order, like :
+// 	<?xml version="1.0" encoding="UTF-8"?>
+// 	<geoip><ip>54.88.55.63</ip><country_code>US</country_code>...</geoip>
+func (gli *GeoLocIp) MarshalXMLWith(opts JSONOptions) ([]byte, error) {
+	encoded, err := gli.MarshalJSONWith(opts)
+	if err != nil {
+		return nil, err
+	}
+	return jsonToXML(encoded, XML_ROOT)
+}
+
+
+// Returns the XML document of a JSON one, with a root element of the
+// given name. The fields of the objects are elements of the same name,
+// the items of the arrays are "item" elements, and null values are
+// left out.
+func jsonToXML(encoded []byte, root string) ([]byte, error) {
+	var buffer bytes.Buffer
+	buffer.WriteString(xml.Header)
+	encoder := xml.NewEncoder(&buffer)
+
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.UseNumber()
+	var encode func(name string) error
+	encode = func(name string) error {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		element := xml.StartElement{ Name: xml.Name{ Local: name } }
+		switch value := token.(type) {
+		case json.Delim :
+			if err := encoder.EncodeToken(element); err != nil {
+				return err
+			}
+			for decoder.More() {
+				child := "item"
+				if value == '{' {
+					key, err := decoder.Token()
+					if err != nil {
+						return err
+					}
+					child = key.(string)
+				}
+				if err := encode(child); err != nil {
+					return err
+				}
+			}
+			if _, err := decoder.Token(); err != nil {	// closing delimiter
+				return err
+			}
+			return encoder.EncodeToken(element.End())
+		case nil :
+			return nil
+		default :
+			return encoder.EncodeElement(value, element)
+		}
+	}
+	if err := encode(root); err != nil {
+		return nil, err
+	}
+	if err := encoder.Flush(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+
+// Tells if a request asks for XML, with the format=xml parameter, or
+// with an Accept header listing an XML media type before JSON
+func requestXML(request *http.Request) bool {
+	if format := request.URL.Query().Get("format"); format != "" {
+		return format == "xml"
+	}
+	return acceptedMedia(request) == "xml"
+}
+
+
+// Writes an error of the REST API as XML, like <error>invalid ip</error>,
+// with a status code
+func writeXMLError(writer http.ResponseWriter, code int, message string) {
+	body, _ := xml.Marshal(struct {
+		XMLName xml.Name `xml:"error"`
+		Message string `xml:",chardata"`
+	}{ Message: message })
+	writer.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	writer.WriteHeader(code)
+	writer.Write([]byte(xml.Header))
+	writer.Write(body)
+}